@@ -0,0 +1,84 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// backup reads an SDCard into a compressed image file.
+//
+// It is the reverse of efe; it is useful to clone a known-good card.
+package main // import "periph.io/x/bootstrap/cmd/backup"
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"periph.io/x/bootstrap/img"
+)
+
+// outputPath parses -compress and returns the path of the image to write,
+// which must have the extension of the compression.
+func outputPath(out, compress string) (string, img.Compression, error) {
+	c, err := img.ParseCompression(compress)
+	if err != nil {
+		return "", c, fmt.Errorf("-compress: %w", err)
+	}
+	ext := c.Ext()
+	if ext == "" {
+		ext = ".img"
+	}
+	if out == "" {
+		return "backup.img" + c.Ext(), c, nil
+	}
+	if !strings.HasSuffix(out, ext) {
+		return "", c, fmt.Errorf("-o must end with %s for -compress %s", ext, c)
+	}
+	return out, c, nil
+}
+
+func mainImpl() error {
+	sdCards := img.ListSDCards()
+	def := ""
+	if len(sdCards) == 1 {
+		def = sdCards[0]
+	}
+	sdCard := flag.String("sdcard", def, "Path to SDCard; one of "+strings.Join(sdCards, ","))
+	out := flag.String("o", "", "Path to the compressed image to write; defaults to backup.img with the extension of -compress")
+	compress := flag.String("compress", "gz", "Compression of the image as format[:level]; one of xz, gz, zst or none, e.g. gz:9 or zst:3")
+	verbose := flag.Bool("v", false, "log verbosely to stderr")
+	debug := flag.Bool("vv", false, "log very verbosely to stderr, including the commands run")
+	quiet := flag.Bool("q", false, "only print errors")
+	flag.Parse()
+	l, err := img.LevelFromFlags(*quiet, *verbose, *debug)
+	if err != nil {
+		return err
+	}
+	img.SetLevel(l)
+	if flag.NArg() != 0 {
+		return errors.New("unexpected argument")
+	}
+	if err := img.CheckOS(); err != nil {
+		return err
+	}
+	if *sdCard == "" {
+		return errors.New("-sdcard is required")
+	}
+	dst, c, err := outputPath(*out, *compress)
+	if err != nil {
+		return err
+	}
+	if err := img.BackupWithCompression(context.Background(), *sdCard, dst, c, nil); err != nil {
+		return err
+	}
+	fmt.Printf("\nYou can now remove the SDCard safely\n")
+	return nil
+}
+
+func main() {
+	if err := mainImpl(); err != nil {
+		fmt.Fprintf(os.Stderr, "backup: %s.\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOutputPath(t *testing.T) {
+	data := []struct {
+		out      string
+		compress string
+		want     string
+		c        string
+	}{
+		{"", "gz", "backup.img.gz", "gz:6"},
+		{"", "xz:9", "backup.img.xz", "xz:9"},
+		{"", "zst", "backup.img.zst", "zst:3"},
+		{"", "none", "backup.img", "none"},
+		{"card.img.gz", "gz", "card.img.gz", "gz:6"},
+		{"card.img.xz", "xz", "card.img.xz", "xz:6"},
+		{"card.img", "none", "card.img", "none"},
+	}
+	for i, line := range data {
+		got, c, err := outputPath(line.out, line.compress)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if got != line.want || c.String() != line.c {
+			t.Fatalf("%d: expected %s %s, got %s %s", i, line.want, line.c, got, c)
+		}
+	}
+}
+
+func TestOutputPathErr(t *testing.T) {
+	data := []struct {
+		out      string
+		compress string
+		err      string
+	}{
+		{"card.img.xz", "gz", "-o must end with .gz for -compress gz:6"},
+		{"card.img", "gz", "-o must end with .gz"},
+		{"card.img.gz", "none", "-o must end with .img for -compress none"},
+		{"card.img.gz", "zst:3", "-o must end with .zst"},
+		{"", "bz2", "-compress: unsupported compression"},
+		{"card.img.gz", "gz:10", "-compress:"},
+	}
+	for i, line := range data {
+		if _, _, err := outputPath(line.out, line.compress); err == nil || !strings.Contains(err.Error(), line.err) {
+			t.Fatalf("%d: expected %q, got %v", i, line.err, err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// check-setup reports the result of the first boot setup of a device flashed
+// by efe with -firstboot-status.
+//
+// The status is read from the boot partition of the SDCard or over ssh.
+package main // import "periph.io/x/bootstrap/cmd/check-setup"
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"periph.io/x/bootstrap/img"
+)
+
+// statusFile is the path of the status file relative to the boot partition
+// root, as written by efe -firstboot-status.
+const statusFile = "firstboot.done"
+
+// errNotDone is returned when the status file doesn't exist yet.
+var errNotDone = errors.New("the first boot setup is not done yet, or -firstboot-status was not used")
+
+// status is the content of the status file written by setup.sh.
+type status struct {
+	Status   string
+	ExitCode int
+	Command  string
+	Host     string
+	Log      string
+	Date     string
+}
+
+// success returns true if the setup completed successfully.
+func (s *status) success() bool {
+	return s.Status == "success" && s.ExitCode == 0
+}
+
+// parseStatus parses the key=value lines written by setup.sh.
+func parseStatus(r io.Reader) (*status, error) {
+	s := &status{}
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid status line %q", line)
+		}
+		switch k {
+		case "status":
+			s.Status = v
+		case "exit_code":
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid exit_code %q", v)
+			}
+			s.ExitCode = n
+		case "command":
+			s.Command = v
+		case "host":
+			s.Host = v
+		case "log":
+			s.Log = v
+		case "date":
+			s.Date = v
+		default:
+			// Ignore unknown keys for forward compatibility.
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if s.Status != "success" && s.Status != "failure" {
+		return nil, fmt.Errorf("invalid status %q", s.Status)
+	}
+	return s, nil
+}
+
+// readCard reads the status file from the boot partition n of disk.
+func readCard(disk string, n int) (*status, error) {
+	var s *status
+	err := img.EditBootPartition(context.Background(), disk, n, func(dir string) error {
+		/* #nosec G304 */
+		f, err := os.Open(filepath.Join(dir, statusFile))
+		if errors.Is(err, os.ErrNotExist) {
+			return errNotDone
+		}
+		if err != nil {
+			return err
+		}
+		/* #nosec G307 */
+		defer f.Close()
+		s, err = parseStatus(f)
+		return err
+	}, nil)
+	return s, err
+}
+
+// readSSH reads the status file on host over ssh.
+func readSSH(host string, port int) (*status, error) {
+	args := []string{"-o", "BatchMode=yes"}
+	if port != 22 {
+		args = append(args, "-p", strconv.Itoa(port))
+	}
+	// Print a marker when the file is missing to distinguish it from a ssh
+	// failure.
+	args = append(args, host, "cat /boot/"+statusFile+" 2>/dev/null || echo missing")
+	/* #nosec G204 */
+	out, err := exec.Command("ssh", args...).Output()
+	if err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			return nil, fmt.Errorf("failed to connect to %s: %w: %s", host, err, strings.TrimSpace(string(exit.Stderr)))
+		}
+		return nil, err
+	}
+	if strings.TrimSpace(string(out)) == "missing" {
+		return nil, errNotDone
+	}
+	return parseStatus(strings.NewReader(string(out)))
+}
+
+func mainImpl() error {
+	sdCards := img.ListSDCards()
+	def := ""
+	if len(sdCards) == 1 {
+		def = sdCards[0]
+	}
+	sdCard := flag.String("sdcard", def, "Path to SDCard; one of "+strings.Join(sdCards, ","))
+	bootPart := flag.Int("boot-part", 1, "Partition number of the FAT boot partition")
+	host := flag.String("host", "", "Device to query over ssh instead of reading the SDCard, e.g. pi@raspberrypi")
+	port := flag.Int("port", 22, "ssh port to use with -host")
+	wait := flag.Duration("wait", 0, "Time to wait for the setup to complete with -host, e.g. 30m")
+	verbose := flag.Bool("v", false, "log verbosely to stderr")
+	debug := flag.Bool("vv", false, "log very verbosely to stderr, including the commands run")
+	quiet := flag.Bool("q", false, "only print errors")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: check-setup [flags]\n\nReports the result of the first boot setup of a device flashed with\nefe -firstboot-status. Exits with 1 if it failed or is not done.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	l, err := img.LevelFromFlags(*quiet, *verbose, *debug)
+	if err != nil {
+		return err
+	}
+	img.SetLevel(l)
+	if flag.NArg() != 0 {
+		return errors.New("unexpected argument")
+	}
+	if *port < 1 || *port > 65535 {
+		return fmt.Errorf("-port %d must be between 1 and 65535", *port)
+	}
+	var s *status
+	if *host != "" {
+		// The device may be rebooting or still running the setup.
+		for start := time.Now(); ; {
+			if s, err = readSSH(*host, *port); err == nil || time.Since(start) >= *wait {
+				break
+			}
+			img.Progressf("- Waiting for %s: %v\n", *host, err)
+			time.Sleep(10 * time.Second)
+		}
+	} else {
+		if *wait != 0 {
+			return errors.New("-wait requires -host")
+		}
+		if err = img.CheckOS(); err != nil {
+			return err
+		}
+		if *sdCard == "" {
+			return errors.New("-sdcard or -host is required")
+		}
+		if *bootPart < 1 {
+			return errors.New("-boot-part must be 1 or higher")
+		}
+		s, err = readCard(*sdCard, *bootPart)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Host:   %s\n", s.Host)
+	fmt.Printf("Date:   %s\n", s.Date)
+	fmt.Printf("Status: %s\n", s.Status)
+	if !s.success() {
+		fmt.Printf("Failed: %s (exit code %d)\n", s.Command, s.ExitCode)
+		return fmt.Errorf("the first boot setup failed; see %s on the device", s.Log)
+	}
+	return nil
+}
+
+func main() {
+	if err := mainImpl(); err != nil {
+		fmt.Fprintf(os.Stderr, "check-setup: %s.\n", err)
+		os.Exit(1)
+	}
+}
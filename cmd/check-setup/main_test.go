@@ -0,0 +1,49 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseStatus(t *testing.T) {
+	data := []struct {
+		in       string
+		expected status
+		success  bool
+	}{
+		{
+			"status=success\nexit_code=0\ncommand=\nhost=pi\nlog=/var/log/firstboot.log\ndate=2026-01-02T03:04:05Z\n",
+			status{Status: "success", Host: "pi", Log: "/var/log/firstboot.log", Date: "2026-01-02T03:04:05Z"},
+			true,
+		},
+		{
+			"\nstatus=failure\nexit_code=100\ncommand=sudo apt-get -y upgrade\nnew=ignored\n",
+			status{Status: "failure", ExitCode: 100, Command: "sudo apt-get -y upgrade"},
+			false,
+		},
+	}
+	for i, line := range data {
+		s, err := parseStatus(strings.NewReader(line.in))
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if *s != line.expected {
+			t.Fatalf("#%d: %#v", i, s)
+		}
+		if s.success() != line.success {
+			t.Fatalf("#%d: %t", i, s.success())
+		}
+	}
+}
+
+func TestParseStatusErr(t *testing.T) {
+	for i, in := range []string{"", "status=success\nexit_code=x\n", "status=unknown\n", "garbage\n"} {
+		if _, err := parseStatus(strings.NewReader(in)); err == nil {
+			t.Fatalf("#%d: expected error", i)
+		}
+	}
+}
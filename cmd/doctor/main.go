@@ -0,0 +1,207 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// doctor checks that this host has what the other tools need and prints what
+// to install or fix.
+//
+// It exits with 1 when a check required by the selected operations fails.
+package main // import "periph.io/x/bootstrap/cmd/doctor"
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"periph.io/x/bootstrap/img"
+)
+
+// level is the result of a check.
+type level int
+
+const (
+	ok level = iota
+	warn
+	fail
+)
+
+func (l level) String() string {
+	switch l {
+	case ok:
+		return " ok "
+	case warn:
+		return "warn"
+	default:
+		return "FAIL"
+	}
+}
+
+// check is one line of the checklist.
+type check struct {
+	level level
+	name  string
+	// fix is the remediation, printed when level is not ok.
+	fix string
+}
+
+// newCheck returns a passing check if good, otherwise one at level l.
+func newCheck(good bool, l level, name, fix string) check {
+	if good {
+		l = ok
+	}
+	return check{level: l, name: name, fix: fix}
+}
+
+// ops are the operations that can be checked.
+var ops = []string{"efe", "push"}
+
+// pushTools are the tools push uses, looked up in PATH.
+var pushTools = []string{"go", "rsync", "scp", "pscp", "ssh", "plink"}
+
+// parseOps splits the comma separated list of operations s.
+func parseOps(s string) ([]string, error) {
+	var out []string
+	for _, o := range strings.Split(s, ",") {
+		if o = strings.TrimSpace(o); o == "" {
+			continue
+		}
+		found := false
+		for _, e := range ops {
+			found = found || o == e
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown operation %q; expected one of %s", o, strings.Join(ops, ", "))
+		}
+		out = append(out, o)
+	}
+	if len(out) == 0 {
+		return nil, errors.New("-for can't be empty")
+	}
+	return out, nil
+}
+
+// efeChecks returns the checks for efe, backup and edit-card on goos.
+//
+// cards is the list of SDCards found.
+func efeChecks(c *img.Capabilities, goos string, cards []string) []check {
+	flashFix := "run as root or install sudo; dd must be in PATH"
+	mountFix := "install udisks2 to get udisksctl, or pmount"
+	listFix := "install util-linux to get lsblk, or specify -sdcard explicitly"
+	switch goos {
+	case "darwin":
+		flashFix = "run as an administrator with sudo; dd and diskutil must be in PATH"
+		mountFix = "diskutil must be in PATH"
+		listFix = "diskutil must be in PATH, or specify -sdcard explicitly"
+	case "windows":
+		listFix = "wmic must be in PATH, or specify -sdcard explicitly"
+	}
+	out := []check{
+		newCheck(c.CanFlash, fail, "Flash SDCards", flashFix),
+		newCheck(c.CanMount, fail, "Mount partitions", mountFix),
+		newCheck(c.CanListSDCards, warn, "List SDCards", listFix),
+		newCheck(c.Tools["xz"] != "", warn, "xz", "install xz to decompress images faster; the slower Go decoder is used otherwise"),
+	}
+	if c.CanListSDCards {
+		out = append(out, newCheck(len(cards) != 0, warn, "SDCard detected", "insert a SDCard, or specify -sdcard explicitly"))
+	}
+	return out
+}
+
+// pushChecks returns the checks for push given tools, the path of each of
+// pushTools or an empty string when not found.
+func pushChecks(tools map[string]string) []check {
+	copyTool := newCheck(tools["rsync"] != "", fail, "Copy tool", "install rsync, OpenSSH or PuTTY")
+	if copyTool.level != ok && (tools["scp"] != "" || tools["pscp"] != "") {
+		copyTool = check{level: warn, name: "Copy tool", fix: "install rsync to push faster and to use -delete, -exclude and -cache; scp or pscp is used otherwise"}
+	}
+	return []check{
+		newCheck(tools["go"] != "", fail, "Go toolchain", "install Go from https://go.dev/dl/"),
+		copyTool,
+		newCheck(tools["ssh"] != "" || tools["plink"] != "", fail, "ssh client", "install OpenSSH or PuTTY"),
+	}
+}
+
+// printChecks prints the checklist to w and returns the number of failures.
+func printChecks(w io.Writer, checks []check) int {
+	failed := 0
+	for _, c := range checks {
+		if c.level == ok {
+			fmt.Fprintf(w, "[%s] %s\n", c.level, c.name)
+			continue
+		}
+		if c.level == fail {
+			failed++
+		}
+		fmt.Fprintf(w, "[%s] %s: %s\n", c.level, c.name, c.fix)
+	}
+	return failed
+}
+
+func mainImpl() error {
+	forOps := flag.String("for", strings.Join(ops, ","), "Comma separated list of the operations to check for; one or more of "+strings.Join(ops, ", ")+"; efe also covers backup and edit-card")
+	verbose := flag.Bool("v", false, "log verbosely to stderr, including the capabilities and tools found")
+	debug := flag.Bool("vv", false, "log very verbosely to stderr, including the commands run")
+	quiet := flag.Bool("q", false, "only print the failed checks")
+	flag.Parse()
+	l, err := img.LevelFromFlags(*quiet, *verbose, *debug)
+	if err != nil {
+		return err
+	}
+	img.SetLevel(l)
+	if flag.NArg() != 0 {
+		return errors.New("unexpected argument")
+	}
+	selected, err := parseOps(*forOps)
+	if err != nil {
+		return err
+	}
+	var checks []check
+	for _, o := range selected {
+		switch o {
+		case "efe":
+			if err := img.CheckOS(); err != nil {
+				checks = append(checks, check{level: fail, name: "Operating system", fix: err.Error()})
+				continue
+			}
+			caps := img.GetCapabilities(nil)
+			log.Printf("Host capabilities:\n%s", &caps)
+			var cards []string
+			if caps.CanListSDCards {
+				cards = img.ListSDCards()
+			}
+			checks = append(checks, efeChecks(&caps, runtime.GOOS, cards)...)
+		case "push":
+			tools := map[string]string{}
+			for _, t := range pushTools {
+				tools[t], _ = exec.LookPath(t)
+			}
+			checks = append(checks, pushChecks(tools)...)
+		}
+	}
+	if *quiet {
+		var failed []check
+		for _, c := range checks {
+			if c.level == fail {
+				failed = append(failed, c)
+			}
+		}
+		checks = failed
+	}
+	if n := printChecks(os.Stdout, checks); n != 0 {
+		return fmt.Errorf("%d critical check(s) failed", n)
+	}
+	return nil
+}
+
+func main() {
+	if err := mainImpl(); err != nil {
+		fmt.Fprintf(os.Stderr, "doctor: %s.\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"periph.io/x/bootstrap/img"
+)
+
+func TestParseOps(t *testing.T) {
+	data := []struct {
+		in       string
+		expected []string
+	}{
+		{"efe", []string{"efe"}},
+		{"efe,push", []string{"efe", "push"}},
+		{" push , ", []string{"push"}},
+	}
+	for i, l := range data {
+		got, err := parseOps(l.in)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if len(got) != len(l.expected) {
+			t.Fatalf("%d: %q", i, got)
+		}
+		for j := range got {
+			if got[j] != l.expected[j] {
+				t.Fatalf("%d: %q", i, got)
+			}
+		}
+	}
+	for i, in := range []string{"", ",", "flash"} {
+		if _, err := parseOps(in); err == nil {
+			t.Fatalf("%d: expected error", i)
+		}
+	}
+}
+
+func TestEfeChecks(t *testing.T) {
+	c := img.Capabilities{CanMount: true, CanListSDCards: true, Tools: map[string]string{"xz": "/usr/bin/xz"}}
+	got := efeChecks(&c, "linux", nil)
+	expected := []level{fail, ok, ok, ok, warn}
+	if len(got) != len(expected) {
+		t.Fatalf("%v", got)
+	}
+	for i, l := range expected {
+		if got[i].level != l {
+			t.Fatalf("%d: %s %s", i, got[i].level, got[i].name)
+		}
+	}
+	// The SDCard detection is skipped when they can't be listed.
+	c = img.Capabilities{CanFlash: true, CanMount: true, Tools: map[string]string{}}
+	if got = efeChecks(&c, "darwin", []string{"/dev/disk4"}); len(got) != 4 || got[2].level != warn || got[3].level != warn {
+		t.Fatalf("%v", got)
+	}
+}
+
+func TestPushChecks(t *testing.T) {
+	data := []struct {
+		tools    map[string]string
+		expected []level
+	}{
+		{map[string]string{"go": "go", "rsync": "rsync", "ssh": "ssh"}, []level{ok, ok, ok}},
+		{map[string]string{"go": "go", "scp": "scp", "ssh": "ssh"}, []level{ok, warn, ok}},
+		{map[string]string{"pscp": "pscp", "plink": "plink"}, []level{fail, warn, ok}},
+		{map[string]string{}, []level{fail, fail, fail}},
+	}
+	for i, l := range data {
+		got := pushChecks(l.tools)
+		for j, e := range l.expected {
+			if got[j].level != e {
+				t.Fatalf("%d: %d: %s %s", i, j, got[j].level, got[j].name)
+			}
+		}
+	}
+}
+
+func TestPrintChecks(t *testing.T) {
+	checks := []check{
+		{level: ok, name: "Go toolchain", fix: "ignored"},
+		{level: warn, name: "xz", fix: "install xz"},
+		{level: fail, name: "ssh client", fix: "install OpenSSH"},
+	}
+	b := bytes.Buffer{}
+	if n := printChecks(&b, checks); n != 1 {
+		t.Fatalf("%d", n)
+	}
+	expected := "[ ok ] Go toolchain\n[warn] xz: install xz\n[FAIL] ssh client: install OpenSSH\n"
+	if s := b.String(); s != expected {
+		t.Fatalf("%q", s)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// edit-card copies files into the boot partition of an already flashed
+// SDCard.
+//
+// It is useful to tweak the configuration of a provisioned card without
+// flashing it again. With -img, it edits the boot partition of an image file
+// instead, without mounting it.
+package main // import "periph.io/x/bootstrap/cmd/edit-card"
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"periph.io/x/bootstrap/img"
+)
+
+// copyTo copies the host file src to dst, a slash separated path relative to
+// the directory dir.
+func copyTo(dir, src, dst string) error {
+	/* #nosec G304 */
+	fs, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	/* #nosec G307 */
+	defer fs.Close()
+	p := filepath.Join(dir, filepath.FromSlash(dst))
+	/* #nosec G301 */
+	if err = os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	/* #nosec G302 G304 */
+	fd, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(fd, fs); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// parseCopy parses an argument in the form src[:dst]. dst defaults to the
+// base name of src.
+func parseCopy(v string) (string, string, error) {
+	src, dst := v, filepath.Base(v)
+	// Use the last colon and skip the volume name so Windows paths like C:\foo
+	// work as src.
+	if i := strings.LastIndexByte(v, ':'); i >= 1 && i >= len(filepath.VolumeName(v)) {
+		src, dst = v[:i], v[i+1:]
+	}
+	// Accept a leading "/" as the partition root.
+	dst = path.Clean(strings.TrimLeft(strings.ReplaceAll(dst, "\\", "/"), "/"))
+	if src == "" || dst == "." || dst == ".." || strings.HasPrefix(dst, "../") {
+		return "", "", fmt.Errorf("expected src[:dst] with dst within the boot partition, got %q", v)
+	}
+	return src, dst, nil
+}
+
+// copyToImage copies the files into the boot partition number bootPart of the
+// image file imgPath with img.BootEditor, without mounting it.
+func copyToImage(imgPath string, bootPart int, copies []file) error {
+	/* #nosec G304 */
+	f, err := os.OpenFile(imgPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	/* #nosec G307 */
+	defer f.Close()
+	l, err := img.Partitions(f, bootPart, 0)
+	if err != nil {
+		return err
+	}
+	e, err := img.NewBootEditor(img.NewFileDisk(f, l.Boot.Offset, l.Boot.Size))
+	if err != nil {
+		return err
+	}
+	for _, c := range copies {
+		img.Progressf("- Copying %s to /%s\n", c.src, c.dst)
+		/* #nosec G304 */
+		b, err := os.ReadFile(c.src)
+		if err != nil {
+			return err
+		}
+		if d := path.Dir(c.dst); d != "." {
+			if err = e.MkdirAll(d); err != nil {
+				return err
+			}
+		}
+		if err = e.WriteFile(c.dst, b); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// file is a host file src to copy as dst in the boot partition.
+type file struct{ src, dst string }
+
+func mainImpl() error {
+	sdCards := img.ListSDCards()
+	def := ""
+	if len(sdCards) == 1 {
+		def = sdCards[0]
+	}
+	sdCard := flag.String("sdcard", def, "Path to SDCard; one of "+strings.Join(sdCards, ","))
+	imgPath := flag.String("img", "", "Edit this image file instead of a SDCard")
+	bootPart := flag.Int("boot-part", 1, "Partition number of the FAT boot partition")
+	eject := flag.Bool("eject", false, "Eject the SDCard once edited")
+	verbose := flag.Bool("v", false, "log verbosely to stderr")
+	debug := flag.Bool("vv", false, "log very verbosely to stderr, including the commands run")
+	quiet := flag.Bool("q", false, "only print errors")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: edit-card [flags] <src[:dst]>...\n\nCopies the host files src into the boot partition of a SDCard or of an image\nfile, as dst relative to the partition root.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	l, err := img.LevelFromFlags(*quiet, *verbose, *debug)
+	if err != nil {
+		return err
+	}
+	img.SetLevel(l)
+	if flag.NArg() == 0 {
+		return errors.New("specify at least one file to copy")
+	}
+	if *imgPath != "" {
+		if *eject {
+			return errors.New("-eject can't be used with -img")
+		}
+	} else {
+		if err := img.CheckOS(); err != nil {
+			return err
+		}
+		if *sdCard == "" {
+			return errors.New("-sdcard is required")
+		}
+	}
+	if *bootPart < 1 {
+		return errors.New("-boot-part must be 1 or higher")
+	}
+	var copies []file
+	for _, a := range flag.Args() {
+		src, dst, err := parseCopy(a)
+		if err != nil {
+			return err
+		}
+		if _, err = os.Stat(src); err != nil {
+			return err
+		}
+		copies = append(copies, file{src, dst})
+	}
+	if *imgPath != "" {
+		return copyToImage(*imgPath, *bootPart, copies)
+	}
+	// Log the files copied along with the ones img writes itself.
+	o := &img.Options{Written: &img.WriteLog{}}
+	err = img.EditBootPartition(context.Background(), *sdCard, *bootPart, func(dir string) error {
+		for _, c := range copies {
+			img.Progressf("- Copying %s to /%s\n", c.src, c.dst)
+			p := filepath.Join(dir, filepath.FromSlash(c.dst))
+			_, err := os.Lstat(p)
+			created := os.IsNotExist(err)
+			if err = copyTo(dir, c.src, c.dst); err != nil {
+				return err
+			}
+			if err = o.Written.Record(p, created); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, o)
+	if err != nil {
+		return err
+	}
+	if *eject {
+		img.Progressf("- Ejecting %s\n", *sdCard)
+		if err = img.Eject(*sdCard, o); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("\nYou can now remove the SDCard safely\n")
+	return nil
+}
+
+func main() {
+	if err := mainImpl(); err != nil {
+		fmt.Fprintf(os.Stderr, "edit-card: %s.\n", err)
+		os.Exit(1)
+	}
+}
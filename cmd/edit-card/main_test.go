@@ -0,0 +1,49 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestParseCopy(t *testing.T) {
+	data := []struct {
+		in  string
+		src string
+		dst string
+	}{
+		{"config.txt", "config.txt", "config.txt"},
+		{"dir/config.txt", "dir/config.txt", "config.txt"},
+		{"a:b", "a", "b"},
+		{"ab:b", "ab", "b"},
+		{"a:/overlays/x.dtbo", "a", "overlays/x.dtbo"},
+		{"dir/a.txt:sub\\b.txt", "dir/a.txt", "sub/b.txt"},
+	}
+	if runtime.GOOS == "windows" {
+		data = append(data, []struct {
+			in  string
+			src string
+			dst string
+		}{
+			{"C:\\foo\\a.txt", "C:\\foo\\a.txt", "a.txt"},
+			{"C:\\foo\\a.txt:b.txt", "C:\\foo\\a.txt", "b.txt"},
+		}...)
+	}
+	for i, l := range data {
+		src, dst, err := parseCopy(l.in)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if src != l.src || dst != l.dst {
+			t.Fatalf("%d: %q %q", i, src, dst)
+		}
+	}
+	for i, in := range []string{"a:", "a:..", "a:../b", "a:/"} {
+		if _, _, err := parseCopy(in); err == nil {
+			t.Fatalf("%d: %q: expected error", i, in)
+		}
+	}
+}
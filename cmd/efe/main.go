@@ -13,36 +13,66 @@
 package main // import "periph.io/x/bootstrap/cmd/efe"
 
 import (
+	"bufio"
 	"bytes"
-	/* #nosec G505 */
-	"crypto/sha1"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
+	// Embed the time zone database to validate -time even on Windows.
+	_ "time/tzdata"
 
-	"github.com/rekby/mbr"
-	"golang.org/x/crypto/pbkdf2"
 	"periph.io/x/bootstrap/img"
 )
 
-// oldRcLocal is the start of /etc/rc.local as found on Debian derived
-// distributions before Debian 10 and Ubuntu 18.04.
-//
-// The comments are essentially the free space available to edit the file
-// without having to understand EXT4. :)
-//
-// TODO(maruel): Find a new way for newer distributions.
-const oldRcLocal = "#!/bin/sh -e\n#\n# rc.local\n#\n# This script is executed at the end of each multiuser runlevel.\n# Make sure that the script will \"exit 0\" on success or any other\n# value on error.\n#\n# In order to enable or disable this script just change the execution\n# bits.\n#\n# By default this script does nothing.\n"
+// defaultFirstBootLog is the default value of -firstboot-log.
+const defaultFirstBootLog = "/var/log/firstboot.log"
+
+// firstBootStatus is the file written by setup.sh with the result of the first
+// boot setup with -firstboot-status. It is in the boot partition so it can be
+// read back from the SDCard with check-setup.
+const firstBootStatus = "/boot/firstboot.done"
+
+// firstBootUnit is a systemd unit running /boot/firstboot.sh once with the
+// arguments found in img.FirstBootArgs, installed in the root partition on
+// images without /etc/rc.local. The log path is substituted.
+const firstBootUnit = `# Generated by https://github.com/periph/bootstrap
+[Unit]
+Description=periph.io/x/bootstrap first boot setup
+Wants=network-online.target
+After=network-online.target
+ConditionPathExists=!%[1]s
 
-// denseRcLocal is a 'dense' version of img.RcLocalContent.
-const denseRcLocal = "#!/bin/sh -e\nL=/var/log/firstboot.log;if [ ! -f $L ];then /boot/firstboot.sh%s 2>&1|tee $L;fi\n#"
+[Service]
+Type=oneshot
+ExecStart=/bin/sh -c "eval \"/boot/firstboot.sh $$(cat /boot/%[2]s)\" 2>&1 | tee %[1]s"
+
+[Install]
+WantedBy=multi-user.target
+`
 
 // raspberryPi3UART is the part to append to /boot/config.txt to enable UART on
 // RaspberryPi 3.
@@ -55,41 +85,401 @@ enable_uart=1
 [all]
 `
 
-// raspberryPiWPASupplicant is a valid wpa_supplicant.conf file for RaspiOS.
+// raspberryPiUART is the part to append to /boot/config.txt to enable UART on
+// all models.
+const raspberryPiUART = `
+
+# Enable console on UART
+enable_uart=1
+`
+
+// raspberryPiModelUART is the part to append to /boot/config.txt to enable
+// UART on a specific model. The model and the extra settings are substituted.
+const raspberryPiModelUART = `
+
+# Enable console on UART on %s
+[%s]
+enable_uart=1
+%s[all]
+`
+
+// raspberryPiI2C is the part to append to /boot/config.txt to enable I²C.
+const raspberryPiI2C = `
+
+# Enable I²C
+dtparam=i2c_arm=on
+`
+
+// raspberryPiSPI is the part to append to /boot/config.txt to enable SPI.
+const raspberryPiSPI = `
+
+# Enable SPI
+dtparam=spi=on
+`
+
+// raspberryPi1Wire is the part to append to /boot/config.txt to enable 1-Wire
+// on GPIO4.
+const raspberryPi1Wire = `
+
+# Enable 1-Wire on GPIO4
+dtoverlay=w1-gpio
+`
+
+// piModels are the supported values for -pi-model, as config.txt conditional
+// filters.
 //
-// On RaspiOS with package raspberrypi-net-mods installed (it is installed by
-// default on stretch lite), a file /boot/wpa_supplicant.conf will
-// automatically be copied to /etc/wpa_supplicant/.
+// https://www.raspberrypi.com/documentation/computers/config_txt.html#model-filters
+var piModels = []string{"pi0", "pi02", "pi3", "pi4", "cm4", "pi5"}
+
+// usesKMS returns true if the model uses the KMS display driver by default,
+// which ignores the legacy hdmi_group and hdmi_mode settings.
+func usesKMS(model string) bool {
+	return model == "pi4" || model == "cm4" || model == "pi5"
+}
+
+// uartConfigTxt returns the part to append to /boot/config.txt to enable the
+// console on UART for the model. An empty model means all models.
+func uartConfigTxt(model string) string {
+	switch model {
+	case "":
+		return raspberryPiUART
+	case "pi3":
+		return raspberryPi3UART
+	case "pi5":
+		// The RPi5 console defaults to the dedicated debug UART connector;
+		// route it to GPIO14/15 like on previous models.
+		return fmt.Sprintf(raspberryPiModelUART, model, model, "dtparam=uart0_console\n")
+	default:
+		return fmt.Sprintf(raspberryPiModelUART, model, model, "")
+	}
+}
+
+// displayMode is a display mode to write in /boot/config.txt.
 //
-// This has two advantages:
-//   - wifi is enabled sooner in the boot process than when it's setup.sh that
-//     does it.
-//   - the preshared key (passphrase) is stored in hashed form.
-const raspberryPiWPASupplicant = `country=%s
-ctrl_interface=DIR=/var/run/wpa_supplicant GROUP=netdev
-update_config=1
+// https://www.raspberrypi.com/documentation/computers/config_txt.html#hdmi-mode
+type displayMode struct {
+	name string
+	// group is 1 for CEA (TVs) and 2 for DMT (monitors).
+	group int
+	mode  int
+	// cvt is a custom mode, used when mode is 87.
+	cvt string
+}
+
+// configTxt returns the part to append to /boot/config.txt.
+func (h *displayMode) configTxt() string {
+	out := fmt.Sprintf("\n\n# Set HDMI display mode to %s\nhdmi_group=%d\nhdmi_mode=%d\n", h.name, h.group, h.mode)
+	if h.cvt != "" {
+		out += "hdmi_cvt=" + h.cvt + "\n"
+	}
+	return out
+}
+
+// cmdlineVideo returns the kernel argument to append to /boot/cmdline.txt to
+// set the mode with the KMS driver.
+func (h *displayMode) cmdlineVideo() string {
+	return "video=HDMI-A-1:" + h.name + "@60"
+}
+
+// displayModes are the supported values for -hdmi-mode.
+var displayModes = []displayMode{
+	{"640x480", 2, 4, ""},
+	{"800x480", 2, 87, "800 480 60 6 0 0 0"},
+	{"800x600", 2, 9, ""},
+	{"1024x600", 2, 87, "1024 600 60 6 0 0 0"},
+	{"1024x768", 2, 16, ""},
+	{"1280x720", 2, 85, ""},
+	{"1280x800", 2, 28, ""},
+	{"1920x1080", 2, 82, ""},
+}
+
+// getDisplayMode returns the displayMode matching the name.
+func getDisplayMode(name string) (*displayMode, error) {
+	for i := range displayModes {
+		if displayModes[i].name == name {
+			return &displayModes[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported -hdmi-mode %q", name)
+}
+
+func getHDMIModeHelp() string {
+	names := make([]string, len(displayModes))
+	for i := range displayModes {
+		names[i] = displayModes[i].name
+	}
+	return fmt.Sprintf("HDMI display resolution (RaspiOS only); one of %s", strings.Join(names, ", "))
+}
+
+// cloudInitHostname is the part to append to /boot/user-data to set the
+// hostname on cloud-init based images.
+const cloudInitHostname = `
 
 # Generated by https://github.com/periph/bootstrap
-network={
-	ssid="%s"
-	psk=%s
-	key_mgmt=WPA-PSK
+hostname: %s
+`
+
+// cloudInitDefaultUser is the part to append to /boot/user-data to rename the
+// default user on cloud-init based images. It keeps its groups and sudo
+// rights.
+const cloudInitDefaultUser = `
+system_info:
+  default_user:
+    name: %s
+`
+
+// cloudInitLocale is the part to append to /boot/user-data to set the locale on
+// cloud-init based images.
+const cloudInitLocale = `
+locale: %s
+`
+
+// cloudInitKeyboard is the part to append to /boot/user-data to set the
+// keyboard layout on cloud-init based images. cloud-init writes
+// /etc/default/keyboard.
+const cloudInitKeyboard = `
+keyboard:
+  layout: %s
+`
+
+// cloudInitSSHPort is the part to append to /boot/user-data to set the ssh
+// daemon port on cloud-init based images. ssh.socket, when used, is regenerated
+// from sshd_config on daemon-reload.
+const cloudInitSSHPort = `
+write_files:
+  - path: /etc/ssh/sshd_config.d/port.conf
+    content: |
+      Port %d
+runcmd:
+  - [sh, -c, "systemctl daemon-reload; systemctl try-restart ssh.socket; systemctl restart ssh"]
+`
+
+// cloudInitEnableSSH is the part to append to /boot/user-data to make sure the
+// ssh daemon is enabled on cloud-init based images. Ubuntu 22.10 and later
+// use socket activation, in which case ssh.service must not be started.
+const cloudInitEnableSSH = `
+bootcmd:
+  - [sh, -c, "systemctl is-enabled -q ssh.socket || systemctl is-enabled -q ssh || systemctl enable --now --no-block ssh"]
+`
+
+// cloudInitNoGrowpart is the part to append to /boot/user-data to keep the
+// root partition and file system at their original size on cloud-init based
+// images.
+const cloudInitNoGrowpart = `
+growpart:
+  mode: "off"
+resize_rootfs: false
+`
+
+// raspiosResizeInit is the kernel argument in /boot/cmdline.txt that expands
+// the root partition on the first boot of RaspiOS.
+const raspiosResizeInit = "init=/usr/lib/raspi-config/init_resize.sh"
+
+// locales are the UTF-8 locales accepted by -locale. They are all listed in
+// Debian's /usr/share/i18n/SUPPORTED.
+var locales = []string{
+	"ca_ES.UTF-8", "cs_CZ.UTF-8", "da_DK.UTF-8", "de_AT.UTF-8", "de_CH.UTF-8",
+	"de_DE.UTF-8", "el_GR.UTF-8", "en_AU.UTF-8", "en_CA.UTF-8", "en_GB.UTF-8",
+	"en_IE.UTF-8", "en_IN.UTF-8", "en_NZ.UTF-8", "en_US.UTF-8", "en_ZA.UTF-8",
+	"es_AR.UTF-8", "es_ES.UTF-8", "es_MX.UTF-8", "fi_FI.UTF-8", "fr_BE.UTF-8",
+	"fr_CA.UTF-8", "fr_CH.UTF-8", "fr_FR.UTF-8", "he_IL.UTF-8", "hu_HU.UTF-8",
+	"it_IT.UTF-8", "ja_JP.UTF-8", "ko_KR.UTF-8", "nb_NO.UTF-8", "nl_BE.UTF-8",
+	"nl_NL.UTF-8", "pl_PL.UTF-8", "pt_BR.UTF-8", "pt_PT.UTF-8", "ro_RO.UTF-8",
+	"ru_RU.UTF-8", "sk_SK.UTF-8", "sv_SE.UTF-8", "tr_TR.UTF-8", "uk_UA.UTF-8",
+	"zh_CN.UTF-8", "zh_TW.UTF-8",
+}
+
+// reKeyboard matches a XKBLAYOUT value, e.g. "gb" or "us".
+var reKeyboard = regexp.MustCompile(`^[a-z]{2,8}$`)
+
+// checkLocale verifies the -locale and -keyboard flags.
+func checkLocale(locale, keyboard string) error {
+	if locale != "" {
+		found := false
+		for _, l := range locales {
+			found = found || l == locale
+		}
+		if !found {
+			return fmt.Errorf("unsupported -locale %q; one of %s", locale, strings.Join(locales, ", "))
+		}
+	}
+	if keyboard != "" && !reKeyboard.MatchString(keyboard) {
+		return fmt.Errorf("-keyboard %q must be a layout like \"us\" or \"gb\"", keyboard)
+	}
+	return nil
+}
+
+var (
+	reWPANetwork = regexp.MustCompile(`(?m)^\s*network\s*=\s*\{`)
+	reWPACountry = regexp.MustCompile(`(?m)^\s*country\s*=\s*[A-Z]{2}\s*$`)
+)
+
+// checkWPAConf verifies that the content of a wpa_supplicant.conf specified
+// with -wpa-conf defines at least one network and the country.
+func checkWPAConf(b []byte) error {
+	if !reWPANetwork.Match(b) {
+		return errors.New("no network={} block")
+	}
+	if !reWPACountry.Match(b) {
+		// Without it, the wifi stays blocked by rfkill on RaspiOS.
+		return errors.New("no country= line")
+	}
+	return nil
+}
+
+// cloudInitSSHKeys returns the part to append to /boot/user-data to set the
+// ssh host key on cloud-init based images.
+func cloudInitSSHKeys(priv, pub []byte) string {
+	out := "\nssh_keys:\n  ed25519_private: |\n"
+	for _, l := range strings.Split(strings.TrimSpace(string(priv)), "\n") {
+		out += "    " + l + "\n"
+	}
+	return out + "  ed25519_public: " + strings.TrimSpace(string(pub)) + "\n"
+}
+
+// cloudInitUser returns the part to append to /boot/user-data to configure the
+// default user on cloud-init based images.
+//
+// Ubuntu forces a password change on the first login, which breaks headless
+// use, so it is disabled. keys are the ssh public keys to authorize and hash,
+// if not empty, is the crypt(3) hash of the password to set.
+//
+// The password is set with both the users form, needed since cloud-init 22.3
+// deprecated list, and the list form, the only one known by older releases.
+func cloudInitUser(user, keys, hash string) string {
+	out := "\nchpasswd:\n  expire: false\n"
+	if hash != "" {
+		out += "  users:\n    - name: " + user + "\n      password: " + hash + "\n      type: hash\n"
+		out += "  list: |\n    " + user + ":" + hash + "\n"
+	}
+	var lines []string
+	for _, l := range strings.Split(keys, "\n") {
+		if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, "#") {
+			// Quote since the comment of a key may contain YAML special characters.
+			lines = append(lines, "  - "+strconv.Quote(l)+"\n")
+		}
+	}
+	if len(lines) != 0 {
+		out += "ssh_authorized_keys:\n" + strings.Join(lines, "")
+	}
+	if *noPassword {
+		out += "ssh_pwauth: false\n"
+	}
+	return out
 }
+
+// cloudInitNetworkConfig is a netplan file to write as /boot/network-config
+// on cloud-init based images to use a static IP.
+const cloudInitNetworkConfig = `# Generated by https://github.com/periph/bootstrap
+version: 2
+ethernets:
+  eth0:
+    dhcp4: false
+    addresses: [%s]
 `
 
+// written records the files written to the SDCards or images, reported with
+// -output json.
+var written img.WriteLog
+
+// opts is how the img package fetches, flashes and mounts, as set by the
+// flags.
+var opts = img.Options{Written: &written}
+
 var (
 	image        img.Image
-	sshKey       = flag.String("ssh-key", img.FindPublicKey(), "ssh public key to use")
 	email        = flag.String("email", "", "email address to forward root@localhost to")
-	wifiCountry  = flag.String("wifi-country", img.GetCountry(), "Country setting for Wifi; affect usable bands")
+	smtpHost     = flag.String("smtp-host", "", "SMTP relay to send emails through with -email, as host or host:port; defaults to port 587")
+	smtpUser     = flag.String("smtp-user", "", "User to authenticate to -smtp-host")
+	smtpPass     = flag.String("smtp-pass", "", "Password to authenticate to -smtp-host")
+	wifiCountry  = flag.String("wifi-country", "", "Country setting for Wifi; affect usable bands; defaults to the country detected via ipinfo.io, or derived from -locale with -offline")
 	wifiSSID     = flag.String("wifi-ssid", "", "wifi ssid")
-	wifiPass     = flag.String("wifi-pass", "", "wifi password")
-	fiveInches   = flag.Bool("5inch", false, "Enable support for 5\" 800x480 display (RaspiOS only)")
-	forceUART    = flag.Bool("forceuart", false, "Enable console UART support (RaspiOS only)")
+	wifiPlainPSK = flag.Bool("wifi-plaintext-psk", false, "Write the wifi password as is in /boot/wpa_supplicant.conf on RaspiOS instead of the hashed key, for networks where the hashed key doesn't work; the password is then readable by anyone with the SDCard")
+	wifiPass     = flag.String("wifi-pass", "", "wifi password; defaults to the environment variable "+envWifiPass+", otherwise it is asked for when run from a terminal, to keep it off the shell history")
+	wpaConf      = flag.String("wpa-conf", "", "Existing wpa_supplicant.conf to copy as-is instead of generating one from -wifi-ssid (RaspiOS only)")
+	fiveInches   = flag.Bool("5inch", false, "Enable support for 5\" 800x480 display (RaspiOS only); alias for -hdmi-mode 800x480")
+	hdmiMode     = flag.String("hdmi-mode", "", getHDMIModeHelp())
+	mdns         = flag.Bool("mdns", false, "Install and enable avahi-daemon on first boot so the device advertises <hostname>.local and its ssh service over mDNS")
+	skipUpgrade  = flag.Bool("skip-upgrade", false, "Skip apt-get upgrade on first boot to come up faster; security updates are then your responsibility until the nightly unattended upgrade")
+	forceUART    = flag.Bool("forceuart", false, "Enable console UART support (Raspberry Pi and Odroid only)")
+	piModel      = flag.String("pi-model", "", "Raspberry Pi model to target for config.txt edits (RaspiOS only); one of "+strings.Join(piModels, ", ")+"; defaults to the one of -board, or all")
+	cmdlineAdd   = flag.String("cmdline-append", "", "Space separated kernel arguments to append to /boot/cmdline.txt (RaspiOS only), e.g. \"cgroup_enable=cpuset cgroup_memory=1 cgroup_enable=memory\" for containers")
+	enableI2C    = flag.Bool("enable-i2c", false, "Enable I²C support (RaspiOS only)")
+	enableSPI    = flag.Bool("enable-spi", false, "Enable SPI support (RaspiOS only)")
+	enable1Wire  = flag.Bool("enable-1wire", false, "Enable 1-Wire support on GPIO4 (RaspiOS only)")
+	staticIP     = flag.String("ip", "", "Static IP address in CIDR form for the wired network, e.g. 192.168.1.10/24; defaults to DHCP")
+	gateway      = flag.String("gateway", "", "Default gateway to use with -ip")
+	dns          = flag.String("dns", "", "Comma separated DNS servers to use with -ip")
+	aptMirror    = flag.String("apt-mirror", "", "Debian or Ubuntu mirror URL replacing the ones in /etc/apt/sources.list before the first apt-get upgrade, e.g. http://mirror.example.com/debian")
+	proxy        = flag.String("proxy", "", "Proxy URL for the downloads, e.g. http://proxy.example.com:3128; defaults to the HTTPS_PROXY and HTTP_PROXY environment variables")
+	aptProxy     = flag.String("apt-proxy", "", "HTTP proxy URL for apt, e.g. http://proxy.example.com:3128")
+	latestSetup  = flag.Bool("latest-setup-sh", false, "Use the setup.sh of GitHub master instead of the one embedded in efe; it may not support every flag of this efe version")
+	firstBootLog = flag.String("firstboot-log", defaultFirstBootLog, "Path of the first boot setup log on the device, e.g. when /var/log is not writable")
+	bootStatus   = flag.Bool("firstboot-status", false, "Write the result of the first boot setup to "+firstBootStatus+", to be read back with check-setup from the SDCard or over ssh")
 	sdCard       = flag.String("sdcard", getDefaultSDCard(), getSDCardHelp())
+	parallel     = flag.Int("parallel", 4, "Maximum number of SDCards to flash concurrently when multiple comma separated -sdcard are specified")
 	timeLocation = flag.String("time", img.GetTimeLocation(), "Location to use to define time")
-	postScript   = flag.String("post", "", "Command to run after setup is done")
-	v            = flag.Bool("v", false, "log verbosely")
+	locale       = flag.String("locale", getDefaultLocale(), "Locale to set on the device, e.g. en_GB.UTF-8; defaults to the host's $LANG when supported")
+	keyboard     = flag.String("keyboard", "", "Keyboard layout to set on the device, e.g. gb; defaults to the image's")
+	imageSpec    = flag.String("image", "", "Image as manufacturer:board:distro, e.g. raspberrypi::raspios64, where any part can be omitted; -manufacturer, -board and -distro override its parts")
+	mirror       = flag.String("mirror", "", "Base URL of a mirror to fetch the image from, e.g. https://de.eu.odroid.in; falls back to the default on failure")
+	imageDate    = flag.String("image-date", "", "Date of the RaspiOS release to use, formatted as YYYY-MM-DD, e.g. 2024-07-04; defaults to the latest")
+	bootPart     = flag.Int("boot-part", 0, "Partition number of the FAT boot partition; defaults to the image's layout")
+	rootPart     = flag.Int("root-part", 0, "Partition number of the EXT4 root partition; defaults to the image's layout")
+	rootFS       = flag.String("root-fs", "", "Locate the EXT4 root partition in the image by its filesystem instead of -root-part, as LABEL=<label> or UUID=<uuid>, e.g. LABEL=rootfs")
+	keepImage    = flag.Bool("keep-image", true, "Keep the fetched image to reuse it on the next run")
+	checkSSHKey  = flag.Bool("check-ssh-key", true, "Warn when a -ssh-key .pub file doesn't have its matching private key next to it")
+	manifest     = flag.String("manifest", "", "File to append a JSON line to for each SDCard provisioned, with the time, device, image, its SHA-256, the hostname and the first boot arguments, with the secrets redacted")
+	keepMod      = flag.Bool("keep-mod", false, "Keep the modified -mod image once flashed")
+	modOut       = flag.String("mod-out", "", "Path to write the modified image copy to; defaults to the image's path with -mod inserted before the extension")
+	driveLetter  = flag.Bool("drive-letter", false, "Assign a drive letter to the boot partition while it is edited and print it (Windows only)")
+	listCache    = flag.Bool("list-cache", false, "List the images cached in the current directory with their distro, date and size, then exit")
+	useCached    = flag.String("use-cached", "", "Use this image listed by -list-cache, by path or file name; like -local-image but fails if the image is not cached")
+	pruneCache   = flag.Duration("prune-cache", 0, "Delete the images cached in the current directory not modified for this long, e.g. 720h, then exit")
+	yes          = flag.Bool("yes", false, "Don't ask for confirmation before erasing the SDCards; the confirmation is only asked when run from a terminal")
+	forceRefresh = flag.Bool("force-refresh", false, "Fetch or decompress the image again instead of reusing the one in the current directory, e.g. when it is corrupted")
+	noSudo       = flag.Bool("no-sudo", false, "Never run sudo, for unattended use where a password prompt would hang; fails up front unless run as root, which runs the commands directly")
+	timeout      = flag.Duration("timeout", 0, "Fail instead of hanging when the whole operation, including fetching, flashing, mounting and waiting for the partitions, takes longer than this, e.g. 30m; disabled by default")
+	offline      = flag.Bool("offline", false, "Disable all network access; requires -local-image")
+	verifySig    = flag.Bool("verify-signature", false, "Verify the OpenPGP signature of the downloaded RaspiOS image with gpgv against the -signing-key keys and refuse to flash it on failure; a cached image is reused only if it was verified against the same signature")
+	info         = flag.Bool("info", false, "Print the resolved image selection, its defaults and the URL it would be fetched from, then exit")
+	detect       = flag.Bool("detect", false, "Print the manufacturer, board and distro of the image already on -sdcard, to re-flash it the same way, then exit")
+	printURL     = flag.Bool("print-url", false, "Print the URL of the image that would be fetched and the decompressed file name, then exit")
+	localImage   = flag.String("local-image", "", "Path to a local .img or .img.xz file to use instead of fetching the image")
+	imageURL     = flag.String("image-url", "", "URL of a raw, .xz or .gz image to stream straight to the SDCard without storing it, instead of fetching the image; the root partition isn't edited before flashing")
+	eject        = flag.Bool("eject", false, "Eject the SDCard once done so it can be removed safely")
+	benchmark    = flag.Bool("benchmark", false, "Measure the SDCard write speed before flashing and warn if it is implausibly slow or reports a fake capacity")
+	saveXZ       = flag.String("save-xz", "", "Write the provisioned image to this .img.xz file instead of flashing a SDCard; see -compress for other formats")
+	compress     = flag.String("compress", "", "Compression of -save-xz as format[:level]; one of xz, gz or zst, e.g. xz:9 or zst:3; defaults to xz:6. The -save-xz extension must match the format")
+	saveImg      = flag.String("save-img", "", "Write the provisioned image to this .img file instead of flashing a SDCard; with -local-image, edits an existing image without network access")
+	checkCap     = flag.Bool("check-capacity", false, "Write and read back patterns across the SDCard before flashing to detect a fake capacity card; fails if the image doesn't fit in the usable capacity")
+	blockSize    = flag.String("flash-block-size", "", "Size of the writes when flashing, e.g. 1M or 512K; a multiple of 512 up to 64M. Defaults to 4M with dd and 64K on Windows")
+	partTimeout  = flag.Duration("partition-timeout", img.DefaultPartitionTimeout, "Time to wait for the partitions to show up once flashed; increase it for slow card readers or USB hubs")
+	mountRetries = flag.Int("mount-retries", img.DefaultMountRetries, "Number of times to retry mounting a partition that fails to mount, e.g. while it is still being probed (Linux only)")
+	baseline     = flag.String("baseline", "", "Path to the image last flashed on the SDCard, updated once flashed; only the 4MiB blocks that differ from it are written, for a faster development loop. The SDCard must not have been booted since. Flashes in full when it doesn't exist yet")
+	bmapPath     = flag.String("bmap", "", "Path to a bmaptool block map file for the image; only the mapped blocks are flashed. Defaults to <image>.bmap when found next to the image")
+	hostname     = flag.String("hostname", "", "Hostname to set on the device; defaults to <board>-<serial> as set by setup.sh; with multiple -sdcard, a -01, -02, ... suffix is appended")
+	hostPrefix   = flag.String("hostname-prefix", "", "Assign the hostnames <prefix>-001, <prefix>-002, ... to the SDCards, e.g. lab; the fleet friendly alternative to -hostname")
+	hostProbe    = flag.Bool("hostname-probe", false, "With -hostname-prefix, skip the names already resolving as <name>.local over mDNS")
+	hostKey      = flag.Bool("host-key", false, "Generate the device's ed25519 ssh host key on this computer and print the matching known_hosts line, so the device can be verified on first connect")
+	sshPort      = flag.Int("ssh-port", 22, "Port for the device's ssh daemon to listen on")
+	userName     = flag.String("user", "", "Account to create on RaspiOS and Ubuntu instead of the image's default user, e.g. alice; its home receives the -ssh-key keys. Requires -password on RaspiOS")
+	password     = flag.String("password", "", "Password to set for the default user or -user on RaspiOS and Ubuntu, written hashed to /boot/userconf.txt or /boot/user-data; use 'random' to generate one, printed once done, or '-' to type it; defaults to the environment variable "+envPassword)
+	noPassword   = flag.Bool("disable-password-auth", false, "Disable ssh password authentication and lock the default user password; requires -ssh-key")
+	forceSystem  = flag.Bool("i-know-what-im-doing", false, "Allow -sdcard to be the disk containing the running OS")
+	sshKeys      stringsFlag
+	githubUsers  stringsFlag
+	postScripts  stringsFlag
+	signingKeys  stringsFlag
+	extraFiles   copiesFlag
+	expandRootFS optionalBool
+	dataFS       = img.DataExt4
+	dataPart     = flag.String("data-partition", "", "Add a data partition after the root partition once flashed, either a size like 512M or 4G or \"rest\" for the remaining space; requires -expand-rootfs=false")
+	output       = flag.String("output", "", "Set to \"json\" to print a machine readable summary on stdout; everything else goes to stderr")
+	v            = flag.Bool("v", false, "log verbosely to stderr")
+	vv           = flag.Bool("vv", false, "log very verbosely to stderr, including the HTTP requests and the commands run")
+	quiet        = flag.Bool("q", false, "only print the prompts, the errors and the final instructions")
+	verboseHTTP  = flag.Bool("verbose-http", false, "trace each HTTP request to stderr, including the redirects, the status and the bytes read, to diagnose mirror issues")
 )
 
 // sdCardsFound is the list of SD cards found on the system. Cache the value as
@@ -97,14 +487,228 @@ var (
 // do it multiple times for the lifetime of this process.
 var sdCardsFound = img.ListSDCards()
 
+// authorizedKeys is the content to write as /boot/authorized_keys, as loaded
+// from -ssh-key and -ssh-import-github.
+var authorizedKeys string
+
+// userPassword is the plain text password of the default user set with
+// -password. generatedPassword is true when it was generated with -password
+// random.
+var userPassword string
+var generatedPassword bool
+
+// hostKeyPriv and hostKeyPub are the ssh host key generated with -host-key.
+var hostKeyPriv, hostKeyPub []byte
+
+// dataSize is the size in bytes of -data-partition; 0 means the remaining
+// space.
+var dataSize int64
+
+// wpaSupplicant is the content of -wpa-conf to write as
+// /boot/wpa_supplicant.conf.
+var wpaSupplicant []byte
+
+// setupSH is the content to write as /boot/firstboot.sh. It is retrieved
+// once before flashing so a failure aborts before touching any SDCard.
+var setupSH []byte
+
 func init() {
+	flag.Var(&sshKeys, "ssh-key", "ssh public key file to authorize; can be specified multiple times. Use '-' to read keys from stdin and 'agent' for all the keys from ssh-agent. A directory authorizes all its *.pub files; defaults to "+img.FindPublicKey())
+	flag.Var(&githubUsers, "ssh-import-github", "GitHub user whose ssh public keys, as listed at https://github.com/<user>.keys, are authorized; can be specified multiple times")
+	flag.Var(&postScripts, "post", "Script to run after setup is done; can be specified multiple times, scripts are run in order")
+	flag.Var(&signingKeys, "signing-key", "OpenPGP public key file to trust with -verify-signature, e.g. raspberrypi.asc; required with -verify-signature since no key is bundled; can be specified multiple times")
+	flag.Var(&expandRootFS, "expand-rootfs", "Expand the root partition to fill the SDCard on first boot; by default only the images doing it on their own, RaspiOS and Ubuntu on the Raspberry Pi, do. Use -expand-rootfs=false to keep the free space, e.g. for another partition")
+	flag.Var(&extraFiles, "copy", "Host file to copy into the boot partition as src:dst, where dst is relative to the partition root; can be specified multiple times")
 	flag.Var(&image.Manufacturer, "manufacturer", img.ManufacturerHelp())
-	flag.Var(&image.Board, "board", img.BoardHelp())
+	flag.Var(&image.Board, "board", img.ImageBoardHelp())
 	flag.Var(&image.Distro, "distro", img.DistroHelp())
+	flag.Var(&opts.LinuxMount, "mount", img.MountBackendHelp())
+	flag.BoolVar(&opts.NoAutomount, "no-automount", false, "Prevent the desktop from automounting the SDCard partitions while it is flashed, with a temporary udev rule (Linux only)")
+	flag.Var(&dataFS, "data-fs", img.DataFSHelp())
+	// Loaded as soon as it is parsed so the boards it defines can be used in
+	// -manufacturer, -board and -distro specified after it.
+	flag.Func("boards", "JSON file defining additional boards; must be specified before -manufacturer, -board and -distro", img.LoadBoards)
 }
 
 // Utils
 
+// stringsFlag is a flag.Value that can be specified multiple times.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+// Set implements flag.Value.
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// optionalBool is a boolean flag.Value that also records whether it was
+// specified.
+type optionalBool struct {
+	set, v bool
+}
+
+func (o *optionalBool) String() string {
+	if o == nil || !o.set {
+		return ""
+	}
+	return strconv.FormatBool(o.v)
+}
+
+// Set implements flag.Value. An empty value resets it to unspecified.
+func (o *optionalBool) Set(s string) error {
+	if s == "" {
+		*o = optionalBool{}
+		return nil
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*o = optionalBool{set: true, v: v}
+	return nil
+}
+
+// IsBoolFlag implements the interface flag uses to accept -name without a
+// value.
+func (o *optionalBool) IsBoolFlag() bool {
+	return true
+}
+
+// secret returns v if set, otherwise the content of the environment variable
+// env, otherwise it asks for it with prompt when run from a terminal.
+//
+// No prompt is done when prompt is empty.
+func secret(ctx context.Context, v, env, prompt string) (string, error) {
+	if v != "" {
+		return v, nil
+	}
+	if v = os.Getenv(env); v != "" || prompt == "" || !isInteractive() {
+		return v, nil
+	}
+	return img.ReadPassword(ctx, prompt)
+}
+
+// askPassword asks for the password of user twice on the terminal.
+func askPassword(ctx context.Context, user string) (string, error) {
+	if !isInteractive() {
+		return "", errors.New("-password - requires a terminal")
+	}
+	p, err := img.ReadPassword(ctx, fmt.Sprintf("Password for %s: ", user))
+	if err != nil {
+		return "", err
+	}
+	if p == "" {
+		return "", errors.New("the password can't be empty")
+	}
+	p2, err := img.ReadPassword(ctx, "Retype the password: ")
+	if err != nil {
+		return "", err
+	}
+	if p != p2 {
+		return "", errors.New("the passwords don't match")
+	}
+	return p, nil
+}
+
+// envWifiPass and envPassword are the environment variables used when
+// -wifi-pass and -password are not specified, to keep the secrets off the
+// command line.
+const (
+	envWifiPass = "BOOTSTRAP_WIFI_PASS"
+	envPassword = "BOOTSTRAP_PASSWORD"
+)
+
+// isInteractive returns true if both stdin and stdout are a terminal.
+func isInteractive() bool {
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		fi, err := f.Stat()
+		if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// chooseSDCard asks the user to select one of the SD cards found.
+//
+// descs is the description of each card, as returned by img.DescribeDisk().
+func chooseSDCard(r io.Reader, w io.Writer, cards, descs []string) (string, error) {
+	fmt.Fprintf(w, "Multiple SDCards found:\n")
+	for i, c := range cards {
+		if descs[i] != "" {
+			fmt.Fprintf(w, "  %d: %s (%s)\n", i+1, c, descs[i])
+		} else {
+			fmt.Fprintf(w, "  %d: %s\n", i+1, c)
+		}
+	}
+	s := bufio.NewScanner(r)
+	for {
+		fmt.Fprintf(w, "Select the SDCard to flash [1-%d]: ", len(cards))
+		if !s.Scan() {
+			if err := s.Err(); err != nil {
+				return "", err
+			}
+			return "", errors.New("no SDCard selected; use -sdcard")
+		}
+		if i, err := strconv.Atoi(strings.TrimSpace(s.Text())); err == nil && i >= 1 && i <= len(cards) {
+			return cards[i-1], nil
+		}
+		fmt.Fprintf(w, "Invalid choice\n")
+	}
+}
+
+// confirmErase asks the user to confirm erasing the SD cards, by typing "yes"
+// or the -sdcard value.
+//
+// descs is the description of each card, as returned by img.DescribeDisk().
+func confirmErase(r io.Reader, w io.Writer, cards, descs []string) error {
+	fmt.Fprintf(w, "Everything on these SDCards will be erased:\n")
+	for i, c := range cards {
+		if descs[i] != "" {
+			fmt.Fprintf(w, "  %s (%s)\n", c, descs[i])
+		} else {
+			fmt.Fprintf(w, "  %s\n", c)
+		}
+	}
+	v := strings.Join(cards, ",")
+	fmt.Fprintf(w, "Type yes or %s to continue: ", v)
+	s := bufio.NewScanner(r)
+	if !s.Scan() {
+		if err := s.Err(); err != nil {
+			return err
+		}
+	} else if a := strings.TrimSpace(s.Text()); a == "yes" || a == v {
+		return nil
+	}
+	return errors.New("aborted; nothing was written. Use -yes to skip the confirmation")
+}
+
+// getDefaultCountry returns the detected country, or the territory of the
+// locale when it cannot be detected, e.g. "GB" for "en_GB.UTF-8".
+func getDefaultCountry(ctx context.Context, locale string) string {
+	if c := img.GetCountry(ctx, &opts); c != "" {
+		return c
+	}
+	l, _, _ := strings.Cut(locale, ".")
+	_, c, _ := strings.Cut(l, "_")
+	return c
+}
+
+// getDefaultLocale returns the host locale if it is supported.
+//
+// This is evaluated before mainImpl() overrides $LANG.
+func getDefaultLocale() string {
+	l := img.GetLocale()
+	if checkLocale(l, "") != nil {
+		return ""
+	}
+	return l
+}
+
 func getDefaultSDCard() string {
 	if len(sdCardsFound) == 1 {
 		return sdCardsFound[0]
@@ -114,12 +718,48 @@ func getDefaultSDCard() string {
 
 func getSDCardHelp() string {
 	if len(sdCardsFound) == 0 {
-		return "Path to SDCard; be sure to insert one first"
+		return "Path to SDCard, or comma separated paths to flash multiple ones; be sure to insert one first"
 	}
 	if len(sdCardsFound) == 1 {
-		return "Path to SDCard"
+		return "Path to SDCard, or comma separated paths to flash multiple ones"
 	}
-	return fmt.Sprintf("Path to SDCard; one of %s", strings.Join(sdCardsFound, ","))
+	return fmt.Sprintf("Path to SDCard, or comma separated paths to flash multiple ones; one of %s", strings.Join(sdCardsFound, ","))
+}
+
+// bootFile is a host file to copy into the boot partition.
+type bootFile struct {
+	src string
+	// dst is the slash separated path relative to the boot partition root.
+	dst  string
+	mode os.FileMode
+}
+
+// copiesFlag is a flag.Value for files to copy into the boot partition, in
+// the form src:dst. It can be specified multiple times.
+type copiesFlag []bootFile
+
+func (c *copiesFlag) String() string {
+	var out []string
+	for _, f := range *c {
+		out = append(out, f.src+":"+f.dst)
+	}
+	return strings.Join(out, ",")
+}
+
+// Set implements flag.Value.
+func (c *copiesFlag) Set(v string) error {
+	// Use the last colon so Windows paths like C:\foo work as src.
+	i := strings.LastIndexByte(v, ':')
+	if i <= 0 || i == len(v)-1 {
+		return fmt.Errorf("expected src:dst, got %q", v)
+	}
+	// Accept a leading "/" as the partition root.
+	dst := path.Clean(strings.TrimLeft(strings.ReplaceAll(v[i+1:], "\\", "/"), "/"))
+	if dst == "." || dst == ".." || strings.HasPrefix(dst, "../") {
+		return fmt.Errorf("destination %q must be a file within the boot partition", v[i+1:])
+	}
+	*c = append(*c, bootFile{src: v[:i], dst: dst, mode: 0o644})
+	return nil
 }
 
 // copyFile copies src from dst.
@@ -132,7 +772,7 @@ func copyFile(dst, src string, mode os.FileMode) error {
 	/* #nosec G307 */
 	defer fs.Close()
 	/* #nosec G304 */
-	fd, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE, mode)
+	fd, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
 	if err != nil {
 		return err
 	}
@@ -143,277 +783,2875 @@ func copyFile(dst, src string, mode os.FileMode) error {
 	return fd.Close()
 }
 
-// Editing EXT4
-
-func modifyEXT4(img string) (bool, error) {
-	fmt.Printf("- Modifying image %s\n", img)
-	/* #nosec G304 */
-	f, err := os.OpenFile(img, os.O_RDWR, 0o600)
+// checkCopySpace returns an error if there is not enough free space to copy
+// src to dst.
+func checkCopySpace(dst, src string) error {
+	fi, err := os.Stat(src)
 	if err != nil {
-		return false, err
+		return err
 	}
-	modified, err := modifyEXT4Inner(f)
-	if err2 := f.Close(); err == nil {
-		err = err2
+	need := fi.Size()
+	// dst is overwritten, so its space is reclaimed.
+	if fi, err = os.Stat(dst); err == nil {
+		need -= fi.Size()
 	}
-	return modified, err
-}
-
-type fileDisk struct {
-	f    *os.File
-	off  int64
-	size int64
-}
-
-func (f *fileDisk) Close() error {
-	return errors.New("abstraction layer error")
-}
-
-func (f *fileDisk) Len() int64 {
-	return f.size
+	return img.CheckFreeSpace(filepath.Dir(dst), need)
 }
 
-func (f *fileDisk) ReadAt(p []byte, off int64) (int, error) {
-	if off+int64(len(p)) > f.size {
-		return 0, io.EOF
+// checkFetchSpace returns an error if there is not enough free space to fetch
+// the image and write the copies made from it, before fetching it.
+func checkFetchSpace(ctx context.Context) error {
+	size := image.EstimatedSize()
+	_, name, err := image.URL(ctx, &opts)
+	if err != nil {
+		return err
 	}
-	return f.f.ReadAt(p, off+f.off)
-}
-
-func (f *fileDisk) SectorSize() int {
-	return 512
+	// The image is decompressed in the current directory while it is
+	// downloaded, so the compressed download is never stored. A cached image
+	// is reused.
+	need := int64(0)
+	if _, err = os.Stat(name); err != nil || *forceRefresh {
+		need = size
+	}
+	if saving() {
+		// The copy edited then saved. Otherwise the copy is only made for the
+		// images with /etc/rc.local, which is known once fetched, and checked
+		// then.
+		mod := "."
+		if *saveImg != "" {
+			mod = filepath.Dir(*saveImg)
+		} else if *modOut != "" {
+			mod = filepath.Dir(*modOut)
+		}
+		if sameDir(mod, ".") {
+			need += size
+		} else if err = img.CheckFreeSpace(mod, size); err != nil {
+			return err
+		}
+	}
+	if err = img.CheckFreeSpace(".", need); err != nil {
+		return err
+	}
+	if *saveXZ != "" {
+		// xz compresses an image to less than a third of its size.
+		return img.CheckFreeSpace(filepath.Dir(*saveXZ), size/3)
+	}
+	return nil
 }
 
-func (f *fileDisk) WriteAt(p []byte, off int64) (int, error) {
-	if off+int64(len(p)) > f.size {
-		return 0, errors.New("overflow")
+// sameDir returns true if a and b are the same directory.
+func sameDir(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
 	}
-	return f.f.WriteAt(p, off+f.off)
+	bi, err := os.Stat(b)
+	return err == nil && os.SameFile(ai, bi)
 }
 
-func modifyEXT4Inner(f *os.File) (bool, error) {
-	m, err := mbr.Read(f)
+// addSigningKey trusts the OpenPGP public keys in the file p.
+func addSigningKey(p string) error {
+	/* #nosec G304 */
+	f, err := os.Open(p)
 	if err != nil {
-		return false, fmt.Errorf("failed to read MBR: %w", err)
+		return err
 	}
-	if err = m.Check(); err != nil {
-		return false, err
+	defer f.Close()
+	if err = img.AddSigningKey(f); err != nil {
+		return fmt.Errorf("%s: %w", p, err)
 	}
-	rootpart := m.GetPartition(2)
-	root := &fileDisk{f, int64(rootpart.GetLBAStart() * 512), int64(rootpart.GetLBALen() * 512)}
+	return nil
+}
 
-	// modifyRoot edits the root partition manually.
-	//
-	// Since on Debian /etc/rc.local is mostly comments, it's large enough to be
-	// safely overwritten.
-	offset := int64(0)
-	prefix := []byte(oldRcLocal)
-	buf := make([]byte, 512)
-	for ; offset < root.Len(); offset += 512 {
-		if _, err = root.ReadAt(buf, offset); err != nil {
-			return false, fmt.Errorf("failed to read at offset %d while seaching for /etc/rc.local: %w", offset, err)
-		}
-		if bytes.Equal(buf[:len(prefix)], prefix) {
-			log.Printf("found /etc/rc.local at offset %d", offset)
-			break
-		}
+// reUserName matches a portable user name as accepted by useradd.
+var reUserName = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// checkUserName verifies the -user flag.
+func checkUserName(name string) error {
+	if name == "" {
+		return nil
 	}
-	if offset >= root.Len() {
-		return false, nil
+	if name == "root" || !reUserName.MatchString(name) {
+		return fmt.Errorf("-user %q must be a lowercase user name other than root, e.g. alice", name)
 	}
-	// TODO(maruel): Keep everything before the "exit 0" before our injected
-	// lines.
-	content := fmt.Sprintf(denseRcLocal, firstBootArgs())
-	copy(buf, content)
-	log.Printf("Writing /etc/rc.local:\n%s", buf)
-	_, err = root.WriteAt(buf, offset)
-	return true, err
+	return nil
 }
 
-func firstBootArgs() string {
-	args := " -t " + *timeLocation
-	if len(*email) != 0 {
-		args += " -e " + *email
+// loginUser returns the account configured on the device: -user, or else the
+// image's default user.
+func loginUser() string {
+	if *userName != "" {
+		return *userName
 	}
-	if *fiveInches {
-		args += " -5"
+	return image.DefaultUser()
+}
+
+// checkModOut returns an error if the modified image can't be written to p.
+//
+// The free space is checked once the size of the image is known.
+func checkModOut(p string) error {
+	if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+		return fmt.Errorf("%s is a directory; specify a file path", p)
 	}
-	if len(*sshKey) != 0 {
-		args += " -sk /boot/authorized_keys"
+	dir := filepath.Dir(p)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
 	}
-	// For RaspiOS, we can dump a /boot/wpa_supplicant.conf that will be picked
-	// up automatically.
-	if image.Distro != img.RaspiOS {
-		args += " -wc " + *wifiCountry
-		if len(*wifiSSID) != 0 {
-			// TODO(maruel): Proper shell escaping.
-			args += fmt.Sprintf(" -ws %q", *wifiSSID)
-		}
-		if len(*wifiPass) != 0 {
-			// TODO(maruel): Proper shell escaping.
-			args += fmt.Sprintf(" -wp %q", *wifiPass)
-		}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
 	}
-	if len(*postScript) != 0 {
-		args += " -- /boot/" + filepath.Base(*postScript)
+	// Checking the permission bits is not reliable across OSes and file
+	// systems, so try to create a file.
+	f, err := os.CreateTemp(dir, ".efe-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
 	}
-	return args
+	_ = f.Close()
+	return os.Remove(f.Name())
 }
 
-// wpaPSK calculates the hex encoded preshared key for the SSID based on the
-// plain text password.
-//
-// This removes the need to have the plain text wifi passphrase on the SD card.
-func wpaPSK(passphrase, ssid string) string {
-	return hex.EncodeToString(pbkdf2.Key([]byte(passphrase), []byte(ssid), 4096, 32, sha1.New))
+// manifestEntry is the line appended to -manifest for each SDCard
+// provisioned.
+type manifestEntry struct {
+	Time   string `json:"time"`
+	Device string `json:"device"`
+	Image  string `json:"image"`
+	// SHA256 is the hash of the image before it is modified.
+	SHA256 string `json:"sha256"`
+	// Hostname is empty when setup.sh sets the default one.
+	Hostname      string `json:"hostname,omitempty"`
+	FirstBootArgs string `json:"firstboot_args"`
 }
 
-// Editing FAT
-
-func setupFirstBoot(boot string) error {
-	fmt.Printf("- First boot setup script\n")
-	if err := os.WriteFile(filepath.Join(boot, "firstboot.sh"), img.GetSetupSH(), 0o755); err != nil /* #nosec G306 */ {
-		return err
-	}
-	if len(*sshKey) != 0 {
-		// This assumes you have properly set your own ssh keys and plan to use them.
-		if err := copyFile(filepath.Join(boot, "authorized_keys"), *sshKey, 0o644); err != nil {
+// appendManifest appends a line to the file p for each device, so batches
+// accumulate in the same file.
+//
+// sum is the hex encoded SHA-256 of imgpath. It is calculated if empty.
+func appendManifest(p, imgpath, sum string, devices, hosts []string) error {
+	if sum == "" {
+		img.Progressf("- Hashing %s for %s\n", imgpath, p)
+		var err error
+		if sum, err = sha256File(imgpath); err != nil {
 			return err
 		}
 	}
-	if len(*postScript) != 0 {
-		if err := copyFile(filepath.Join(boot, filepath.Base(*postScript)), *postScript, 0o755); err != nil {
-			return err
+	now := time.Now().UTC().Format(time.RFC3339)
+	var b bytes.Buffer
+	for i, d := range devices {
+		e := manifestEntry{
+			Time:          now,
+			Device:        d,
+			Image:         filepath.Base(imgpath),
+			SHA256:        sum,
+			Hostname:      hosts[i],
+			FirstBootArgs: redactArgs(strings.TrimSpace(firstBootArgs())),
 		}
-	}
-	// For RaspiOS, we can dump a /boot/wpa_supplicant.conf that will be picked
-	// up automatically.
-	if (image.Distro == img.RaspiOS || image.Distro == img.RaspiOS64) && len(*wifiSSID) != 0 {
-		c := fmt.Sprintf(raspberryPiWPASupplicant, *wifiCountry, *wifiSSID, wpaPSK(*wifiPass, *wifiSSID))
-		if err := os.WriteFile(filepath.Join(boot, "wpa_supplicant.conf"), []byte(c), 0o644); err != nil /* #nosec G306 */ {
+		l, err := json.Marshal(&e)
+		if err != nil {
 			return err
 		}
+		b.Write(l)
+		b.WriteByte('\n')
 	}
-	return nil
-}
-
-// raspiosEnableUART enables console on UART on RPi3.
-//
-// This is only needed when debugging over serial, mainly to debug issues with
-// setup.sh.
-//
-// https://www.raspberrypi.org/forums/viewtopic.php?f=28&t=141195
-func raspiosEnableUART(boot string) error {
-	fmt.Printf("- Enabling console on UART on RPi3\n")
 	/* #nosec G304 */
-	/* #nosec G302 */
-	f, err := os.OpenFile(filepath.Join(boot, "config.txt"), os.O_APPEND|os.O_WRONLY, 0o666)
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
 	if err != nil {
 		return err
 	}
-	if _, err = f.WriteString(raspberryPi3UART); err != nil {
+	if _, err = f.Write(b.Bytes()); err != nil {
+		_ = f.Close()
 		return err
 	}
 	return f.Close()
 }
 
-//
-
-func mainImpl() error {
-	// Simplify our life on locale not in en_US.
-	_ = os.Setenv("LANG", "C")
-	// TODO(maruel): Make it usable without root with:
-	//   sudo setcap CAP_SYS_ADMIN,CAP_DAC_OVERRIDE=ep __file__
-	flag.Parse()
-	if !*v {
-		log.SetOutput(io.Discard)
+// copyFileSum is like copyFile but also returns the hex encoded SHA-256 of
+// src, so it doesn't need to be read a second time.
+func copyFileSum(dst, src string, mode os.FileMode) (string, error) {
+	/* #nosec G304 */
+	fs, err := os.Open(src)
+	if err != nil {
+		return "", err
 	}
-	if (*wifiSSID != "") != (*wifiPass != "") {
-		return errors.New("use both --wifi-ssid and --wifi-pass")
+	/* #nosec G307 */
+	defer fs.Close()
+	/* #nosec G304 */
+	fd, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return "", err
 	}
-	if err := image.Check(); err != nil {
-		return err
+	h := sha256.New()
+	if _, err := io.Copy(fd, io.TeeReader(fs, h)); err != nil {
+		_ = fd.Close()
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), fd.Close()
+}
+
+// sha256File returns the hex encoded SHA-256 of the file p.
+func sha256File(p string) (string, error) {
+	/* #nosec G304 */
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	/* #nosec G307 */
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cleanupImages deletes the images once flashed, unless requested to keep
+// them.
+//
+// imgmod is the same as imgpath when the image was flashed unmodified.
+//
+// Failing to delete is not fatal.
+func cleanupImages(imgpath, imgmod string, keepImage, keepMod bool) {
+	type file struct {
+		p    string
+		keep bool
+	}
+	files := []file{{imgpath, keepImage}}
+	if imgmod != imgpath {
+		files = append(files, file{imgmod, keepMod})
+	}
+	for _, f := range files {
+		if f.keep {
+			img.Progressf("- Keeping %s\n", f.p)
+			continue
+		}
+		img.Progressf("- Deleting %s\n", f.p)
+		if err := os.Remove(f.p); err != nil {
+			img.Progressf("  failed to delete: %v\n", err)
+		}
+	}
+}
+
+// checkBootPartition verifies that the partition number bootPart (1 based) in
+// the image is FAT, since the files are written to it once flashed.
+func checkBootPartition(imgPath string, bootPart int) error {
+	/* #nosec G304 */
+	f, err := os.Open(imgPath)
+	if err != nil {
+		return err
+	}
+	/* #nosec G307 */
+	defer f.Close()
+	if bootPart < 1 {
+		return fmt.Errorf("boot partition #%d not found in the image", bootPart)
+	}
+	l, err := img.Partitions(f, bootPart, 0)
+	if err != nil {
+		return err
+	}
+	t, err := img.FATType(io.NewSectionReader(f, l.Boot.Offset, l.Boot.Size))
+	if err != nil {
+		return fmt.Errorf("boot partition #%d: %w; use -boot-part to select the FAT partition", bootPart, err)
+	}
+	log.Printf("boot partition #%d is %s", bootPart, t)
+	return nil
+}
+
+// readPartitions returns the partitions of the image imgPath and whether its
+// partition table is a GPT one.
+func readPartitions(imgPath string) ([]img.Partition, bool, error) {
+	/* #nosec G304 */
+	f, err := os.Open(imgPath)
+	if err != nil {
+		return nil, false, err
+	}
+	/* #nosec G307 */
+	defer f.Close()
+	gpt, err := img.IsGPT(f)
+	if err != nil {
+		return nil, false, err
+	}
+	parts, err := img.ReadPartitions(f)
+	return parts, gpt, err
+}
+
+// Editing EXT4
+
+// modifyEXT4 overwrites /etc/rc.local at offset in the root partition of the
+// image, as found by img.FindRcLocal.
+func modifyEXT4(imgPath string, rootPart int, offset int64) error {
+	img.Progressf("- Modifying image %s\n", imgPath)
+	/* #nosec G304 */
+	f, err := os.OpenFile(imgPath, os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	err = img.EditRcLocal(f, rootPart, offset, *firstBootLog, &opts)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// findRootPart returns the partition number of the EXT4 filesystem matching
+// spec in the image.
+func findRootPart(imgPath, spec string) (int, error) {
+	/* #nosec G304 */
+	f, err := os.Open(imgPath)
+	if err != nil {
+		return 0, err
+	}
+	/* #nosec G307 */
+	defer f.Close()
+	return img.FindPartition(f, spec)
+}
+
+// getFirstBootUnit returns the content of firstboot.service.
+func getFirstBootUnit() string {
+	// checkFirstBootLog rejects the characters systemd would expand.
+	return fmt.Sprintf(firstBootUnit, *firstBootLog, img.FirstBootArgs)
+}
+
+// installFirstBootUnit installs firstboot.service in the root partition
+// mounted at root and enables it.
+func installFirstBootUnit(ctx context.Context, root string) error {
+	img.Progressf("- Installing firstboot.service\n")
+	dir := filepath.Join(root, "etc", "systemd", "system")
+	wants := filepath.Join(dir, "multi-user.target.wants")
+	p := filepath.Join(dir, "firstboot.service")
+	link := filepath.Join(wants, "firstboot.service")
+	// As done by "systemctl enable".
+	target := "/etc/systemd/system/firstboot.service"
+	unit := getFirstBootUnit()
+	err := os.MkdirAll(wants, 0o755) /* #nosec G301 */
+	if err == nil {
+		err = written.WriteFile(p, []byte(unit), 0o644) /* #nosec G306 */
+	}
+	if err == nil {
+		err = os.Symlink(target, link)
+	}
+	if !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	// The files in the root partition are owned by root.
+	log.Printf("retrying with sudo: %v", err)
+	if err = img.Sudo(ctx, &opts, "", "mkdir", "-p", wants); err == nil {
+		if err = img.Sudo(ctx, &opts, unit, "dd", "status=none", "of="+p); err == nil {
+			written.Add(p, int64(len(unit)), true)
+			err = img.Sudo(ctx, &opts, "", "ln", "-sf", target, link)
+		}
+	}
+	return err
+}
+
+// installNMConnection writes the NetworkManager connection for -wifi-ssid in
+// the root partition mounted at root.
+//
+// It also unblocks the wifi, which RaspiOS keeps blocked by rfkill until the
+// country is set.
+func installNMConnection(ctx context.Context, root string) error {
+	w := wifiNetwork()
+	img.Progressf("- Writing the NetworkManager connection for %s\n", w.SSID)
+	dir := filepath.Join(root, "etc", "NetworkManager", "system-connections")
+	p := filepath.Join(dir, w.NMConnectionName())
+	c := w.NMConnection()
+	rfkill, _ := filepath.Glob(filepath.Join(root, "var", "lib", "systemd", "rfkill", "*:wlan"))
+	err := os.MkdirAll(dir, 0o755) /* #nosec G301 */
+	if err == nil {
+		err = written.WriteFile(p, []byte(c), 0o600)
+	}
+	if err == nil {
+		// NetworkManager ignores the connections readable by others.
+		err = os.Chmod(p, 0o600)
+	}
+	for _, f := range rfkill {
+		if err == nil {
+			err = written.WriteFile(f, []byte("0\n"), 0o644) /* #nosec G306 */
+		}
+	}
+	if !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	// The files in the root partition are owned by root.
+	log.Printf("retrying with sudo: %v", err)
+	if err = img.Sudo(ctx, &opts, "", "mkdir", "-p", dir); err == nil {
+		// Create it empty first so the password is never readable by others.
+		if err = img.Sudo(ctx, &opts, "", "install", "-m", "600", "/dev/null", p); err == nil {
+			// dd doesn't echo the password in the logs like tee would.
+			if err = img.Sudo(ctx, &opts, c, "dd", "status=none", "of="+p); err == nil {
+				written.Add(p, int64(len(c)), true)
+			}
+		}
+	}
+	for _, f := range rfkill {
+		if err == nil {
+			if err = img.Sudo(ctx, &opts, "0\n", "dd", "status=none", "of="+f); err == nil {
+				written.Add(f, 2, false)
+			}
+		}
+	}
+	return err
+}
+
+func firstBootArgs() string {
+	args := " -t " + shellQuote(*timeLocation)
+	if len(*email) != 0 {
+		args += " -e " + shellQuote(*email)
+		if len(*smtpHost) != 0 {
+			args += " -sr /boot/smtp_sasl_passwd"
+		}
+	}
+	if len(*userName) != 0 {
+		args += " -u " + shellQuote(*userName)
+	}
+	if len(authorizedKeys) != 0 {
+		args += " -sk /boot/authorized_keys"
+		if *noPassword {
+			args += " -dp"
+		}
+	}
+	if len(*hostname) != 0 || len(*hostPrefix) != 0 {
+		if perCardHostname() {
+			// Each card gets its own hostname, written by setupFirstBoot().
+			args += " -Hf /boot/hostname"
+		} else {
+			args += " -H " + shellQuote(*hostname)
+		}
+	}
+	// For RaspiOS, we can dump a /boot/wpa_supplicant.conf that will be picked
+	// up automatically, or a NetworkManager connection when the root partition
+	// can be edited.
+	if (image.Distro != img.RaspiOS && image.Distro != img.RaspiOS64) || (networkManager && !writesNMConnection()) {
+		w := wifiNetwork()
+		for _, a := range w.SetupArgs() {
+			args += " " + shellQuote(a)
+		}
+	}
+	// For cloud-init, /boot/user-data and /boot/network-config are written
+	// instead.
+	if !usesCloudInit() {
+		if *sshPort != 22 {
+			args += " -sp " + strconv.Itoa(*sshPort)
+		}
+		if len(hostKeyPriv) != 0 {
+			args += " -hk /boot/ssh_host_ed25519_key"
+		}
+		if len(*locale) != 0 {
+			args += " -l " + shellQuote(*locale)
+		}
+		if len(*keyboard) != 0 {
+			args += " -kb " + shellQuote(*keyboard)
+		}
+		if len(*aptMirror) != 0 {
+			args += " -am " + shellQuote(*aptMirror)
+		}
+		if len(*aptProxy) != 0 {
+			args += " -ap " + shellQuote(*aptProxy)
+		}
+		if len(*staticIP) != 0 {
+			args += " -ip " + shellQuote(*staticIP)
+			if len(*gateway) != 0 {
+				args += " -gw " + shellQuote(*gateway)
+			}
+			if len(*dns) != 0 {
+				args += " -dns " + shellQuote(*dns)
+			}
+		}
+	}
+	if *mdns {
+		args += " -md"
+	}
+	if *skipUpgrade {
+		args += " -su"
+	}
+	// The other images expand the root partition on their own.
+	if expandRootFS.set && expandRootFS.v && !expandsRootFS() {
+		args += " -xr"
+	}
+	if *firstBootLog != defaultFirstBootLog {
+		args += " -fl " + shellQuote(*firstBootLog)
+	}
+	if *bootStatus {
+		args += " -sf " + firstBootStatus
+	}
+	if len(postScripts) != 0 {
+		// setup.sh runs each argument after "--" as a separate script, in order.
+		args += " --"
+		for _, p := range postScripts {
+			args += " " + shellQuote("/boot/"+filepath.Base(p))
+		}
+	}
+	return args
+}
+
+// secretArgs are the setup.sh flags whose value must not be recorded, like
+// in the -manifest.
+var secretArgs = map[string]bool{"-wp": true}
+
+// redactArgs replaces the value of the secretArgs in args, as quoted by
+// shellQuote, with ***.
+func redactArgs(args string) string {
+	var out []string
+	redact := false
+	for _, w := range splitShellWords(args) {
+		if redact {
+			w = "***"
+		}
+		redact = secretArgs[w]
+		out = append(out, w)
+	}
+	return strings.Join(out, " ")
+}
+
+// splitShellWords splits s on spaces, keeping the single quoted strings and
+// the backslash escaped characters, as produced by shellQuote, in the same
+// word.
+func splitShellWords(s string) []string {
+	var out []string
+	var w strings.Builder
+	quoted, escaped := false, false
+	for _, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted:
+			quoted = c != '\''
+		case c == '\'':
+			quoted = true
+		case c == '\\':
+			escaped = true
+		case c == ' ':
+			if w.Len() != 0 {
+				out = append(out, w.String())
+				w.Reset()
+			}
+			continue
+		}
+		w.WriteRune(c)
+	}
+	if w.Len() != 0 {
+		out = append(out, w.String())
+	}
+	return out
+}
+
+// reShellSafe matches the strings that don't need to be quoted for a shell.
+var reShellSafe = regexp.MustCompile(`^[a-zA-Z0-9_./:,=@+-]+$`)
+
+// shellQuote quotes s as a single argument for a POSIX shell, if needed.
+func shellQuote(s string) string {
+	if reShellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// checkCapabilities returns an error if the host can't flash cards or edit
+// them once flashed.
+//
+// A regular file used as a SDCard is written without the flashing tools.
+func checkCapabilities(c *img.Capabilities, cards []string) error {
+	for _, card := range cards {
+		if fi, err := os.Stat(card); (err != nil || !fi.Mode().IsRegular()) && !c.CanFlash {
+			return fmt.Errorf("can't flash %s on this host; use -v to list the tools found", card)
+		}
+	}
+	if !c.CanMount {
+		return errors.New("can't mount partitions on this host to edit them; use -v to list the tools found")
+	}
+	return nil
+}
+
+// checkHostname verifies that the hostname is a valid RFC 1123 label.
+func checkHostname(h string) error {
+	if len(h) == 0 || len(h) > 63 {
+		return fmt.Errorf("hostname %q must be between 1 and 63 characters", h)
+	}
+	if h[0] == '-' || h[len(h)-1] == '-' {
+		return fmt.Errorf("hostname %q must not start or end with a hyphen", h)
+	}
+	for _, c := range h {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return fmt.Errorf("hostname %q must contain only letters, digits and hyphens", h)
+		}
+	}
+	return nil
+}
+
+// checkEmail verifies the -email and -smtp-* flags.
+func checkEmail(addr, host, user, pass string) error {
+	if addr != "" {
+		a, err := mail.ParseAddress(addr)
+		if err != nil || a.Name != "" || a.Address != addr {
+			return fmt.Errorf("-email %q must be an email address like user@example.com", addr)
+		}
+	}
+	if host == "" {
+		if user != "" || pass != "" {
+			return errors.New("-smtp-user and -smtp-pass require -smtp-host")
+		}
+		return nil
+	}
+	if addr == "" {
+		return errors.New("-smtp-host requires -email")
+	}
+	if (user != "") != (pass != "") {
+		return errors.New("use both -smtp-user and -smtp-pass")
+	}
+	h, _, err := net.SplitHostPort(host)
+	if err != nil {
+		h = host
+	}
+	if h == "" || strings.ContainsAny(h, " []/@") {
+		return fmt.Errorf("-smtp-host %q must be a host or host:port", host)
+	}
+	if strings.ContainsAny(user, " \n") || strings.Contains(pass, "\n") {
+		return errors.New("-smtp-user and -smtp-pass must be on a single line and the user must not contain spaces")
+	}
+	return nil
+}
+
+// getSMTPRelay returns the content of /boot/smtp_sasl_passwd, in postfix
+// sasl_passwd format.
+func getSMTPRelay(host, user, pass string) string {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		h = host
+		port = "587"
+	}
+	out := "[" + h + "]:" + port
+	if user != "" {
+		out += " " + user + ":" + pass
+	}
+	return out + "\n"
+}
+
+// checkTimeLocation verifies that loc is a valid IANA time zone name, e.g.
+// America/Toronto.
+func checkTimeLocation(loc string) error {
+	if loc == "" || loc == "Local" {
+		return fmt.Errorf("-time %q must be a time zone name like America/Toronto", loc)
+	}
+	if _, err := time.LoadLocation(loc); err != nil {
+		return fmt.Errorf("-time %q is not a known time zone: %w", loc, err)
+	}
+	return nil
+}
+
+// checkStaticIP verifies the -ip, -gateway and -dns flags.
+func checkStaticIP(ip, gw, servers string) error {
+	if ip == "" {
+		if gw != "" || servers != "" {
+			return errors.New("-gateway and -dns require -ip")
+		}
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(ip); err != nil {
+		return fmt.Errorf("-ip %q must be in CIDR form, e.g. 192.168.1.10/24", ip)
+	}
+	if gw != "" && net.ParseIP(gw) == nil {
+		return fmt.Errorf("-gateway %q is not a valid IP address", gw)
+	}
+	if servers != "" {
+		for _, d := range strings.Split(servers, ",") {
+			if net.ParseIP(d) == nil {
+				return fmt.Errorf("-dns %q is not a valid IP address", d)
+			}
+		}
+	}
+	return nil
+}
+
+// checkAptURL verifies that the value of the -apt-mirror or -apt-proxy flag
+// is a http or https URL.
+func checkAptURL(name, u string) error {
+	if u == "" {
+		return nil
+	}
+	p, err := url.Parse(u)
+	if err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" || strings.ContainsAny(u, " \t\n\"'#") {
+		return fmt.Errorf("%s %q must be a http or https URL", name, u)
+	}
+	return nil
+}
+
+// checkFirstBootLog verifies the -firstboot-log value. It is used unquoted in
+// /etc/rc.local and in the systemd unit.
+func checkFirstBootLog(p string) error {
+	if !strings.HasPrefix(p, "/") || strings.HasSuffix(p, "/") || !reShellSafe.MatchString(p) {
+		return fmt.Errorf("-firstboot-log %q must be an absolute file path without special characters", p)
+	}
+	return nil
+}
+
+// cloudInitApt returns the part to append to /boot/user-data to set the apt
+// mirror and proxy on cloud-init based images.
+func cloudInitApt(mirror, proxy string) string {
+	out := "\napt:\n"
+	if mirror != "" {
+		out += "  primary:\n    - arches: [default]\n      uri: " + mirror + "\n"
+	}
+	if proxy != "" {
+		out += "  proxy: " + proxy + "\n"
+	}
+	return out
+}
+
+// getNetworkConfig returns the content of /boot/network-config for a static
+// IP on cloud-init based images.
+func getNetworkConfig(ip, gw, servers string) string {
+	out := fmt.Sprintf(cloudInitNetworkConfig, ip)
+	if gw != "" {
+		out += "    routes:\n      - to: default\n        via: " + gw + "\n"
+	}
+	if servers != "" {
+		out += "    nameservers:\n      addresses: [" + strings.Join(strings.Split(servers, ","), ", ") + "]\n"
+	}
+	return out
+}
+
+// usesCloudInit returns true if the image is configured via cloud-init
+// user-data on the boot partition instead of /etc/rc.local.
+func usesCloudInit() bool {
+	return image.Manufacturer == img.Raspberry && image.Distro == img.Ubuntu
+}
+
+// bootFiles returns the host files to copy into the boot partition.
+func bootFiles() []bootFile {
+	var out []bootFile
+	for _, p := range postScripts {
+		out = append(out, bootFile{src: p, dst: filepath.Base(p), mode: 0o755})
+	}
+	return append(out, extraFiles...)
+}
+
+// checkBootFiles verifies that the files exist and that they do not collide
+// once copied into /boot.
+func checkBootFiles(files []bootFile) error {
+	// Files that are written or edited by editBoot(). FAT is case
+	// insensitive.
+	seen := map[string]string{
+		"firstboot.sh":             "setup.sh",
+		img.FirstBootArgs:          "setup.sh",
+		"wpa_supplicant.conf":      "-wifi-ssid or -wpa-conf",
+		"authorized_keys":          "-ssh-key",
+		"smtp_sasl_passwd":         "-smtp-host",
+		"ssh_host_ed25519_key":     "-host-key",
+		"ssh_host_ed25519_key.pub": "-host-key",
+		"network-config":           "-ip",
+		"hostname":                 "-hostname or -hostname-prefix",
+		"ssh":                      "the ssh enablement",
+		"userconf.txt":             "-password",
+		"user-data":                "cloud-init",
+		"meta-data":                "cloud-init",
+		"config.txt":               "the boot configuration",
+		"cmdline.txt":              "the kernel command line",
+		"boot.ini":                 "-forceuart",
+	}
+	for _, f := range files {
+		if fi, err := os.Stat(f.src); err != nil {
+			return err
+		} else if fi.IsDir() {
+			return fmt.Errorf("%s is a directory", f.src)
+		}
+		k := strings.ToLower(f.dst)
+		if prev, ok := seen[k]; ok {
+			return fmt.Errorf("%s collides with %s as /boot/%s", f.src, prev, f.dst)
+		}
+		seen[k] = f.src
+	}
+	return nil
+}
+
+// loadSSHKeys returns the content of authorized_keys with all the public keys
+// found in srcs, then the ones of the GitHub users.
+//
+// Each src is a file path, a directory containing *.pub files, "-" to read
+// from stdin or "agent" to list the keys from ssh-agent. Empty values are
+// ignored. Duplicate keys are skipped.
+func loadSSHKeys(ctx context.Context, srcs, github []string, stdin io.Reader) (string, error) {
+	var out []string
+	seen := map[string]bool{}
+	add := func(keys []string) {
+		for _, l := range keys {
+			if !seen[l] {
+				seen[l] = true
+				out = append(out, l)
+			}
+		}
+	}
+	for _, src := range srcs {
+		var b []byte
+		var err error
+		switch src {
+		case "":
+			continue
+		case "-":
+			if b, err = io.ReadAll(stdin); err != nil {
+				return "", fmt.Errorf("failed to read ssh keys from stdin: %w", err)
+			}
+		case "agent":
+			if b, err = exec.Command("ssh-add", "-L").Output(); err != nil {
+				return "", fmt.Errorf("failed to list the keys from ssh-agent: %w", err)
+			}
+		default:
+			if fi, err := os.Stat(src); err == nil && fi.IsDir() {
+				keys, err := loadSSHKeyDir(src)
+				if err != nil {
+					return "", err
+				}
+				add(keys)
+				continue
+			}
+			/* #nosec G304 */
+			if b, err = os.ReadFile(src); err != nil {
+				return "", err
+			}
+		}
+		keys, err := img.ParseAuthorizedKeys(b)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", src, err)
+		}
+		add(keys)
+	}
+	for _, u := range github {
+		keys, err := img.FetchGitHubKeys(ctx, u, &opts)
+		if err != nil {
+			return "", fmt.Errorf("-ssh-import-github: %w", err)
+		}
+		add(keys)
+	}
+	if len(out) == 0 {
+		return "", nil
+	}
+	return strings.Join(out, "\n") + "\n", nil
+}
+
+// checkPrivateKeys warns about the public key files in srcs that don't have
+// their matching private key next to them, as the user could be locked out.
+func checkPrivateKeys(srcs []string) {
+	for _, src := range srcs {
+		if !strings.HasSuffix(src, ".pub") {
+			// stdin, ssh-agent, directories and authorized_keys files.
+			continue
+		}
+		if err := img.CheckPrivateKey(src); err != nil {
+			fmt.Printf("Warning! %v; make sure you can log in with this key\n", err)
+		}
+	}
+}
+
+// loadSSHKeyDir returns the public keys in the *.pub files in dir.
+//
+// Files that are not valid public keys, like a private key named .pub, are
+// skipped with a warning. It is an error if no key is found.
+func loadSSHKeyDir(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pub"))
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, f := range files {
+		/* #nosec G304 */
+		b, err := os.ReadFile(f)
+		if err == nil {
+			var keys []string
+			if keys, err = img.ParseAuthorizedKeys(b); err == nil {
+				out = append(out, keys...)
+				continue
+			}
+		}
+		fmt.Printf("Warning! Skipping %s: %v\n", f, err)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no public key found in %s", dir)
+	}
+	return out, nil
+}
+
+// wifiNetwork returns the wifi network specified with the -wifi-* flags.
+func wifiNetwork() img.WifiNetwork {
+	return img.WifiNetwork{SSID: *wifiSSID, Pass: *wifiPass, Country: *wifiCountry, PlaintextPSK: *wifiPlainPSK}
+}
+
+// randomPassword returns a random password of n characters, excluding the
+// ones easily confused with each other.
+func randomPassword(n int) (string, error) {
+	const chars = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	b := make([]byte, n)
+	for i := range b {
+		v, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = chars[v.Int64()]
+	}
+	return string(b), nil
+}
+
+// userconf returns the content of the RaspiOS /boot/userconf.txt file that
+// sets the password of user on first boot.
+//
+// This removes the need to have the plain text password on the SD card.
+func userconf(user, pass string) (string, error) {
+	h, err := img.CryptSHA512(pass)
+	if err != nil {
+		return "", err
+	}
+	return user + ":" + h + "\n", nil
+}
+
+// Editing FAT
+
+// perCardHostname returns true if each card gets its own hostname, written to
+// /boot/hostname, instead of passing it to setup.sh.
+func perCardHostname() bool {
+	return len(*hostPrefix) != 0 || len(sdCards) > 1
+}
+
+// prefixHostnames returns n hostnames "<prefix>-001", "<prefix>-002", ...
+//
+// The names for which used returns true are skipped.
+func prefixHostnames(prefix string, n int, used func(string) bool) ([]string, error) {
+	out := make([]string, 0, n)
+	for i := 1; len(out) < n; i++ {
+		if i > 999 {
+			return nil, fmt.Errorf("no hostname left for -hostname-prefix %s", prefix)
+		}
+		h := fmt.Sprintf("%s-%03d", prefix, i)
+		if used != nil && used(h) {
+			img.Progressf("- %s is already in use; skipping\n", h)
+			continue
+		}
+		out = append(out, h)
+	}
+	return out, nil
+}
+
+// hostnameInUse returns true if <h>.local resolves, i.e. a device already
+// advertises this name over mDNS.
+//
+// It relies on the OS resolver, which supports mDNS on macOS, on Windows 10
+// and later, and on Linux with nss-mdns.
+func hostnameInUse(ctx context.Context, h string) bool {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, h+".local")
+	return err == nil && len(addrs) != 0
+}
+
+// cardHostname returns the hostname for the card number i out of n, e.g.
+// "base-01".
+//
+// The hostname is base when flashing a single card.
+func cardHostname(base string, i, n int) string {
+	if base == "" || n <= 1 {
+		return base
+	}
+	w := len(strconv.Itoa(n))
+	if w < 2 {
+		w = 2
+	}
+	return fmt.Sprintf("%s-%0*d", base, w, i+1)
+}
+
+// bootFS is the boot partition being edited, either mounted on the host or
+// in place with img.BootEditor. Names are slash separated and relative to the
+// root of the partition.
+//
+// The files written are recorded in the written WriteLog.
+type bootFS interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	// AppendFile appends data to the existing file name.
+	AppendFile(name string, data []byte) error
+	MkdirAll(name string) error
+}
+
+// mountedBoot is a boot partition mounted at this directory.
+type mountedBoot string
+
+func (m mountedBoot) ReadFile(name string) ([]byte, error) {
+	/* #nosec G304 */
+	return os.ReadFile(m.path(name))
+}
+
+func (m mountedBoot) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return written.WriteFile(m.path(name), data, perm)
+}
+
+func (m mountedBoot) AppendFile(name string, data []byte) error {
+	p := m.path(name)
+	/* #nosec G304 */
+	/* #nosec G302 */
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_WRONLY, 0o666)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return written.Record(p, false)
+}
+
+func (m mountedBoot) MkdirAll(name string) error {
+	return os.MkdirAll(m.path(name), 0o755) /* #nosec G301 */
+}
+
+func (m mountedBoot) path(name string) string {
+	return filepath.Join(string(m), filepath.FromSlash(name))
+}
+
+// editedBoot is the boot partition of device edited in place with
+// img.BootEditor, without mounting it.
+//
+// FAT has no permissions, so perm is ignored.
+type editedBoot struct {
+	e      *img.BootEditor
+	device string
+}
+
+func (b *editedBoot) ReadFile(name string) ([]byte, error) {
+	return b.e.ReadFile(name)
+}
+
+func (b *editedBoot) WriteFile(name string, data []byte, perm os.FileMode) error {
+	_, err := b.e.ReadFile(name)
+	created := errors.Is(err, fs.ErrNotExist)
+	if err = b.e.WriteFile(name, data); err != nil {
+		return err
+	}
+	written.AddFile(b.device, "/boot/"+name, int64(len(data)), created)
+	return nil
+}
+
+func (b *editedBoot) AppendFile(name string, data []byte) error {
+	old, err := b.e.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if err = b.e.AppendFile(name, data); err != nil {
+		return err
+	}
+	written.AddFile(b.device, "/boot/"+name, int64(len(old)+len(data)), false)
+	return nil
+}
+
+func (b *editedBoot) MkdirAll(name string) error {
+	return b.e.MkdirAll(name)
+}
+
+// openBootEditor opens the FAT partition number part of card to edit it in
+// place with img.BootEditor, without mounting it.
+//
+// This is done for the image files on all OSes and for the SDCards on Linux
+// when the process can write to the device, e.g. when run as root. Otherwise
+// it returns a nil file and the partition has to be mounted instead.
+func openBootEditor(card string, part int) (*os.File, *editedBoot, error) {
+	fi, err := os.Stat(card)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !fi.Mode().IsRegular() && runtime.GOOS != "linux" {
+		return nil, nil, nil
+	}
+	/* #nosec G304 */
+	f, err := os.OpenFile(card, os.O_RDWR, 0)
+	if err != nil {
+		if fi.Mode().IsRegular() {
+			return nil, nil, err
+		}
+		log.Printf("can't open %s to edit it in place; mounting it instead: %v", card, err)
+		return nil, nil, nil
+	}
+	l, err := img.Partitions(f, part, 0)
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	e, err := img.NewBootEditor(img.NewFileDisk(f, l.Boot.Offset, l.Boot.Size))
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	return f, &editedBoot{e: e, device: card}, nil
+}
+
+// setupFirstBoot writes the files in the boot partition.
+//
+// host is the hostname to set on this card, if any.
+func setupFirstBoot(boot bootFS, host string) error {
+	img.Progressf("- First boot setup script\n")
+	if len(setupSH) == 0 {
+		// The board would boot but do nothing.
+		return errors.New("refusing to write an empty firstboot.sh")
+	}
+	if err := boot.WriteFile("firstboot.sh", setupSH, 0o755); err != nil {
+		return err
+	}
+	// Read by /etc/rc.local or firstboot.service, then deleted by setup.sh.
+	if err := boot.WriteFile(img.FirstBootArgs, []byte(strings.TrimSpace(firstBootArgs())+"\n"), 0o600); err != nil {
+		return err
+	}
+	if len(authorizedKeys) != 0 {
+		// This assumes you have properly set your own ssh keys and plan to use them.
+		if err := boot.WriteFile("authorized_keys", []byte(authorizedKeys), 0o644); err != nil {
+			return err
+		}
+	}
+	if userPassword != "" && !usesCloudInit() {
+		c, err := userconf(loginUser(), userPassword)
+		if err != nil {
+			return err
+		}
+		if err = boot.WriteFile("userconf.txt", []byte(c), 0o644); err != nil {
+			return err
+		}
+	}
+	for _, f := range bootFiles() {
+		if d := path.Dir(f.dst); d != "." {
+			if err := boot.MkdirAll(d); err != nil {
+				return err
+			}
+		}
+		log.Printf("Copying %s to /boot/%s", f.src, f.dst)
+		/* #nosec G304 */
+		b, err := os.ReadFile(f.src)
+		if err != nil {
+			return err
+		}
+		if err = boot.WriteFile(f.dst, b, f.mode); err != nil {
+			return err
+		}
+	}
+	if usesCloudInit() && len(host) != 0 {
+		// cloud-init sets the hostname before setup.sh has a chance to run.
+		if err := appendFile(boot, "user-data", fmt.Sprintf(cloudInitHostname, host)); err != nil {
+			return err
+		}
+	} else if perCardHostname() && len(host) != 0 {
+		if err := boot.WriteFile("hostname", []byte(host+"\n"), 0o644); err != nil {
+			return err
+		}
+	}
+	if len(*email) != 0 && len(*smtpHost) != 0 {
+		// setup.sh moves it into /etc/postfix/.
+		if err := boot.WriteFile("smtp_sasl_passwd", []byte(getSMTPRelay(*smtpHost, *smtpUser, *smtpPass)), 0o600); err != nil {
+			return err
+		}
+	}
+	if len(hostKeyPriv) != 0 {
+		if usesCloudInit() {
+			if err := appendFile(boot, "user-data", cloudInitSSHKeys(hostKeyPriv, hostKeyPub)); err != nil {
+				return err
+			}
+		} else {
+			// setup.sh moves them into /etc/ssh/.
+			if err := boot.WriteFile("ssh_host_ed25519_key", hostKeyPriv, 0o600); err != nil {
+				return err
+			}
+			if err := boot.WriteFile("ssh_host_ed25519_key.pub", hostKeyPub, 0o644); err != nil {
+				return err
+			}
+		}
+	}
+	if usesCloudInit() {
+		// Configure the user right away instead of waiting for setup.sh, so the
+		// device is reachable even if it fails.
+		hash := ""
+		if userPassword != "" {
+			var err error
+			if hash, err = img.CryptSHA512(userPassword); err != nil {
+				return err
+			}
+		}
+		if *userName != "" && *userName != image.DefaultUser() {
+			if err := appendFile(boot, "user-data", fmt.Sprintf(cloudInitDefaultUser, *userName)); err != nil {
+				return err
+			}
+		}
+		if err := appendFile(boot, "user-data", cloudInitUser(loginUser(), authorizedKeys, hash)); err != nil {
+			return err
+		}
+	}
+	if usesCloudInit() && len(*locale) != 0 {
+		if err := appendFile(boot, "user-data", fmt.Sprintf(cloudInitLocale, *locale)); err != nil {
+			return err
+		}
+	}
+	if usesCloudInit() && len(*keyboard) != 0 {
+		if err := appendFile(boot, "user-data", fmt.Sprintf(cloudInitKeyboard, *keyboard)); err != nil {
+			return err
+		}
+	}
+	if usesCloudInit() && *sshPort != 22 {
+		if err := appendFile(boot, "user-data", fmt.Sprintf(cloudInitSSHPort, *sshPort)); err != nil {
+			return err
+		}
+	}
+	if usesCloudInit() && (len(*aptMirror) != 0 || len(*aptProxy) != 0) {
+		if err := appendFile(boot, "user-data", cloudInitApt(*aptMirror, *aptProxy)); err != nil {
+			return err
+		}
+	}
+	if usesCloudInit() && len(*staticIP) != 0 {
+		c := getNetworkConfig(*staticIP, *gateway, *dns)
+		if err := boot.WriteFile("network-config", []byte(c), 0o644); err != nil {
+			return err
+		}
+	}
+	// On RaspiOS with package raspberrypi-net-mods installed (it is installed
+	// by default on lite), /boot/wpa_supplicant.conf is automatically copied to
+	// /etc/wpa_supplicant/. This enables the wifi sooner in the boot process
+	// than setup.sh and the passphrase is stored hashed.
+	// Bookworm ignores it and only needs the wifi country.
+	if networkManager && len(*wifiSSID) != 0 && len(*wifiCountry) != 0 {
+		if err := appendCmdline(boot, "cfg80211.ieee80211_regdom="+strings.ToUpper(*wifiCountry)); err != nil {
+			return err
+		}
+	}
+	if (image.Distro == img.RaspiOS || image.Distro == img.RaspiOS64) && !networkManager && len(*wifiSSID) != 0 {
+		w := wifiNetwork()
+		c := w.WPASupplicant()
+		if err := boot.WriteFile("wpa_supplicant.conf", []byte(c), 0o644); err != nil {
+			return err
+		}
+	}
+	if len(wpaSupplicant) != 0 {
+		if err := boot.WriteFile("wpa_supplicant.conf", wpaSupplicant, 0o644); err != nil {
+			return err
+		}
+	}
+	return enableSSH(boot)
+}
+
+// enableSSH makes sure the ssh daemon runs on the first boot, which is done
+// differently on each image.
+func enableSSH(boot bootFS) error {
+	switch {
+	case image.Distro == img.RaspiOS || image.Distro == img.RaspiOS64:
+		// RaspiOS only enables ssh when /boot/ssh exists.
+		return boot.WriteFile("ssh", nil, 0o644)
+	case usesCloudInit():
+		return appendFile(boot, "user-data", cloudInitEnableSSH)
+	default:
+		// The Armbian, Debian and Ubuntu images for the other boards ship with
+		// ssh enabled.
+		return nil
+	}
+}
+
+// appendFile appends content to the existing file name in boot.
+func appendFile(boot bootFS, name, content string) error {
+	return boot.AppendFile(name, []byte(content))
+}
+
+// supportsUART returns true if enableUART knows how to enable the console on
+// UART for the image.
+func supportsUART() bool {
+	return image.Manufacturer == img.Raspberry || image.Manufacturer == img.HardKernel
+}
+
+// enableUART enables console on UART, by editing the boot configuration file
+// of the board in the boot partition.
+//
+// This is only needed when debugging over serial, mainly to debug issues with
+// setup.sh.
+func enableUART(boot bootFS) error {
+	img.Progressf("- Enabling console on UART\n")
+	switch image.Manufacturer {
+	case img.Raspberry:
+		// https://www.raspberrypi.org/forums/viewtopic.php?f=28&t=141195
+		return appendConfigTxt(boot, uartConfigTxt(*piModel))
+	case img.HardKernel:
+		return odroidEnableUART(boot)
+	default:
+		return fmt.Errorf("-forceuart is not supported on %s", &image)
+	}
+}
+
+// odroidUART is the kernel argument for the console on the UART of the
+// Odroid serial header.
+const odroidUART = "console=ttyS0,115200n8"
+
+// odroidEnableUART adds the console on UART to the kernel arguments in
+// /boot/boot.ini, unless already present.
+//
+// https://wiki.odroid.com/odroid-c1/application_note/software/boot_ini
+func odroidEnableUART(boot bootFS) error {
+	b, err := boot.ReadFile("boot.ini")
+	if err != nil {
+		return err
+	}
+	out, err := addBootIniConsole(string(b))
+	if err != nil || out == string(b) {
+		return err
+	}
+	return boot.WriteFile("boot.ini", []byte(out), 0o644)
+}
+
+// addBootIniConsole returns the content of a boot.ini with odroidUART
+// appended to the kernel arguments right before booting.
+func addBootIniConsole(ini string) (string, error) {
+	if strings.Contains(ini, "console=ttyS0") {
+		log.Printf("boot.ini already enables the console on UART")
+		return ini, nil
+	}
+	lines := strings.SplitAfter(ini, "\n")
+	for i, l := range lines {
+		if f := strings.Fields(l); len(f) != 0 && (f[0] == "bootm" || f[0] == "booti" || f[0] == "bootz") {
+			set := "# Enable console on UART\nsetenv bootargs \"${bootargs} " + odroidUART + "\"\n"
+			return strings.Join(lines[:i], "") + set + strings.Join(lines[i:], ""), nil
+		}
+	}
+	return "", errors.New("failed to find the boot command in boot.ini")
+}
+
+// raspiosEditConfig appends the requested changes to /boot/config.txt.
+func raspiosEditConfig(boot bootFS) error {
+	if *hdmiMode != "" {
+		h, err := getDisplayMode(*hdmiMode)
+		if err != nil {
+			return err
+		}
+		img.Progressf("- Setting HDMI display mode to %s\n", h.name)
+		if usesKMS(*piModel) {
+			err = appendCmdline(boot, h.cmdlineVideo())
+		} else {
+			err = appendConfigTxt(boot, h.configTxt())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if args := strings.Fields(*cmdlineAdd); len(args) != 0 {
+		img.Progressf("- Appending %s to cmdline.txt\n", strings.Join(args, " "))
+		for _, a := range args {
+			if err := appendCmdline(boot, a); err != nil {
+				return err
+			}
+		}
+	}
+	for _, c := range []struct {
+		enabled bool
+		name    string
+		content string
+	}{
+		{*enableI2C, "I²C", raspberryPiI2C},
+		{*enableSPI, "SPI", raspberryPiSPI},
+		{*enable1Wire, "1-Wire", raspberryPi1Wire},
+	} {
+		if c.enabled {
+			img.Progressf("- Enabling %s\n", c.name)
+			if err := appendConfigTxt(boot, c.content); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// appendConfigTxt appends content to /boot/config.txt, unless it is already
+// present.
+//
+// This makes it safe to run multiple times on the same boot partition.
+//
+// https://www.raspberrypi.com/documentation/computers/config_txt.html
+func appendConfigTxt(boot bootFS, content string) error {
+	b, err := boot.ReadFile("config.txt")
+	if err != nil {
+		return err
+	}
+	if containsBlock(string(b), content) {
+		log.Printf("config.txt already contains %q", strings.TrimSpace(content))
+		return nil
+	}
+	return appendFile(boot, "config.txt", content)
+}
+
+// appendCmdline appends a kernel argument to /boot/cmdline.txt, unless it is
+// already present.
+//
+// The file must stay a single line.
+//
+// https://www.raspberrypi.com/documentation/computers/configuration.html#the-kernel-command-line
+func appendCmdline(boot bootFS, arg string) error {
+	b, err := boot.ReadFile("cmdline.txt")
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(b))
+	for _, f := range fields {
+		if f == arg {
+			log.Printf("cmdline.txt already contains %q", arg)
+			return nil
+		}
+	}
+	fields = append(fields, arg)
+	return boot.WriteFile("cmdline.txt", []byte(strings.Join(fields, " ")+"\n"), 0o644)
+}
+
+// checkCmdline verifies the -cmdline-append value. cmdline.txt must stay a
+// single line.
+func checkCmdline(v string) error {
+	for _, r := range v {
+		if r != ' ' && r != '\t' && !unicode.IsGraphic(r) {
+			return fmt.Errorf("-cmdline-append %q must not contain newlines or control characters", v)
+		}
+	}
+	if v != "" && len(strings.Fields(v)) == 0 {
+		return errors.New("-cmdline-append is empty")
+	}
+	return nil
+}
+
+// containsBlock returns true if block is already in content, ignoring
+// surrounding whitespace and line endings.
+func containsBlock(content, block string) bool {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	return strings.Contains(content, strings.TrimSpace(block))
+}
+
+//
+
+// expandsRootFS returns true if the image expands the root partition to fill
+// the SDCard on its own on first boot.
+func expandsRootFS() bool {
+	return usesCloudInit() || image.Distro == img.RaspiOS || image.Distro == img.RaspiOS64
+}
+
+// disableExpandRootFS prevents the image from expanding the root partition on
+// first boot, by editing the boot partition.
+func disableExpandRootFS(boot bootFS) error {
+	img.Progressf("- Disabling the root partition expansion\n")
+	if usesCloudInit() {
+		return appendFile(boot, "user-data", cloudInitNoGrowpart)
+	}
+	found, err := removeCmdline(boot, raspiosResizeInit)
+	if err == nil && !found {
+		fmt.Printf("Warning! cmdline.txt doesn't contain %s; the root partition may still be expanded\n", raspiosResizeInit)
+	}
+	return err
+}
+
+// removeCmdline removes arg from /boot/cmdline.txt and returns true if it was
+// present.
+func removeCmdline(boot bootFS, arg string) (bool, error) {
+	b, err := boot.ReadFile("cmdline.txt")
+	if err != nil {
+		return false, err
+	}
+	fields := strings.Fields(string(b))
+	out := fields[:0]
+	for _, f := range fields {
+		if f != arg {
+			out = append(out, f)
+		}
+	}
+	if len(out) == len(fields) {
+		return false, nil
+	}
+	return true, boot.WriteFile("cmdline.txt", []byte(strings.Join(out, " ")+"\n"), 0o644)
+}
+
+// summary is printed on stdout with -output json.
+type summary struct {
+	Image string `json:"image"`
+	// URL and Date are empty with -local-image.
+	URL    string `json:"url,omitempty"`
+	Date   string `json:"date,omitempty"`
+	Board  string `json:"board"`
+	Distro string `json:"distro"`
+	// Device is empty with -save-xz and -save-img.
+	Device      string `json:"device"`
+	Hostname    string `json:"hostname"`
+	DefaultUser string `json:"default_user"`
+	Wifi        bool   `json:"wifi"`
+	// FirstBoot is set only when the image couldn't be modified to run it
+	// automatically.
+	FirstBoot string `json:"firstboot,omitempty"`
+	// KnownHosts is the line to add to ~/.ssh/known_hosts with -host-key.
+	KnownHosts string `json:"known_hosts,omitempty"`
+	// XZ is the compressed image written with -save-xz.
+	XZ string `json:"xz,omitempty"`
+	// Img is the image written with -save-img.
+	Img string `json:"img,omitempty"`
+	// Password is the password of DefaultUser generated with -password random.
+	Password string `json:"password,omitempty"`
+	// Files are the files written to the image and the SDCards.
+	Files []img.WrittenFile `json:"files"`
+}
+
+// detectedImage is the image found on the SDCard printed with -detect.
+type detectedImage struct {
+	Device       string `json:"device"`
+	Manufacturer string `json:"manufacturer"`
+	Board        string `json:"board"`
+	Distro       string `json:"distro"`
+}
+
+// detectCard prints the image found in the boot partition of -sdcard.
+func detectCard(ctx context.Context, stdout io.Writer) error {
+	cards, err := splitSDCards(*sdCard)
+	if err != nil {
+		return err
+	}
+	if len(cards) != 1 {
+		return errors.New("-detect requires a single -sdcard")
+	}
+	card := cards[0]
+	part := *bootPart
+	if part == 0 {
+		part = 1
+		// Only implemented on Linux.
+		if b, _, err := img.PartitionRoles(card); err == nil && b != 0 {
+			part = b
+		}
+	}
+	boot, err := img.Mount(ctx, card, part, &opts)
+	if err != nil {
+		return err
+	}
+	i, err := img.DetectImage(boot)
+	if err2 := img.Umount(card, &opts); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", card, err)
+	}
+	d := detectedImage{Device: card, Manufacturer: string(i.Manufacturer), Board: string(i.Board), Distro: string(i.Distro)}
+	if stdout != nil {
+		e := json.NewEncoder(stdout)
+		e.SetIndent("", "  ")
+		return e.Encode(&d)
+	}
+	fmt.Printf("Found %s on %s. To re-flash it with the same image, use:\n", &i, card)
+	fmt.Printf("  efe -manufacturer %s -board %s -distro %s\n", d.Manufacturer, d.Board, d.Distro)
+	return nil
+}
+
+// imageInfo is the resolved image selection printed with -info.
+type imageInfo struct {
+	Manufacturer    string `json:"manufacturer"`
+	Board           string `json:"board"`
+	Distro          string `json:"distro"`
+	DefaultUser     string `json:"default_user"`
+	DefaultHostname string `json:"default_hostname"`
+	BootPartition   int    `json:"boot_partition"`
+	RootPartition   int    `json:"root_partition"`
+	// RootFS is -root-fs, which locates the root partition instead of
+	// RootPartition once the image is fetched.
+	RootFS string `json:"root_fs,omitempty"`
+	// URL is the URL the image would be fetched from, including the mirror.
+	// URL and File are empty when the image cannot be fetched automatically.
+	URL string `json:"url"`
+	// File is the name of the decompressed image.
+	File string `json:"file"`
+}
+
+// getImageInfo returns the information about the image i, which must have
+// been checked with Check, flashed with the partitions bootPart and rootPart.
+func getImageInfo(ctx context.Context, i *img.Image, bootPart, rootPart int, rootFS string) (*imageInfo, error) {
+	u, name, err := i.URL(ctx, &opts)
+	if err != nil && !errors.Is(err, img.ErrImageNotFound) {
+		return nil, err
+	}
+	return &imageInfo{
+		Manufacturer:    string(i.Manufacturer),
+		Board:           string(i.Board),
+		Distro:          string(i.Distro),
+		DefaultUser:     i.DefaultUser(),
+		DefaultHostname: i.DefaultHostname(),
+		BootPartition:   bootPart,
+		RootPartition:   rootPart,
+		RootFS:          rootFS,
+		URL:             u,
+		File:            name,
+	}, nil
+}
+
+// mountMu serializes mounting as on OSX, Mount finds the new volume by
+// comparing the mounted volumes before and after.
+var mountMu sync.Mutex
+
+// sdCards are the SDCards to flash, as specified with -sdcard.
+var sdCards []string
+
+// installUnit is true when the image has no /etc/rc.local to edit, so
+// firstboot.service is installed in the root partition once flashed.
+var installUnit bool
+
+// networkManager is true when the image is RaspiOS Bookworm or later, which
+// configures the wifi with NetworkManager and ignores
+// /boot/wpa_supplicant.conf.
+var networkManager bool
+
+// writesNMConnection returns true if the NetworkManager connection for
+// -wifi-ssid is written in the root partition once flashed. EXT4 can only be
+// mounted on Linux; otherwise setup.sh configures the wifi with nmcli.
+func writesNMConnection() bool {
+	return networkManager && *wifiSSID != "" && runtime.GOOS == "linux"
+}
+
+// manageCache implements -list-cache and -prune-cache.
+func manageCache(stdout io.Writer) error {
+	if *listCache && *pruneCache != 0 {
+		return errors.New("-list-cache and -prune-cache are mutually exclusive")
+	}
+	l := img.ListCachedImages()
+	if *pruneCache < 0 {
+		return errors.New("-prune-cache must be positive")
+	} else if *pruneCache > 0 {
+		var err error
+		if l, err = img.PruneCachedImages(*pruneCache); err != nil {
+			return err
+		}
+	}
+	if stdout != nil {
+		if l == nil {
+			l = []img.CachedImage{}
+		}
+		e := json.NewEncoder(stdout)
+		e.SetIndent("", "  ")
+		return e.Encode(l)
+	}
+	if *pruneCache > 0 {
+		fmt.Printf("Deleted %d cached images\n", len(l))
+		return nil
+	}
+	printCachedImages(os.Stdout, l)
+	return nil
+}
+
+// printCachedImages prints the cached images as a table.
+func printCachedImages(w io.Writer, l []img.CachedImage) {
+	if len(l) == 0 {
+		fmt.Fprintf(w, "No cached image\n")
+		return
+	}
+	for _, c := range l {
+		d, date := string(c.Distro), c.Date
+		if d == "" {
+			d = "?"
+		}
+		if date == "" {
+			date = "?"
+		}
+		fmt.Fprintf(w, "%-10s %-10s %9.1fGiB  %s  %s\n", d, date, float64(c.Size)/1024/1024/1024, c.ModTime.Format("2006-01-02 15:04"), filepath.Base(c.Path))
+	}
+}
+
+// findCachedImage returns the path of the image p in the cached images l, by
+// path or file name.
+func findCachedImage(p string, l []img.CachedImage) (string, error) {
+	a, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range l {
+		if c.Path == a || filepath.Base(c.Path) == p {
+			if strings.HasSuffix(c.Path, ".gz") || strings.HasSuffix(c.Path, ".zst") {
+				return "", fmt.Errorf("-use-cached: %s must be decompressed first", p)
+			}
+			return c.Path, nil
+		}
+	}
+	return "", fmt.Errorf("-use-cached: %s is not a cached image; see -list-cache", p)
+}
+
+// compression is the -compress value.
+var compression img.Compression
+
+// bootPartAuto is true when -boot-part is not specified, so the boot partition
+// can be identified by its file system type once flashed.
+var bootPartAuto bool
+
+// flashCard flashes imgmod to card then edits the boot partition.
+//
+// host is the hostname to set on this card, if any.
+func flashCard(ctx context.Context, imgmod, card, host string) error {
+	var parts []img.Partition
+	var gpt bool
+	if *dataPart != "" {
+		// Check there is room before flashing.
+		var err error
+		if parts, gpt, err = readPartitions(imgmod); err != nil {
+			return err
+		}
+		if _, _, err = img.PlanDataPartition(card, parts, gpt, dataSize); err != nil {
+			return err
+		}
+	}
+	if *checkCap {
+		c, err := img.CheckCapacity(card, &opts)
+		if err != nil {
+			return err
+		}
+		for _, w := range c.Warnings() {
+			fmt.Printf("Warning! %s: %s\n", card, w)
+		}
+		fi, err := os.Stat(imgmod)
+		if err != nil {
+			return err
+		}
+		if err = c.Fits(fi.Size()); err != nil {
+			return fmt.Errorf("%s: %w", card, err)
+		}
+	}
+	if *benchmark {
+		r, err := img.Benchmark(ctx, imgmod, card, &opts)
+		if err != nil {
+			return err
+		}
+		img.Progressf("- %s writes at %.1fMB/s\n", card, r.Speed()/1000/1000)
+		for _, w := range r.Warnings() {
+			fmt.Printf("Warning! %s: %s\n", card, w)
+		}
+	}
+	if *baseline != "" {
+		// Edit the root partition before flashing so the baseline saved below
+		// matches the SDCard. Only the FAT partitions, always written in full,
+		// are edited once flashed.
+		if err := editRoot(ctx, imgmod); err != nil {
+			return err
+		}
+		if err := img.Umount(imgmod, &opts); err != nil {
+			return err
+		}
+		if err := img.FlashIncremental(ctx, imgmod, *baseline, card, &opts); err != nil {
+			return err
+		}
+		// The SDCard now matches imgmod, up to the boot partition edits below.
+		img.Progressf("- Saving %s as the baseline for the next flash\n", *baseline)
+		if err := copyFile(*baseline, imgmod, 0o644); err != nil {
+			return err
+		}
+	} else if err := img.FlashWithBmap(ctx, imgmod, *bmapPath, card, &opts); err != nil {
+		return err
+	}
+	if *dataPart != "" {
+		if _, err := img.AddDataPartition(ctx, card, parts, gpt, dataSize, dataFS, &opts); err != nil {
+			return err
+		}
+	}
+	return editCard(ctx, card, host)
+}
+
+// flashCardURL streams the image at u to card then edits the boot partition.
+//
+// Returns the hash of the image written, for -manifest.
+func flashCardURL(ctx context.Context, u, card, host string) (string, error) {
+	sum, err := img.FlashURL(ctx, u, card, &opts)
+	if err != nil {
+		return "", err
+	}
+	return sum, editCard(ctx, card, host)
+}
+
+// saving returns true if the provisioned image is written to a file with
+// -save-xz or -save-img instead of being flashed.
+func saving() bool {
+	return *saveXZ != "" || *saveImg != ""
+}
+
+// savedPath returns the file written with -save-xz or -save-img.
+func savedPath() string {
+	if *saveXZ != "" {
+		return *saveXZ
+	}
+	return *saveImg
+}
+
+// editCard edits the boot partition of card, which is either a flashed SDCard
+// or the image itself with -save-xz or -save-img.
+func editCard(ctx context.Context, card, host string) error {
+	part := *bootPart
+	if bootPartAuto {
+		// Only implemented on Linux.
+		if b, _, err := img.PartitionRoles(card); err == nil && b != 0 && b != part {
+			log.Printf("using the FAT partition #%d of %s instead of #%d", b, card, part)
+			part = b
+		}
+	}
+	// Unmount so the partition isn't modified behind the back of the host.
+	if err := img.Umount(card, &opts); err != nil {
+		return err
+	}
+	if err := editBootPart(ctx, card, part, host); err != nil {
+		return err
+	}
+	if *baseline == "" {
+		// With -baseline, the root partition was edited in the image before
+		// flashing.
+		if err := editRoot(ctx, card); err != nil {
+			return err
+		}
+	}
+	if err := img.Umount(card, &opts); err != nil {
+		return err
+	}
+	if *eject {
+		img.Progressf("- Ejecting %s\n", card)
+		if err := img.Eject(card, &opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// editBootPart edits the FAT partition number part of card, in place with
+// img.BootEditor when possible, otherwise by mounting it.
+func editBootPart(ctx context.Context, card string, part int, host string) error {
+	f, e, err := openBootEditor(card, part)
+	if err != nil {
+		return err
+	}
+	if f != nil {
+		log.Printf("  editing /boot of %s in place\n", card)
+		if err = editBoot(e, host); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if err = f.Sync(); err != nil {
+			_ = f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	mountMu.Lock()
+	boot, err := img.Mount(ctx, card, part, &opts)
+	mountMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if boot == "" {
+		return errors.New("failed to mount /boot")
+	}
+	if *driveLetter {
+		img.Progressf("- Boot partition of %s mounted as %s\n", card, boot)
+	} else {
+		log.Printf("  /boot mounted as %s\n", boot)
+	}
+	written.Mounted(card, boot, "/boot")
+	return editBoot(mountedBoot(boot), host)
+}
+
+// editBoot writes the files in the boot partition and edits its
+// configuration.
+func editBoot(boot bootFS, host string) error {
+	if err := setupFirstBoot(boot, host); err != nil {
+		return err
+	}
+	if err := raspiosEditConfig(boot); err != nil {
+		return err
+	}
+	if *forceUART {
+		if err := enableUART(boot); err != nil {
+			return err
+		}
+	}
+	if expandRootFS.set && !expandRootFS.v && expandsRootFS() {
+		return disableExpandRootFS(boot)
+	}
+	return nil
+}
+
+// editRoot edits the EXT4 root partition of card, a SDCard or an image file,
+// when needed. It is left mounted.
+func editRoot(ctx context.Context, card string) error {
+	if !installUnit && !writesNMConnection() {
+		return nil
+	}
+	mountMu.Lock()
+	root, err := img.Mount(ctx, card, *rootPart, &opts)
+	mountMu.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Printf("  / mounted as %s\n", root)
+	written.Mounted(card, root, "/")
+	if installUnit {
+		if err = installFirstBootUnit(ctx, root); err != nil {
+			return err
+		}
+	}
+	if writesNMConnection() {
+		if err = installNMConnection(ctx, root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flashCards calls f for each card concurrently, with at most parallel calls
+// at a time. f is passed the index of the card.
+//
+// Returns the error for each card.
+func flashCards(cards []string, parallel int, f func(i int, card string) error) []error {
+	errs := make([]error, len(cards))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, c := range cards {
+		wg.Add(1)
+		go func(i int, c string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() {
+				<-sem
+			}()
+			img.Progressf("- Flashing %s\n", c)
+			start := time.Now()
+			if errs[i] = f(i, c); errs[i] == nil {
+				img.Progressf("- Flashed %s in %s\n", c, time.Since(start).Round(time.Second))
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	return errs
+}
+
+// splitSDCards splits the comma separated -sdcard value.
+func splitSDCards(v string) ([]string, error) {
+	var out []string
+	seen := map[string]bool{}
+	for _, c := range strings.Split(v, ",") {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+		if seen[c] {
+			return nil, fmt.Errorf("-sdcard %s is specified twice", c)
+		}
+		seen[c] = true
+		out = append(out, c)
+	}
+	if len(out) == 0 {
+		return nil, errors.New("-sdcard is required")
+	}
+	return out, nil
+}
+
+// checkFlags validates the flags and derives the settings from them, e.g.
+// image, opts and compression.
+//
+// It neither prompts nor accesses the network or the SDCards, so the secrets
+// must already be read. The modes exiting early, like -print-url, only get
+// the flags they use checked.
+func checkFlags() error {
+	if *timeout < 0 {
+		return errors.New("-timeout must be positive")
+	}
+	if *output != "" && *output != "json" {
+		return fmt.Errorf("unsupported -output %q", *output)
+	}
+	if (*wifiSSID != "") != (*wifiPass != "") {
+		return errors.New("use both --wifi-ssid and --wifi-pass, or set " + envWifiPass)
+	}
+	if *wifiPlainPSK && *wifiSSID == "" {
+		return errors.New("-wifi-plaintext-psk requires -wifi-ssid")
+	}
+	opts.Offline = *offline
+	opts.TraceHTTP = *verboseHTTP
+	if *proxy != "" {
+		p, err := img.ParseProxy(*proxy)
+		if err != nil {
+			return fmt.Errorf("-proxy: %w", err)
+		}
+		opts.Proxy = p
+	}
+	opts.ForceRefresh = *forceRefresh
+	opts.NoSudo = *noSudo
+	if *noSudo && runtime.GOOS != "windows" && os.Geteuid() != 0 && !saving() && !*printURL && !*info {
+		return errors.New("-no-sudo requires running as root, since flashing a SDCard needs elevated privileges")
+	}
+	opts.VerifySignature = *verifySig
+	var err error
+	if *blockSize != "" {
+		if opts.FlashBlockSize, err = img.ParseBlockSize(*blockSize); err != nil {
+			return fmt.Errorf("-flash-block-size: %w", err)
+		}
+	}
+	if *partTimeout <= 0 {
+		return errors.New("-partition-timeout must be positive")
+	}
+	opts.PartitionTimeout = *partTimeout
+	if *mountRetries < 0 {
+		return errors.New("-mount-retries can't be negative")
+	}
+	// img uses its default on 0.
+	opts.MountRetries = *mountRetries
+	if *mountRetries == 0 {
+		opts.MountRetries = -1
+	}
+	if *driveLetter && runtime.GOOS != "windows" {
+		return errors.New("-drive-letter is only supported on Windows")
+	}
+	opts.DriveLetter = *driveLetter
+	opts.AllowSystemDisk = *forceSystem
+	if *listCache || *pruneCache != 0 {
+		return nil
+	}
+	if *useCached != "" {
+		if *localImage != "" || *imageURL != "" {
+			return errors.New("-use-cached, -local-image and -image-url are mutually exclusive")
+		}
+		if *localImage, err = findCachedImage(*useCached, img.ListCachedImages()); err != nil {
+			return err
+		}
+	}
+	if *offline && *localImage == "" && !*printURL && !*info && !*detect {
+		return errors.New("-offline requires -local-image")
+	}
+	if *offline && *latestSetup {
+		return errors.New("-latest-setup-sh fetches setup.sh from GitHub and can't be used with -offline")
+	}
+	if *offline && len(githubUsers) != 0 {
+		return errors.New("-ssh-import-github fetches the keys from GitHub and can't be used with -offline")
+	}
+	if *wifiSSID != "" {
+		// An empty -wifi-country is detected by mainImpl afterward.
+		w := wifiNetwork()
+		if err = w.Check(); err != nil {
+			return err
+		}
+	}
+	image.Mirror = *mirror
+	if *imageSpec != "" {
+		i, err := img.ParseImage(*imageSpec)
+		if err != nil {
+			return fmt.Errorf("-image: %w", err)
+		}
+		// The individual flags take precedence.
+		if image.Manufacturer == "" {
+			image.Manufacturer = i.Manufacturer
+		}
+		if image.Board == "" {
+			image.Board = i.Board
+		}
+		if image.Distro == "" {
+			image.Distro = i.Distro
+		}
+	}
+	if *detect {
+		// -manufacturer is not needed.
+		return nil
+	}
+	if err = image.Check(); err != nil {
+		return err
+	}
+	// The distro is only known once defaulted by Check.
+	if *wifiPlainPSK && image.Distro != img.RaspiOS && image.Distro != img.RaspiOS64 {
+		return errors.New("-wifi-plaintext-psk is only supported on RaspiOS, setup.sh configures the wifi on the other images")
+	}
+	if *imageDate != "" {
+		if _, err = time.Parse("2006-01-02", *imageDate); err != nil {
+			return fmt.Errorf("-image-date must be formatted as YYYY-MM-DD: %q", *imageDate)
+		}
+		if image.Distro != img.RaspiOS && image.Distro != img.RaspiOS64 {
+			return errors.New("-image-date is only supported with -distro raspios or raspios64")
+		}
+		if *localImage != "" {
+			return errors.New("-image-date and -local-image are mutually exclusive")
+		}
+		image.Date = *imageDate
+	}
+	if *printURL {
+		if *output != "" {
+			return errors.New("-print-url and -output are mutually exclusive")
+		}
+		return nil
+	}
+	if *bootPart == 0 {
+		bootPartAuto = true
+		*bootPart = image.BootPartition()
+	}
+	if *rootFS != "" {
+		if *rootPart != 0 {
+			return errors.New("-root-fs and -root-part are mutually exclusive")
+		}
+		if _, _, err = img.ParseFSSpec(*rootFS); err != nil {
+			return fmt.Errorf("-root-fs: %w", err)
+		}
+	}
+	if *rootPart == 0 {
+		// Replaced once the image is fetched with -root-fs.
+		*rootPart = image.RootPartition()
+	}
+	if *info {
+		return nil
+	}
+	if image.Distro == img.Armbian {
+		// The files are written to the FAT boot partition, which Armbian
+		// doesn't have.
+		return errors.New("provisioning armbian is not supported since it has no FAT boot partition; use -print-url to fetch it")
+	}
+	if image.Manufacturer == img.Radxa {
+		// Its FAT partitions are not mounted as /boot, where the first boot
+		// script is expected.
+		return errors.New("provisioning radxa's debian is not supported; use -print-url to fetch it")
+	}
+	if *bootPart < 1 || *rootPart < 1 || *bootPart == *rootPart {
+		return errors.New("-boot-part and -root-part must be different partition numbers starting at 1")
+	}
+	if *fiveInches {
+		if *hdmiMode != "" && *hdmiMode != "800x480" {
+			return errors.New("-5inch and -hdmi-mode are mutually exclusive")
+		}
+		*hdmiMode = "800x480"
+	}
+	if *hdmiMode != "" {
+		if _, err = getDisplayMode(*hdmiMode); err != nil {
+			return err
+		}
+	}
+	if err = checkCmdline(*cmdlineAdd); err != nil {
+		return err
+	}
+	if *piModel != "" {
+		found := false
+		for _, m := range piModels {
+			found = found || m == *piModel
+		}
+		if !found {
+			return fmt.Errorf("unsupported -pi-model %q; one of %s", *piModel, strings.Join(piModels, ", "))
+		}
+	}
+	if *forceUART && !supportsUART() {
+		return fmt.Errorf("-forceuart is not supported on %s", &image)
 	}
 	if image.Distro != img.RaspiOS && image.Distro != img.RaspiOS64 {
-		if *fiveInches {
-			return errors.New("-5inch only make sense with -distro raspios")
+		if *hdmiMode != "" {
+			return errors.New("-5inch and -hdmi-mode only make sense with -distro raspios")
 		}
-		if *forceUART {
-			return errors.New("-forceuart only make sense with -distro raspios")
+		if *piModel != "" {
+			return errors.New("-pi-model only make sense with -distro raspios")
 		}
+		if *cmdlineAdd != "" {
+			return errors.New("-cmdline-append only make sense with -distro raspios")
+		}
+		if *enableI2C {
+			return errors.New("-enable-i2c only make sense with -distro raspios")
+		}
+		if *enableSPI {
+			return errors.New("-enable-spi only make sense with -distro raspios")
+		}
+		if *enable1Wire {
+			return errors.New("-enable-1wire only make sense with -distro raspios")
+		}
+	} else if m := image.PiModel(); m != "" {
+		if *piModel != "" && *piModel != m {
+			return fmt.Errorf("-pi-model %s doesn't match -board %s", *piModel, image.Board)
+		}
+		*piModel = m
 	}
-	if *sdCard == "" {
-		return errors.New("-sdcard is required")
+	if *saveXZ != "" && *saveImg != "" {
+		return errors.New("-save-xz and -save-img are mutually exclusive")
 	}
-
-	if *wifiSSID == "" {
-		fmt.Println("Wifi will not be configured!")
+	if *compress != "" && *saveXZ == "" {
+		return errors.New("-compress requires -save-xz")
 	}
-	imgpath, err := image.Fetch()
-	if err != nil {
+	c := *compress
+	if c == "" {
+		c = "xz"
+	}
+	if compression, err = img.ParseCompression(c); err != nil {
+		return fmt.Errorf("-compress: %w", err)
+	}
+	if compression.Format == "none" {
+		return errors.New("-compress none is not supported; use -save-img for an uncompressed image")
+	}
+	if *saveImg != "" && !strings.HasSuffix(*saveImg, ".img") {
+		return errors.New("-save-img must end with .img")
+	}
+	if *saveImg != "" && *localImage != "" && filepath.Clean(*saveImg) == filepath.Clean(*localImage) {
+		return errors.New("-save-img must be different from -local-image")
+	}
+	if *modOut != "" {
+		if *saveImg != "" {
+			return errors.New("-mod-out and -save-img are mutually exclusive; -save-img is edited in place")
+		}
+		if *localImage != "" && filepath.Clean(*modOut) == filepath.Clean(*localImage) {
+			return errors.New("-mod-out must be different from -local-image")
+		}
+		if err = checkModOut(*modOut); err != nil {
+			return fmt.Errorf("-mod-out: %w", err)
+		}
+	}
+	// The number of SDCards to flash; one is chosen interactively when
+	// -sdcard is not specified.
+	n := 1
+	if saving() {
+		if *saveXZ != "" && !strings.HasSuffix(*saveXZ, compression.Ext()) {
+			return fmt.Errorf("-save-xz must end with %s for -compress %s", compression.Ext(), compression)
+		}
+		if runtime.GOOS == "windows" {
+			return errors.New("-save-xz and -save-img are not supported on Windows")
+		}
+		if *benchmark || *eject || *checkCap {
+			return errors.New("-benchmark, -check-capacity and -eject only make sense when flashing a SDCard")
+		}
+	} else if *sdCard != "" {
+		cards, err := splitSDCards(*sdCard)
+		if err != nil {
+			return err
+		}
+		n = len(cards)
+	}
+	if *parallel < 1 {
+		return errors.New("-parallel must be at least 1")
+	}
+	if n > 1 {
+		// The devices would all end up with the same address or host key.
+		if *staticIP != "" {
+			return errors.New("-ip is not supported with multiple -sdcard")
+		}
+		if *hostKey {
+			return errors.New("-host-key is not supported with multiple -sdcard")
+		}
+	}
+	if *hostname != "" {
+		// The last one is the longest.
+		if err = checkHostname(cardHostname(*hostname, n-1, n)); err != nil {
+			return err
+		}
+	}
+	if *hostPrefix != "" {
+		if *hostname != "" {
+			return errors.New("-hostname and -hostname-prefix are mutually exclusive")
+		}
+		if err = checkHostname(*hostPrefix + "-001"); err != nil {
+			return fmt.Errorf("-hostname-prefix: %w", err)
+		}
+	} else if *hostProbe {
+		return errors.New("-hostname-probe requires -hostname-prefix")
+	}
+	if err = checkTimeLocation(*timeLocation); err != nil {
 		return err
 	}
-	e := filepath.Ext(imgpath)
-	imgmod := imgpath[:len(imgpath)-len(e)] + "-mod" + e
-	if err = copyFile(imgmod, imgpath, 0o666); err != nil {
+	if err = checkEmail(*email, *smtpHost, *smtpUser, *smtpPass); err != nil {
 		return err
 	}
-	// TODO(maruel): Recent distros do not have a /etc/rc.local file.
-	modified, err := modifyEXT4(imgmod)
-	if err != nil {
+	if err = checkStaticIP(*staticIP, *gateway, *dns); err != nil {
 		return err
 	}
-	if !modified {
-		fmt.Printf("Couldn't modified the image to setup automatically on boot.\n")
-		fmt.Printf("You will have to ssh in and run:\n")
-		fmt.Printf("  /boot/firstboot.sh%s\n", firstBootArgs())
+	if err = checkLocale(*locale, *keyboard); err != nil {
+		return err
 	}
-	fmt.Printf("Warning! This will blow up everything in %s\n\n", *sdCard)
-	if runtime.GOOS != "windows" {
-		fmt.Printf("This script has minimal use of 'sudo' for 'dd' to format the SDCard\n\n")
+	if err = checkAptURL("-apt-mirror", *aptMirror); err != nil {
+		return err
 	}
-	if err = img.Flash(imgmod, *sdCard); err != nil {
+	if err = checkAptURL("-apt-proxy", *aptProxy); err != nil {
 		return err
 	}
-
-	// Unmount then remount to ensure we get the path.
-	if err = img.Umount(*sdCard); err != nil {
+	if err = checkFirstBootLog(*firstBootLog); err != nil {
+		return err
+	}
+	if *sshPort < 1 || *sshPort > 65535 {
+		return fmt.Errorf("-ssh-port %d must be between 1 and 65535", *sshPort)
+	}
+	if *dataPart != "" {
+		if dataSize, err = img.ParseDataSize(*dataPart); err != nil {
+			return fmt.Errorf("-data-partition: %w", err)
+		}
+		if expandRootFS.set && expandRootFS.v || !expandRootFS.set && expandsRootFS() {
+			return errors.New("-data-partition requires -expand-rootfs=false")
+		}
+		if saving() {
+			return errors.New("-data-partition is not supported with -save-xz and -save-img")
+		}
+		if err = dataFS.Check(); err != nil {
+			return fmt.Errorf("-data-fs %s: %w", dataFS, err)
+		}
+	}
+	if *imageURL != "" {
+		if err = img.CheckImageURL(*imageURL); err != nil {
+			return fmt.Errorf("-image-url: %w", err)
+		}
+		if *localImage != "" || *imageDate != "" || *offline {
+			return errors.New("-image-url is mutually exclusive with -local-image, -image-date and -offline")
+		}
+		// The image is never on disk, so nothing can inspect it beforehand.
+		if saving() || *bmapPath != "" || *dataPart != "" || *checkCap || *benchmark || *rootFS != "" || *modOut != "" {
+			return errors.New("-image-url is not supported with -save-xz, -save-img, -bmap, -data-partition, -check-capacity, -benchmark, -root-fs and -mod-out")
+		}
+		if n > 1 {
+			return errors.New("-image-url supports a single -sdcard")
+		}
+	}
+	if *baseline != "" {
+		if saving() || *imageURL != "" || *bmapPath != "" || *dataPart != "" {
+			return errors.New("-baseline is not supported with -save-xz, -save-img, -image-url, -bmap and -data-partition")
+		}
+		if n > 1 {
+			return errors.New("-baseline supports a single -sdcard")
+		}
+		for _, p := range []string{*localImage, *modOut} {
+			if p != "" && filepath.Clean(p) == filepath.Clean(*baseline) {
+				return errors.New("-baseline must be different from -local-image and -mod-out")
+			}
+		}
+	}
+	if *verifySig {
+		if *localImage != "" || *imageURL != "" || *offline {
+			return errors.New("-verify-signature verifies the downloaded image and can't be used with -local-image, -image-url or -offline")
+		}
+		if image.Distro != img.RaspiOS && image.Distro != img.RaspiOS64 {
+			return errors.New("-verify-signature is only supported on RaspiOS, the other images are not signed")
+		}
+		if len(signingKeys) == 0 {
+			return errors.New("-verify-signature requires -signing-key, no key is trusted by default")
+		}
+		for _, k := range signingKeys {
+			if err = addSigningKey(k); err != nil {
+				return fmt.Errorf("-signing-key: %w", err)
+			}
+		}
+	} else if len(signingKeys) != 0 {
+		return errors.New("-signing-key requires -verify-signature")
+	}
+	if *wpaConf != "" {
+		if *wifiSSID != "" {
+			return errors.New("-wpa-conf and -wifi-ssid are mutually exclusive")
+		}
+		if image.Distro != img.RaspiOS && image.Distro != img.RaspiOS64 {
+			return errors.New("-wpa-conf is only supported on RaspiOS")
+		}
+		/* #nosec G304 */
+		if wpaSupplicant, err = os.ReadFile(*wpaConf); err != nil {
+			return err
+		}
+		if err = checkWPAConf(wpaSupplicant); err != nil {
+			return fmt.Errorf("-wpa-conf %s: %w", *wpaConf, err)
+		}
+	}
+	if err = checkBootFiles(bootFiles()); err != nil {
 		return err
 	}
-	boot, err := img.Mount(*sdCard, 1)
+	if err = checkUserName(*userName); err != nil {
+		return err
+	}
+	if *userName != "" && image.Distro != img.RaspiOS && image.Distro != img.RaspiOS64 && !usesCloudInit() {
+		return errors.New("-user is only supported on RaspiOS and Ubuntu for the Raspberry Pi")
+	}
+	if *userName != "" && *password == "" && !usesCloudInit() {
+		// The account is created from /boot/userconf.txt, which requires a
+		// password hash.
+		return errors.New("-user requires -password on RaspiOS")
+	}
+	if *password != "" {
+		if image.Distro != img.RaspiOS && image.Distro != img.RaspiOS64 && !usesCloudInit() {
+			return errors.New("-password is only supported on RaspiOS and Ubuntu for the Raspberry Pi")
+		}
+		if *noPassword {
+			return errors.New("-password and -disable-password-auth are mutually exclusive")
+		}
+	}
+	return nil
+}
+
+func mainImpl(ctx context.Context) (err error) {
+	// Simplify our life on locale not in en_US.
+	_ = os.Setenv("LANG", "C")
+	// TODO(maruel): Make it usable without root with:
+	//   sudo setcap CAP_SYS_ADMIN,CAP_DAC_OVERRIDE=ep __file__
+	flag.Parse()
+	l, err := img.LevelFromFlags(*quiet, *v, *vv)
 	if err != nil {
 		return err
 	}
-	if boot == "" {
-		return errors.New("failed to mount /boot")
+	img.SetLevel(l)
+	if *wifiSSID != "" {
+		if *wifiPass, err = secret(ctx, *wifiPass, envWifiPass, fmt.Sprintf("Wifi password for %s: ", *wifiSSID)); err != nil {
+			return err
+		}
+	}
+	if *password, err = secret(ctx, *password, envPassword, ""); err != nil {
+		return err
+	}
+	if err = checkFlags(); err != nil {
+		return err
+	}
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+		defer func() {
+			if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				err = fmt.Errorf("timed out after -timeout %s: %w", *timeout, err)
+			}
+		}()
+	}
+	var stdout io.Writer
+	if *output == "json" {
+		// Send all the prose, including the one from the img package and the
+		// child processes, to stderr.
+		stdout = os.Stdout
+		os.Stdout = os.Stderr
+	}
+	if *listCache || *pruneCache != 0 {
+		return manageCache(stdout)
+	}
+	if !*printURL && !*info {
+		// Only these two don't need to access a SDCard.
+		if err = img.CheckOS(); err != nil {
+			return fmt.Errorf("%w; -print-url and -info are still supported", err)
+		}
+	}
+	if *detect {
+		return detectCard(ctx, stdout)
+	}
+	if *printURL {
+		u, name, err := image.URL(ctx, &opts)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %s\n", u, name)
+		return nil
+	}
+	if *info {
+		i, err := getImageInfo(ctx, &image, *bootPart, *rootPart, *rootFS)
+		if err != nil {
+			return err
+		}
+		if stdout != nil {
+			e := json.NewEncoder(stdout)
+			e.SetIndent("", "  ")
+			return e.Encode(i)
+		}
+		fmt.Printf("Manufacturer:     %s\n", i.Manufacturer)
+		fmt.Printf("Board:            %s\n", i.Board)
+		fmt.Printf("Distro:           %s\n", i.Distro)
+		fmt.Printf("Default user:     %s\n", i.DefaultUser)
+		fmt.Printf("Default hostname: %s\n", i.DefaultHostname)
+		fmt.Printf("Boot partition:   #%d\n", i.BootPartition)
+		if i.RootFS != "" {
+			fmt.Printf("Root partition:   %s\n", i.RootFS)
+		} else {
+			fmt.Printf("Root partition:   #%d\n", i.RootPartition)
+		}
+		if i.URL != "" {
+			fmt.Printf("URL:              %s\n", i.URL)
+			fmt.Printf("File:             %s\n", i.File)
+		} else {
+			fmt.Printf("URL:              not fetched automatically; use -local-image\n")
+		}
+		return nil
+	}
+	if *wifiCountry == "" {
+		*wifiCountry = getDefaultCountry(ctx, *locale)
+	}
+	if !saving() && *sdCard == "" && len(sdCardsFound) > 1 && isInteractive() {
+		descs := make([]string, len(sdCardsFound))
+		for i, c := range sdCardsFound {
+			descs[i] = img.DescribeDisk(c)
+		}
+		if *sdCard, err = chooseSDCard(os.Stdin, os.Stdout, sdCardsFound, descs); err != nil {
+			return err
+		}
+	}
+	var cards []string
+	if !saving() {
+		if cards, err = splitSDCards(*sdCard); err != nil {
+			return err
+		}
+	}
+	sdCards = cards
+	caps := img.GetCapabilities(&opts)
+	log.Printf("Host capabilities:\n%s", &caps)
+	if err = checkCapabilities(&caps, cards); err != nil {
+		return err
+	}
+	if *noSudo && saving() && !caps.CanMountImage {
+		// The image is edited through a loop device, which needs sudo without
+		// udisksctl.
+		return fmt.Errorf("-no-sudo can't be used with -save-xz or -save-img on this host unless run as root, since the partitions of %s can't be mounted; use -v to list the tools found", savedPath())
+	}
+	if len(sshKeys) == 0 && len(githubUsers) == 0 {
+		if p := img.FindPublicKey(); p != "" {
+			sshKeys = stringsFlag{p}
+		}
+	}
+	if authorizedKeys, err = loadSSHKeys(ctx, sshKeys, githubUsers, os.Stdin); err != nil {
+		return err
+	}
+	if *checkSSHKey {
+		checkPrivateKeys(sshKeys)
+	}
+	if *noPassword && len(authorizedKeys) == 0 {
+		// Otherwise the device would be unreachable.
+		return errors.New("-disable-password-auth requires -ssh-key")
+	}
+	if *password != "" {
+		userPassword = *password
+		switch userPassword {
+		case "random":
+			if userPassword, err = randomPassword(16); err != nil {
+				return err
+			}
+			generatedPassword = true
+		case "-":
+			if userPassword, err = askPassword(ctx, loginUser()); err != nil {
+				return err
+			}
+		}
+	}
+	if *hostKey {
+		if hostKeyPriv, hostKeyPub, err = img.GenerateHostKey(); err != nil {
+			return err
+		}
 	}
-	log.Printf("  /boot mounted as %s\n", boot)
 
-	if err = setupFirstBoot(boot); err != nil {
+	if setupSH, err = img.GetSetupSH(ctx, *latestSetup, &opts); err != nil {
+		return fmt.Errorf("can't get the first boot script: %w", err)
+	}
+
+	if *wifiSSID == "" && *wpaConf == "" {
+		fmt.Println("Wifi will not be configured!")
+	}
+	if !saving() && !*yes && isInteractive() {
+		// Ask before fetching the image, which can take a while.
+		descs := make([]string, len(cards))
+		for i, c := range cards {
+			descs[i] = img.DescribeDisk(c)
+		}
+		if err = confirmErase(os.Stdin, os.Stdout, cards, descs); err != nil {
+			return err
+		}
+	}
+	var imgpath string
+	// fetched is nil with -local-image.
+	var fetched *img.FetchResult
+	if *imageURL != "" {
+		// Streamed while flashing.
+		imgpath = *imageURL
+		fetched = &img.FetchResult{URL: *imageURL}
+	} else if *localImage != "" {
+		imgpath, err = img.LocalImage(ctx, *localImage, &opts)
+	} else {
+		if err = checkFetchSpace(ctx); err != nil {
+			return err
+		}
+		if fetched, err = image.FetchDetails(ctx, &opts); err == nil {
+			imgpath = fetched.Path
+		}
+	}
+	if err != nil {
 		return err
 	}
-	if *forceUART {
-		if err = raspiosEnableUART(boot); err != nil {
+	networkManager = (image.Distro == img.RaspiOS || image.Distro == img.RaspiOS64) && img.RaspiOSUsesNetworkManager(imgpath)
+	if networkManager {
+		log.Printf("%s configures the wifi with NetworkManager", filepath.Base(imgpath))
+		if *wpaConf != "" {
+			return errors.New("-wpa-conf is not supported on RaspiOS Bookworm and later, which ignore wpa_supplicant.conf; use -wifi-ssid")
+		}
+	}
+	if *rootFS != "" {
+		if *rootPart, err = findRootPart(imgpath, *rootFS); err != nil {
 			return err
 		}
+		if *rootPart == *bootPart {
+			return fmt.Errorf("-root-fs %s is the boot partition #%d", *rootFS, *bootPart)
+		}
+		log.Printf("%s is partition #%d", *rootFS, *rootPart)
+	}
+	// Fail before the copy rather than midway through flashing.
+	if !saving() && *imageURL == "" {
+		for _, c := range cards {
+			if err = img.CheckImageFits(imgpath, c); err != nil {
+				return err
+			}
+		}
+	}
+	// A streamed image can't be inspected before it is flashed.
+	if *imageURL == "" {
+		if err = checkBootPartition(imgpath, *bootPart); err != nil {
+			if !bootPartAuto || runtime.GOOS != "linux" {
+				return err
+			}
+			// The boot partition is identified by its file system type once
+			// flashed.
+			log.Printf("%v", err)
+		}
+	}
+	// Only the images with /etc/rc.local need their root partition to be
+	// edited before flashing, on a copy to keep the image pristine. Otherwise
+	// the image is flashed as is and only the boot partition is edited on the
+	// SDCard, which saves a full copy of the image. -save-xz and -save-img
+	// edit the image itself and -baseline its root partition before flashing,
+	// so they always need the copy.
+	needsCopy := saving() || *baseline != ""
+	// The offset of /etc/rc.local is the same in the copy.
+	var rcLocal int64
+	hasRcLocal := false
+	if *imageURL == "" {
+		if rcLocal, hasRcLocal, err = img.FindRcLocal(imgpath, *rootPart); err != nil {
+			return err
+		}
+		needsCopy = needsCopy || hasRcLocal
+	}
+	imgmod := imgpath
+	// imgSum is the hash of the image when it is copied, for -manifest.
+	imgSum := ""
+	modified := false
+	if needsCopy {
+		e := filepath.Ext(imgpath)
+		imgmod = imgpath[:len(imgpath)-len(e)] + "-mod" + e
+		if *saveImg != "" {
+			// Edit the copy in place so it doesn't need to be moved.
+			imgmod = *saveImg
+		} else if *modOut != "" {
+			imgmod = *modOut
+		}
+		if filepath.Clean(imgmod) == filepath.Clean(imgpath) {
+			return fmt.Errorf("the modified image can't overwrite %s", imgpath)
+		}
+		if err = checkCopySpace(imgmod, imgpath); err != nil {
+			return err
+		}
+		if imgSum, err = copyFileSum(imgmod, imgpath, 0o666); err != nil {
+			return err
+		}
+		if hasRcLocal {
+			if err = modifyEXT4(imgmod, *rootPart, rcLocal); err != nil {
+				return err
+			}
+			modified = true
+		}
+	}
+	if *bmapPath == "" && *baseline == "" && *imageURL == "" && !saving() {
+		// The copy is named differently, so look next to the original image.
+		// Editing /etc/rc.local in place doesn't change which blocks are used.
+		if *bmapPath = img.FindBmap(imgpath); *bmapPath != "" {
+			img.Progressf("- Using the block map %s\n", *bmapPath)
+		}
+	}
+	firstBoot := ""
+	if !modified && runtime.GOOS == "linux" {
+		// Recent distros do not have a /etc/rc.local file. EXT4 can only be
+		// mounted on Linux.
+		img.Progressf("- No /etc/rc.local found; firstboot.service will be installed instead\n")
+		installUnit = true
+	} else if !modified {
+		firstBoot = "/boot/firstboot.sh" + firstBootArgs()
+		fmt.Printf("Couldn't modified the image to setup automatically on boot.\n")
+		fmt.Printf("You will have to ssh in and run:\n")
+		fmt.Printf("  /boot/firstboot.sh%s\n", firstBootArgs())
+	}
+	hosts := []string{*hostname}
+	if *hostPrefix != "" {
+		var used func(string) bool
+		if *hostProbe {
+			used = func(h string) bool { return hostnameInUse(ctx, h) }
+		}
+		n := len(cards)
+		if saving() {
+			n = 1
+		}
+		if hosts, err = prefixHostnames(*hostPrefix, n, used); err != nil {
+			return err
+		}
+		if !saving() {
+			for i, c := range cards {
+				fmt.Printf("- %s: %s\n", c, hosts[i])
+			}
+		}
+	}
+	if !saving() {
+		fmt.Printf("Warning! This will blow up everything in %s\n\n", strings.Join(cards, ", "))
+		if runtime.GOOS != "windows" {
+			fmt.Printf("This script has minimal use of 'sudo' for 'dd' to format the SDCard\n\n")
+		}
+		if *hostPrefix == "" {
+			hosts = make([]string, len(cards))
+			for i := range cards {
+				hosts[i] = cardHostname(*hostname, i, len(cards))
+			}
+		}
+	}
+	// The devices provisioned successfully and their hostname, for -manifest.
+	var doneDevices, doneHosts []string
+	switch {
+	case saving():
+		// The image is attached as a loop device and edited in place.
+		err = editCard(ctx, imgmod, hosts[0])
+		if err == nil && *saveXZ != "" {
+			err = img.Compress(ctx, imgmod, *saveXZ, compression)
+		}
+		if err == nil {
+			doneDevices, doneHosts = []string{savedPath()}, hosts
+		}
+	case *imageURL != "":
+		if imgSum, err = flashCardURL(ctx, *imageURL, cards[0], hosts[0]); err == nil {
+			doneDevices, doneHosts = cards, hosts
+		}
+	case len(cards) == 1:
+		if err = flashCard(ctx, imgmod, cards[0], hosts[0]); err == nil {
+			doneDevices, doneHosts = cards, hosts
+		}
+	default:
+		if *parallel > 1 {
+			// Prompt for the password once instead of once per dd, and only
+			// report when each card starts and ends since the dd progress of
+			// each card would overwrite the others.
+			if err = img.CacheSudo(&opts); err != nil {
+				break
+			}
+			opts.NoDDProgress = true
+		}
+		errs := flashCards(cards, *parallel, func(i int, card string) error {
+			return flashCard(ctx, imgmod, card, hosts[i])
+		})
+		failed := 0
+		for i, c := range cards {
+			suffix := ""
+			if hosts[i] != "" {
+				suffix = " as " + hosts[i]
+			}
+			if errs[i] != nil {
+				failed++
+				fmt.Printf("- %s%s: failed: %v\n", c, suffix, errs[i])
+			} else {
+				fmt.Printf("- %s%s: done\n", c, suffix)
+				doneDevices = append(doneDevices, c)
+				doneHosts = append(doneHosts, hosts[i])
+			}
+		}
+		if failed != 0 {
+			err = fmt.Errorf("%d out of %d SDCards failed", failed, len(cards))
+		}
+	}
+	if *manifest != "" && len(doneDevices) != 0 {
+		// Record the cards that succeeded even if others failed.
+		if err2 := appendManifest(*manifest, imgpath, imgSum, doneDevices, doneHosts); err == nil {
+			err = err2
+		}
+	}
+	if *imageURL == "" {
+		// Never delete a raw local image; it is the user's file.
+		isUserFile := *localImage != "" && !strings.HasSuffix(*localImage, ".xz")
+		cleanupImages(imgpath, imgmod, *keepImage || isUserFile, *keepMod || *saveImg != "")
 	}
-	if err = img.Umount(*sdCard); err != nil {
+	if err != nil {
 		return err
 	}
 
-	fmt.Printf("\nYou can now remove the SDCard safely and boot your micro computer\n")
-	fmt.Printf("Connect with:\n")
-	fmt.Printf("  ssh -o StrictHostKeyChecking=no %s@%s\n\n", image.DefaultUser(), image.DefaultHostname())
+	host := image.DefaultHostname()
+	if hosts[0] != "" {
+		// With multiple cards, each one has its own hostname as printed above;
+		// use the first one as the example.
+		host = hosts[0]
+	}
+	target := host
+	if *staticIP != "" {
+		ip, _, _ := net.ParseCIDR(*staticIP)
+		target = ip.String()
+	}
+	knownHosts := ""
+	if len(hostKeyPub) != 0 {
+		if *sshPort != 22 {
+			// known_hosts lists the hosts on a non default port as [host]:port.
+			knownHosts = fmt.Sprintf("[%s]:%d %s", target, *sshPort, strings.TrimSpace(string(hostKeyPub)))
+		} else {
+			knownHosts = target + " " + strings.TrimSpace(string(hostKeyPub))
+		}
+	}
+	portArg := ""
+	if *sshPort != 22 {
+		portArg = "-p " + strconv.Itoa(*sshPort) + " "
+	}
+	if stdout != nil {
+		s := summary{
+			Image:       imgpath,
+			Board:       string(image.Board),
+			Distro:      string(image.Distro),
+			Device:      strings.Join(cards, ","),
+			Hostname:    host,
+			DefaultUser: loginUser(),
+			Wifi:        *wifiSSID != "" || *wpaConf != "",
+			FirstBoot:   firstBoot,
+			KnownHosts:  knownHosts,
+			XZ:          *saveXZ,
+			Img:         *saveImg,
+			Files:       written.Files(),
+		}
+		if generatedPassword {
+			s.Password = userPassword
+		}
+		if hosts[0] != "" {
+			s.Hostname = strings.Join(hosts, ",")
+		}
+		if fetched != nil {
+			s.URL = fetched.URL
+			s.Date = fetched.Date
+		}
+		e := json.NewEncoder(stdout)
+		e.SetIndent("", "  ")
+		return e.Encode(&s)
+	}
+	verb := "Flashed"
+	if saving() {
+		verb = "Provisioned"
+	}
+	if fetched != nil {
+		if fetched.Date != "" {
+			fmt.Printf("\n%s %s %s from %s\n", verb, image.Distro, fetched.Date, fetched.URL)
+		} else {
+			fmt.Printf("\n%s %s from %s\n", verb, image.Distro, fetched.URL)
+		}
+	}
+	if saving() {
+		fmt.Printf("\nThe image was saved to %s; flash it to a SDCard and boot your micro computer\n", savedPath())
+	} else {
+		fmt.Printf("\nYou can now remove the SDCard safely and boot your micro computer\n")
+	}
+	if knownHosts != "" {
+		fmt.Printf("Add the device's host key to ~/.ssh/known_hosts:\n")
+		fmt.Printf("  %s\n", knownHosts)
+		fmt.Printf("Then connect with:\n")
+		fmt.Printf("  ssh %s%s@%s\n\n", portArg, loginUser(), target)
+	} else {
+		fmt.Printf("Connect with:\n")
+		fmt.Printf("  ssh %s-o StrictHostKeyChecking=no %s@%s\n\n", portArg, loginUser(), target)
+	}
+	if generatedPassword {
+		// It is not stored anywhere, so this is the only chance to see it.
+		fmt.Printf("The password of %s is:\n", loginUser())
+		fmt.Printf("  %s\n", userPassword)
+		fmt.Printf("Save it now; it is not printed again.\n\n")
+	} else if userPassword != "" {
+		fmt.Printf("Log in as %s with the password passed to -password.\n\n", loginUser())
+	}
 	fmt.Printf("You can follow the update process by either:\n")
 	fmt.Printf("- connecting a monitor\n")
 	fmt.Printf("- connecting to the serial port\n")
 	fmt.Printf("- ssh'ing into the device and running:\n")
-	fmt.Printf("    tail -f /var/log/firstboot.log\n")
+	fmt.Printf("    tail -f %s\n", *firstBootLog)
+	if *bootStatus {
+		fmt.Printf("Once done, verify the setup succeeded with:\n")
+		checkPort := ""
+		if *sshPort != 22 {
+			checkPort = "-port " + strconv.Itoa(*sshPort) + " "
+		}
+		fmt.Printf("  check-setup %s-host %s@%s\n", checkPort, loginUser(), target)
+	}
 	return nil
 }
 
 func main() {
-	if err := mainImpl(); err != nil {
+	// On Ctrl-C, stop fetching or flashing cleanly instead of leaving a partial
+	// image or unflushed writes behind. A second Ctrl-C kills the process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	context.AfterFunc(ctx, stop)
+	err := mainImpl(ctx)
+	stop()
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintf(os.Stderr, "\nefe: aborted.\n")
+		os.Exit(1)
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "\nefe: %s.\n", err)
 		os.Exit(1)
 	}
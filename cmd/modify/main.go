@@ -0,0 +1,269 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// modify edits an image file so it self-configures upon first boot, without
+// flashing a SDCard.
+//
+// Unlike efe -save-img, it doesn't mount anything: the boot partition is
+// edited with img.BootEditor and /etc/rc.local is overwritten in place, so it
+// needs neither root nor network access. This limits it to the images that
+// still have /etc/rc.local.
+package main // import "periph.io/x/bootstrap/cmd/modify"
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	// Embed the time zone database to validate -time even on Windows.
+	_ "time/tzdata"
+
+	"periph.io/x/bootstrap/img"
+)
+
+// firstBootLog is where /etc/rc.local logs the output of firstboot.sh.
+const firstBootLog = "/var/log/firstboot.log"
+
+// uartConfigTxt is the part to append to config.txt to enable the console on
+// UART on a Raspberry Pi.
+const uartConfigTxt = "\n\n# Enable console on UART\nenable_uart=1\n"
+
+// shellQuote quotes s for a POSIX shell, if needed.
+func shellQuote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"'\\$&|;<>()*?[]#~`") {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+	return s
+}
+
+// copyFile copies the file src to dst.
+func copyFile(src, dst string) error {
+	/* #nosec G304 */
+	fs, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	/* #nosec G307 */
+	defer fs.Close()
+	/* #nosec G302 G304 */
+	fd, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(fd, fs); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// isRaspiOS returns true if the boot partition is the one of RaspiOS, which
+// records how it was built in issue.txt.
+func isRaspiOS(boot *img.BootEditor) bool {
+	b, _ := boot.ReadFile("issue.txt")
+	return strings.Contains(string(b), "pi-gen")
+}
+
+// checkFlags validates the flags that don't need any file access.
+func checkFlags(imgPath, out string, bootPart, rootPart int, tz string) error {
+	if imgPath == "" {
+		return errors.New("-img is required")
+	}
+	if !strings.HasSuffix(imgPath, ".img") && !strings.HasSuffix(imgPath, ".img.xz") {
+		return errors.New("-img must be a .img or .img.xz file")
+	}
+	if out != "" && !strings.HasSuffix(out, ".img") {
+		return errors.New("-o must end with .img")
+	}
+	if bootPart < 1 || rootPart < 1 || bootPart == rootPart {
+		return errors.New("-boot-part and -root-part must be different partition numbers, 1 or higher")
+	}
+	if _, err := time.LoadLocation(tz); err != nil {
+		return fmt.Errorf("invalid -time: %w", err)
+	}
+	return nil
+}
+
+// checkWifi validates the Wifi flags; the others are only valid with an SSID.
+func checkWifi(w *img.WifiNetwork) error {
+	if w.SSID != "" {
+		return w.Check()
+	}
+	if w.Pass != "" || w.Country != "" {
+		return errors.New("-wifi-country and -wifi-pass require -wifi-ssid")
+	}
+	return nil
+}
+
+// prepareImage returns the absolute path of the image to edit.
+//
+// An .img.xz is decompressed in the current directory. When out is set, the
+// image is copied there first so imgPath is left untouched.
+func prepareImage(imgPath, out string) (string, error) {
+	p, err := img.LocalImage(context.Background(), imgPath, nil)
+	if err != nil {
+		return "", err
+	}
+	if out == "" {
+		return p, nil
+	}
+	dst, err := filepath.Abs(out)
+	if err != nil {
+		return "", err
+	}
+	if dst != p {
+		img.Progressf("- Copying %s to %s\n", p, dst)
+		if err = copyFile(p, dst); err != nil {
+			return "", err
+		}
+	}
+	return dst, nil
+}
+
+func mainImpl() error {
+	imgPath := flag.String("img", "", "Image to modify, either .img or .img.xz")
+	out := flag.String("o", "", "Write the modified image to this .img file instead of editing -img in place; an .img.xz is decompressed in the current directory by default")
+	bootPart := flag.Int("boot-part", 1, "Partition number of the FAT boot partition")
+	rootPart := flag.Int("root-part", 2, "Partition number of the EXT4 root partition")
+	sshKey := flag.String("ssh-key", img.FindPublicKey(), "SSH public key to authorize")
+	wifiCountry := flag.String("wifi-country", "", "Country setting for Wifi; affect usable bands")
+	wifiSSID := flag.String("wifi-ssid", "", "SSID of the Wifi network to connect to")
+	wifiPass := flag.String("wifi-pass", "", "Password of the Wifi network")
+	timeLocation := flag.String("time", img.GetTimeLocation(), "Location to use to define time")
+	forceUART := flag.Bool("forceuart", false, "Enable console on UART; only supported on RaspiOS")
+	verbose := flag.Bool("v", false, "log verbosely to stderr")
+	debug := flag.Bool("vv", false, "log very verbosely to stderr, including the commands run")
+	quiet := flag.Bool("q", false, "only print errors")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: modify -img <path> [flags]\n\nEdits an image file so it self-configures upon first boot, without flashing it.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	l, err := img.LevelFromFlags(*quiet, *verbose, *debug)
+	if err != nil {
+		return err
+	}
+	img.SetLevel(l)
+	if flag.NArg() != 0 {
+		return errors.New("unexpected argument")
+	}
+	if err = checkFlags(*imgPath, *out, *bootPart, *rootPart, *timeLocation); err != nil {
+		return err
+	}
+	var keys []byte
+	if *sshKey != "" {
+		/* #nosec G304 */
+		if keys, err = os.ReadFile(*sshKey); err != nil {
+			return err
+		}
+	}
+	w := img.WifiNetwork{SSID: *wifiSSID, Pass: *wifiPass, Country: *wifiCountry}
+	if err = checkWifi(&w); err != nil {
+		return err
+	}
+
+	p, err := prepareImage(*imgPath, *out)
+	if err != nil {
+		return err
+	}
+	// Check before touching the boot partition so a refused image is left as
+	// is.
+	rcLocal, ok, err := img.FindRcLocal(p, *rootPart)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%s has no /etc/rc.local to edit; use efe -local-image %s -save-img <path> instead, which mounts the root partition", p, *imgPath)
+	}
+
+	img.Progressf("- Modifying image %s\n", p)
+	/* #nosec G304 */
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = modify(f, *bootPart, *rootPart, rcLocal, keys, &w, *timeLocation, *forceUART)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nThe image was saved to %s; flash it to a SDCard and boot your micro computer\n", p)
+	return nil
+}
+
+// modify writes firstboot.sh and its configuration in the boot partition of
+// the image f and edits /etc/rc.local at offset rcLocal in its root partition
+// to run it.
+func modify(f *os.File, bootPart, rootPart int, rcLocal int64, keys []byte, w *img.WifiNetwork, tz string, forceUART bool) error {
+	l, err := img.Partitions(f, bootPart, rootPart)
+	if err != nil {
+		return err
+	}
+	boot, err := img.NewBootEditor(img.NewFileDisk(f, l.Boot.Offset, l.Boot.Size))
+	if err != nil {
+		return err
+	}
+	raspiOS := isRaspiOS(boot)
+	if forceUART && !raspiOS {
+		return errors.New("-forceuart is only supported on RaspiOS")
+	}
+	setupSH, err := img.GetSetupSH(context.Background(), false, nil)
+	if err != nil {
+		return err
+	}
+	if err = boot.WriteFile("firstboot.sh", setupSH); err != nil {
+		return err
+	}
+	args := " -t " + shellQuote(tz)
+	if len(keys) != 0 {
+		img.Progressf("- Writing authorized_keys\n")
+		if err = boot.WriteFile("authorized_keys", keys); err != nil {
+			return err
+		}
+		args += " -sk /boot/authorized_keys"
+		if raspiOS {
+			// Enables sshd.
+			if err = boot.WriteFile("ssh", nil); err != nil {
+				return err
+			}
+		}
+	}
+	if w.SSID != "" {
+		if raspiOS {
+			// The hashed key keeps the passphrase off the SDCard.
+			img.Progressf("- Writing wpa_supplicant.conf for %s\n", w.SSID)
+			if err = boot.WriteFile("wpa_supplicant.conf", []byte(w.WPASupplicant())); err != nil {
+				return err
+			}
+		} else {
+			for _, a := range w.SetupArgs() {
+				args += " " + shellQuote(a)
+			}
+		}
+	}
+	if forceUART {
+		img.Progressf("- Enabling console on UART\n")
+		if err = boot.AppendFile("config.txt", []byte(uartConfigTxt)); err != nil {
+			return err
+		}
+	}
+	// Read by /etc/rc.local, then deleted by setup.sh.
+	if err = boot.WriteFile(img.FirstBootArgs, []byte(strings.TrimSpace(args)+"\n")); err != nil {
+		return err
+	}
+	return img.EditRcLocal(f, rootPart, rcLocal, firstBootLog, nil)
+}
+
+func main() {
+	if err := mainImpl(); err != nil {
+		fmt.Fprintf(os.Stderr, "modify: %s.\n", err)
+		os.Exit(1)
+	}
+}
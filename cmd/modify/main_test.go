@@ -0,0 +1,183 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+	"periph.io/x/bootstrap/img"
+)
+
+func TestCheckFlags(t *testing.T) {
+	data := []struct {
+		imgPath  string
+		out      string
+		bootPart int
+		rootPart int
+		tz       string
+		err      string
+	}{
+		{"a.img", "", 1, 2, "UTC", ""},
+		{"a.img.xz", "b.img", 1, 2, "America/Toronto", ""},
+		{"a.img", "", 2, 1, "", ""},
+		{"", "", 1, 2, "UTC", "-img is required"},
+		{"a.zip", "", 1, 2, "UTC", "-img must be a .img or .img.xz file"},
+		{"a.xz", "", 1, 2, "UTC", "-img must be a .img or .img.xz file"},
+		{"a.img", "b.img.xz", 1, 2, "UTC", "-o must end with .img"},
+		{"a.img", "b", 1, 2, "UTC", "-o must end with .img"},
+		{"a.img", "", 0, 2, "UTC", "-boot-part and -root-part"},
+		{"a.img", "", 1, 0, "UTC", "-boot-part and -root-part"},
+		{"a.img", "", 2, 2, "UTC", "-boot-part and -root-part"},
+		{"a.img", "", 1, 2, "Nowhere/Atlantis", "invalid -time"},
+	}
+	for i, line := range data {
+		err := checkFlags(line.imgPath, line.out, line.bootPart, line.rootPart, line.tz)
+		if line.err == "" {
+			if err != nil {
+				t.Fatalf("%d: %v", i, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), line.err) {
+			t.Fatalf("%d: expected %q, got %v", i, line.err, err)
+		}
+	}
+}
+
+func TestCheckWifi(t *testing.T) {
+	data := []struct {
+		w  img.WifiNetwork
+		ok bool
+	}{
+		{img.WifiNetwork{}, true},
+		{img.WifiNetwork{SSID: "home", Pass: "password123", Country: "CA"}, true},
+		{img.WifiNetwork{Pass: "password123"}, false},
+		{img.WifiNetwork{Country: "CA"}, false},
+		{img.WifiNetwork{SSID: "home", Pass: "short"}, false},
+		{img.WifiNetwork{SSID: "home", Pass: "password123", Country: "Canada"}, false},
+	}
+	for i, line := range data {
+		if err := checkWifi(&line.w); (err == nil) != line.ok {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+}
+
+func TestPrepareImage_InPlace(t *testing.T) {
+	d := t.TempDir()
+	src := filepath.Join(d, "a.img")
+	if err := os.WriteFile(src, []byte("image"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := prepareImage(src, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != src {
+		t.Fatalf("expected %s, got %s", src, p)
+	}
+	// Passing the same path as -o edits in place too.
+	if p, err = prepareImage(src, src); err != nil {
+		t.Fatal(err)
+	}
+	if p != src {
+		t.Fatalf("expected %s, got %s", src, p)
+	}
+	checkContent(t, src, "image")
+}
+
+func TestPrepareImage_Out(t *testing.T) {
+	d := t.TempDir()
+	src := filepath.Join(d, "a.img")
+	if err := os.WriteFile(src, []byte("image"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(d, "b.img")
+	p, err := prepareImage(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != dst {
+		t.Fatalf("expected %s, got %s", dst, p)
+	}
+	checkContent(t, dst, "image")
+	// Editing the copy must not affect the original.
+	if err = os.WriteFile(dst, []byte("edited"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, src, "image")
+}
+
+func TestPrepareImage_XZ(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := t.TempDir()
+	if err = os.Chdir(d); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Error(err)
+		}
+	}()
+	src := filepath.Join(t.TempDir(), "a.img.xz")
+	var buf bytes.Buffer
+	xw, err := xz.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = xw.Write([]byte("image")); err != nil {
+		t.Fatal(err)
+	}
+	if err = xw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(src, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without -o, the image is decompressed in the current directory.
+	p, err := prepareImage(src, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(d, "a.img"); p != want {
+		t.Fatalf("expected %s, got %s", want, p)
+	}
+	checkContent(t, p, "image")
+
+	// With -o, the decompressed image is copied there.
+	dst := filepath.Join(t.TempDir(), "b.img")
+	if p, err = prepareImage(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if p != dst {
+		t.Fatalf("expected %s, got %s", dst, p)
+	}
+	checkContent(t, dst, "image")
+}
+
+func TestPrepareImage_Missing(t *testing.T) {
+	if _, err := prepareImage(filepath.Join(t.TempDir(), "a.img"), ""); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func checkContent(t *testing.T, p, want string) {
+	t.Helper()
+	/* #nosec G304 */
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != want {
+		t.Fatalf("%s: expected %q, got %q", p, want, b)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// provision flashes a SDCard with efe, waits for the device to complete its
+// first boot setup with check-setup, then pushes executables to it with push.
+//
+// It runs the efe, check-setup and push executables, so they must be
+// installed next to it or in PATH.
+package main // import "periph.io/x/bootstrap/cmd/provision"
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"periph.io/x/bootstrap/img"
+)
+
+// splitArgs splits args at the first "--" into the efe arguments and the push
+// arguments.
+func splitArgs(args []string) ([]string, []string, error) {
+	for i, a := range args {
+		if a == "--" {
+			return args[:i], args[i+1:], nil
+		}
+	}
+	return nil, nil, errors.New("expected efe flags and push arguments separated by --")
+}
+
+// hasFlag returns true if the flag name is set in args, except to false.
+func hasFlag(args []string, name string) bool {
+	for _, a := range args {
+		// Both -name and --name are accepted by the flag package.
+		if strings.HasPrefix(a, "--") {
+			a = a[1:]
+		}
+		if a == "-"+name || (strings.HasPrefix(a, "-"+name+"=") && a != "-"+name+"=false") {
+			return true
+		}
+	}
+	return false
+}
+
+// flagValue returns the value of the last occurrence of the flag name in
+// args, as -name=value or -name value.
+func flagValue(args []string, name string) (string, bool) {
+	v, found := "", false
+	for i, a := range args {
+		if strings.HasPrefix(a, "--") {
+			a = a[1:]
+		}
+		if strings.HasPrefix(a, "-"+name+"=") {
+			v, found = a[len(name)+2:], true
+		} else if a == "-"+name && i+1 < len(args) {
+			v, found = args[i+1], true
+		}
+	}
+	return v, found
+}
+
+// commands returns the command lines to run, in order.
+//
+// efe always writes the status file so check-setup can tell when the setup is
+// done. The -ssh-port passed to efe is forwarded to check-setup and push.
+func commands(efeArgs, pushArgs []string, host string, wait time.Duration) [][]string {
+	efe := append([]string{"efe"}, efeArgs...)
+	if !hasFlag(efeArgs, "firstboot-status") {
+		efe = append(efe, "-firstboot-status")
+	}
+	check := []string{"check-setup", "-host", host, "-wait", wait.String()}
+	push := []string{"push", "-host", host}
+	if port, ok := flagValue(efeArgs, "ssh-port"); ok {
+		check = append(check, "-port", port)
+		push = append(push, "-port", port)
+	}
+	return [][]string{efe, check, append(push, pushArgs...)}
+}
+
+// lookTool returns the path of the executable name, preferring the one next
+// to provision.
+func lookTool(name string) (string, error) {
+	if exe, err := os.Executable(); err == nil {
+		p := filepath.Join(filepath.Dir(exe), name)
+		if filepath.Ext(exe) == ".exe" {
+			p += ".exe"
+		}
+		if _, err = os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	p, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("%s not found; install it with: go install periph.io/x/bootstrap/cmd/%s@latest", name, name)
+	}
+	return p, nil
+}
+
+// run runs the command line c, connected to the terminal since efe may ask
+// for confirmation.
+func run(c []string) error {
+	log.Printf("running %s", strings.Join(c, " "))
+	/* #nosec G204 */
+	cmd := exec.Command(c[0], c[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w", filepath.Base(c[0]), err)
+	}
+	return nil
+}
+
+func mainImpl() error {
+	host := flag.String("host", os.Getenv("PUSH_HOST"), "Device to wait for and push to, e.g. pi@raspberrypi; defaults to content of environment variable PUSH_HOST")
+	wait := flag.Duration("wait", 30*time.Minute, "Time to wait for the first boot setup to complete")
+	dry := flag.Bool("dry-run", false, "print the commands instead of running them")
+	verbose := flag.Bool("v", false, "log verbosely to stderr, including the commands run")
+	debug := flag.Bool("vv", false, "log very verbosely to stderr")
+	quiet := flag.Bool("q", false, "only print errors")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: provision [flags] -- [efe flags] -- [push flags] [packages]\n\nFlashes a SDCard with efe, waits for the device to boot and complete its\nsetup with check-setup, then pushes the packages to it with push.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	l, err := img.LevelFromFlags(*quiet, *verbose, *debug)
+	if err != nil {
+		return err
+	}
+	img.SetLevel(l)
+	efeArgs, pushArgs, err := splitArgs(flag.Args())
+	if err != nil {
+		return err
+	}
+	if *host == "" {
+		return errors.New("-host is required")
+	}
+	if *wait <= 0 {
+		return errors.New("-wait must be positive")
+	}
+	if hasFlag(pushArgs, "host") {
+		return errors.New("specify -host before the first --, it is used for both check-setup and push")
+	}
+	if _, ok := flagValue(efeArgs, "ssh-port"); ok && hasFlag(pushArgs, "port") {
+		return errors.New("don't specify -port to push, the efe -ssh-port is used for both check-setup and push")
+	}
+	cmds := commands(efeArgs, pushArgs, *host, *wait)
+	if *dry {
+		for _, c := range cmds {
+			fmt.Println(strings.Join(c, " "))
+		}
+		return nil
+	}
+	for _, c := range cmds {
+		if c[0], err = lookTool(c[0]); err != nil {
+			return err
+		}
+	}
+	img.Progressf("- Flashing\n")
+	if err = run(cmds[0]); err != nil {
+		return err
+	}
+	img.Progressf("- Insert the SDCard into the device and power it on\n")
+	img.Progressf("- Waiting up to %s for %s to complete its setup\n", *wait, *host)
+	if err = run(cmds[1]); err != nil {
+		return err
+	}
+	img.Progressf("- Pushing to %s\n", *host)
+	return run(cmds[2])
+}
+
+func main() {
+	if err := mainImpl(); err != nil {
+		fmt.Fprintf(os.Stderr, "provision: %s.\n", err)
+		os.Exit(1)
+	}
+}
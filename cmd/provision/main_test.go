@@ -0,0 +1,93 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitArgs(t *testing.T) {
+	efe, push, err := splitArgs([]string{"-manufacturer", "raspberrypi", "--", "-rel", "bin", "./cmd/..."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(efe, []string{"-manufacturer", "raspberrypi"}) {
+		t.Fatal(efe)
+	}
+	if !reflect.DeepEqual(push, []string{"-rel", "bin", "./cmd/..."}) {
+		t.Fatal(push)
+	}
+	if _, _, err = splitArgs([]string{"-manufacturer", "raspberrypi"}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestHasFlag(t *testing.T) {
+	data := []struct {
+		args     []string
+		expected bool
+	}{
+		{nil, false},
+		{[]string{"-firstboot-status"}, true},
+		{[]string{"--firstboot-status"}, true},
+		{[]string{"-firstboot-status=true"}, true},
+		{[]string{"-firstboot-status=false"}, false},
+		{[]string{"-firstboot-status-file"}, false},
+		{[]string{"-v", "firstboot-status"}, false},
+	}
+	for i, l := range data {
+		if got := hasFlag(l.args, "firstboot-status"); got != l.expected {
+			t.Fatalf("%d: %t", i, got)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	got := commands([]string{"-manufacturer", "raspberrypi"}, []string{"."}, "pi@raspberrypi", 30*time.Minute)
+	expected := [][]string{
+		{"efe", "-manufacturer", "raspberrypi", "-firstboot-status"},
+		{"check-setup", "-host", "pi@raspberrypi", "-wait", "30m0s"},
+		{"push", "-host", "pi@raspberrypi", "."},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatal(got)
+	}
+	got = commands([]string{"-firstboot-status"}, nil, "pi@raspberrypi", time.Minute)
+	if !reflect.DeepEqual(got[0], []string{"efe", "-firstboot-status"}) {
+		t.Fatal(got[0])
+	}
+	// -ssh-port is forwarded.
+	got = commands([]string{"-ssh-port", "2222"}, []string{"."}, "pi@raspberrypi", time.Minute)
+	expected = [][]string{
+		{"efe", "-ssh-port", "2222", "-firstboot-status"},
+		{"check-setup", "-host", "pi@raspberrypi", "-wait", "1m0s", "-port", "2222"},
+		{"push", "-host", "pi@raspberrypi", "-port", "2222", "."},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatal(got)
+	}
+}
+
+func TestFlagValue(t *testing.T) {
+	data := []struct {
+		args  []string
+		value string
+		found bool
+	}{
+		{nil, "", false},
+		{[]string{"-ssh-port", "2222"}, "2222", true},
+		{[]string{"--ssh-port=2222"}, "2222", true},
+		{[]string{"-ssh-port=22", "-ssh-port=2222"}, "2222", true},
+		{[]string{"-ssh-port"}, "", false},
+		{[]string{"-ssh-port-x=1"}, "", false},
+	}
+	for i, l := range data {
+		if v, found := flagValue(l.args, "ssh-port"); v != l.value || found != l.found {
+			t.Fatalf("%d: %q %t", i, v, found)
+		}
+	}
+}
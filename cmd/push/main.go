@@ -7,18 +7,27 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"log"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"periph.io/x/bootstrap/img"
 )
 
 // run is a shorthand for exec.Command().Run().
@@ -35,12 +44,17 @@ const (
 	none tool = iota
 	rsyncProgress
 	rsyncOld
+	// rsyncLegacy is rsync before 3.0, without --protect-args.
+	rsyncLegacy
 	pscp
 	scp
+	// scpLegacy is scp from OpenSSH before 9.0, which uses the SCP protocol
+	// where the remote shell interprets the destination path.
+	scpLegacy
 )
-const toolName = "nonersyncrsyncpscpscp"
+const toolName = "nonersyncrsyncrsyncpscpscpscp"
 
-var toolIndex = [...]uint8{0, 4, 9, 14, 18, 21}
+var toolIndex = [...]uint8{0, 4, 9, 14, 19, 23, 26, 29}
 
 func (t tool) String() string {
 	if t < 0 || t >= tool(len(toolIndex)-1) {
@@ -49,145 +63,566 @@ func (t tool) String() string {
 	return toolName[toolIndex[t]:toolIndex[t+1]]
 }
 
-func (t tool) push(verbose bool, src string, pkgs []string, host, rel string) error {
-	dst := fmt.Sprintf("%s:%s", host, rel)
+// exeName returns the name of the executable built for pkg.
+func exeName(goos, pkg string) string {
+	if goos == "windows" {
+		return filepath.Base(pkg) + ".exe"
+	}
+	return filepath.Base(pkg)
+}
+
+// isRsync returns true for all the versions of rsync.
+func (t tool) isRsync() bool {
+	return t == rsyncProgress || t == rsyncOld || t == rsyncLegacy
+}
+
+// ssh returns the tool to run a command on the remote host with.
+func (t tool) ssh() string {
+	if t == pscp {
+		return "plink"
+	}
+	return "ssh"
+}
+
+// portArgs returns the arguments of the command name, either a tool or an ssh
+// client, to connect to the ssh port of the remote host. It is empty for the
+// default port 22.
+func portArgs(name string, port int) []string {
+	if port == 22 {
+		return nil
+	}
+	p := strconv.Itoa(port)
+	switch name {
+	case "ssh":
+		return []string{"-p", p}
+	case "rsync":
+		return []string{"-e", "ssh -p " + p}
+	default:
+		// plink, pscp and scp.
+		return []string{"-P", p}
+	}
+}
+
+// commands returns the command lines to push the executables of pkgs in src
+// to rel on host, listening for ssh on port.
+//
+// rel is never interpreted by the remote shell: it is passed as is, or quoted
+// for the tools that let the remote shell parse it.
+//
+// With del, the files in rel that are not one of the executables are deleted.
+// The executables matching one of excludes are not pushed. Both are only
+// supported with rsync.
+func (t tool) commands(verbose, del bool, excludes []string, src, goos string, pkgs []string, host string, port int, rel string) ([][]string, error) {
+	remote := func(p string) string {
+		if t == rsyncLegacy || t == scpLegacy {
+			p = shellQuote(p)
+		}
+		return host + ":" + p
+	}
+	dst := remote(rel)
 	var args []string
 	switch t {
-	case rsyncProgress:
+	case rsyncProgress, rsyncOld, rsyncLegacy:
 		// Push all files via rsync. This is the fastest method.
-		args = []string{"--archive", "--info=progress2", "--compress", src + "/", dst}
-		if verbose {
-			args = append([]string{"-v"}, args...)
+		//
+		// List the files explicitly as src may be a cache directory containing
+		// other files. --protect-args prevents the remote shell from splitting
+		// rel on spaces; it is the default since rsync 3.2.4 and doesn't exist
+		// before 3.0, where rel is quoted instead.
+		args = []string{"--archive", "--info=progress2", "--compress"}
+		if t != rsyncProgress {
+			args[1] = "--progress"
+		}
+		if t != rsyncLegacy {
+			args = append(args, "--protect-args")
+		}
+		args = append(args, portArgs(t.String(), port)...)
+		// The first matching rule wins, so the excludes must be first.
+		for _, e := range excludes {
+			args = append(args, "--exclude="+e)
+		}
+		if del {
+			// Mirror the whole directory but filter on the executables, so the
+			// other files in src are ignored and the other files in rel are
+			// deleted.
+			args = append(args, "--delete", "--delete-excluded")
+			for _, pkg := range pkgs {
+				args = append(args, "--include=/"+exeName(goos, pkg))
+			}
+			args = append(args, "--exclude=*", src+"/", remote(strings.TrimSuffix(rel, "/")+"/"))
+		} else {
+			for _, pkg := range pkgs {
+				args = append(args, filepath.Join(src, exeName(goos, pkg)))
+			}
+			args = append(args, dst)
 		}
-	case rsyncOld:
-		// Push all files via rsync. This is the fastest method.
-		args = []string{"--archive", "--progress", "--compress", src + "/", dst}
 		if verbose {
 			args = append([]string{"-v"}, args...)
 		}
-	case pscp, scp:
+	case pscp, scp, scpLegacy:
+		if del {
+			return nil, fmt.Errorf("%s doesn't support deleting files", t)
+		}
+		if len(excludes) != 0 {
+			return nil, fmt.Errorf("%s doesn't support excluding files", t)
+		}
 		// Push all files via pscp/scp, provided by PuTTY/OpenSSH.
 		//
 		// It is slower than rsync and will fail if one of the destination
-		// executable is under use, but it is a reasonable fallback.
+		// executable is under use, but it is a reasonable fallback. Both use the
+		// SFTP protocol by default, which doesn't interpret rel, unlike the
+		// legacy SCP protocol of OpenSSH before 9.0 where rel is quoted.
 		// TODO(maruel): pscp/scp with an alternate name, then plink/ssh in to
 		// rename the files.
-		args = []string{"-C", "-p", "-r"}
+		args = append([]string{"-C", "-p", "-r"}, portArgs(t.String(), port)...)
 		for _, pkg := range pkgs {
-			args = append(args, filepath.Join(src, filepath.Base(pkg)))
+			args = append(args, filepath.Join(src, exeName(goos, pkg)))
 		}
 		if verbose {
 			args = append([]string{"-v"}, args...)
 		}
 		args = append(args, dst)
 	default:
-		return errors.New("please make sure at least one of rsync, scp or pscp is in PATH")
-	}
-	if err := run(t.String(), args...); err != nil {
-		return err
+		return nil, errors.New("please make sure at least one of rsync, scp or pscp is in PATH")
 	}
-	if runtime.GOOS == "windows" {
+	out := [][]string{append([]string{t.String()}, args...)}
+	if runtime.GOOS == "windows" && goos != "windows" {
 		// On Windows, the +x bit is lost, so we are required to ssh in to change
-		// the file mode.
-		args = []string{host, "chmod", "+x"}
-		for _, pkg := range pkgs {
-			args = append(args, filepath.Join(rel, filepath.Base(pkg)))
+		// the file mode. A Windows host doesn't need it.
+		out = append(out, t.chmod(host, port, rel, pkgs))
+	}
+	return out, nil
+}
+
+// chmod returns the command line to mark the executables pushed in rel as
+// executable on host.
+func (t tool) chmod(host string, port int, rel string, pkgs []string) []string {
+	// The remote command is run by the remote shell, so the paths are quoted.
+	args := append(append([]string{t.ssh()}, portArgs(t.ssh(), port)...), host, "chmod", "+x")
+	for _, pkg := range pkgs {
+		// The remote host is not Windows, so use forward slashes.
+		args = append(args, shellQuote(path.Join(rel, filepath.Base(pkg))))
+	}
+	return args
+}
+
+// shellQuote quotes s for a POSIX shell, if needed.
+func shellQuote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"'\\$&|;<>()*?[]#~`") {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+	return s
+}
+
+// isTransient returns true if the exit code of a command likely denotes a
+// connection failure that is worth retrying, e.g. the host is still booting.
+//
+// Only the exit code 255 of ssh and plink, also returned by rsync, scp and
+// pscp when their ssh connection fails, is retried. The other codes, e.g. 1
+// for scp, are also returned for permanent errors like a missing file.
+func isTransient(code int) bool {
+	return code == 255
+}
+
+// retryDelay is the delay before the first retry. It doubles at each retry.
+var retryDelay = time.Second
+
+// backoff returns the delay before the retry number i, starting at 0.
+func backoff(i int) time.Duration {
+	if i > 5 {
+		i = 5
+	}
+	return retryDelay << i
+}
+
+// runRetry runs c, retrying up to retries times on transient failures.
+func runRetry(retries int, c []string) error {
+	for i := 0; ; i++ {
+		err := run(c[0], c[1:]...)
+		var exitErr *exec.ExitError
+		if err == nil || i >= retries || !errors.As(err, &exitErr) || !isTransient(exitErr.ExitCode()) {
+			return err
 		}
-		switch t {
-		case rsyncProgress, rsyncOld, scp:
-			return run("ssh", args...)
-		case pscp:
-			return run("plink", args...)
+		d := backoff(i)
+		img.Progressf("- %s failed (%s), retrying in %s (%d/%d)\n", c[0], err, d, i+1, retries)
+		time.Sleep(d)
+	}
+}
+
+// push runs the commands to push the executables, retrying each one up to
+// retries times on connection failures.
+func (t tool) push(verbose, del bool, excludes []string, retries int, src, goos string, pkgs []string, host string, port int, rel string) error {
+	cmds, err := t.commands(verbose, del, excludes, src, goos, pkgs, host, port, rel)
+	if err != nil {
+		return err
+	}
+	for _, c := range cmds {
+		if err = runRetry(retries, c); err != nil {
+			return err
 		}
 	}
 	return nil
+}
 
+// formatCmd returns the command line c as it would be typed in a shell.
+func formatCmd(c []string) string {
+	out := make([]string, len(c))
+	for i, a := range c {
+		out[i] = shellQuote(a)
+	}
+	return strings.Join(out, " ")
 }
 
 // As printed by print_rsync_version() in
 // https://git.samba.org/?p=rsync.git;a=blob;f=options.c
-// Ignore the patch version and protocol version.
-var reRsyncVersion = regexp.MustCompile(`^rsync\s+version\s+(\d+)\.(\d+)`)
+// Ignore the protocol version. Versions 3.2.3 and later prefix the version
+// with "v".
+var reRsyncVersion = regexp.MustCompile(`^rsync\s+version\s+v?((\d+)\.(\d+)\S*)`)
 
-func getRsyncVersion(v []byte) (int, int) {
+// getRsyncVersion returns the version, major and minor of the output of
+// "rsync --version".
+func getRsyncVersion(v []byte) (string, int, int) {
 	m := reRsyncVersion.FindSubmatch(v)
 	if m == nil {
-		return 0, 0
+		return "", 0, 0
 	}
-	major, err := strconv.Atoi(string(m[1]))
+	major, err := strconv.Atoi(string(m[2]))
 	if err != nil {
-		return 0, 0
+		return "", 0, 0
 	}
-	minor, err := strconv.Atoi(string(m[1]))
+	minor, err := strconv.Atoi(string(m[3]))
 	if err != nil {
-		return 0, 0
+		return "", 0, 0
+	}
+	return string(m[1]), major, minor
+}
+
+// rsyncTool returns the tool to use for the rsync version major.minor.
+func rsyncTool(major, minor int) tool {
+	// --info=progress2 has been introduced in 3.1.0 as noted at
+	// https://download.samba.org/pub/rsync/src/rsync-3.1.0-NEWS
+	if major > 3 || (major == 3 && minor >= 1) {
+		return rsyncProgress
 	}
-	return major, minor
+	// --protect-args has been introduced in 3.0.0.
+	if major < 3 {
+		return rsyncLegacy
+	}
+	return rsyncOld
 }
 
-func detectRsync() tool {
+// firstLine returns the first non-empty line of b.
+func firstLine(b []byte) string {
+	return strings.SplitN(strings.TrimSpace(string(b)), "\n", 2)[0]
+}
+
+// detectRsync returns the rsync tool and its version.
+func detectRsync() (tool, string) {
 	if v, err := exec.Command("rsync", "--version").CombinedOutput(); err == nil {
-		if major, minor := getRsyncVersion(v); major != 0 {
-			// --info=progress2 has been introduced in 3.1.0 as noted at
-			// https://download.samba.org/pub/rsync/src/rsync-3.1.0-NEWS
-			if major > 3 || (major == 3 && minor <= 1) {
-				return rsyncProgress
-			}
-			return rsyncOld
+		if version, major, minor := getRsyncVersion(v); major != 0 {
+			return rsyncTool(major, minor), version
 		}
 	}
-	return none
+	return none, ""
 }
 
-func detectPscp() tool {
+// detectPscp returns the pscp tool and its version.
+func detectPscp() (tool, string) {
 	if runtime.GOOS == "windows" {
-		if _, err := exec.Command("pscp", "-V").CombinedOutput(); err == nil {
-			return pscp
+		if v, err := exec.Command("pscp", "-V").CombinedOutput(); err == nil {
+			// e.g. "pscp: Release 0.81"
+			return pscp, strings.TrimSpace(strings.TrimPrefix(firstLine(v), "pscp:"))
 		}
 	}
-	return none
+	return none, ""
 }
 
-func detectScp() tool {
+// detectScp returns the scp tool and the version of OpenSSH, if known.
+func detectScp() (tool, string) {
 	_, err := exec.Command("scp", "-V").CombinedOutput()
 	if err2, ok := err.(*exec.Error); ok && err2.Err == exec.ErrNotFound {
-		return none
+		return none, ""
+	}
+	// scp doesn't have a version flag, ssh does, e.g. "OpenSSH_9.6p1 ...".
+	v, _ := exec.Command("ssh", "-V").CombinedOutput()
+	version := strings.SplitN(firstLine(v), ",", 2)[0]
+	return scpTool(version), version
+}
+
+var reOpenSSHVersion = regexp.MustCompile(`^OpenSSH_(\d+)\.`)
+
+// scpTool returns the tool to use for scp from the OpenSSH version, e.g.
+// "OpenSSH_9.6p1".
+//
+// OpenSSH switched scp to the SFTP protocol in 9.0. An unknown version is
+// assumed to be recent.
+func scpTool(version string) tool {
+	if m := reOpenSSHVersion.FindStringSubmatch(version); m != nil {
+		if major, err := strconv.Atoi(m[1]); err == nil && major < 9 {
+			return scpLegacy
+		}
 	}
 	return scp
 }
 
-// detect returns which tool to use.
-func detect() tool {
-	if t := detectRsync(); t != none {
-		return t
+// detect returns which tool to use and its version.
+func detect() (tool, string) {
+	if t, v := detectRsync(); t != none {
+		return t, v
 	}
-	if t := detectPscp(); t != none {
-		return t
+	if t, v := detectPscp(); t != none {
+		return t, v
 	}
 	return detectScp()
 }
 
-// toPkg returns one or multiple packages matching the relpath.
+// describe returns a description of the tool t at version, including the
+// progress mode selected for rsync.
+func describe(t tool, version string) string {
+	s := t.String()
+	if version != "" {
+		s += " " + version
+	}
+	switch t {
+	case rsyncProgress:
+		s += " (--info=progress2)"
+	case rsyncOld, rsyncLegacy:
+		s += " (--progress, 3.1 or later is needed for --info=progress2)"
+	}
+	return s
+}
+
+// toPkg returns one or multiple main packages matching the relpath.
 func toPkg(item string) ([]string, error) {
-	out, err := exec.Command("go", "list", item).CombinedOutput()
-	s := strings.TrimSpace(string(out))
+	c := exec.Command("go", "list", "-f", "{{.Name}} {{.ImportPath}}", item)
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
 	if err != nil {
-		return nil, fmt.Errorf("failed to list package %q: %v\n%s", item, err, s)
+		return nil, fmt.Errorf("failed to list package %q: %v\n%s", item, err, strings.TrimSpace(stderr.String()))
+	}
+	pkgs, skipped := parseGoList(string(out))
+	for _, pkg := range skipped {
+		fmt.Fprintf(os.Stderr, "Warning: skipping non-main package %s\n", pkg)
+	}
+	if len(pkgs) == 0 {
+		if len(skipped) != 0 {
+			return nil, fmt.Errorf("%q matched no main package", item)
+		}
+		return nil, fmt.Errorf("%q matched no package", item)
+	}
+	return pkgs, nil
+}
+
+// parseGoList parses the output of go list -f "{{.Name}} {{.ImportPath}}".
+//
+// It returns the main packages and the other ones separately.
+func parseGoList(out string) ([]string, []string) {
+	var pkgs, skipped []string
+	for _, l := range strings.Split(out, "\n") {
+		name, pkg, ok := strings.Cut(strings.TrimSpace(l), " ")
+		if !ok {
+			continue
+		}
+		if name == "main" {
+			pkgs = append(pkgs, pkg)
+		} else {
+			skipped = append(skipped, pkg)
+		}
+	}
+	return pkgs, skipped
+}
+
+// manifestPath returns the path of the file containing the checksums of the
+// files last pushed to host:rel from the cache directory d.
+func manifestPath(d, host, rel string) string {
+	h := sha256.Sum256([]byte(host + ":" + rel))
+	return filepath.Join(d, "manifest-"+hex.EncodeToString(h[:8])+".txt")
+}
+
+// readManifest reads a manifest in the sha256sum format.
+//
+// A missing manifest is not an error.
+func readManifest(p string) (map[string]string, error) {
+	out := map[string]string{}
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return out, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if sum, name, ok := strings.Cut(s.Text(), "  "); ok {
+			out[name] = sum
+		}
+	}
+	return out, s.Err()
+}
+
+// writeManifest writes a manifest in the sha256sum format.
+func writeManifest(p string, sums map[string]string) error {
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s  %s\n", sums[name], name)
+	}
+	return os.WriteFile(p, []byte(b.String()), 0o644)
+}
+
+// changedPkgs returns the packages whose executable in d differ from the
+// checksums in old, along with the checksums of all the executables.
+func changedPkgs(d, goos string, pkgs []string, old map[string]string) ([]string, map[string]string, error) {
+	var changed []string
+	sums := map[string]string{}
+	for _, pkg := range pkgs {
+		name := exeName(goos, pkg)
+		b, err := os.ReadFile(filepath.Join(d, name))
+		if err != nil {
+			return nil, nil, err
+		}
+		h := sha256.Sum256(b)
+		sums[name] = hex.EncodeToString(h[:])
+		if old[name] != sums[name] {
+			changed = append(changed, pkg)
+		}
+	}
+	return changed, sums, nil
+}
+
+// buildOptions are the options passed to go build.
+type buildOptions struct {
+	// goos is the GOOS value the executables are built for.
+	goos     string
+	tags     string
+	ldflags  string
+	trimpath bool
+}
+
+// args returns the arguments to build pkg into out.
+//
+// ldflags is passed as a single argument; go build does the splitting itself
+// and supports quoting, e.g. -X 'main.version=1.0 beta'.
+func (b *buildOptions) args(out, pkg string) []string {
+	args := []string{"build", "-v", "-o", out}
+	if b.tags != "" {
+		args = append(args, "-tags", b.tags)
+	}
+	if b.ldflags != "" {
+		args = append(args, "-ldflags="+b.ldflags)
+	}
+	if b.trimpath {
+		args = append(args, "-trimpath")
 	}
-	return strings.Split(s, "\n"), nil
+	return append(args, pkg)
+}
+
+// unameArch converts the output of uname -m to a GOARCH value.
+//
+// Returns an empty string if unknown.
+func unameArch(m string) string {
+	switch {
+	case strings.HasPrefix(m, "armv"):
+		return "arm"
+	case m == "aarch64" || m == "arm64":
+		return "arm64"
+	case m == "x86_64" || m == "amd64":
+		return "amd64"
+	case m == "i386" || m == "i686":
+		return "386"
+	case m == "riscv64":
+		return "riscv64"
+	default:
+		return ""
+	}
+}
+
+// elfArch returns the GOARCH of an ELF executable.
+func elfArch(p string) (string, error) {
+	f, err := elf.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	switch f.Machine {
+	case elf.EM_ARM:
+		return "arm", nil
+	case elf.EM_AARCH64:
+		return "arm64", nil
+	case elf.EM_X86_64:
+		return "amd64", nil
+	case elf.EM_386:
+		return "386", nil
+	case elf.EM_RISCV:
+		return "riscv64", nil
+	default:
+		return "", fmt.Errorf("%s: unsupported machine %s", p, f.Machine)
+	}
+}
+
+// remoteArch returns the GOARCH of host as reported by uname -m.
+func (t tool) remoteArch(host string, port int) (string, error) {
+	// Don't hang forever on an unreachable host.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	c := exec.CommandContext(ctx, t.ssh(), append(portArgs(t.ssh(), port), host, "uname", "-m")...)
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	m := strings.TrimSpace(string(out))
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if e := strings.TrimSpace(stderr.String()); e != "" {
+			return "", fmt.Errorf("failed to run uname -m on %s: %v\n%s", host, err, e)
+		}
+		return "", fmt.Errorf("failed to run uname -m on %s: %v", host, err)
+	}
+	a := unameArch(m)
+	if a == "" {
+		return "", fmt.Errorf("%s: unknown architecture %q", host, m)
+	}
+	return a, nil
+}
+
+// verifyArch confirms the executables in d can run on host.
+func verifyArch(t tool, host string, port int, d string, pkgs []string) error {
+	want, err := t.remoteArch(host, port)
+	if err != nil {
+		return err
+	}
+	for _, pkg := range pkgs {
+		got, err := elfArch(filepath.Join(d, filepath.Base(pkg)))
+		if err != nil {
+			return err
+		}
+		if got != want {
+			return fmt.Errorf("%s was built for %s but %s is %s; use -goarch %s", pkg, got, host, want, want)
+		}
+	}
+	return nil
 }
 
 // pushInner does the actual work: build then push.
-func pushInner(verbose bool, t tool, pkgs []string, tags string, host, rel, d string) error {
+//
+// When cached is true, only the executables that changed since the last push
+// to host:rel are pushed. When verify is true, the architecture of host is
+// checked against the executables before pushing. When del is true, the other
+// files in host:rel are deleted. The transfer is retried up to retries times on
+// connection failures, but the build is never retried. The executables matching
+// excludes are not pushed.
+func pushInner(verbose bool, t tool, pkgs []string, b *buildOptions, host string, port int, rel, d string, cached, verify, del bool, excludes []string, retries int) error {
 	// First build everything.
 	for _, pkg := range pkgs {
-		fmt.Printf("- Building %s\n", pkg)
-		args := []string{"build", "-v", "-o", filepath.Join(d, filepath.Base(pkg))}
-		if tags != "" {
-			args = append(args, "-tags", tags)
-		}
-		args = append(args, pkg)
-		if err := run("go", args...); err != nil {
+		img.Progressf("- Building %s\n", pkg)
+		if err := run("go", b.args(filepath.Join(d, exeName(b.goos, pkg)), pkg)...); err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to build %s\n", pkg)
 			return err
 		}
@@ -197,13 +632,84 @@ func pushInner(verbose bool, t tool, pkgs []string, tags string, host, rel, d st
 		fmt.Printf("Note: -host not provided, not pushing.\n")
 		return nil
 	}
+	if verify {
+		img.Progressf("- Verifying the architecture of %s\n", host)
+		if err := verifyArch(t, host, port, d, pkgs); err != nil {
+			return err
+		}
+	}
+	var sums map[string]string
+	var manifest string
+	if cached {
+		manifest = manifestPath(d, host, rel)
+		old, err := readManifest(manifest)
+		if err != nil {
+			return err
+		}
+		var changed []string
+		if changed, sums, err = changedPkgs(d, b.goos, pkgs, old); err != nil {
+			return err
+		}
+		if len(changed) == 0 && !del {
+			img.Progressf("- Nothing changed since the last push to %s in %s\n", rel, host)
+			return nil
+		}
+		if !del {
+			// Deleting requires the full list of executables. rsync will skip
+			// the unchanged ones anyway.
+			pkgs = changed
+		}
+	}
 	// Then push it all as one swoop.
-	fmt.Printf("- Pushing %d executables to %s in %s via %s\n", len(pkgs), rel, host, t)
-	return t.push(verbose, d, pkgs, host, rel)
+	img.Progressf("- Pushing %d executables to %s in %s via %s\n", len(pkgs), rel, host, t)
+	if err := t.push(verbose, del, excludes, retries, d, b.goos, pkgs, host, port, rel); err != nil {
+		return err
+	}
+	if cached {
+		return writeManifest(manifest, sums)
+	}
+	return nil
 }
 
-// push wraps pushInner with a temporary directory.
-func push(verbose bool, t tool, items []string, tags string, host, rel string) error {
+// buildEnv lists the environment variables that affect go build, as set by
+// mainImpl.
+var buildEnv = []string{"GOOS", "GOARCH", "GOARM", "CGO_ENABLED", "CC"}
+
+// dryRun prints the commands pushInner would run, without running them.
+//
+// All the executables are listed, as the cache is not looked up.
+func dryRun(verbose bool, t tool, pkgs []string, b *buildOptions, host string, port int, rel, d string, verify, del bool, excludes []string) error {
+	var env []string
+	for _, k := range buildEnv {
+		if v := os.Getenv(k); v != "" {
+			env = append(env, k+"="+v)
+		}
+	}
+	for _, pkg := range pkgs {
+		c := append([]string{"go"}, b.args(filepath.Join(d, exeName(b.goos, pkg)), pkg)...)
+		fmt.Println(formatCmd(append(env[:len(env):len(env)], c...)))
+	}
+	if host == "" {
+		return nil
+	}
+	if verify {
+		fmt.Println(formatCmd(append(append([]string{t.ssh()}, portArgs(t.ssh(), port)...), host, "uname", "-m")))
+	}
+	cmds, err := t.commands(verbose, del, excludes, d, b.goos, pkgs, host, port, rel)
+	if err != nil {
+		return err
+	}
+	for _, c := range cmds {
+		fmt.Println(formatCmd(c))
+	}
+	return nil
+}
+
+// push wraps pushInner with a temporary directory, or the cache directory when
+// specified.
+//
+// With dry, the commands are printed instead.
+func push(verbose bool, t tool, items []string, b *buildOptions, host string, port int, rel, cache string, verify, dry, del bool, excludes []string, retries int) error {
 	// First convert the passed strings into real package names.
 	var pkgs []string
 	for _, item := range items {
@@ -214,58 +720,196 @@ func push(verbose bool, t tool, items []string, tags string, host, rel string) e
 		pkgs = append(pkgs, i...)
 	}
 
+	if dry {
+		d := cache
+		if d == "" {
+			d = filepath.Join(os.TempDir(), "push")
+		}
+		return dryRun(verbose, t, pkgs, b, host, port, rel, d, verify, del, excludes)
+	}
+	if cache != "" {
+		if err := os.MkdirAll(cache, 0o755); err != nil {
+			return err
+		}
+		return pushInner(verbose, t, pkgs, b, host, port, rel, cache, true, verify, del, excludes, retries)
+	}
 	d, err := os.MkdirTemp("", "push")
 	if err != nil {
 		return err
 	}
-	err = pushInner(verbose, t, pkgs, tags, host, rel, d)
+	err = pushInner(verbose, t, pkgs, b, host, port, rel, d, false, verify, del, excludes, retries)
 	if err1 := os.RemoveAll(d); err == nil {
 		err = err1
 	}
 	return err
 }
 
+// isKnownTarget returns true if the GOOS/GOARCH pair is listed in the output
+// of "go tool dist list".
+func isKnownTarget(list, goos, goarch string) bool {
+	for _, l := range strings.Split(list, "\n") {
+		if strings.TrimSpace(l) == goos+"/"+goarch {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTarget returns an error if the GOOS/GOARCH pair is not supported by the
+// Go toolchain.
+func checkTarget(goos, goarch string) error {
+	out, err := exec.Command("go", "tool", "dist", "list").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list the Go targets: %w", err)
+	}
+	if !isKnownTarget(string(out), goos, goarch) {
+		return fmt.Errorf("-goos %s -goarch %s is not a known Go target; see \"go tool dist list\"", goos, goarch)
+	}
+	return nil
+}
+
+// excludeFlag is a repeatable flag of rsync exclude patterns.
+type excludeFlag []string
+
+func (e *excludeFlag) String() string {
+	return strings.Join(*e, ",")
+}
+
+// Set implements flag.Value.
+func (e *excludeFlag) Set(v string) error {
+	if err := checkExclude(v); err != nil {
+		return err
+	}
+	*e = append(*e, v)
+	return nil
+}
+
+// checkExclude returns an error if the rsync exclude pattern v is invalid.
+func checkExclude(v string) error {
+	if strings.TrimSpace(v) == "" {
+		return errors.New("pattern can't be empty")
+	}
+	// rsync parses a leading "+ " or "- " as a rule modifier and "!" resets
+	// the list, which would be surprising here.
+	if strings.HasPrefix(v, "+ ") || strings.HasPrefix(v, "- ") || v == "!" {
+		return fmt.Errorf("pattern %q must not be a filter rule", v)
+	}
+	// rsync uses the same wildcards as filepath.Match, plus "**".
+	if _, err := filepath.Match(strings.ReplaceAll(v, "**", "*"), ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", v, err)
+	}
+	return nil
+}
+
+// boardTarget returns the GOARCH and GOARM values to build for board b.
+//
+// set lists the flags specified on the command line; an explicit -goarch or
+// -goarm overrides the value of the board.
+func boardTarget(b img.Board, set map[string]bool, goarch, goarm string) (string, string) {
+	if b == "" {
+		return goarch, goarm
+	}
+	a, arm := b.GoArch()
+	if !set["goarch"] {
+		goarch = a
+	}
+	if !set["goarm"] {
+		goarm = arm
+	}
+	return goarch, goarm
+}
+
 func mainImpl() error {
 	goarch := flag.String("goarch", "arm", "GOARCH value to use")
 	goarm := flag.String("goarm", "6", "GOARM value to use")
+	var board img.Board
+	flag.Var(&board, "board", "board to build for, setting -goarch and -goarm accordingly; "+img.BoardHelp())
 	goos := flag.String("goos", "linux", "GOOS value to use")
 	tags := flag.String("tags", "", "build tags to pass")
+	ldflags := flag.String("ldflags", "", "ldflags to pass to go build, e.g. \"-s -w -X main.version=1.0\"")
+	trimpath := flag.Bool("trimpath", false, "pass -trimpath to go build for reproducible builds")
 	rel := flag.String("rel", ".", "directory on remote host to push files into")
 	host := flag.String("host", os.Getenv("PUSH_HOST"), "host to push to; defaults to content of environment variable PUSH_HOST")
+	port := flag.Int("port", 22, "ssh port of -host")
+	cache := flag.String("cache", "", "directory to keep the built executables in between runs; only the executables that changed since the last push are pushed")
+	verifyRemote := flag.Bool("verify-remote", false, "ssh into -host to confirm its architecture matches the executables before pushing")
 	preferredTool := flag.String("tool", "", "tool to push with: either rsync, pscp or scp; autodetects by default")
-	verbose := flag.Bool("v", false, "verbose output")
+	dry := flag.Bool("dry-run", false, "print the build and transfer commands instead of running them")
+	retries := flag.Int("retries", 2, "number of times to retry pushing when the connection to the host fails, e.g. while it is booting")
+	var excludes excludeFlag
+	flag.Var(&excludes, "exclude", "pattern of the executables not to push, as understood by rsync --exclude; can be specified multiple times; only supported with rsync")
+	del := flag.Bool("delete", false, "delete all the other files in -rel on the remote host, so it only contains the executables; only supported with rsync")
+	verbose := flag.Bool("v", false, "verbose output to stderr")
+	debug := flag.Bool("vv", false, "very verbose output to stderr, including the commands run")
+	quiet := flag.Bool("q", false, "only print errors")
 	flag.Parse()
+	l, err := img.LevelFromFlags(*quiet, *verbose, *debug)
+	if err != nil {
+		return err
+	}
+	img.SetLevel(l)
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	*goarch, *goarm = boardTarget(board, set, *goarch, *goarm)
+	if *rel == "" {
+		// "host:" is the home directory, which is likely not what was meant.
+		return errors.New("-rel can't be empty; use -rel . for the home directory")
+	}
+	if r := path.Clean(*rel); *del && (r == "." || r == "~" || r == "/") {
+		return errors.New("-delete would delete all the files in the home directory; use a dedicated -rel")
+	}
+	if *retries < 0 {
+		return errors.New("-retries can't be negative")
+	}
+	if *port < 1 || *port > 65535 {
+		return fmt.Errorf("-port %d must be between 1 and 65535", *port)
+	}
 	pkgs := flag.Args()
 	if len(pkgs) == 0 {
-		fmt.Printf("Note: No argument provided, defaulting to the current directory.\n")
+		img.Progressf("Note: No argument provided, defaulting to the current directory.\n")
 		pkgs = []string{"."}
 	}
-	if !*verbose {
-		log.SetOutput(io.Discard)
-	}
-
 	var t tool
+	var version string
 	switch *preferredTool {
 	case "rsync":
 		// Do a quick version detect.
-		if t = detectRsync(); t == none {
+		if t, version = detectRsync(); t == none {
 			return errors.New("failed to detect rsync")
 		}
 	case "pscp":
-		if t = detectPscp(); t == none {
+		if t, version = detectPscp(); t == none {
 			return errors.New("failed to detect pscp")
 		}
 	case "scp":
-		if t = detectScp(); t == none {
+		if t, version = detectScp(); t == none {
 			return errors.New("failed to detect scp")
 		}
 	case "":
-		if t = detect(); t == none {
+		if t, version = detect(); t == none {
 			return errors.New("please make sure at least one of rsync, scp or pscp is in PATH")
 		}
 	default:
 		return fmt.Errorf("unrecognized tool %q", *preferredTool)
 	}
+	if *dry {
+		fmt.Printf("# Using %s\n", describe(t, version))
+	} else {
+		img.Progressf("- Using %s\n", describe(t, version))
+	}
+
+	if *del && !t.isRsync() {
+		fmt.Printf("Warning! -delete is only supported with rsync, not %s; ignoring.\n", t)
+		*del = false
+	}
+	if len(excludes) != 0 && !t.isRsync() {
+		fmt.Printf("Warning! -exclude is only supported with rsync, not %s; ignoring.\n", t)
+		excludes = nil
+	}
+
+	if err = checkTarget(*goos, *goarch); err != nil {
+		return err
+	}
 
 	// Simplify our life and just set it process wide.
 	_ = os.Setenv("GOARCH", *goarch)
@@ -277,12 +921,21 @@ func mainImpl() error {
 		// Set CGO_ENABLED=0 to disable this feature.
 		// Set CC to your desired compiled to override the one chosen by default.
 		if _, err := os.Stat("/usr/bin/arm-linux-gnueabihf-gcc"); err == nil {
-			fmt.Printf("- Using cross compiling gcc\n")
+			img.Progressf("- Using cross compiling gcc\n")
 			_ = os.Setenv("CC", "/usr/bin/arm-linux-gnueabihf-gcc")
 			_ = os.Setenv("CGO_ENABLED", "1")
 		}
 	}
-	return push(*verbose, t, pkgs, *tags, *host, *rel)
+	if os.Getenv("CC") == "" && os.Getenv("CGO_ENABLED") == "" && (*goos != runtime.GOOS || *goarch != runtime.GOARCH) {
+		// There's no C cross compiler for the target, so don't try to use cgo.
+		// Set CC to use one.
+		_ = os.Setenv("CGO_ENABLED", "0")
+	}
+	b := buildOptions{goos: *goos, tags: *tags, ldflags: *ldflags, trimpath: *trimpath}
+	if *verifyRemote && *goos != "linux" {
+		return errors.New("-verify-remote is only supported with -goos linux")
+	}
+	return push(*verbose, t, pkgs, &b, *host, *port, *rel, *cache, *verifyRemote, *dry, *del, excludes, *retries)
 }
 
 func main() {
@@ -4,7 +4,17 @@
 
 package main
 
-import "testing"
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"periph.io/x/bootstrap/img"
+)
 
 func TestString(t *testing.T) {
 	if s := none.String(); s != "none" {
@@ -16,10 +26,404 @@ func TestString(t *testing.T) {
 	if s := rsyncOld.String(); s != "rsync" {
 		t.Fatal(s)
 	}
+	if s := rsyncLegacy.String(); s != "rsync" {
+		t.Fatal(s)
+	}
 	if s := pscp.String(); s != "pscp" {
 		t.Fatal(s)
 	}
 	if s := scp.String(); s != "scp" {
 		t.Fatal(s)
 	}
+	if s := scpLegacy.String(); s != "scp" {
+		t.Fatal(s)
+	}
+}
+
+func TestGetRsyncVersion(t *testing.T) {
+	data := []struct {
+		in      string
+		version string
+		major   int
+		minor   int
+		tool    tool
+	}{
+		{"rsync  version 3.0.9  protocol version 30\n", "3.0.9", 3, 0, rsyncOld},
+		{"rsync  version 3.1.2  protocol version 31\n", "3.1.2", 3, 1, rsyncProgress},
+		{"rsync  version v3.2.7  protocol version 31\n", "3.2.7", 3, 2, rsyncProgress},
+		{"rsync  version 2.6.9  protocol version 29\n", "2.6.9", 2, 6, rsyncLegacy},
+		{"openrsync: protocol version 29\n", "", 0, 0, none},
+	}
+	for i, line := range data {
+		version, major, minor := getRsyncVersion([]byte(line.in))
+		if version != line.version || major != line.major || minor != line.minor {
+			t.Fatalf("%d: %q %d.%d", i, version, major, minor)
+		}
+		if major != 0 {
+			if got := rsyncTool(major, minor); got != line.tool {
+				t.Fatalf("%d: %d != %d", i, got, line.tool)
+			}
+		}
+	}
+}
+
+func TestScpTool(t *testing.T) {
+	data := []struct {
+		version string
+		want    tool
+	}{
+		{"OpenSSH_9.6p1 Ubuntu-3ubuntu13", scp},
+		{"OpenSSH_10.0p2", scp},
+		{"OpenSSH_8.9p1 Ubuntu-3ubuntu0.10", scpLegacy},
+		{"OpenSSH_7.4p1", scpLegacy},
+		{"", scp},
+	}
+	for i, line := range data {
+		if got := scpTool(line.version); got != line.want {
+			t.Fatalf("%d: %d != %d", i, got, line.want)
+		}
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	if s := describe(rsyncProgress, "3.2.7"); s != "rsync 3.2.7 (--info=progress2)" {
+		t.Fatal(s)
+	}
+	if s := describe(scp, ""); s != "scp" {
+		t.Fatal(s)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	d := t.TempDir()
+	for _, n := range []string{"foo", "bar"} {
+		if err := os.WriteFile(filepath.Join(d, n), []byte(n), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := manifestPath(d, "pi", ".")
+	old, err := readManifest(p)
+	if err != nil || len(old) != 0 {
+		t.Fatal(old, err)
+	}
+	pkgs := []string{"example.com/foo", "example.com/bar"}
+	changed, sums, err := changedPkgs(d, "linux", pkgs, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 2 {
+		t.Fatal(changed)
+	}
+	if err = writeManifest(p, sums); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(d, "bar"), []byte("baz"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if old, err = readManifest(p); err != nil {
+		t.Fatal(err)
+	}
+	if changed, _, err = changedPkgs(d, "linux", pkgs, old); err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || changed[0] != "example.com/bar" {
+		t.Fatal(changed)
+	}
+	if manifestPath(d, "pi", "bin") == p {
+		t.Fatal("expected a different manifest per destination")
+	}
+}
+
+func TestBuildOptionsArgs(t *testing.T) {
+	b := buildOptions{tags: "foo", ldflags: "-s -w -X 'main.version=1.0 beta'", trimpath: true}
+	got := strings.Join(b.args("out", "./cmd"), "|")
+	want := "build|-v|-o|out|-tags|foo|-ldflags=-s -w -X 'main.version=1.0 beta'|-trimpath|./cmd"
+	if got != want {
+		t.Fatalf("%q != %q", got, want)
+	}
+	b = buildOptions{}
+	if got = strings.Join(b.args("out", "./cmd"), "|"); got != "build|-v|-o|out|./cmd" {
+		t.Fatal(got)
+	}
+}
+
+func TestFormatCmd(t *testing.T) {
+	got := formatCmd([]string{"go", "build", "-ldflags=-s -w", "it's", ""})
+	if want := `go build '-ldflags=-s -w' 'it'\''s' ''`; got != want {
+		t.Fatalf("%q != %q", got, want)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	cmds, err := rsyncProgress.commands(false, false, nil, "/tmp/push", "linux", []string{"periph.io/x/cmd/gpio-read"}, "pi", 22, "bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cmds[0], "|"); got != "rsync|--archive|--info=progress2|--compress|--protect-args|"+filepath.Join("/tmp/push", "gpio-read")+"|pi:bin" {
+		t.Fatal(got)
+	}
+	cmds, err = scp.commands(false, false, nil, "/tmp/push", "linux", []string{"periph.io/x/cmd/gpio-read"}, "pi", 22, "my apps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cmds[0][len(cmds[0])-1]; got != "pi:my apps" {
+		t.Fatal(got)
+	}
+	cmds, err = rsyncProgress.commands(false, true, nil, "/tmp/push", "linux", []string{"periph.io/x/cmd/gpio-read"}, "pi", 22, "bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cmds[0], "|"); got != "rsync|--archive|--info=progress2|--compress|--protect-args|--delete|--delete-excluded|--include=/gpio-read|--exclude=*|/tmp/push/|pi:bin/" {
+		t.Fatal(got)
+	}
+	cmds, err = rsyncOld.commands(false, false, []string{"*.log"}, "/tmp/push", "linux", []string{"periph.io/x/cmd/gpio-read"}, "pi", 22, "bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cmds[0], "|"); got != "rsync|--archive|--progress|--compress|--protect-args|--exclude=*.log|"+filepath.Join("/tmp/push", "gpio-read")+"|pi:bin" {
+		t.Fatal(got)
+	}
+	// rsync before 3.0 and the SCP protocol let the remote shell parse rel.
+	cmds, err = rsyncLegacy.commands(false, false, nil, "/tmp/push", "linux", []string{"periph.io/x/cmd/gpio-read"}, "pi", 22, "my apps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cmds[0], "|"); got != "rsync|--archive|--progress|--compress|"+filepath.Join("/tmp/push", "gpio-read")+"|pi:'my apps'" {
+		t.Fatal(got)
+	}
+	cmds, err = rsyncLegacy.commands(false, true, nil, "/tmp/push", "linux", []string{"periph.io/x/cmd/gpio-read"}, "pi", 22, "it's")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cmds[0][len(cmds[0])-1]; got != `pi:'it'\''s/'` {
+		t.Fatal(got)
+	}
+	cmds, err = scpLegacy.commands(false, false, nil, "/tmp/push", "linux", []string{"periph.io/x/cmd/gpio-read"}, "pi", 22, "my apps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cmds[0][len(cmds[0])-1]; got != "pi:'my apps'" {
+		t.Fatal(got)
+	}
+	// A non default ssh port.
+	cmds, err = rsyncProgress.commands(false, false, nil, "/tmp/push", "linux", []string{"periph.io/x/cmd/gpio-read"}, "pi", 2222, "bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cmds[0], "|"); got != "rsync|--archive|--info=progress2|--compress|--protect-args|-e|ssh -p 2222|"+filepath.Join("/tmp/push", "gpio-read")+"|pi:bin" {
+		t.Fatal(got)
+	}
+	cmds, err = pscp.commands(false, false, nil, "/tmp/push", "linux", []string{"periph.io/x/cmd/gpio-read"}, "pi", 2222, "bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cmds[0], "|"); got != "pscp|-C|-p|-r|-P|2222|"+filepath.Join("/tmp/push", "gpio-read")+"|pi:bin" {
+		t.Fatal(got)
+	}
+	if _, err = scp.commands(false, false, []string{"*.log"}, "/tmp/push", "linux", nil, "pi", 22, "bin"); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err = scp.commands(false, true, nil, "/tmp/push", "linux", nil, "pi", 22, "bin"); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err = none.commands(false, false, nil, "/tmp/push", "linux", nil, "pi", 22, "bin"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestCheckExclude(t *testing.T) {
+	for i, v := range []string{"*.log", "gpio-*", "**/tmp", "[ab]*", "foo/"} {
+		if err := checkExclude(v); err != nil {
+			t.Fatalf("%d: %q: %v", i, v, err)
+		}
+	}
+	for i, v := range []string{"", " ", "[ab", "- foo", "+ foo", "!"} {
+		if checkExclude(v) == nil {
+			t.Fatalf("%d: %q: expected error", i, v)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	data := []struct {
+		code int
+		want bool
+	}{
+		{255, true},
+		{1, false},
+		{2, false},
+		{12, false},
+		{23, false},
+	}
+	for i, line := range data {
+		if got := isTransient(line.code); got != line.want {
+			t.Fatalf("%d: %d: %t != %t", i, line.code, got, line.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	data := []struct {
+		i    int
+		want time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{5, 32 * time.Second},
+		{10, 32 * time.Second},
+	}
+	for i, line := range data {
+		if got := backoff(line.i); got != line.want {
+			t.Fatalf("%d: %s != %s", i, got, line.want)
+		}
+	}
+}
+
+func TestChmod(t *testing.T) {
+	data := []struct {
+		rel  string
+		want string
+	}{
+		{"bin", "ssh|pi|chmod|+x|bin/gpio-read"},
+		{"my apps", "ssh|pi|chmod|+x|'my apps/gpio-read'"},
+		{"it's", `ssh|pi|chmod|+x|'it'\''s/gpio-read'`},
+	}
+	for i, line := range data {
+		got := strings.Join(scp.chmod("pi", 22, line.rel, []string{"periph.io/x/cmd/gpio-read"}), "|")
+		if got != line.want {
+			t.Fatalf("%d: %q != %q", i, got, line.want)
+		}
+	}
+	if got := strings.Join(pscp.chmod("pi", 2222, "bin", []string{"periph.io/x/cmd/gpio-read"}), "|"); got != "plink|-P|2222|pi|chmod|+x|bin/gpio-read" {
+		t.Fatal(got)
+	}
+	if got := strings.Join(scp.chmod("pi", 2222, "bin", []string{"periph.io/x/cmd/gpio-read"}), "|"); got != "ssh|-p|2222|pi|chmod|+x|bin/gpio-read" {
+		t.Fatal(got)
+	}
+}
+
+func TestExeName(t *testing.T) {
+	if got := exeName("linux", "periph.io/x/cmd/gpio-read"); got != "gpio-read" {
+		t.Fatal(got)
+	}
+	if got := exeName("windows", "periph.io/x/cmd/gpio-read"); got != "gpio-read.exe" {
+		t.Fatal(got)
+	}
+}
+
+func TestIsKnownTarget(t *testing.T) {
+	list := "darwin/arm64\nlinux/arm\nlinux/arm64\nwindows/amd64\n"
+	data := []struct {
+		goos, goarch string
+		expected     bool
+	}{
+		{"linux", "arm", true},
+		{"windows", "amd64", true},
+		{"windows", "arm", false},
+		{"linux", "", false},
+		{"plan10", "arm", false},
+	}
+	for i, l := range data {
+		if got := isKnownTarget(list, l.goos, l.goarch); got != l.expected {
+			t.Fatalf("%d: %t", i, got)
+		}
+	}
+}
+
+func TestParseGoList(t *testing.T) {
+	pkgs, skipped := parseGoList("main periph.io/x/cmd/gpio-read\nconn periph.io/x/conn\nmain periph.io/x/cmd/gpio-write\n")
+	if strings.Join(pkgs, ",") != "periph.io/x/cmd/gpio-read,periph.io/x/cmd/gpio-write" {
+		t.Fatal(pkgs)
+	}
+	if strings.Join(skipped, ",") != "periph.io/x/conn" {
+		t.Fatal(skipped)
+	}
+	if pkgs, skipped = parseGoList(""); len(pkgs) != 0 || len(skipped) != 0 {
+		t.Fatal(pkgs, skipped)
+	}
+}
+
+func TestToPkg(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip(err)
+	}
+	pkgs, err := toPkg(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) != 1 || pkgs[0] != "periph.io/x/bootstrap/cmd/push" {
+		t.Fatal(pkgs)
+	}
+	if _, err = toPkg("./does-not-exist/..."); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err = toPkg("periph.io/x/bootstrap/img"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestUnameArch(t *testing.T) {
+	data := []struct {
+		in, expected string
+	}{
+		{"armv6l", "arm"},
+		{"armv7l", "arm"},
+		{"aarch64", "arm64"},
+		{"x86_64", "amd64"},
+		{"i686", "386"},
+		{"riscv64", "riscv64"},
+		{"mips", ""},
+	}
+	for i, l := range data {
+		if got := unameArch(l.in); got != l.expected {
+			t.Fatalf("%d: %q != %q", i, got, l.expected)
+		}
+	}
+}
+
+func TestBoardTarget(t *testing.T) {
+	data := []struct {
+		board         img.Board
+		set           []string
+		goarch, goarm string
+	}{
+		{"", nil, "arm", "6"},
+		{img.RaspberryPiZero, nil, "arm", "6"},
+		{img.RaspberryPi4, nil, "arm", "7"},
+		{img.JetsonNano, nil, "arm64", ""},
+		{img.RaspberryPi4, []string{"goarch"}, "arm", "7"},
+		{img.RaspberryPi4, []string{"goarm"}, "arm", "6"},
+		{img.RaspberryPiZero2, []string{"goarch", "goarm"}, "arm", "6"},
+	}
+	for i, l := range data {
+		set := map[string]bool{}
+		for _, s := range l.set {
+			set[s] = true
+		}
+		goarch, goarm := boardTarget(l.board, set, "arm", "6")
+		if goarch != l.goarch || goarm != l.goarm {
+			t.Fatalf("%d: %s %s", i, goarch, goarm)
+		}
+	}
+}
+
+func TestElfArch(t *testing.T) {
+	if _, err := elfArch("main.go"); err == nil {
+		t.Fatal("expected error")
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("the test executable is not an ELF file")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := elfArch(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != runtime.GOARCH {
+		t.Fatalf("%q != %q", got, runtime.GOARCH)
+	}
 }
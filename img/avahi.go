@@ -0,0 +1,74 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Host is a device found on the LAN.
+type Host struct {
+	// Name is the hostname without the .local suffix.
+	Name string
+	IPv4 net.IP
+}
+
+// ParseAvahiBrowse parses the output of "avahi-browse -p -r -t" and returns
+// the hosts resolved over IPv4, in order and without duplicates.
+//
+// The lines that are not resolved, IPv6 addresses and truncated lines are
+// ignored.
+func ParseAvahiBrowse(out string) []Host {
+	var hosts []Host
+	seen := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		// =;interface;protocol;name;type;domain;hostname;address;port;txt
+		f := strings.Split(strings.TrimRight(line, "\r"), ";")
+		if len(f) < 8 || f[0] != "=" || f[2] != "IPv4" {
+			continue
+		}
+		ip := net.ParseIP(f[7]).To4()
+		if ip == nil {
+			continue
+		}
+		name := strings.TrimSuffix(unescapeAvahi(f[6]), ".local")
+		if name == "" {
+			continue
+		}
+		if k := name + " " + ip.String(); !seen[k] {
+			seen[k] = true
+			hosts = append(hosts, Host{Name: name, IPv4: ip})
+		}
+	}
+	return hosts
+}
+
+// unescapeAvahi decodes the escapes avahi-browse -p uses: \DDD for the byte
+// with the decimal value DDD, e.g. \032 for a space or \059 for ';', and \c
+// for the character c, e.g. "\." for a dot in a label.
+func unescapeAvahi(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 10, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		i++
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,59 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseAvahiBrowse(t *testing.T) {
+	// Output of avahi-browse 0.8 -p -r -t _ssh._tcp, with a truncated last
+	// line.
+	const out = "+;wlan0;IPv6;raspberrypi;SSH Remote Terminal;local\n" +
+		"+;wlan0;IPv4;raspberrypi;SSH Remote Terminal;local\n" +
+		"+;eth0;IPv4;lab-001;SSH Remote Terminal;local\n" +
+		"=;wlan0;IPv6;raspberrypi;SSH Remote Terminal;local;raspberrypi.local;fe80::ba27:ebff:fe01:2345;22;\n" +
+		"=;wlan0;IPv4;raspberrypi;SSH Remote Terminal;local;raspberrypi.local;192.168.1.10;22;\n" +
+		"=;eth0;IPv4;raspberrypi;SSH Remote Terminal;local;raspberrypi.local;192.168.1.10;22;\n" +
+		"=;eth0;IPv4;lab-001;SSH Remote Terminal;local;lab-001.local;192.168.1.11;22;\"board=rpi\"\r\n" +
+		"=;eth0;IPv4;Living\\032Room\\059Pi;SSH Remote Terminal;local;living\\.room.local;192.168.1.12;22;\n" +
+		"=;eth0;IPv4;broken;SSH Remote Terminal;local;broken.local;not-an-ip;22;\n" +
+		"=;eth0;IPv4;empty;SSH Remote Terminal;local;;192.168.1.13;22;\n" +
+		"Failed to resolve service 'x' of type '_ssh._tcp' in domain 'local': Timeout reached\n" +
+		"=;eth0;IPv4;short;SSH"
+	got := ParseAvahiBrowse(out)
+	expected := []string{"raspberrypi 192.168.1.10", "lab-001 192.168.1.11", "living.room 192.168.1.12"}
+	if len(got) != len(expected) {
+		t.Fatal(got)
+	}
+	for i, h := range got {
+		if s := fmt.Sprintf("%s %s", h.Name, h.IPv4); s != expected[i] {
+			t.Fatalf("%d: %q != %q", i, s, expected[i])
+		}
+	}
+	if got := ParseAvahiBrowse(""); len(got) != 0 {
+		t.Fatal(got)
+	}
+}
+
+func TestUnescapeAvahi(t *testing.T) {
+	data := []struct {
+		in, expected string
+	}{
+		{"raspberrypi", "raspberrypi"},
+		{`Living\032Room`, "Living Room"},
+		{`a\059b\092c`, `a;b\c`},
+		{`a\.b`, "a.b"},
+		{`a\`, `a\`},
+		{`a\03`, "a03"},
+		{`\999`, "999"},
+	}
+	for i, l := range data {
+		if got := unescapeAvahi(l.in); got != l.expected {
+			t.Fatalf("%d: %q != %q", i, got, l.expected)
+		}
+	}
+}
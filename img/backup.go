@@ -0,0 +1,209 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// Backup reads the content of disk and writes it to dst compressed with gzip,
+// the default compression. Use BackupWithCompression to select another one.
+//
+// This is the reverse of Flash. If disk has a MBR partition table, the
+// unpartitioned space after the last partition is skipped. Otherwise the whole
+// disk is read. Reading stops early when ctx is canceled.
+func Backup(ctx context.Context, disk, dst string, o *Options) error {
+	return BackupWithCompression(ctx, disk, dst, Compression{Format: "gz", Level: compressionLevels["gz"][2]}, o)
+}
+
+// BackupWithCompression is like Backup, with dst compressed with c.
+func BackupWithCompression(ctx context.Context, disk, dst string, c Compression, o *Options) error {
+	if err := checkDisk(disk); err != nil {
+		return err
+	}
+	if err := Umount(disk, o); err != nil {
+		return err
+	}
+	r, err := openDisk(disk, 512, o)
+	if err != nil {
+		return err
+	}
+	h, err := io.ReadAll(r)
+	if err2 := r.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the partition table of %s: %w", disk, err)
+	}
+	size := usedSize(h)
+	if size == 0 {
+		Progressf("- No MBR partition table found; reading the whole disk\n")
+	}
+
+	Progressf("- Reading %s into %s with %s\n", disk, dst, c)
+	/* #nosec G304 */
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	w, err := c.NewWriter(f)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	if r, err = openDisk(disk, size, o); err != nil {
+		_ = w.Close()
+		_ = f.Close()
+		return err
+	}
+	err = copyProgress(ctx, w, r, size)
+	if err2 := r.Close(); err == nil {
+		err = err2
+	}
+	if err2 := w.Close(); err == nil {
+		err = err2
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// usedSize returns the number of bytes up to the end of the last partition
+// described in the MBR h.
+//
+// Returns 0 if h is not a valid MBR or it is a GPT protective MBR.
+func usedSize(h []byte) int64 {
+	// The GPT header is past h so it fails to be read.
+	parts, err := ReadPartitions(bytes.NewReader(h[:min(len(h), SectorSize)]))
+	if err != nil {
+		return 0
+	}
+	var end int64
+	for _, p := range parts {
+		end = max(end, p.Offset+p.Size)
+	}
+	return end
+}
+
+// openDisk opens disk for reading the first n bytes. n == 0 means the whole
+// disk.
+func openDisk(disk string, n int64, o *Options) (io.ReadCloser, error) {
+	if runtime.GOOS == "windows" {
+		// Requires the process to be running as an admin account with an high
+		// level token.
+		/* #nosec G304 */
+		f, err := os.Open(disk)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return f, nil
+		}
+		return &limitedReadCloser{io.LimitReader(f, n), f}, nil
+	}
+	if runtime.GOOS == "darwin" {
+		disk = toRawDiskOSX(disk)
+	}
+	// OSX uses 'M' but Ubuntu uses 'm' but using numbers works everywhere.
+	const bs = 1024 * 1024
+	args := []string{"dd", fmt.Sprintf("bs=%d", bs), "if=" + disk}
+	if n != 0 {
+		// BSD dd doesn't support count_bytes; round up to the block size and
+		// trim afterward.
+		args = append(args, fmt.Sprintf("count=%d", (n+bs-1)/bs))
+	}
+	name, args, err := sudoCommand("sudo", args, o.noSudo())
+	if err != nil {
+		return nil, err
+	}
+	/* #nosec G204 */
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = io.Discard
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	c := &cmdReadCloser{cmd: cmd, r: out}
+	if n == 0 {
+		return c, nil
+	}
+	return &limitedReadCloser{io.LimitReader(out, n), c}, nil
+}
+
+// copyProgress copies src to dst while printing the progress.
+//
+// size is the expected number of bytes. If 0, the number of bytes copied so
+// far is printed instead. It stops early when ctx is canceled.
+func copyProgress(ctx context.Context, dst io.Writer, src io.Reader, size int64) error {
+	b := make([]byte, 1024*1024)
+	r := bufio.NewReaderSize(src, len(b))
+	o := int64(0)
+	for {
+		if err := ctx.Err(); err != nil {
+			Progressf("\n")
+			return err
+		}
+		n, err := r.Read(b)
+		if n != 0 {
+			if _, err2 := dst.Write(b[:n]); err2 != nil {
+				return err2
+			}
+			o += int64(n)
+			if size != 0 {
+				Progressf("\r%.1f%%", float64(o)*100./float64(size))
+			} else {
+				Progressf("\r%s", formatSize(o))
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	Progressf("\n")
+	if size != 0 && o != size {
+		return fmt.Errorf("short read: %d bytes out of %d", o, size)
+	}
+	return nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// cmdReadCloser reads the stdout of a process and waits for it on Close.
+type cmdReadCloser struct {
+	cmd *exec.Cmd
+	r   io.ReadCloser
+}
+
+func (c *cmdReadCloser) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *cmdReadCloser) Close() error {
+	// Drain so the process can exit cleanly; dd may have read a bit more than
+	// needed when the size is not a multiple of its block size.
+	_, _ = io.Copy(io.Discard, c.r)
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("failed to read the disk: %w", err)
+	}
+	return nil
+}
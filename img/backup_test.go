@@ -0,0 +1,67 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestUsedSize(t *testing.T) {
+	h := make([]byte, 512)
+	h[510] = 0x55
+	h[511] = 0xAA
+	if n := usedSize(h); n != 0 {
+		t.Fatal(n)
+	}
+	// Partition 1: FAT32 LBA from sector 8192 for 524288 sectors.
+	// Partition 2: Linux from sector 532480 for 3612672 sectors.
+	for i, p := range [][3]uint32{{0x0c, 8192, 524288}, {0x83, 532480, 3612672}} {
+		e := h[446+16*i:]
+		e[4] = byte(p[0])
+		binary.LittleEndian.PutUint32(e[8:], p[1])
+		binary.LittleEndian.PutUint32(e[12:], p[2])
+	}
+	if n := usedSize(h); n != (532480+3612672)*512 {
+		t.Fatal(n)
+	}
+	// Not a MBR.
+	h[511] = 0
+	if n := usedSize(h); n != 0 {
+		t.Fatal(n)
+	}
+}
+
+func TestCopyProgress(t *testing.T) {
+	var out bytes.Buffer
+	if err := copyProgress(context.Background(), &out, strings.NewReader("hello"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "hello" {
+		t.Fatal(out.String())
+	}
+	if err := copyProgress(context.Background(), &out, strings.NewReader("hello"), 10); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := copyProgress(context.Background(), &out, strings.NewReader("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyProgressCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var out bytes.Buffer
+	if err := copyProgress(ctx, &out, strings.NewReader("hello"), 5); !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Fatal(out.String())
+	}
+}
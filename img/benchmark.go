@@ -0,0 +1,113 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+)
+
+const (
+	// benchmarkSize is the amount of data written by Benchmark.
+	benchmarkSize = 16 * 1024 * 1024
+	// minSpeed is the write speed in bytes per second under which a card is
+	// considered implausibly slow. Even class 2 cards do better.
+	minSpeed = 2 * 1000 * 1000
+	// maxSize is the largest capacity allowed by the SDXC specification. Larger
+	// SDUC cards are rare enough that this is most likely a fake capacity card.
+	maxSize = 2 * 1000 * 1000 * 1000 * 1000
+)
+
+// BenchmarkResult is the result of Benchmark.
+type BenchmarkResult struct {
+	// Written is the number of bytes written.
+	Written int64
+	// Duration is the time it took to write, including flushing.
+	Duration time.Duration
+	// DiskSize is the size reported by the disk, or 0 if unknown.
+	DiskSize int64
+}
+
+// Speed returns the write speed in bytes per second.
+func (b *BenchmarkResult) Speed() float64 {
+	if b.Duration <= 0 {
+		return 0
+	}
+	return float64(b.Written) / b.Duration.Seconds()
+}
+
+// Warnings returns the reasons to suspect the disk is counterfeit or failing,
+// if any.
+func (b *BenchmarkResult) Warnings() []string {
+	var out []string
+	if s := b.Speed(); s < minSpeed {
+		out = append(out, fmt.Sprintf("it writes at %.1fMB/s, which is implausibly slow; it may be counterfeit or failing", s/1000/1000))
+	}
+	if b.DiskSize > maxSize {
+		out = append(out, fmt.Sprintf("it reports a size of %s, more than the SDXC maximum; it may be a fake capacity card", formatSize(b.DiskSize)))
+	}
+	return out
+}
+
+// Benchmark writes the start of imgPath to disk and measures the write speed.
+//
+// It is meant to be called right before Flash, which overwrites the data
+// written. It uses the same write path and does the same checks as Flash.
+func Benchmark(ctx context.Context, imgPath, disk string, o *Options) (*BenchmarkResult, error) {
+	if isRegularFile(disk) {
+		return nil, errors.New("can't benchmark a regular file")
+	}
+	fi, err := os.Stat(imgPath)
+	if err != nil {
+		return nil, err
+	}
+	// Write whole blocks of the image only.
+	const blockSize = 1024 * 1024
+	blocks := min(fi.Size(), benchmarkSize) / blockSize
+	if blocks == 0 {
+		return nil, fmt.Errorf("%s is too small to benchmark", imgPath)
+	}
+	m := &bmap{imageSize: fi.Size(), blockSize: blockSize, ranges: []bmapRange{{0, blocks - 1}}}
+	if err = checkDisk(disk); err != nil {
+		return nil, err
+	}
+	if err = checkNotSystemDisk(disk, o); err != nil {
+		return nil, err
+	}
+	if err = Umount(disk, o); err != nil {
+		return nil, err
+	}
+	r := &BenchmarkResult{Written: m.mappedBytes(), DiskSize: DiskSize(disk)}
+	Progressf("- Benchmarking %s\n", disk)
+	switch runtime.GOOS {
+	case "darwin", "linux":
+		// Cache the credentials first so the password prompt isn't timed.
+		if err = run(o, "sudo", "-v"); err != nil {
+			return nil, err
+		}
+		dst := disk
+		if runtime.GOOS == "darwin" {
+			dst = toRawDiskOSX(disk)
+		}
+		// Only the writes and the flush are timed.
+		start := time.Now()
+		if err = ddWriteBmap(ctx, imgPath, dst, m, o); err == nil {
+			err = run(o, "sudo", "sync")
+		}
+		r.Duration = time.Since(start)
+	case "windows":
+		r.Duration, err = benchmarkWindows(imgPath, disk, r.Written)
+	default:
+		return nil, fmt.Errorf("Benchmark(): %w", ErrUnsupportedOS)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
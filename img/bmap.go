@@ -0,0 +1,140 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FlashWithBmap flashes imgPath to disk, only writing the blocks listed in
+// the block map file bmapPath.
+//
+// The block map file is the format used by bmaptool, commonly distributed
+// alongside Yocto images. It lists the blocks containing data, so the unused
+// space in the partitions is not written, which is significantly faster.
+//
+// If bmapPath is empty, the block map file found by FindBmap is used, else it
+// falls back to Flash. Blocks are never skipped based on their content since
+// the card is not guaranteed to be blank.
+func FlashWithBmap(ctx context.Context, imgPath, bmapPath, disk string, o *Options) error {
+	if bmapPath == "" {
+		if bmapPath = FindBmap(imgPath); bmapPath == "" {
+			return Flash(ctx, imgPath, disk, o)
+		}
+		Progressf("- Using the block map %s\n", bmapPath)
+	}
+	/* #nosec G304 */
+	f, err := os.Open(bmapPath)
+	if err != nil {
+		return err
+	}
+	m, err := parseBmap(f)
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", bmapPath, err)
+	}
+	fi, err := os.Stat(imgPath)
+	if err != nil {
+		return err
+	}
+	if fi.Size() != m.imageSize {
+		return fmt.Errorf("%s describes an image of %d bytes but %s is %d bytes", bmapPath, m.imageSize, imgPath, fi.Size())
+	}
+	return flash(ctx, imgPath, disk, m, o)
+}
+
+// FindBmap returns the block map file next to imgPath, as named by bmaptool,
+// e.g. foo.img.bmap or foo.bmap for foo.img. It returns an empty string if
+// there is none.
+func FindBmap(imgPath string) string {
+	for _, p := range []string{imgPath + ".bmap", strings.TrimSuffix(imgPath, filepath.Ext(imgPath)) + ".bmap"} {
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() {
+			return p
+		}
+	}
+	return ""
+}
+
+// bmapRange is an inclusive range of blocks.
+type bmapRange struct {
+	first, last int64
+}
+
+// bmap is a parsed bmaptool block map.
+type bmap struct {
+	imageSize int64
+	blockSize int64
+	ranges    []bmapRange
+}
+
+// mappedBytes returns the number of bytes to write.
+func (m *bmap) mappedBytes() int64 {
+	n := int64(0)
+	for _, r := range m.ranges {
+		n += (r.last - r.first + 1) * m.blockSize
+	}
+	return n
+}
+
+// bmapXML is the schema of a bmaptool block map file.
+//
+// https://github.com/yoctoproject/bmaptool
+type bmapXML struct {
+	XMLName   xml.Name `xml:"bmap"`
+	ImageSize string
+	BlockSize string
+	BlockMap  struct {
+		Range []string
+	}
+}
+
+func parseBmap(r io.Reader) (*bmap, error) {
+	v := bmapXML{}
+	if err := xml.NewDecoder(r).Decode(&v); err != nil {
+		return nil, err
+	}
+	m := &bmap{}
+	var err error
+	if m.imageSize, err = strconv.ParseInt(strings.TrimSpace(v.ImageSize), 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid ImageSize: %w", err)
+	}
+	if m.blockSize, err = strconv.ParseInt(strings.TrimSpace(v.BlockSize), 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid BlockSize: %w", err)
+	}
+	if m.blockSize <= 0 || m.blockSize%512 != 0 {
+		return nil, fmt.Errorf("invalid BlockSize %d", m.blockSize)
+	}
+	blocks := (m.imageSize + m.blockSize - 1) / m.blockSize
+	for _, s := range v.BlockMap.Range {
+		s = strings.TrimSpace(s)
+		first, last, found := strings.Cut(s, "-")
+		if !found {
+			last = first
+		}
+		r := bmapRange{}
+		if r.first, err = strconv.ParseInt(first, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid Range %q: %w", s, err)
+		}
+		if r.last, err = strconv.ParseInt(last, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid Range %q: %w", s, err)
+		}
+		if r.first < 0 || r.last < r.first || r.last >= blocks {
+			return nil, fmt.Errorf("invalid Range %q", s)
+		}
+		if len(m.ranges) != 0 && r.first <= m.ranges[len(m.ranges)-1].last {
+			return nil, errors.New("ranges are not sorted")
+		}
+		m.ranges = append(m.ranges, r)
+	}
+	return m, nil
+}
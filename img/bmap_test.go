@@ -0,0 +1,91 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseBmap(t *testing.T) {
+	const data = `<?xml version="1.0" ?>
+<bmap version="2.0">
+    <ImageSize> 821752 </ImageSize>
+    <BlockSize> 4096 </BlockSize>
+    <BlocksCount> 201 </BlocksCount>
+    <MappedBlocksCount> 6 </MappedBlocksCount>
+    <ChecksumType> sha256 </ChecksumType>
+    <BlockMap>
+        <Range chksum="d9cf7d503b7936a4ba1fa3e8bf0eb1aa0e0ce1b4e22b3ba2b5fa8d88ffc8e45a"> 0-1 </Range>
+        <Range chksum="b6e7f8bb9c0ff9ee2efec8f7bd0bf9a1d3a1b8a1ee8c58b6b1b8c79d1f8d9a1c"> 3-5 </Range>
+        <Range chksum="8d1b1bc6e5a6f2d9a0d9d49b6fc7e7bd4e6f1a8c0a1d2f8b8f1a9e1b2c3d4e5f"> 200 </Range>
+    </BlockMap>
+</bmap>
+`
+	m, err := parseBmap(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.imageSize != 821752 || m.blockSize != 4096 {
+		t.Fatalf("%#v", m)
+	}
+	expected := []bmapRange{{0, 1}, {3, 5}, {200, 200}}
+	if len(m.ranges) != len(expected) {
+		t.Fatalf("%#v", m.ranges)
+	}
+	for i := range expected {
+		if m.ranges[i] != expected[i] {
+			t.Fatalf("%d: %#v", i, m.ranges[i])
+		}
+	}
+	if n := m.mappedBytes(); n != 6*4096 {
+		t.Fatal(n)
+	}
+}
+
+func TestParseBmapInvalid(t *testing.T) {
+	data := []string{
+		"",
+		"<bmap><ImageSize>a</ImageSize><BlockSize>4096</BlockSize></bmap>",
+		"<bmap><ImageSize>8192</ImageSize><BlockSize>100</BlockSize></bmap>",
+		"<bmap><ImageSize>8192</ImageSize><BlockSize>4096</BlockSize><BlockMap><Range>2</Range></BlockMap></bmap>",
+		"<bmap><ImageSize>8192</ImageSize><BlockSize>4096</BlockSize><BlockMap><Range>1-0</Range></BlockMap></bmap>",
+		"<bmap><ImageSize>8192</ImageSize><BlockSize>4096</BlockSize><BlockMap><Range>1</Range><Range>0</Range></BlockMap></bmap>",
+	}
+	for i, in := range data {
+		if _, err := parseBmap(strings.NewReader(in)); err == nil {
+			t.Fatalf("%d: expected error", i)
+		}
+	}
+}
+
+func TestFindBmap(t *testing.T) {
+	d := t.TempDir()
+	a := filepath.Join(d, "a.img")
+	if p := FindBmap(a); p != "" {
+		t.Fatal(p)
+	}
+	if err := os.WriteFile(filepath.Join(d, "a.bmap"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if p := FindBmap(a); p != filepath.Join(d, "a.bmap") {
+		t.Fatal(p)
+	}
+	// The full image name is preferred.
+	if err := os.WriteFile(a+".bmap", nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if p := FindBmap(a); p != a+".bmap" {
+		t.Fatal(p)
+	}
+	if err := os.Mkdir(filepath.Join(d, "b.img.bmap"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if p := FindBmap(filepath.Join(d, "b.img")); p != "" {
+		t.Fatal(p)
+	}
+}
@@ -5,18 +5,24 @@
 package img
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
-
-	"github.com/ulikunitz/xz"
+	"time"
 )
 
 // Manufacturer is a board brand manufacturer.
@@ -27,6 +33,16 @@ const (
 	HardKernel Manufacturer = "hardkernel"
 	// Raspberry is Raspberry Pi foundation; https://www.raspberrypi.org/about/
 	Raspberry Manufacturer = "raspberrypi"
+	// NVIDIA makes the Jetson boards; https://developer.nvidia.com/embedded
+	//
+	// Their images are not supported, see resolve().
+	NVIDIA Manufacturer = "nvidia"
+	// Sinovoip makes the Banana Pi boards; https://www.banana-pi.org/
+	Sinovoip Manufacturer = "sinovoip"
+	// Xunlong makes the Orange Pi boards; http://www.orangepi.org/
+	Xunlong Manufacturer = "xunlong"
+	// Radxa makes the Rock boards; https://radxa.com/
+	Radxa Manufacturer = "radxa"
 
 	// NextThingCo was a company at https://getchip.com
 	NextThingCo Manufacturer = "ntc"
@@ -36,7 +52,7 @@ func (m *Manufacturer) String() string {
 	return string(*m)
 }
 
-var manufacturers = []Manufacturer{HardKernel, NextThingCo, Raspberry}
+var manufacturers = []Manufacturer{HardKernel, NextThingCo, NVIDIA, Radxa, Raspberry, Sinovoip, Xunlong}
 
 // Set implements flag.Value.
 func (m *Manufacturer) Set(s string) error {
@@ -50,35 +66,87 @@ func (m *Manufacturer) Set(s string) error {
 }
 
 // ManufacturerHelp generates the help for Manufacturer.
+//
+// The manufacturers whose images can't be provisioned are marked as fetch
+// only.
 func ManufacturerHelp() string {
 	var names []string
 	for _, e := range manufacturers {
-		names = append(names, string(e))
+		n := string(e)
+		if e.FetchOnly() {
+			n += " (fetch only)"
+		}
+		names = append(names, n)
 	}
 	sort.Strings(names)
 	return fmt.Sprintf("Board manufacturer: %s", strings.Join(names, ", "))
 }
 
-// boards return the boards that need a separate image.
+// FetchOnly returns true if the images of the manufacturer can be fetched,
+// e.g. with efe -print-url, but not provisioned: Armbian has no FAT boot
+// partition and Radxa's Debian doesn't mount its FAT partition as /boot.
+func (m *Manufacturer) FetchOnly() bool {
+	return *m == Radxa || *m == Sinovoip || *m == Xunlong
+}
+
+// boards return the boards that need a separate image, including the ones
+// loaded with LoadBoards.
 func (m *Manufacturer) boards() []Board {
+	out := m.builtinBoards()
+	for _, c := range customBoards {
+		if c.Manufacturer == *m && !containsName(out, c.Board) {
+			out = append(out, c.Board)
+		}
+	}
+	return out
+}
+
+// builtinBoards return the boards supported without a definition file.
+func (m *Manufacturer) builtinBoards() []Board {
 	switch *m {
 	case HardKernel:
 		return []Board{OdroidC1}
 	case NextThingCo:
 		return []Board{CHIP, CHIPPro, PocketCHIP}
 	case Raspberry:
-		// All boards use the same images on RaspiOS, so from our point of view,
-		// they are all the same.
-		// TODO(maruel): That's not true for Ubuntu, since they provide arm64
-		// images that only works on RPi3 and later.
-		return []Board{RaspberryPi}
+		// All boards use the same images, so the generic one is kept as the
+		// default. The specific models only change the default distro and the
+		// config.txt edits.
+		return []Board{RaspberryPi, RaspberryPiZero, RaspberryPiZero2, RaspberryPi3, RaspberryPi4, RaspberryPi5}
+	case NVIDIA:
+		return []Board{JetsonNano}
+	case Sinovoip:
+		return []Board{BananaPiM2Plus}
+	case Xunlong:
+		return []Board{OrangePiPC, OrangePiZero}
+	case Radxa:
+		return []Board{RockPi4, Rock3A}
 	default:
 		return nil
 	}
 }
 
-// distros return the distros valid.
+// distros return the distros valid, including the ones loaded with
+// LoadBoards.
 func (m *Manufacturer) distros() []Distro {
+	out := m.builtinDistros("")
+	for _, c := range customBoards {
+		if c.Manufacturer != *m {
+			continue
+		}
+		for _, d := range c.Distros {
+			if !containsName(out, d) {
+				out = append(out, d)
+			}
+		}
+	}
+	return out
+}
+
+// builtinDistros return the distros supported without a definition file on
+// the board b, the default one first. An empty board means any board of the
+// manufacturer.
+func (m *Manufacturer) builtinDistros(b Board) []Distro {
 	switch *m {
 	case HardKernel:
 		return []Distro{Ubuntu}
@@ -86,8 +154,25 @@ func (m *Manufacturer) distros() []Distro {
 		// debian-headless
 		return []Distro{Debian}
 	case Raspberry:
-		// raspios-lite
-		return []Distro{RaspiOS, RaspiOS64, Ubuntu}
+		switch b {
+		case RaspberryPiZero:
+			// The BCM2835 is armv6, which only the 32 bits RaspiOS supports.
+			return []Distro{RaspiOS}
+		case RaspberryPi3, RaspberryPi4, RaspberryPi5:
+			return []Distro{RaspiOS64, RaspiOS, Ubuntu}
+		default:
+			// The Zero 2 W is arm64 capable but its 512MiB of RAM is better used
+			// with armhf.
+			return []Distro{RaspiOS, RaspiOS64, Ubuntu}
+		}
+	case NVIDIA:
+		// L4T, which is based on Ubuntu.
+		return []Distro{Ubuntu}
+	case Sinovoip, Xunlong:
+		return []Distro{Armbian}
+	case Radxa:
+		// Debian is Radxa's own image.
+		return []Distro{Armbian, Debian}
 	default:
 		return nil
 	}
@@ -101,8 +186,35 @@ type Board string
 const (
 	// OdroidC1 is a board sold by HardKernel.
 	OdroidC1 Board = "odroidc1"
-	// RaspberryPi is a series of boards sold by Raspberry.
+	// RaspberryPi is a series of boards sold by Raspberry. Use it when the
+	// image is meant to boot on any model.
 	RaspberryPi Board = "raspberrypi"
+	// RaspberryPiZero is the Raspberry Pi Zero and Zero W.
+	RaspberryPiZero Board = "rpizero"
+	// RaspberryPiZero2 is the Raspberry Pi Zero 2 W.
+	RaspberryPiZero2 Board = "rpizero2"
+	// RaspberryPi3 is the Raspberry Pi 3 B and B+.
+	RaspberryPi3 Board = "rpi3"
+	// RaspberryPi4 is the Raspberry Pi 4 B and 400.
+	RaspberryPi4 Board = "rpi4"
+	// RaspberryPi5 is the Raspberry Pi 5.
+	RaspberryPi5 Board = "rpi5"
+
+	// JetsonNano is the Jetson Nano Developer Kit sold by NVIDIA.
+	JetsonNano Board = "jetsonnano"
+
+	// BananaPiM2Plus is the Banana Pi M2+ sold by Sinovoip.
+	BananaPiM2Plus Board = "bananapim2plus"
+
+	// OrangePiPC is the Orange Pi PC sold by Xunlong.
+	OrangePiPC Board = "orangepipc"
+	// OrangePiZero is the Orange Pi Zero sold by Xunlong.
+	OrangePiZero Board = "orangepizero"
+
+	// RockPi4 is the ROCK Pi 4 B sold by Radxa.
+	RockPi4 Board = "rockpi4"
+	// Rock3A is the ROCK 3A sold by Radxa.
+	Rock3A Board = "rock3a"
 
 	// CHIP used to be sold by NextThingCo.
 	CHIP Board = "chip"
@@ -112,7 +224,36 @@ const (
 	PocketCHIP Board = "pocketchip"
 )
 
-var boards = []Board{OdroidC1, RaspberryPi, CHIP, CHIPPro, PocketCHIP}
+var boards = []Board{OdroidC1, RaspberryPi, RaspberryPiZero, RaspberryPiZero2, RaspberryPi3, RaspberryPi4, RaspberryPi5, JetsonNano, BananaPiM2Plus, OrangePiPC, OrangePiZero, RockPi4, Rock3A, CHIP, CHIPPro, PocketCHIP}
+
+// boardArch is the GOARCH and GOARM values to build executables running on a
+// board. The Raspberry Pi 3 and later are arm64 capable but armv7 runs on both
+// the 32 and 64 bits RaspiOS.
+var boardArch = map[Board][2]string{
+	OdroidC1:         {"arm", "7"},
+	RaspberryPi:      {"arm", "6"},
+	RaspberryPiZero:  {"arm", "6"},
+	RaspberryPiZero2: {"arm", "7"},
+	RaspberryPi3:     {"arm", "7"},
+	RaspberryPi4:     {"arm", "7"},
+	RaspberryPi5:     {"arm", "7"},
+	JetsonNano:       {"arm64", ""},
+	BananaPiM2Plus:   {"arm", "7"},
+	OrangePiPC:       {"arm", "7"},
+	OrangePiZero:     {"arm", "7"},
+	RockPi4:          {"arm64", ""},
+	Rock3A:           {"arm64", ""},
+	CHIP:             {"arm", "7"},
+	CHIPPro:          {"arm", "7"},
+	PocketCHIP:       {"arm", "7"},
+}
+
+// GoArch returns the GOARCH and GOARM values to cross compile executables for
+// the board. goarm is empty when goarch is not arm.
+func (b *Board) GoArch() (goarch, goarm string) {
+	a := boardArch[*b]
+	return a[0], a[1]
+}
 
 func (b *Board) String() string {
 	return string(*b)
@@ -139,10 +280,43 @@ func BoardHelp() string {
 	return fmt.Sprintf("Boards: %s", strings.Join(names, ", "))
 }
 
+// ImageBoardHelp returns the help for the boards an image can be fetched
+// for, with the boards whose images can't be provisioned marked as fetch
+// only.
+func ImageBoardHelp() string {
+	var names []string
+	for _, e := range boards {
+		n := string(e)
+		if e.fetchOnly() {
+			n += " (fetch only)"
+		}
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("Boards: %s", strings.Join(names, ", "))
+}
+
+// fetchOnly returns true if the board is only made by fetch only
+// manufacturers.
+func (b *Board) fetchOnly() bool {
+	found := false
+	for _, m := range manufacturers {
+		if containsName(m.builtinBoards(), *b) {
+			if !m.FetchOnly() {
+				return false
+			}
+			found = true
+		}
+	}
+	return found
+}
+
 // Distro is an OS distribution.
 type Distro string
 
 const (
+	// Armbian is https://www.armbian.com/
+	Armbian Distro = "armbian"
 	// Debian is https://www.debian.org/
 	Debian Distro = "debian"
 	// RaspiOS is Raspberry Pi OS Lite.
@@ -155,7 +329,7 @@ const (
 	Ubuntu Distro = "ubuntu"
 )
 
-var distros = []Distro{Debian, RaspiOS, RaspiOS64, Ubuntu}
+var distros = []Distro{Armbian, Debian, RaspiOS, RaspiOS64, Ubuntu}
 
 func (d *Distro) String() string {
 	return string(*d)
@@ -188,12 +362,42 @@ type Image struct {
 	Manufacturer Manufacturer
 	Board        Board
 	Distro       Distro
+	// Mirror is the base URL of a mirror to fetch the image from, e.g.
+	// "https://de.eu.odroid.in". It substitutes the scheme and host of the
+	// default URL. If fetching from the mirror fails, the default URL is used.
+	Mirror string
+	// Date is the date of the RaspiOS release directory to use, formatted as
+	// YYYY-MM-DD. The latest release is used when empty.
+	Date string
 }
 
 func (i *Image) String() string {
 	return fmt.Sprintf("%s:%s:%s", i.Manufacturer, i.Board, i.Distro)
 }
 
+// ParseImage parses an image in the "manufacturer:board:distro" form returned
+// by Image.String.
+//
+// Any part can be omitted, e.g. "raspberrypi::raspios" or ":rpi4", as well as
+// the trailing separators, e.g. "raspberrypi". Call Check to fill the omitted
+// parts with their default.
+func ParseImage(s string) (Image, error) {
+	var i Image
+	parts := strings.Split(s, ":")
+	if s == "" || len(parts) > 3 {
+		return i, fmt.Errorf("invalid image %q; use manufacturer:board:distro", s)
+	}
+	for n, v := range []flag.Value{&i.Manufacturer, &i.Board, &i.Distro} {
+		if n >= len(parts) || parts[n] == "" {
+			continue
+		}
+		if err := v.Set(parts[n]); err != nil {
+			return Image{}, fmt.Errorf("invalid image %q: %w", s, err)
+		}
+	}
+	return i, nil
+}
+
 // Check sets default values and confirm specified values.
 func (i *Image) Check() error {
 	if i.Manufacturer == "" {
@@ -206,10 +410,26 @@ func (i *Image) Check() error {
 			i.Manufacturer = NextThingCo
 		case OdroidC1:
 			i.Manufacturer = HardKernel
-		case RaspberryPi:
+		case RaspberryPi, RaspberryPiZero, RaspberryPiZero2, RaspberryPi3, RaspberryPi4, RaspberryPi5:
 			i.Manufacturer = Raspberry
+		case JetsonNano:
+			i.Manufacturer = NVIDIA
+		case BananaPiM2Plus:
+			i.Manufacturer = Sinovoip
+		case OrangePiPC, OrangePiZero:
+			i.Manufacturer = Xunlong
+		case RockPi4, Rock3A:
+			i.Manufacturer = Radxa
 		default:
-			return errors.New("unknown board")
+			for _, c := range customBoards {
+				if c.Board == i.Board {
+					i.Manufacturer = c.Manufacturer
+					break
+				}
+			}
+			if i.Manufacturer == "" {
+				return errors.New("unknown board")
+			}
 		}
 	} else {
 		b := i.Manufacturer.boards()
@@ -232,23 +452,124 @@ func (i *Image) Check() error {
 		}
 	}
 
+	builtin := containsName(i.Manufacturer.builtinBoards(), i.Board)
 	if i.Distro == "" {
-		di := i.Manufacturer.distros()
+		di := i.Manufacturer.builtinDistros(i.Board)
+		if !builtin {
+			// A board loaded with LoadBoards; use its first distro.
+			di = nil
+			for _, c := range customBoards {
+				if c.Manufacturer == i.Manufacturer && c.Board == i.Board {
+					di = c.Distros
+					break
+				}
+			}
+		}
 		if len(di) == 0 {
 			return errors.New("unknown manufacturer")
 		}
 		i.Distro = di[0]
+	} else if builtin && i.custom() == nil && !containsName(i.Manufacturer.builtinDistros(i.Board), i.Distro) {
+		return fmt.Errorf("distro %s is not supported on board %s", i.Distro, i.Board)
+	}
+	if i.Mirror != "" {
+		u, err := url.Parse(i.Mirror)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid mirror %q; it must be a http or https URL", i.Mirror)
+		}
 	}
 	return nil
 }
 
+// BootPartition returns the partition number (1 based) of the FAT boot
+// partition in the image.
+func (i *Image) BootPartition() int {
+	if c := i.custom(); c != nil {
+		return c.BootPartition
+	}
+	// All the built-in images use the same layout.
+	return 1
+}
+
+// RootPartition returns the partition number (1 based) of the EXT4 root
+// partition in the image.
+func (i *Image) RootPartition() int {
+	if c := i.custom(); c != nil {
+		return c.RootPartition
+	}
+	if i.Distro == Armbian {
+		// Armbian has a single partition, with /boot in it.
+		return 1
+	}
+	if i.Manufacturer == Radxa {
+		// The GPT has a FAT config partition and a FAT boot partition before the
+		// root one.
+		return 3
+	}
+	return 2
+}
+
+// PiModel returns the config.txt conditional filter matching the board, or
+// an empty string for the generic RaspberryPi board and other manufacturers.
+//
+// https://www.raspberrypi.com/documentation/computers/config_txt.html#model-filters
+func (i *Image) PiModel() string {
+	switch i.Board {
+	case RaspberryPiZero:
+		return "pi0"
+	case RaspberryPiZero2:
+		return "pi02"
+	case RaspberryPi3:
+		return "pi3"
+	case RaspberryPi4:
+		return "pi4"
+	case RaspberryPi5:
+		return "pi5"
+	default:
+		return ""
+	}
+}
+
+// EstimatedSize returns the approximate size in bytes of the decompressed
+// image, for free space checks before fetching it.
+func (i *Image) EstimatedSize() int64 {
+	const gib = 1024 * 1024 * 1024
+	switch i.Manufacturer {
+	case HardKernel:
+		return 2 * gib
+	case Raspberry:
+		if i.Distro == Ubuntu {
+			return 4 * gib
+		}
+		return 3 * gib
+	case Sinovoip, Xunlong:
+		// The minimal images.
+		return 2 * gib
+	case Radxa:
+		if i.Distro == Armbian {
+			return 2 * gib
+		}
+		return 4 * gib
+	default:
+		return 4 * gib
+	}
+}
+
 // DefaultUser returns the default user account created by the image.
 func (i *Image) DefaultUser() string {
+	if c := i.custom(); c != nil {
+		return c.DefaultUser
+	}
 	switch i.Manufacturer {
 	case HardKernel:
-		return "chip"
-	case NextThingCo:
 		return "odroid"
+	case NextThingCo:
+		// The Debian images flashed on the C.H.I.P. family, including the
+		// PocketCHIP one with pocket-home, all create the same account.
+		switch i.Board {
+		case CHIP, CHIPPro, PocketCHIP:
+			return "chip"
+		}
 	case Raspberry:
 		switch i.Distro {
 		case RaspiOS, RaspiOS64:
@@ -256,122 +577,402 @@ func (i *Image) DefaultUser() string {
 		case Ubuntu:
 			return "ubuntu"
 		}
+	case Sinovoip, Xunlong:
+		// Armbian asks to create a user on the first root login.
+		return "root"
+	case Radxa:
+		if i.Distro == Armbian {
+			return "root"
+		}
+		return "radxa"
 	}
 	return ""
 }
 
 // DefaultHostname returns the default hostname as set by the image.
 func (i *Image) DefaultHostname() string {
+	if c := i.custom(); c != nil {
+		return c.DefaultHostname
+	}
 	switch i.Manufacturer {
 	case HardKernel:
-		return "chip"
-	case NextThingCo:
 		return "odroid"
+	case NextThingCo:
+		// The PocketCHIP image is the C.H.I.P. one with pocket-home installed,
+		// and the CHIP Pro Debian image kept the same hostname.
+		switch i.Board {
+		case CHIP, CHIPPro, PocketCHIP:
+			return "chip"
+		}
+		return ""
 	case Raspberry:
 		return "raspberrypi"
+	case Sinovoip, Xunlong:
+		// Armbian uses the board name.
+		return armbianBoard(i.Board)
+	case Radxa:
+		if i.Distro == Armbian {
+			return armbianBoard(i.Board)
+		}
+		// Radxa uses the product name, which is also the repository name.
+		return path.Base(radxaRepo(i.Board))
 	default:
 		return ""
 	}
 }
 
+// FetchResult describes the image fetched by FetchDetails.
+type FetchResult struct {
+	// Path is the absolute path to the decompressed image.
+	Path string
+	// URL is the URL the image is fetched from, without the mirror
+	// substitution.
+	URL string
+	// Date is the release date of the image, or its version when the date is
+	// not known.
+	Date string
+	// Size is the size of the decompressed image in bytes.
+	Size int64
+}
+
 // Fetch fetches the distro image remotely.
 //
 // Returns the absolute path to the file downloaded.
-func (i *Image) Fetch() (string, error) {
+//
+// When ctx is canceled, e.g. on Ctrl-C, the download stops as soon as possible
+// and the partially fetched image is deleted. The returned error wraps
+// context.Canceled, or context.DeadlineExceeded when its deadline expired.
+func (i *Image) Fetch(ctx context.Context, o *Options) (string, error) {
+	r, err := i.FetchDetails(ctx, o)
+	if err != nil {
+		return "", err
+	}
+	return r.Path, nil
+}
+
+// FetchDetails is like Fetch but also returns where the image was fetched
+// from, which is useful to report exactly what was installed.
+//
+// An image already present in the current directory is reused.
+func (i *Image) FetchDetails(ctx context.Context, o *Options) (*FetchResult, error) {
+	if o.offline() {
+		return nil, fmt.Errorf("Fetch(): %w", ErrOffline)
+	}
+	c := i.custom()
+	if c == nil && i.Manufacturer == NextThingCo {
+		// - https://flash.getchip.com/ better to flash then run setup.sh
+		//   manually.
+		return nil, fmt.Errorf("fetching %s is not implemented: %w", i, ErrImageNotFound)
+	}
+	u, name, date, err := i.resolve(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+	imgpath, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	var sig []byte
+	if o.verifySignature() {
+		su, err := i.signatureURL(u)
+		if err != nil {
+			return nil, err
+		}
+		if sig, err = fetchURL(ctx, su, o); err != nil {
+			return nil, err
+		}
+	}
+	if fi, err := os.Stat(imgpath); err == nil {
+		// Only a download can be verified, so a cached image is only reused if
+		// it was verified against the same signature when downloaded.
+		if !o.forceRefresh() && (!o.verifySignature() || isVerified(imgpath, sig)) {
+			Progressf("- Reusing %s image %s\n", i.Distro, imgpath)
+			return &FetchResult{Path: imgpath, URL: u, Date: date, Size: fi.Size()}, nil
+		}
+		Progressf("- Deleting cached image %s\n", imgpath)
+		if err = os.Remove(imgpath); err != nil {
+			return nil, err
+		}
+	}
+	if err = os.Remove(verifiedPath(imgpath)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if c != nil && c.Compression == "none" {
+		err = fetchRawMirror(ctx, i.Mirror, u, imgpath, o)
+	} else {
+		u, err = fetchXZAlternates(ctx, i.Mirror, append([]string{u}, i.alternateURLs()...), imgpath, sig, o)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(imgpath)
+	if err != nil {
+		return nil, err
+	}
+	return &FetchResult{Path: imgpath, URL: u, Date: date, Size: fi.Size()}, nil
+}
+
+// URL returns the URL of the image Fetch would download and the name of the
+// decompressed file, without downloading it.
+//
+// When a mirror is specified, the mirror URL is returned.
+func (i *Image) URL(ctx context.Context, o *Options) (string, string, error) {
+	u, name, _, err := i.resolve(ctx, o)
+	if err != nil {
+		return "", "", err
+	}
+	if i.Mirror != "" {
+		if u, err = mirrorURL(i.Mirror, u); err != nil {
+			return "", "", err
+		}
+	}
+	return u, name, nil
+}
+
+// resolve returns the URL of the image, the name of the decompressed file and
+// the release date of the image.
+func (i *Image) resolve(ctx context.Context, o *Options) (string, string, string, error) {
+	if c := i.custom(); c != nil {
+		// The release date is unknown.
+		u, name := c.resolve(i.Distro)
+		return u, name, "", nil
+	}
 	switch i.Manufacturer {
 	case HardKernel:
-		return fetchHardKernel()
-	case NextThingCo:
-		return "", errors.New("implement me")
+		u, name := hardKernelURL()
+		return u, name, "2017-02-21", nil
 	case Raspberry:
 		switch i.Distro {
 		case RaspiOS:
-			return fetchRPiRaspiOSLite(false)
+			return raspiosGetLatestImageURL(ctx, false, i.Mirror, i.Date, o)
 		case RaspiOS64:
-			return fetchRPiRaspiOSLite(true)
+			return raspiosGetLatestImageURL(ctx, true, i.Mirror, i.Date, o)
 		case Ubuntu:
-			return fetchRPiUbuntu()
+			u, name := rpiUbuntuURL()
+			return u, name, ubuntuVersion, nil
 		}
+	case NVIDIA:
+		// The SD card image is a zip file behind a login wall and its root
+		// partition comes first, without a FAT boot partition.
+		return "", "", "", fmt.Errorf("%s can't be fetched nor provisioned; download the SD card image from https://developer.nvidia.com/embedded/downloads, or use NVIDIA SDK Manager, and flash it with balenaEtcher or dd: %w", i, ErrImageNotFound)
+	case Sinovoip, Xunlong:
+		u, name, version := fetchArmbianBoard(ctx, i.Board, o)
+		return u, name, version, nil
+	case Radxa:
+		if i.Distro == Armbian {
+			u, name, version := fetchArmbianBoard(ctx, i.Board, o)
+			return u, name, version, nil
+		}
+		return fetchRadxa(ctx, i.Board, o)
 	}
 	// - https://www.armbian.com/download/
 	// - https://beagleboard.org/latest-images better to flash then run setup.sh
 	//   manually.
-	// - https://flash.getchip.com/ better to flash then run setup.sh manually.
-	return "", fmt.Errorf("don't know how to fetch %s", i)
+	return "", "", "", fmt.Errorf("don't know how to fetch %s: %w", i, ErrImageNotFound)
 }
 
-func fetchHardKernel() (string, error) {
-	// http://odroid.com/dokuwiki/doku.php?id=en:odroid-c1
-	// http://odroid.in/ubuntu_16.04lts/
-	mirror := "https://odroid.in/ubuntu_16.04lts/"
-	// http://east.us.odroid.in/ubuntu_16.04lts
-	// http://de.eu.odroid.in/ubuntu_16.04lts
-	// http://dn.odroid.com/S805/Ubuntu
-	imgpath, err := filepath.Abs("ubuntu-16.04.2-minimal-odroid-c1-20170221.img")
+// LocalImage returns the path to a raw image for a local image file, instead of
+// fetching it remotely with Fetch.
+//
+// If p is xz compressed, it is decompressed in the current directory and the
+// path to the decompressed file is returned. A decompressed file more recent
+// than p is reused, unless o.ForceRefresh is set. Decompressing stops when ctx
+// is canceled.
+func LocalImage(ctx context.Context, p string, o *Options) (string, error) {
+	/* #nosec G304 */
+	f, err := os.Open(p)
 	if err != nil {
 		return "", err
 	}
-	if f, _ := os.Open(imgpath); f != nil /* #nosec G304 */ {
-		fmt.Printf("- Reusing Ubuntu minimal image %s\n", imgpath)
-		_ = f.Close()
-		return imgpath, nil
-	}
-	imgurl := mirror + imgpath + ".xz"
-	if err := fetchXZ(imgurl, imgpath); err != nil {
+	/* #nosec G307 */
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
 		return "", err
 	}
-	return imgpath, nil
-}
-
-func fetchRPiRaspiOSLite(is64bits bool) (string, error) {
-	imgurl, imgname := raspiosGetLatestImageURL(is64bits)
-	imgpath, err := filepath.Abs(imgname)
+	if fi.IsDir() {
+		return "", fmt.Errorf("%s is a directory", p)
+	}
+	if !strings.HasSuffix(p, ".xz") {
+		return filepath.Abs(p)
+	}
+	imgpath, err := filepath.Abs(filepath.Base(p[:len(p)-3]))
 	if err != nil {
 		return "", err
 	}
-	if f, _ := os.Open(imgpath); f != nil /* #nosec G304 */ {
-		name := "RaspiOS"
-		if is64bits {
-			name += "64"
-		}
-		fmt.Printf("- Reusing %s Lite image %s\n", name, imgpath)
-		_ = f.Close()
+	if di, err := os.Stat(imgpath); err == nil && di.ModTime().After(fi.ModTime()) && !o.forceRefresh() {
+		Progressf("- Reusing decompressed image %s\n", imgpath)
 		return imgpath, nil
 	}
-	if err := fetchXZ(imgurl, imgname); err != nil {
+	Progressf("- Decompressing %s\n", p)
+	if err = decompressXZ(ctx, f, p, imgpath, xzUncompressedSize(f, fi.Size())); err != nil {
 		return "", err
 	}
-	return imgname, nil
+	return imgpath, nil
+}
+
+// alternateURLs returns the URLs to fall back to, in order, when fetching the
+// image from its default URL fails.
+func (i *Image) alternateURLs() []string {
+	if i.custom() != nil || i.Manufacturer != HardKernel {
+		return nil
+	}
+	_, name := hardKernelURL()
+	out := make([]string, 0, len(hardKernelMirrors)-1)
+	for _, m := range hardKernelMirrors[1:] {
+		out = append(out, m+name+".xz")
+	}
+	return out
+}
+
+// hardKernelMirrors are the directories hosting the Odroid C1 image, the
+// default first. They don't share the same path so Image.Mirror can't be used
+// to switch between them. odroid.in is frequently down.
+//
+// http://odroid.com/dokuwiki/doku.php?id=en:odroid-c1
+var hardKernelMirrors = []string{
+	"https://odroid.in/ubuntu_16.04lts/",
+	"https://east.us.odroid.in/ubuntu_16.04lts/",
+	"https://de.eu.odroid.in/ubuntu_16.04lts/",
+	"https://dn.odroid.com/S805/Ubuntu/",
+}
+
+// hardKernelURL returns the URL and the decompressed file name of the Odroid
+// C1 image.
+func hardKernelURL() (string, string) {
+	imgname := "ubuntu-16.04.2-minimal-odroid-c1-20170221.img"
+	return hardKernelMirrors[0] + imgname + ".xz", imgname
 }
 
-func fetchRPiUbuntu() (string, error) {
+// rpiUbuntuURL returns the URL and the decompressed file name of the Ubuntu
+// image for the Raspberry Pi.
+func rpiUbuntuURL() (string, string) {
 	// https://ubuntu.com/download/raspberry-pi
 	// For now, if the user requests ubuntu, assume they want the 64 bits version.
 	// TODO(maruel): Do not hardcode the version.
-	ver := "20.04"
-	imgname := "ubuntu-" + ver + "-preinstalled-server-arm64+raspi.img"
-	imgpath, err := filepath.Abs(imgname)
+	imgname := "ubuntu-" + ubuntuVersion + "-preinstalled-server-arm64+raspi.img"
+	return "http://cdimage.ubuntu.com/releases/" + ubuntuVersion + "/release/" + imgname + ".xz", imgname
+}
+
+// ubuntuVersion is the version of Ubuntu fetched for the Raspberry Pi.
+const ubuntuVersion = "20.04"
+
+// armbianBoard returns the name of the board on the Armbian download site.
+func armbianBoard(b Board) string {
+	switch b {
+	case RockPi4:
+		return "rockpi-4b"
+	case Rock3A:
+		return "rock-3a"
+	default:
+		// The names happen to be the same.
+		return string(b)
+	}
+}
+
+// fetchArmbianBoard returns the URL, the decompressed file name and the
+// version of the latest minimal Armbian image for the board.
+//
+// The Armbian download site redirects to the latest image, which is resolved
+// to get a stable file name. The redirector URL is used as is if it can't be
+// resolved.
+func fetchArmbianBoard(ctx context.Context, b Board, o *Options) (string, string, string) {
+	// https://docs.armbian.com/User-Guide_Getting-Started/
+	latest := "https://dl.armbian.com/" + armbianBoard(b) + "/Bookworm_current_minimal"
+	u, err := resolveRedirect(ctx, latest, o)
+	if err == nil {
+		if name, version, ok := armbianParseImageURL(u); ok {
+			log.Printf("Armbian URL: %s", u)
+			return u, name, version
+		}
+		err = fmt.Errorf("unexpected redirect to %s", u)
+	}
+	log.Printf("failed to resolve %s: %v", latest, err)
+	return latest, "Armbian_" + armbianBoard(b) + "_bookworm_current_minimal.img", ""
+}
+
+// armbianParseImageURL parses the URL of an Armbian image and returns the
+// decompressed file name and the Armbian version.
+func armbianParseImageURL(u string) (string, string, bool) {
+	re := regexp.MustCompile(`/(Armbian_(\d+\.\d+(?:\.\d+)?)_[A-Za-z0-9_.+-]+\.img)\.xz$`)
+	m := re.FindStringSubmatch(u)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// radxaRepo returns the GitHub repository where Radxa publishes the images
+// for the board.
+func radxaRepo(b Board) string {
+	switch b {
+	case RockPi4:
+		return "radxa-build/rock-pi-4b"
+	case Rock3A:
+		return "radxa-build/rock-3a"
+	default:
+		return ""
+	}
+}
+
+// fetchRadxa returns the URL, the decompressed file name and the release tag
+// of the latest Radxa Debian image for the board.
+//
+// The images are published as GitHub releases, looked up via the GitHub API.
+func fetchRadxa(ctx context.Context, b Board, o *Options) (string, string, string, error) {
+	latest := "https://api.github.com/repos/" + radxaRepo(b) + "/releases/latest"
+	raw, err := fetchURL(ctx, latest, o)
 	if err != nil {
-		return "", err
+		return "", "", "", err
 	}
-	if f, _ := os.Open(imgpath); f != nil /* #nosec G304 */ {
-		fmt.Printf("- Reusing Ubuntu %s image %s\n", ver, imgpath)
-		_ = f.Close()
-		return imgpath, nil
+	u, name, tag, err := radxaParseRelease(raw)
+	if err != nil {
+		return "", "", "", fmt.Errorf("%s: %w", latest, err)
 	}
-	imgurl := "http://cdimage.ubuntu.com/releases/" + ver + "/release/" + imgname + ".xz"
-	if err := fetchXZ(imgurl, imgpath); err != nil {
-		return "", err
+	log.Printf("Radxa URL: %s", u)
+	return u, name, tag, nil
+}
+
+// radxaParseRelease parses a GitHub release and returns the URL of the xz
+// compressed image, the decompressed file name and the release tag.
+//
+// The headless "cli" image is preferred over the desktop ones.
+func radxaParseRelease(raw []byte) (string, string, string, error) {
+	var r struct {
+		TagName string `json:"tag_name"`
+		Assets  []struct {
+			Name string `json:"name"`
+			URL  string `json:"browser_download_url"`
+		} `json:"assets"`
 	}
-	return imgpath, nil
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return "", "", "", fmt.Errorf("failed to parse the release: %w", err)
+	}
+	u, name := "", ""
+	for _, a := range r.Assets {
+		if !strings.HasSuffix(a.Name, ".img.xz") {
+			continue
+		}
+		if u == "" || (strings.Contains(a.Name, "_cli") && !strings.Contains(name, "_cli")) {
+			u, name = a.URL, strings.TrimSuffix(a.Name, ".xz")
+		}
+	}
+	if u == "" {
+		return "", "", "", fmt.Errorf("no image in release %q: %w", r.TagName, ErrImageNotFound)
+	}
+	return u, name, r.TagName, nil
 }
 
 //
 
 // raspiosGetLatestImageURL reads the image listing to find the latest one.
 //
+// Returns the URL, the decompressed file name and the date of the image
+// directory. When date is set, the image in this directory is used instead of
+// the latest one, and an error is returned if it can't be found.
+//
 // Getting the torrent would be nicer to the host.
-func raspiosGetLatestImageURL(is64bits bool) (string, string) {
+func raspiosGetLatestImageURL(ctx context.Context, is64bits bool, mirror, date string, o *Options) (string, string, string, error) {
 	// The final URL looks like:
 	// https://downloads.raspberrypi.org/raspios_lite_armhf/images/raspios_lite_armhf-2022-09-26/2022-09-22-raspios-bullseye-armhf-lite.img.xz
 	arch := "armhf"
@@ -380,67 +981,440 @@ func raspiosGetLatestImageURL(is64bits bool) (string, string) {
 	}
 	baseImgURL := "https://downloads.raspberrypi.org/raspios_lite_" + arch + "/images/"
 	dirFmt := "raspios_lite_" + arch + "-%s/"
-	re1 := regexp.MustCompile(`raspios_lite_` + arch + `-(20\d\d-\d\d-\d\d)/`)
-	re2 := regexp.MustCompile(`(20\d\d-\d\d-\d\d-raspios-[[:alpha:]]+-` + arch + `-lite\.img\.xz)`)
-	var matches [][][]byte
-	var match [][]byte
 
-	// Use a recent (as of now) default date, it's not a big deal if the image is
-	// a bit stale, it'll just take more time to "apt upgrade".
-	date := "2022-09-26"
-	// TODO(maruel): Figure out the distro automatically.
-	distro := "bullseye"
-	// It's a bit annoying as the image date and the directory date do not match.
-	xzFile := "2022-09-22" + "-raspios-" + distro + "-" + arch + "-lite.img.xz"
-	imgFile := "2022-09-22" + "-raspios-" + distro + "-" + arch + "-lite.img"
+	fetch := func(u string) ([]byte, error) {
+		return fetchURLMirror(ctx, mirror, u, o)
+	}
+	var xzFile string
+	if date != "" {
+		// A specific release was requested, skip the search for the latest one.
+		f, err := raspiosFindDate(fetch, baseImgURL, arch, date)
+		if err != nil {
+			return "", "", "", err
+		}
+		xzFile = f
+	} else {
+		// Use a recent (as of now) default date, it's not a big deal if the image
+		// is a bit stale, it'll just take more time to "apt upgrade".
+		date = "2022-09-26"
+		// It's a bit annoying as the image date and the directory date do not
+		// match.
+		xzFile = "2022-09-22-raspios-bullseye-" + arch + "-lite.img.xz"
+		// Skip the lookup while the image found last time is present, then ask
+		// the official redirector, then fall back to scraping the directory
+		// listing.
+		if d, f, ok := loadLatest(arch, o); ok {
+			date = d
+			xzFile = f
+		} else if o.offline() {
+			return "", "", "", fmt.Errorf("the latest RaspiOS image is unknown offline; look it up once online first: %w", ErrOffline)
+		} else if d, f, err := raspiosFindRedirect(ctx, mirror, arch, o); err == nil {
+			date = d
+			xzFile = f
+			saveLatest(arch, date, xzFile)
+		} else if d, f, err = raspiosFindLatest(fetch, baseImgURL, arch); err == nil {
+			date = d
+			xzFile = f
+			saveLatest(arch, date, xzFile)
+		} else {
+			log.Printf("using the default image: %v", err)
+		}
+	}
+	// The image may be in a subdirectory of the dated directory.
+	imgFile := strings.TrimSuffix(path.Base(xzFile), ".xz")
+
+	url := baseImgURL + fmt.Sprintf(dirFmt, date) + xzFile
+	name := "RaspiOS"
+	if is64bits {
+		name += "64"
+	}
+	log.Printf("%s date: %s", name, date)
+	log.Printf("%s distro: %s", name, RaspiOSRelease(xzFile))
+	log.Printf("%s URL: %s", name, url)
+	log.Printf("%s file: %s", name, imgFile)
+	return url, imgFile, date, nil
+}
+
+// reRaspiOSFile matches the date and the Debian release in the file name of
+// a RaspiOS image, e.g. 2024-07-04-raspios-bookworm-arm64-lite.img.xz.
+var reRaspiOSFile = regexp.MustCompile(`^(20\d\d-\d\d-\d\d)(?:-raspios-([[:alpha:]]+)-)?`)
+
+// RaspiOSRelease returns the Debian release of a RaspiOS image from its file
+// name, e.g. "bookworm" for 2024-07-04-raspios-bookworm-arm64-lite.img.xz.
+//
+// Returns an empty string if the file name doesn't follow this pattern.
+func RaspiOSRelease(file string) string {
+	if m := reRaspiOSFile.FindStringSubmatch(filepath.Base(file)); m != nil {
+		return m[2]
+	}
+	return ""
+}
+
+// raspiosNetworkManagerDate is the date of the first RaspiOS release, Bookworm,
+// configuring the network with NetworkManager instead of dhcpcd and
+// wpa_supplicant.
+const raspiosNetworkManagerDate = "2023-10-10"
+
+// RaspiOSUsesNetworkManager returns true if the RaspiOS image file configures
+// the network with NetworkManager, i.e. Bookworm and later, so
+// /boot/wpa_supplicant.conf is ignored.
+//
+// The release is determined from the file name, or from its date prefix when
+// the release is not in the name.
+func RaspiOSUsesNetworkManager(file string) bool {
+	m := reRaspiOSFile.FindStringSubmatch(filepath.Base(file))
+	if m == nil {
+		return false
+	}
+	switch m[2] {
+	case "stretch", "buster", "bullseye":
+		return false
+	case "":
+		return m[1] >= raspiosNetworkManagerDate
+	default:
+		return true
+	}
+}
+
+// latestImage is the latest RaspiOS image found, saved in the current
+// directory next to the image.
+type latestImage struct {
+	Date string    `json:"date"`
+	File string    `json:"file"`
+	Time time.Time `json:"time"`
+}
+
+// latestPath returns the path of the file remembering the latest image.
+func latestPath(arch string) string {
+	return ".raspios_lite_" + arch + ".latest.json"
+}
 
-	r, err := fetchURL(baseImgURL)
+// loadLatest returns the date of the directory and the image file name of the
+// latest image found less than o.LatestTTL ago, if the image is present.
+//
+// When o.Offline is set, the latest image found is returned regardless since
+// it can't be looked up.
+func loadLatest(arch string, o *Options) (string, string, bool) {
+	offline, ttl := o.offline(), o.latestTTL()
+	if !offline && (o.forceRefresh() || ttl <= 0) {
+		return "", "", false
+	}
+	b, err := os.ReadFile(latestPath(arch))
 	if err != nil {
-		log.Printf("failed to fetch: %v", err)
-		goto end
+		return "", "", false
+	}
+	var l latestImage
+	if err = json.Unmarshal(b, &l); err != nil {
+		log.Printf("ignoring %s: %v", latestPath(arch), err)
+		return "", "", false
+	}
+	if age := time.Since(l.Time); !offline && (age < 0 || age >= ttl) {
+		return "", "", false
 	}
+	// Don't trust the content, it is used to build the URL and the file name.
+	if _, _, ok := raspiosParseImageURL("/raspios_lite_"+arch+"-"+l.Date+"/"+l.File, arch); !ok {
+		return "", "", false
+	}
+	if _, err = os.Stat(strings.TrimSuffix(path.Base(l.File), ".xz")); err != nil && !offline {
+		return "", "", false
+	}
+	debugf("using the latest image found at %s", l.Time.Format(time.RFC3339))
+	return l.Date, l.File, true
+}
 
+// saveLatest remembers the latest image found.
+func saveLatest(arch, date, file string) {
+	b, err := json.Marshal(latestImage{Date: date, File: file, Time: time.Now().UTC()})
+	if err == nil {
+		/* #nosec G306 */
+		err = os.WriteFile(latestPath(arch), b, 0o644)
+	}
+	if err != nil {
+		log.Printf("failed to save the latest image: %v", err)
+	}
+}
+
+// raspiosParseImageURL parses the URL of a RaspiOS Lite image and returns the
+// date of its directory and the image file name, relative to this directory.
+func raspiosParseImageURL(u, arch string) (string, string, bool) {
+	re := regexp.MustCompile(`/raspios_lite_` + arch + `-(20\d\d-\d\d-\d\d)/((?:[\w.-]+/)?[\w.-]+\.img\.xz)$`)
+	m := re.FindStringSubmatch(u)
+	if m == nil || !isRaspiOSLite(m[2]) {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// isRaspiOSLite returns true if the relative path f looks like a RaspiOS Lite
+// image, e.g. 2024-07-04-raspios-bookworm-arm64-lite.img.xz, tolerating minor
+// changes to the naming scheme.
+func isRaspiOSLite(f string) bool {
+	for _, e := range strings.Split(f, "/") {
+		if e == "" || e == "." || e == ".." {
+			return false
+		}
+	}
+	b := path.Base(f)
+	return strings.HasSuffix(b, ".img.xz") && strings.Contains(b, "lite") && !strings.Contains(b, "full")
+}
+
+// reListingLink matches the links of a HTML directory listing.
+var reListingLink = regexp.MustCompile(`href="([\w.-]+/?(?:[\w.-]+)?)"`)
+
+// raspiosFindImage returns the path of the RaspiOS Lite image in the directory
+// listing at dir, relative to dir.
+//
+// When the listing has no image, its subdirectories are searched one level
+// deep, as the image has at times been nested further. When there are
+// multiple candidates, the ones ending with -<arch>-lite.img.xz are
+// preferred, then the most recent one.
+func raspiosFindImage(fetch func(string) ([]byte, error), dir, arch string) (string, error) {
+	r, err := fetch(dir)
+	if err != nil {
+		return "", err
+	}
+	var candidates, subdirs []string
+	seen := map[string]bool{}
+	for _, m := range reListingLink.FindAllSubmatch(r, -1) {
+		l := string(m[1])
+		if seen[l] {
+			continue
+		}
+		seen[l] = true
+		switch {
+		case isRaspiOSLite(l):
+			log.Printf("candidate image %s%s", dir, l)
+			candidates = append(candidates, l)
+		case strings.HasSuffix(l, "/") && l != "../" && l != "./":
+			subdirs = append(subdirs, l)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, d := range subdirs {
+			r, err := fetch(dir + d)
+			if err != nil {
+				log.Printf("failed to fetch: %v", err)
+				continue
+			}
+			for _, m := range reListingLink.FindAllSubmatch(r, -1) {
+				if l := string(m[1]); !strings.Contains(l, "/") && isRaspiOSLite(d+l) && !seen[d+l] {
+					seen[d+l] = true
+					log.Printf("candidate image %s%s%s", dir, d, l)
+					candidates = append(candidates, d+l)
+				}
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no RaspiOS Lite image found in %s", dir)
+	}
+	suffix := "-" + arch + "-lite.img.xz"
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := strings.HasSuffix(candidates[i], suffix), strings.HasSuffix(candidates[j], suffix)
+		if a != b {
+			return !a
+		}
+		return path.Base(candidates[i]) < path.Base(candidates[j])
+	})
+	return candidates[len(candidates)-1], nil
+}
+
+// raspiosFindRedirect returns the date of the directory and the image file
+// name of the latest RaspiOS Lite image as reported by the official
+// redirector.
+//
+// The redirector of the mirror is tried first, if any.
+func raspiosFindRedirect(ctx context.Context, mirror, arch string, o *Options) (string, string, error) {
+	latest := "https://downloads.raspberrypi.org/raspios_lite_" + arch + "_latest"
+	if mirror != "" {
+		m, err := mirrorURL(mirror, latest)
+		if err == nil {
+			var d, f string
+			if d, f, err = raspiosResolveLatest(ctx, m, arch, o); err == nil {
+				return d, f, nil
+			}
+		}
+		log.Printf("failed to use mirror %s, falling back to the default: %v", mirror, err)
+	}
+	return raspiosResolveLatest(ctx, latest, arch, o)
+}
+
+// raspiosResolveLatest returns the date of the directory and the image file
+// name the redirector at latest points to.
+func raspiosResolveLatest(ctx context.Context, latest, arch string, o *Options) (string, string, error) {
+	u, err := resolveRedirect(ctx, latest, o)
+	if err != nil {
+		log.Printf("failed to resolve %s: %v", latest, err)
+		return "", "", err
+	}
+	d, f, ok := raspiosParseImageURL(u, arch)
+	if !ok {
+		log.Printf("unexpected redirect from %s: %s", latest, u)
+		return "", "", fmt.Errorf("unexpected redirect from %s: %s", latest, u)
+	}
+	return d, f, nil
+}
+
+// resolveRedirect returns the final URL after following the redirects from u,
+// without downloading the content.
+func resolveRedirect(ctx context.Context, u string, o *Options) (string, error) {
+	if o.offline() {
+		return "", ErrOffline
+	}
+	req, err := http.NewRequestWithContext(withOptions(ctx, o), http.MethodHead, u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	_ = resp.Body.Close()
+	debugf("HEAD %s: %s from %s", u, resp.Status, resp.Request.URL)
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("failed to fetch %q: status %d", u, resp.StatusCode)
+	}
+	return resp.Request.URL.String(), nil
+}
+
+// raspiosFindLatest returns the date of the most recent directory in the
+// RaspiOS image listing at baseImgURL that contains an image, along with the
+// image file name.
+//
+// The directories are tried from newest to oldest, as the newest may not
+// contain the image yet while it is being published.
+func raspiosFindLatest(fetch func(string) ([]byte, error), baseImgURL, arch string) (string, string, error) {
+	dirFmt := "raspios_lite_" + arch + "-%s/"
+	re1 := regexp.MustCompile(`raspios_lite_` + arch + `-(20\d\d-\d\d-\d\d)/`)
+	r, err := fetch(baseImgURL)
+	if err != nil {
+		return "", "", err
+	}
 	// This will be good until 2099.
-	matches = re1.FindAllSubmatch(r, -1)
+	matches := re1.FindAllSubmatch(r, -1)
 	if len(matches) == 0 {
-		log.Printf("failed to match: %q", r)
-		goto end
+		return "", "", fmt.Errorf("failed to match: %q", r)
 	}
+	// It's already in sorted order. Each directory may be listed more than once,
+	// e.g. in the href and in the text.
+	tried := map[string]bool{}
+	for i := len(matches) - 1; i >= 0; i-- {
+		date := string(matches[i][1])
+		if tried[date] {
+			continue
+		}
+		tried[date] = true
+		// Find the distro name.
+		f, err := raspiosFindImage(fetch, baseImgURL+fmt.Sprintf(dirFmt, date), arch)
+		if err == nil {
+			log.Printf("Found date %s with xzfile %s", date, f)
+			return date, f, nil
+		}
+		log.Printf("no image found for date %s: %v", date, err)
+	}
+	return "", "", fmt.Errorf("no image found in the %d directories at %s", len(tried), baseImgURL)
+}
 
-	// It's already in sorted order.
-	date = string(matches[len(matches)-1][1])
-	log.Printf("Found date %s", date)
+// raspiosFindDate returns the image file name in the RaspiOS image directory
+// of date at baseImgURL.
+func raspiosFindDate(fetch func(string) ([]byte, error), baseImgURL, arch, date string) (string, error) {
+	dir := baseImgURL + "raspios_lite_" + arch + "-" + date + "/"
+	f, err := raspiosFindImage(fetch, dir, arch)
+	if err != nil {
+		return "", fmt.Errorf("no RaspiOS release dated %s: %w", date, err)
+	}
+	return f, nil
+}
 
-	// Find the distro name.
-	r, err = fetchURL(baseImgURL + fmt.Sprintf(dirFmt, date))
+// mirrorURL returns u with its scheme and host substituted with the ones of
+// mirror.
+//
+// A path in mirror is prepended to the path of u.
+func mirrorURL(mirror, u string) (string, error) {
+	m, err := url.Parse(mirror)
 	if err != nil {
-		log.Printf("failed to fetch: %v", err)
-		goto end
+		return "", err
 	}
-	match = re2.FindSubmatch(r)
-	if len(match) == 0 {
-		log.Printf("failed to match: %q", r)
-		goto end
+	p, err := url.Parse(u)
+	if err != nil {
+		return "", err
 	}
-	xzFile = string(match[1])
-	log.Printf("Found xzfile %s", xzFile)
-	imgFile = xzFile[:len(xzFile)-3]
+	p.Scheme = m.Scheme
+	p.Host = m.Host
+	p.Path = strings.TrimSuffix(m.Path, "/") + p.Path
+	return p.String(), nil
+}
 
-end:
-	url := baseImgURL + fmt.Sprintf(dirFmt, date) + xzFile
-	name := "RaspiOS"
-	if is64bits {
-		name += "64"
+// fetchURLMirror is like fetchURL but tries the mirror first, if any.
+func fetchURLMirror(ctx context.Context, mirror, u string, o *Options) ([]byte, error) {
+	if mirror != "" {
+		m, err := mirrorURL(mirror, u)
+		if err == nil {
+			var b []byte
+			if b, err = fetchURL(ctx, m, o); err == nil {
+				return b, nil
+			}
+		}
+		log.Printf("failed to use mirror %s, falling back to the default: %v", mirror, err)
 	}
-	log.Printf("%s date: %s", name, date)
-	log.Printf("%s distro: %s", name, distro)
-	log.Printf("%s URL: %s", name, url)
-	log.Printf("%s file: %s", name, imgFile)
-	return url, imgFile
+	return fetchURL(ctx, u, o)
+}
+
+// fetchXZMirror is like fetchXZ but tries the mirror first, if any.
+func fetchXZMirror(ctx context.Context, mirror, imgurl, imgpath string, sig []byte, o *Options) error {
+	if mirror != "" {
+		m, err := mirrorURL(mirror, imgurl)
+		if err == nil {
+			if err = fetchXZ(ctx, m, imgpath, sig, o); err == nil {
+				return nil
+			}
+		}
+		Progressf("- Failed to fetch from mirror %s, falling back to the default: %v\n", mirror, err)
+	}
+	return fetchXZ(ctx, imgurl, imgpath, sig, o)
 }
 
-func fetchURL(url string) ([]byte, error) {
-	r, err := http.DefaultClient.Get(url)
+// fetchXZAlternates is like fetchXZMirror but falls back to each of the
+// alternate URLs in order, urls[0] being the default one.
+//
+// A failed request, a non 200 status or a truncated download moves to the next
+// URL. Returns the URL the image was fetched from.
+func fetchXZAlternates(ctx context.Context, mirror string, urls []string, imgpath string, sig []byte, o *Options) (string, error) {
+	err := fetchXZMirror(ctx, mirror, urls[0], imgpath, sig, o)
+	for i := 1; i < len(urls) && err != nil && !errors.Is(err, ErrOffline) && ctx.Err() == nil; i++ {
+		Progressf("- Failed to fetch %s: %v\n", urls[i-1], err)
+		err = fetchXZ(ctx, urls[i], imgpath, sig, o)
+		if err == nil {
+			return urls[i], nil
+		}
+	}
+	return urls[0], err
+}
+
+// httpGet is http.Get traced at LevelDebug.
+//
+// The request is canceled when ctx is done and honors o.Proxy and
+// o.TraceHTTP.
+func httpGet(ctx context.Context, u string, o *Options) (*http.Response, error) {
+	debugf("GET %s", u)
+	req, err := http.NewRequestWithContext(withOptions(ctx, o), http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		debugf("GET %s: %v", u, err)
+		return nil, err
+	}
+	debugf("GET %s: %s, %d bytes", u, resp.Status, resp.ContentLength)
+	return resp, nil
+}
+
+func fetchURL(ctx context.Context, url string, o *Options) ([]byte, error) {
+	if o.offline() {
+		return nil, fmt.Errorf("failed to fetch %q: %w", url, ErrOffline)
+	}
+	r, err := httpGet(ctx, url, o)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch %q: %w", url, err)
 	}
@@ -455,26 +1429,106 @@ func fetchURL(url string) ([]byte, error) {
 	return reply, nil
 }
 
-func fetchXZ(imgurl, imgpath string) error {
-	fmt.Printf("- Fetching %s\n", imgurl)
-	resp, err := http.DefaultClient.Get(imgurl)
+// magicXZ is the magic bytes at the start of a xz stream.
+var magicXZ = []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}
+
+// checkMagic verifies that the stream starts with the expected magic bytes.
+//
+// It returns a reader that still includes the peeked bytes.
+//
+// This catches mirrors returning an HTML error page with a status 200, which
+// would otherwise fail with a cryptic decoding error.
+func checkMagic(r io.Reader, magic []byte, url string) (io.Reader, error) {
+	b := bufio.NewReader(r)
+	h, err := b.Peek(len(magic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read %q: %w", url, err)
+	}
+	if !bytes.Equal(h, magic) {
+		return nil, fmt.Errorf("server returned non-image content for %q; the mirror may be broken (starts with %q)", url, h)
+	}
+	return b, nil
+}
+
+// fetchXZ downloads and decompresses imgurl into imgpath.
+//
+// Some mirrors serve the image uncompressed, in which case it is written as
+// is.
+//
+// When sig is set, it is the detached signature of the compressed image. The
+// image is removed if it doesn't verify, otherwise it is recorded as verified
+// so it can be reused from the cache.
+func fetchXZ(ctx context.Context, imgurl, imgpath string, sig []byte, o *Options) error {
+	if o.offline() {
+		return fmt.Errorf("failed to fetch %q: %w", imgurl, ErrOffline)
+	}
+	Progressf("- Fetching %s\n", imgurl)
+	resp, err := httpGet(ctx, imgurl, o)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	r, err := xz.NewReader(resp.Body)
+	if resp.StatusCode == 404 {
+		return fmt.Errorf("failed to fetch %q: %w", imgurl, ErrImageNotFound)
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("failed to fetch %q: status %d", imgurl, resp.StatusCode)
+	}
+	size := max(resp.ContentLength, 0)
+	if sig == nil {
+		// Decompress as the file is being downloaded.
+		return writeImage(ctx, resp.Body, imgurl, imgpath, size)
+	}
+	check, err := newSignatureCheck(sig)
+	if err != nil {
+		return err
+	}
+	body := io.TeeReader(resp.Body, check)
+	err = writeImage(ctx, body, imgurl, imgpath, size)
+	if err == nil {
+		// The signature covers any trailing bytes after the xz stream too.
+		_, err = io.Copy(io.Discard, body)
+	}
+	if err = check.close(err); err == nil {
+		err = markVerified(imgpath, sig)
+	}
+	if err != nil {
+		_ = os.Remove(imgpath)
+	}
+	return err
+}
+
+// decompressXZ decompresses the xz stream src into the file imgpath while
+// printing the progress.
+//
+// name is used for error messages. size is the uncompressed size if known,
+// otherwise 0 and the number of bytes written so far is printed instead. It
+// stops early when ctx is canceled.
+func decompressXZ(ctx context.Context, src io.Reader, name, imgpath string, size int64) error {
+	body, err := checkMagic(src, magicXZ, name)
+	if err != nil {
+		return err
+	}
+	r, wait, err := newXZReader(body)
 	if err != nil {
 		return err
 	}
 	/* #nosec G304 */
 	f, err := os.Create(imgpath)
 	if err != nil {
+		_ = wait()
 		return err
 	}
-	// Decompress as the file is being downloaded.
-	if _, err = io.Copy(f, r); err != nil {
-		_ = f.Close()
-		return err
+	err = copyProgress(ctx, f, r, size)
+	if err2 := wait(); err == nil {
+		err = err2
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		// Don't leave a partial image around that could be reused later.
+		_ = os.Remove(imgpath)
 	}
-	return f.Close()
+	return err
 }
@@ -0,0 +1,708 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// BootEditor edits the files of a FAT12, FAT16 or FAT32 file system in place,
+// e.g. the boot partition of an image, without mounting it.
+//
+// It works the same on all OSes and doesn't need elevated privileges for an
+// image file. Paths are slash separated and relative to the root of the file
+// system; names are matched case insensitively, like FAT does.
+//
+// It only implements what the boot partition edits need: creating, replacing
+// and appending to files and creating directories. Files are never deleted nor
+// renamed and the file system is not repaired. It is used by efe, edit-card
+// -img and modify.
+type BootEditor struct {
+	dev         ReaderWriterAt
+	fatBits     int
+	clusterSize int64
+	numFATs     int64
+	fatOff      int64
+	fatSize     int64
+	// rootOff and rootSize locate the fixed root directory of FAT12 and FAT16.
+	rootOff  int64
+	rootSize int64
+	// rootClus is the first cluster of the root directory of FAT32.
+	rootClus uint32
+	dataOff  int64
+	// maxClus is the highest valid cluster number.
+	maxClus uint32
+	fsInfo  int64
+	// fat is the content of the first FAT, written back to all of them.
+	fat []byte
+}
+
+// NewBootEditor returns a BootEditor for the FAT file system in dev, e.g. a
+// FileDisk for the boot partition of an image.
+func NewBootEditor(dev ReaderWriterAt) (*BootEditor, error) {
+	p, err := readBPB(dev)
+	if err != nil {
+		return nil, err
+	}
+	e := &BootEditor{
+		dev:         dev,
+		fatBits:     p.bits,
+		clusterSize: p.clusterSize,
+		numFATs:     p.numFATs,
+		fatOff:      p.fatOff,
+		fatSize:     p.fatSize,
+		rootOff:     p.rootOff,
+		rootSize:    p.rootSize,
+		rootClus:    p.rootClus,
+		dataOff:     p.dataOff,
+		maxClus:     uint32(p.clusters + 1),
+		fsInfo:      p.fsInfo,
+	}
+	// The FAT must be large enough for all the clusters.
+	if need := (int64(e.maxClus)+1)*int64(e.fatBits)/8 + 1; need > e.fatSize {
+		return nil, errors.New("not a FAT filesystem: FAT too small")
+	}
+	e.fat = make([]byte, e.fatSize)
+	if _, err := dev.ReadAt(e.fat, e.fatOff); err != nil {
+		return nil, fmt.Errorf("failed to read the FAT: %w", err)
+	}
+	return e, nil
+}
+
+// ReadFile returns the content of the file name.
+func (e *BootEditor) ReadFile(name string) ([]byte, error) {
+	_, ent, err := e.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if ent.isDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	out := make([]byte, 0, ent.size)
+	for _, c := range e.chain(ent.clus) {
+		b, err := e.readCluster(c)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
+		if int64(len(out)) >= int64(ent.size) {
+			break
+		}
+	}
+	if len(out) < int(ent.size) {
+		return nil, fmt.Errorf("%s: truncated cluster chain", name)
+	}
+	return out[:ent.size], nil
+}
+
+// ReadDir returns the names of the entries in the directory name, without
+// "." and "..".
+func (e *BootEditor) ReadDir(name string) ([]string, error) {
+	clus := e.rootClus
+	if p := strings.Trim(name, "/"); p != "" {
+		_, ent, err := e.lookup(p)
+		if err != nil {
+			return nil, err
+		}
+		if !ent.isDir() {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+		}
+		clus = ent.clus
+	}
+	d, err := e.readDir(clus)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, ent := range parseDir(d) {
+		if ent.name != "." && ent.name != ".." && ent.attr&attrVolumeID == 0 {
+			out = append(out, ent.name)
+		}
+	}
+	return out, nil
+}
+
+// WriteFile creates the file name with data, or replaces its content if it
+// exists. Its directory must exist.
+func (e *BootEditor) WriteFile(name string, data []byte) error {
+	dir, base, err := e.parent(name)
+	if err != nil {
+		return err
+	}
+	d, err := e.readDir(dir)
+	if err != nil {
+		return err
+	}
+	var clus uint32
+	if len(data) != 0 {
+		n := (int64(len(data)) + e.clusterSize - 1) / e.clusterSize
+		if clus, err = e.alloc(n); err != nil {
+			return err
+		}
+		for i, c := range e.chain(clus) {
+			chunk := data[int64(i)*e.clusterSize:]
+			if int64(len(chunk)) > e.clusterSize {
+				chunk = chunk[:e.clusterSize]
+			}
+			if _, err = e.dev.WriteAt(chunk, e.clusterOff(c)); err != nil {
+				return err
+			}
+		}
+	}
+	if ent := findEntry(parseDir(d), base); ent != nil {
+		if ent.isDir() {
+			return &fs.PathError{Op: "write", Path: name, Err: errors.New("is a directory")}
+		}
+		e.free(ent.clus)
+		s := d[ent.slot*32 : ent.slot*32+32]
+		setEntryClus(s, clus)
+		binary.LittleEndian.PutUint32(s[28:], uint32(len(data)))
+		setEntryTime(s[22:], time.Now())
+	} else if d, err = e.addEntry(dir, d, base, 0, clus, uint32(len(data))); err != nil {
+		e.free(clus)
+		return err
+	}
+	if err = e.writeDir(dir, d); err != nil {
+		return err
+	}
+	return e.flush()
+}
+
+// AppendFile appends data to the existing file name.
+func (e *BootEditor) AppendFile(name string, data []byte) error {
+	b, err := e.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return e.WriteFile(name, append(b, data...))
+}
+
+// MkdirAll creates the directory name along with its missing parents.
+func (e *BootEditor) MkdirAll(name string) error {
+	dir := e.rootClus
+	for _, p := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if p == "" {
+			continue
+		}
+		d, err := e.readDir(dir)
+		if err != nil {
+			return err
+		}
+		if ent := findEntry(parseDir(d), p); ent != nil {
+			if !ent.isDir() {
+				return &fs.PathError{Op: "mkdir", Path: name, Err: errors.New("not a directory")}
+			}
+			dir = ent.clus
+			continue
+		}
+		c, err := e.alloc(1)
+		if err != nil {
+			return err
+		}
+		// The new directory only contains "." and "..", which points to 0 for
+		// the root directory.
+		sub := make([]byte, e.clusterSize)
+		parentClus := dir
+		if parentClus == e.rootClus {
+			parentClus = 0
+		}
+		for i, n := range []string{".          ", "..         "} {
+			s := sub[i*32 : i*32+32]
+			copy(s, n)
+			s[11] = attrDirectory
+			setEntryTime(s[14:], time.Now())
+			setEntryTime(s[22:], time.Now())
+			setEntryClus(s, []uint32{c, parentClus}[i])
+		}
+		if _, err = e.dev.WriteAt(sub, e.clusterOff(c)); err != nil {
+			return err
+		}
+		if d, err = e.addEntry(dir, d, p, attrDirectory, c, 0); err != nil {
+			e.free(c)
+			return err
+		}
+		if err = e.writeDir(dir, d); err != nil {
+			return err
+		}
+		if err = e.flush(); err != nil {
+			return err
+		}
+		dir = c
+	}
+	return nil
+}
+
+const (
+	attrDirectory = 0x10
+	attrVolumeID  = 0x08
+	attrLFN       = 0x0F
+)
+
+// dirEntry is a file or directory in a directory.
+type dirEntry struct {
+	name  string
+	short [11]byte
+	attr  byte
+	clus  uint32
+	size  uint32
+	// slot is the index of the short entry in the directory; first is the
+	// index of its first long name entry, if any.
+	slot  int
+	first int
+}
+
+func (d *dirEntry) isDir() bool {
+	return d.attr&attrDirectory != 0
+}
+
+// parseDir returns the entries of the raw directory d.
+func parseDir(d []byte) []dirEntry {
+	var out []dirEntry
+	var lfn []uint16
+	first := -1
+	sum := byte(0)
+	for i := 0; i+32 <= len(d); i += 32 {
+		s := d[i : i+32]
+		if s[0] == 0 {
+			break
+		}
+		if s[0] == 0xE5 {
+			lfn, first = nil, -1
+			continue
+		}
+		if s[11] == attrLFN {
+			if s[0]&0x40 != 0 {
+				lfn, first, sum = make([]uint16, 13*int(s[0]&0x1F)), i/32, s[13]
+			}
+			if n := int(s[0]&0x1F) - 1; lfn != nil && n >= 0 && n*13+13 <= len(lfn) && s[13] == sum {
+				for j, o := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+					lfn[n*13+j] = binary.LittleEndian.Uint16(s[o:])
+				}
+			} else {
+				lfn, first = nil, -1
+			}
+			continue
+		}
+		ent := dirEntry{attr: s[11], slot: i / 32, first: i / 32, size: binary.LittleEndian.Uint32(s[28:])}
+		copy(ent.short[:], s[:11])
+		ent.clus = uint32(binary.LittleEndian.Uint16(s[20:]))<<16 | uint32(binary.LittleEndian.Uint16(s[26:]))
+		if lfn != nil && lfnChecksum(ent.short) == sum {
+			for k, c := range lfn {
+				if c == 0 {
+					lfn = lfn[:k]
+					break
+				}
+			}
+			ent.name = string(utf16.Decode(lfn))
+			ent.first = first
+		} else {
+			ent.name = shortNameString(ent.short, s[12])
+		}
+		lfn, first = nil, -1
+		out = append(out, ent)
+	}
+	return out
+}
+
+// findEntry returns the entry named name, case insensitively.
+func findEntry(l []dirEntry, name string) *dirEntry {
+	for i := range l {
+		if strings.EqualFold(l[i].name, name) || strings.EqualFold(shortNameString(l[i].short, 0), name) {
+			return &l[i]
+		}
+	}
+	return nil
+}
+
+// shortNameString returns the 8.3 name as displayed, with the lower case flags
+// of byte 12 of the entry.
+func shortNameString(s [11]byte, flags byte) string {
+	base := strings.TrimRight(string(s[:8]), " ")
+	ext := strings.TrimRight(string(s[8:]), " ")
+	if base != "" && base[0] == 0x05 {
+		base = "\xE5" + base[1:]
+	}
+	if flags&0x08 != 0 {
+		base = strings.ToLower(base)
+	}
+	if flags&0x10 != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+// lfnChecksum returns the checksum of the short name stored in the long name
+// entries.
+func lfnChecksum(s [11]byte) byte {
+	sum := byte(0)
+	for _, c := range s {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+// shortName returns the 8.3 name for name, unique among the entries l, and
+// whether long name entries are needed to store name.
+func shortName(name string, l []dirEntry) ([11]byte, bool) {
+	var s [11]byte
+	clean := func(v string, n int) (string, bool) {
+		var b strings.Builder
+		lossy := false
+		for _, r := range strings.ToUpper(v) {
+			switch {
+			case r == ' ' || r == '.':
+				lossy = true
+			case r > 0x7F || strings.ContainsRune(`"*+,/:;<=>?[\]|`, r):
+				b.WriteByte('_')
+				lossy = true
+			default:
+				b.WriteRune(r)
+			}
+		}
+		out := b.String()
+		if len(out) > n {
+			return out[:n], true
+		}
+		return out, lossy
+	}
+	base, ext := name, ""
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	b, lossyB := clean(base, 8)
+	x, lossyX := clean(ext, 3)
+	if b == "" {
+		b, lossyB = "_", true
+	}
+	fill := func(v string) {
+		copy(s[:], "           ")
+		copy(s[:8], v)
+		copy(s[8:], x)
+	}
+	fill(b)
+	lossy := lossyB || lossyX
+	if !lossy && findShort(l, s) == nil {
+		// The name fits in 8.3; a long name only preserves its case.
+		return s, shortNameString(s, 0) != name
+	}
+	for i := 1; i < 1000000; i++ {
+		t := "~" + strconv.Itoa(i)
+		v := b
+		if len(v)+len(t) > 8 {
+			v = v[:8-len(t)]
+		}
+		fill(v + t)
+		if findShort(l, s) == nil {
+			break
+		}
+	}
+	return s, true
+}
+
+func findShort(l []dirEntry, s [11]byte) *dirEntry {
+	for i := range l {
+		if l[i].short == s {
+			return &l[i]
+		}
+	}
+	return nil
+}
+
+// addEntry adds the entry name to the raw directory d of the directory
+// starting at cluster dir and returns the updated raw directory, which may
+// have grown.
+func (e *BootEditor) addEntry(dir uint32, d []byte, name string, attr byte, clus, size uint32) ([]byte, error) {
+	if name == "" || name == "." || name == ".." || len(name) > 255 || strings.ContainsAny(name, "/\\") {
+		return nil, fmt.Errorf("invalid file name %q", name)
+	}
+	l := parseDir(d)
+	short, long := shortName(name, l)
+	var slots [][]byte
+	if long {
+		u := utf16.Encode([]rune(name))
+		n := (len(u) + 12) / 13
+		if len(u)%13 != 0 {
+			u = append(u, 0)
+		}
+		for len(u) < n*13 {
+			u = append(u, 0xFFFF)
+		}
+		sum := lfnChecksum(short)
+		for i := n; i >= 1; i-- {
+			s := make([]byte, 32)
+			s[0] = byte(i)
+			if i == n {
+				s[0] |= 0x40
+			}
+			s[11] = attrLFN
+			s[13] = sum
+			for j, o := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				binary.LittleEndian.PutUint16(s[o:], u[(i-1)*13+j])
+			}
+			slots = append(slots, s)
+		}
+	}
+	s := make([]byte, 32)
+	copy(s, short[:])
+	s[11] = attr
+	setEntryTime(s[14:], time.Now())
+	setEntryTime(s[22:], time.Now())
+	setEntryClus(s, clus)
+	binary.LittleEndian.PutUint32(s[28:], size)
+	slots = append(slots, s)
+
+	// Find a run of free slots, growing the directory if needed.
+	start, run := -1, 0
+	for i := 0; ; i++ {
+		if (i+1)*32 > len(d) {
+			if dir == 0 && e.fatBits != 32 {
+				return nil, errors.New("the root directory is full")
+			}
+			d = append(d, make([]byte, e.clusterSize)...)
+		}
+		if c := d[i*32]; c == 0 || c == 0xE5 {
+			if run == 0 {
+				start = i
+			}
+			if run++; run == len(slots) {
+				break
+			}
+		} else {
+			run = 0
+		}
+	}
+	for i, s := range slots {
+		copy(d[(start+i)*32:], s)
+	}
+	return d, nil
+}
+
+// lookup returns the directory containing name and its entry.
+func (e *BootEditor) lookup(name string) (uint32, *dirEntry, error) {
+	dir, base, err := e.parent(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	d, err := e.readDir(dir)
+	if err != nil {
+		return 0, nil, err
+	}
+	ent := findEntry(parseDir(d), base)
+	if ent == nil {
+		return 0, nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return dir, ent, nil
+}
+
+// parent returns the first cluster of the directory containing name, 0 for
+// the fixed root directory of FAT12 and FAT16, and the base name.
+func (e *BootEditor) parent(name string) (uint32, string, error) {
+	p := strings.Trim(path.Clean("/"+name), "/")
+	if p == "" {
+		return 0, "", fmt.Errorf("invalid file name %q", name)
+	}
+	parts := strings.Split(p, "/")
+	dir := e.rootClus
+	for _, s := range parts[:len(parts)-1] {
+		d, err := e.readDir(dir)
+		if err != nil {
+			return 0, "", err
+		}
+		ent := findEntry(parseDir(d), s)
+		if ent == nil {
+			return 0, "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		if !ent.isDir() {
+			return 0, "", &fs.PathError{Op: "open", Path: name, Err: errors.New("not a directory")}
+		}
+		dir = ent.clus
+	}
+	return dir, parts[len(parts)-1], nil
+}
+
+// readDir returns the raw content of the directory starting at cluster dir.
+func (e *BootEditor) readDir(dir uint32) ([]byte, error) {
+	if dir == 0 && e.fatBits != 32 {
+		b := make([]byte, e.rootSize)
+		_, err := e.dev.ReadAt(b, e.rootOff)
+		return b, err
+	}
+	var out []byte
+	for _, c := range e.chain(dir) {
+		b, err := e.readCluster(c)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
+	}
+	return out, nil
+}
+
+// writeDir writes back the raw content of the directory starting at cluster
+// dir, extending its cluster chain as needed.
+func (e *BootEditor) writeDir(dir uint32, d []byte) error {
+	if dir == 0 && e.fatBits != 32 {
+		_, err := e.dev.WriteAt(d, e.rootOff)
+		return err
+	}
+	chain := e.chain(dir)
+	if n := int64(len(d))/e.clusterSize - int64(len(chain)); n > 0 {
+		c, err := e.alloc(n)
+		if err != nil {
+			return err
+		}
+		e.setFAT(chain[len(chain)-1], c)
+		chain = append(chain, e.chain(c)...)
+	}
+	for i, c := range chain {
+		if _, err := e.dev.WriteAt(d[int64(i)*e.clusterSize:int64(i+1)*e.clusterSize], e.clusterOff(c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chain returns the clusters of the chain starting at c.
+func (e *BootEditor) chain(c uint32) []uint32 {
+	var out []uint32
+	for c >= 2 && c <= e.maxClus && len(out) <= int(e.maxClus) {
+		out = append(out, c)
+		c = e.getFAT(c)
+	}
+	return out
+}
+
+// alloc allocates a chain of n free clusters and returns its first cluster.
+func (e *BootEditor) alloc(n int64) (uint32, error) {
+	var l []uint32
+	for c := uint32(2); c <= e.maxClus && int64(len(l)) < n; c++ {
+		if e.getFAT(c) == 0 {
+			l = append(l, c)
+		}
+	}
+	if int64(len(l)) < n {
+		return 0, errors.New("no space left in the FAT filesystem")
+	}
+	for i, c := range l {
+		next := e.eoc()
+		if i+1 < len(l) {
+			next = l[i+1]
+		}
+		e.setFAT(c, next)
+	}
+	return l[0], nil
+}
+
+// free marks the chain starting at c as free.
+func (e *BootEditor) free(c uint32) {
+	for _, c := range e.chain(c) {
+		e.setFAT(c, 0)
+	}
+}
+
+func (e *BootEditor) eoc() uint32 {
+	switch e.fatBits {
+	case 12:
+		return 0xFFF
+	case 16:
+		return 0xFFFF
+	default:
+		return 0x0FFFFFFF
+	}
+}
+
+func (e *BootEditor) getFAT(c uint32) uint32 {
+	switch e.fatBits {
+	case 12:
+		v := uint32(binary.LittleEndian.Uint16(e.fat[c+c/2:]))
+		if c&1 != 0 {
+			return v >> 4
+		}
+		return v & 0xFFF
+	case 16:
+		return uint32(binary.LittleEndian.Uint16(e.fat[2*c:]))
+	default:
+		return binary.LittleEndian.Uint32(e.fat[4*c:]) & 0x0FFFFFFF
+	}
+}
+
+func (e *BootEditor) setFAT(c, v uint32) {
+	switch e.fatBits {
+	case 12:
+		o := c + c/2
+		old := binary.LittleEndian.Uint16(e.fat[o:])
+		if c&1 != 0 {
+			old = old&0x000F | uint16(v)<<4
+		} else {
+			old = old&0xF000 | uint16(v)&0x0FFF
+		}
+		binary.LittleEndian.PutUint16(e.fat[o:], old)
+	case 16:
+		binary.LittleEndian.PutUint16(e.fat[2*c:], uint16(v))
+	default:
+		old := binary.LittleEndian.Uint32(e.fat[4*c:])
+		binary.LittleEndian.PutUint32(e.fat[4*c:], old&0xF0000000|v&0x0FFFFFFF)
+	}
+}
+
+// flush writes the FAT to all its copies. On FAT32, the free cluster count
+// hint is invalidated since it is not maintained.
+func (e *BootEditor) flush() error {
+	for i := int64(0); i < e.numFATs; i++ {
+		if _, err := e.dev.WriteAt(e.fat, e.fatOff+i*e.fatSize); err != nil {
+			return err
+		}
+	}
+	if e.fsInfo != 0 {
+		b := make([]byte, 512)
+		if _, err := e.dev.ReadAt(b, e.fsInfo); err != nil {
+			return err
+		}
+		if bytes.Equal(b[:4], []byte("RRaA")) {
+			binary.LittleEndian.PutUint32(b[488:], 0xFFFFFFFF)
+			binary.LittleEndian.PutUint32(b[492:], 0xFFFFFFFF)
+			if _, err := e.dev.WriteAt(b, e.fsInfo); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *BootEditor) clusterOff(c uint32) int64 {
+	return e.dataOff + int64(c-2)*e.clusterSize
+}
+
+func (e *BootEditor) readCluster(c uint32) ([]byte, error) {
+	b := make([]byte, e.clusterSize)
+	_, err := e.dev.ReadAt(b, e.clusterOff(c))
+	return b, err
+}
+
+func setEntryClus(s []byte, c uint32) {
+	binary.LittleEndian.PutUint16(s[20:], uint16(c>>16))
+	binary.LittleEndian.PutUint16(s[26:], uint16(c))
+}
+
+// setEntryTime writes t as a DOS time then date at the start of s.
+func setEntryTime(s []byte, t time.Time) {
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.Local)
+	}
+	binary.LittleEndian.PutUint16(s, uint16(t.Hour()<<11|t.Minute()<<5|t.Second()/2))
+	binary.LittleEndian.PutUint16(s[2:], uint16((t.Year()-1980)<<9|int(t.Month())<<5|t.Day()))
+}
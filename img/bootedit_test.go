@@ -0,0 +1,325 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBootEditor(t *testing.T) {
+	for _, bits := range []int{12, 16, 32} {
+		m := newTestFAT(bits)
+		e, err := NewBootEditor(m)
+		if err != nil {
+			t.Fatalf("%d: %v", bits, err)
+		}
+		if e.fatBits != bits {
+			t.Fatalf("%d: got FAT%d", bits, e.fatBits)
+		}
+		big := bytes.Repeat([]byte("0123456789abcdef"), 200)
+		files := map[string][]byte{
+			"config.txt":                []byte("dtparam=i2c_arm=on\n"),
+			"CMDLINE.TXT":               []byte("console=serial0,115200\n"),
+			"wpa_supplicant.conf":       []byte("network={}\n"),
+			"firstboot.sh":              big,
+			"ssh":                       nil,
+			"overlays/my overlay.dtbo":  []byte("dtb"),
+			"overlays/a/b/c.txt":        []byte("deep"),
+			"héllo wörld with long.txt": []byte("unicode"),
+		}
+		if err = e.MkdirAll("overlays/a/b"); err != nil {
+			t.Fatalf("%d: %v", bits, err)
+		}
+		for n, d := range files {
+			if err = e.WriteFile(n, d); err != nil {
+				t.Fatalf("%d: %s: %v", bits, n, err)
+			}
+		}
+		// Replace with a smaller content and append.
+		files["firstboot.sh"] = []byte("#!/bin/sh\n")
+		if err = e.WriteFile("FirstBoot.sh", []byte("#!/bin/sh\n")); err != nil {
+			t.Fatalf("%d: %v", bits, err)
+		}
+		files["config.txt"] = append(files["config.txt"], "dtoverlay=dwc2\n"...)
+		if err = e.AppendFile("config.txt", []byte("dtoverlay=dwc2\n")); err != nil {
+			t.Fatalf("%d: %v", bits, err)
+		}
+
+		// Reopen to make sure everything was written to the device.
+		if e, err = NewBootEditor(m); err != nil {
+			t.Fatalf("%d: %v", bits, err)
+		}
+		for n, d := range files {
+			got, err := e.ReadFile(n)
+			if err != nil {
+				t.Fatalf("%d: %s: %v", bits, n, err)
+			}
+			if !bytes.Equal(got, d) {
+				t.Fatalf("%d: %s: %q != %q", bits, n, got, d)
+			}
+		}
+		names, err := e.ReadDir("/")
+		if err != nil {
+			t.Fatalf("%d: %v", bits, err)
+		}
+		expected := "CMDLINE.TXT,config.txt,firstboot.sh,héllo wörld with long.txt,overlays,ssh,wpa_supplicant.conf"
+		if got := strings.Join(sorted(names), ","); got != expected {
+			t.Fatalf("%d: %s", bits, got)
+		}
+		if names, err = e.ReadDir("overlays"); err != nil || strings.Join(sorted(names), ",") != "a,my overlay.dtbo" {
+			t.Fatalf("%d: %v %v", bits, names, err)
+		}
+		if _, err = e.ReadFile("missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("%d: %v", bits, err)
+		}
+		if err = e.WriteFile("missing/foo.txt", nil); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("%d: %v", bits, err)
+		}
+		if err = e.WriteFile("overlays", nil); err == nil {
+			t.Fatalf("%d: expected error", bits)
+		}
+		// Both FATs are kept in sync.
+		if !bytes.Equal(m[e.fatOff:e.fatOff+e.fatSize], m[e.fatOff+e.fatSize:e.fatOff+2*e.fatSize]) {
+			t.Fatalf("%d: FATs differ", bits)
+		}
+		// The free cluster count of FAT32 is invalidated.
+		if bits == 32 && binary.LittleEndian.Uint32(m[512+488:]) != 0xFFFFFFFF {
+			t.Fatalf("%d: FSInfo not updated", bits)
+		}
+	}
+}
+
+func TestBootEditor_Grow(t *testing.T) {
+	// Creating many files grows subdirectories past their first cluster and
+	// fills the fixed root directory of FAT16.
+	m := newTestFAT(16)
+	e, err := NewBootEditor(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.MkdirAll("dir"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 40; i++ {
+		n := "dir/a long file name " + strconv.Itoa(i) + ".txt"
+		if err = e.WriteFile(n, []byte(n)); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+	for i := 0; i < 40; i++ {
+		n := "dir/a long file name " + strconv.Itoa(i) + ".txt"
+		if got, err := e.ReadFile(n); err != nil || string(got) != n {
+			t.Fatalf("%d: %q %v", i, got, err)
+		}
+	}
+	var i int
+	for i = 0; i < 100; i++ {
+		if err = e.WriteFile("root file "+strconv.Itoa(i), nil); err != nil {
+			break
+		}
+	}
+	if err == nil || i == 0 {
+		t.Fatal("expected the root directory to be full")
+	}
+}
+
+// TestBootEditor_Fsck formats FAT file systems with mkfs.fat, edits them with
+// BootEditor, then checks them with fsck.fat and reads the files back with
+// mtools, which share no code with BootEditor.
+//
+// The test is skipped when dosfstools or mtools are not installed.
+func TestBootEditor_Fsck(t *testing.T) {
+	for _, n := range []string{"mkfs.fat", "fsck.fat", "mcopy", "mtype"} {
+		if _, err := exec.LookPath(n); err != nil {
+			t.Skip(err)
+		}
+	}
+	// The size in KiB selecting each FAT type with 512 bytes clusters.
+	sizes := map[int]string{12: "1024", 16: "16384", 32: "40960"}
+	for _, bits := range []int{12, 16, 32} {
+		d := t.TempDir()
+		p := filepath.Join(d, "boot.img")
+		runTool(t, "mkfs.fat", "-C", "-F", strconv.Itoa(bits), "-s", "1", p, sizes[bits])
+		// A file written by mtools is read back by BootEditor.
+		cmdline := []byte("console=serial0,115200 root=/dev/mmcblk0p2\n")
+		src := filepath.Join(d, "cmdline.txt")
+		if err := os.WriteFile(src, cmdline, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		runTool(t, "mcopy", "-i", p, src, "::/cmdline.txt")
+
+		f, err := os.OpenFile(p, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := NewBootEditor(NewFileDisk(f, 0, fi.Size()))
+		if err != nil {
+			t.Fatalf("%d: %v", bits, err)
+		}
+		if got, err := e.ReadFile("cmdline.txt"); err != nil || !bytes.Equal(got, cmdline) {
+			t.Fatalf("%d: %q %v", bits, got, err)
+		}
+		files := map[string][]byte{
+			"config.txt":               []byte("dtparam=i2c_arm=on\n"),
+			"wpa_supplicant.conf":      []byte("network={}\n"),
+			"firstboot.sh":             []byte("#!/bin/sh\n"),
+			"authorized_keys":          bytes.Repeat([]byte("ssh-ed25519 AAAA\n"), 200),
+			"ssh":                      nil,
+			"overlays/my overlay.dtbo": []byte("dtb"),
+			"overlays/a/b/c.txt":       []byte("deep"),
+		}
+		if err = e.MkdirAll("overlays/a/b"); err != nil {
+			t.Fatalf("%d: %v", bits, err)
+		}
+		// Write firstboot.sh large first, so the replacement frees clusters.
+		if err = e.WriteFile("firstboot.sh", files["authorized_keys"]); err != nil {
+			t.Fatalf("%d: %v", bits, err)
+		}
+		for n, c := range files {
+			if err = e.WriteFile(n, c); err != nil {
+				t.Fatalf("%d: %s: %v", bits, n, err)
+			}
+		}
+		files["config.txt"] = append(files["config.txt"], "dtoverlay=dwc2\n"...)
+		if err = e.AppendFile("config.txt", []byte("dtoverlay=dwc2\n")); err != nil {
+			t.Fatalf("%d: %v", bits, err)
+		}
+		files["cmdline.txt"] = append(cmdline, "quiet\n"...)
+		if err = e.AppendFile("cmdline.txt", []byte("quiet\n")); err != nil {
+			t.Fatalf("%d: %v", bits, err)
+		}
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		runTool(t, "fsck.fat", "-n", p)
+		for n, c := range files {
+			if got := runTool(t, "mtype", "-i", p, "::/"+n); !bytes.Equal(got, c) {
+				t.Fatalf("%d: %s: %q != %q", bits, n, got, c)
+			}
+		}
+	}
+}
+
+func TestBootEditor_Invalid(t *testing.T) {
+	if _, err := NewBootEditor(make(memFile, 4096)); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestShortName(t *testing.T) {
+	data := []struct {
+		name     string
+		existing []string
+		short    string
+		long     bool
+	}{
+		{"CONFIG.TXT", nil, "CONFIG  TXT", false},
+		{"config.txt", nil, "CONFIG  TXT", true},
+		{"ssh", nil, "SSH        ", true},
+		{"wpa_supplicant.conf", nil, "WPA_SU~1CON", true},
+		{"wpa_supplicant.conf", []string{"WPA_SU~1CON"}, "WPA_SU~2CON", true},
+		{"a+b.txt", nil, "A_B~1   TXT", true},
+		{".hidden", nil, "HIDDEN~1   ", true},
+	}
+	for i, line := range data {
+		var l []dirEntry
+		for _, s := range line.existing {
+			var d dirEntry
+			copy(d.short[:], s)
+			l = append(l, d)
+		}
+		s, long := shortName(line.name, l)
+		if string(s[:]) != line.short || long != line.long {
+			t.Fatalf("%d: %q %t", i, s, long)
+		}
+	}
+}
+
+// newTestFAT returns a freshly formatted FAT image with 512 bytes clusters.
+func newTestFAT(bits int) memFile {
+	totSec := map[int]int{12: 2048, 16: 16384, 32: 70000}[bits]
+	rsvd, rootEnt := 1, 64
+	if bits == 32 {
+		rsvd, rootEnt = 32, 0
+	}
+	fatSz := ((totSec+2)*bits/8 + 511) / 512
+	m := make(memFile, totSec*512)
+	b := m[:512]
+	copy(b, "\xEB\x3C\x90mkfs.fat")
+	binary.LittleEndian.PutUint16(b[11:], 512)
+	b[13] = 1
+	binary.LittleEndian.PutUint16(b[14:], uint16(rsvd))
+	b[16] = 2
+	binary.LittleEndian.PutUint16(b[17:], uint16(rootEnt))
+	b[21] = 0xF8
+	if totSec < 65536 {
+		binary.LittleEndian.PutUint16(b[19:], uint16(totSec))
+	} else {
+		binary.LittleEndian.PutUint32(b[32:], uint32(totSec))
+	}
+	if bits == 32 {
+		binary.LittleEndian.PutUint32(b[36:], uint32(fatSz))
+		binary.LittleEndian.PutUint32(b[44:], 2)
+		binary.LittleEndian.PutUint16(b[48:], 1)
+		fi := m[512:1024]
+		copy(fi, "RRaA")
+		copy(fi[484:], "rrAa")
+		binary.LittleEndian.PutUint32(fi[488:], 1234)
+		fi[510], fi[511] = 0x55, 0xAA
+	} else {
+		binary.LittleEndian.PutUint16(b[22:], uint16(fatSz))
+	}
+	b[510], b[511] = 0x55, 0xAA
+	for i := 0; i < 2; i++ {
+		f := m[(rsvd+i*fatSz)*512:]
+		switch bits {
+		case 12:
+			copy(f, "\xF8\xFF\xFF")
+		case 16:
+			copy(f, "\xF8\xFF\xFF\xFF")
+		default:
+			// Cluster 2 is the root directory.
+			copy(f, "\xF8\xFF\xFF\x0F\xFF\xFF\xFF\x0F\xFF\xFF\xFF\x0F")
+		}
+	}
+	return m
+}
+
+// runTool runs the command and returns its stdout. The test fails if it
+// exits with an error.
+func runTool(t *testing.T, name string, args ...string) []byte {
+	/* #nosec G204 */
+	c := exec.Command(name, args...)
+	// mtools otherwise rejects the images whose size isn't a whole number of
+	// tracks.
+	c.Env = append(os.Environ(), "MTOOLS_SKIP_CHECK=1")
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		t.Fatalf("%s %s: %v\n%s%s", name, strings.Join(args, " "), err, out, stderr.String())
+	}
+	return out
+}
+
+func sorted(l []string) []string {
+	sort.Strings(l)
+	return l
+}
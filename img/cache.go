@@ -0,0 +1,127 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CachedImage is an image in the current directory, e.g. fetched by Fetch,
+// decompressed by LocalImage or saved by efe -save-xz.
+type CachedImage struct {
+	Path string `json:"path"`
+	// Distro is inferred from the file name; it is empty when unknown.
+	Distro Distro `json:"distro,omitempty"`
+	// Date is the date in the file name, usually the release date; it is
+	// empty when unknown.
+	Date    string    `json:"date,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// reFileDate matches a date in a file name.
+var reFileDate = regexp.MustCompile(`20\d\d-\d\d-\d\d`)
+
+// cachedImageExts are the extensions of the files listed by ListCachedImages.
+var cachedImageExts = []string{".img", ".img.xz", ".img.gz", ".img.zst"}
+
+// ListCachedImages returns the .img, .img.xz, .img.gz and .img.zst files in the
+// current directory, sorted by name.
+//
+// The files that can't be read are skipped.
+func ListCachedImages() []CachedImage {
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		log.Printf("failed to list the cached images: %v", err)
+		return nil
+	}
+	var out []CachedImage
+	for _, e := range entries {
+		n := e.Name()
+		if !e.Type().IsRegular() || !hasCachedImageExt(n) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		p, err := filepath.Abs(n)
+		if err != nil {
+			continue
+		}
+		out = append(out, CachedImage{
+			Path:    p,
+			Distro:  distroFromName(n),
+			Date:    reFileDate.FindString(n),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+// PruneCachedImages deletes the cached images not modified for at least age
+// and returns them.
+//
+// Only the images of a known distro are deleted, as they were fetched by
+// Fetch or decompressed from one. The other images, e.g. custom.img, may be
+// the only copy of the user's work and are left for the user to delete.
+func PruneCachedImages(age time.Duration) ([]CachedImage, error) {
+	var out []CachedImage
+	for _, c := range ListCachedImages() {
+		if time.Since(c.ModTime) < age {
+			continue
+		}
+		if c.Distro == "" {
+			Progressf("- Keeping %s, not a known distro image; delete it manually if unneeded\n", c.Path)
+			continue
+		}
+		Progressf("- Deleting cached image %s\n", c.Path)
+		if err := os.Remove(c.Path); err != nil {
+			return out, err
+		}
+		_ = os.Remove(verifiedPath(c.Path))
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+func hasCachedImageExt(n string) bool {
+	for _, e := range cachedImageExts {
+		if strings.HasSuffix(n, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// distroFromName guesses the distro of an image from its file name, e.g.
+// RaspiOS64 for 2024-07-04-raspios-bookworm-arm64-lite.img.
+//
+// Returns an empty string when unknown.
+func distroFromName(n string) Distro {
+	n = strings.ToLower(n)
+	switch {
+	case strings.Contains(n, "raspios") && strings.Contains(n, "arm64"):
+		return RaspiOS64
+	case strings.Contains(n, "raspios"):
+		return RaspiOS
+	case strings.Contains(n, "armbian"):
+		return Armbian
+	case strings.Contains(n, "ubuntu"):
+		return Ubuntu
+	case strings.Contains(n, "debian"):
+		return Debian
+	default:
+		return ""
+	}
+}
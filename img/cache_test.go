@@ -0,0 +1,93 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListCachedImages(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := t.TempDir()
+	if err = os.Chdir(d); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Error(err)
+		}
+	}()
+	if l := ListCachedImages(); len(l) != 0 {
+		t.Fatal(l)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	for _, f := range []struct {
+		name string
+		size int
+		old  bool
+	}{
+		{"2024-07-04-raspios-bookworm-arm64-lite.img", 3, true},
+		{"2022-09-22-raspios-bullseye-armhf-lite.img.xz", 2, false},
+		{"Armbian_23.8.1_Bananapipro_bookworm_current_6.1.50.img", 1, false},
+		{"custom.img", 4, true},
+		{"2024-07-04-raspios-bookworm-arm64-lite.img.gz", 5, false},
+		{"ubuntu-22.04.img.zst", 6, true},
+		{"notes.txt", 1, true},
+		{".raspios_lite_arm64.latest.json", 1, true},
+	} {
+		if err = os.WriteFile(f.name, make([]byte, f.size), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if f.old {
+			if err = os.Chtimes(f.name, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = os.Mkdir("dir.img", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	expected := []CachedImage{
+		{Path: "2022-09-22-raspios-bullseye-armhf-lite.img.xz", Distro: RaspiOS, Date: "2022-09-22", Size: 2},
+		{Path: "2024-07-04-raspios-bookworm-arm64-lite.img", Distro: RaspiOS64, Date: "2024-07-04", Size: 3},
+		{Path: "2024-07-04-raspios-bookworm-arm64-lite.img.gz", Distro: RaspiOS64, Date: "2024-07-04", Size: 5},
+		{Path: "Armbian_23.8.1_Bananapipro_bookworm_current_6.1.50.img", Distro: Armbian, Size: 1},
+		{Path: "custom.img", Size: 4},
+		{Path: "ubuntu-22.04.img.zst", Distro: Ubuntu, Size: 6},
+	}
+	l := ListCachedImages()
+	if len(l) != len(expected) {
+		t.Fatal(l)
+	}
+	for i, e := range expected {
+		c := l[i]
+		if !filepath.IsAbs(c.Path) || filepath.Base(c.Path) != e.Path || c.Distro != e.Distro || c.Date != e.Date || c.Size != e.Size || c.ModTime.IsZero() {
+			t.Fatalf("%d: %#v", i, c)
+		}
+	}
+
+	p, err := PruneCachedImages(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p) != 2 || filepath.Base(p[0].Path) != "2024-07-04-raspios-bookworm-arm64-lite.img" || filepath.Base(p[1].Path) != "ubuntu-22.04.img.zst" {
+		t.Fatal(p)
+	}
+	if l = ListCachedImages(); len(l) != 4 {
+		t.Fatal(l)
+	}
+	// The images of an unknown distro are never deleted.
+	for _, n := range []string{"custom.img", "notes.txt"} {
+		if _, err = os.Stat(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
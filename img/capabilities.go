@@ -0,0 +1,136 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Capabilities is what the host supports, to report the platform limitations
+// up front instead of failing midway.
+type Capabilities struct {
+	// CanFlash is true if SDCards can be flashed.
+	CanFlash bool
+	// CanMount is true if the partitions of a SDCard can be mounted, which is
+	// needed to edit the boot partition once flashed.
+	CanMount bool
+	// CanListSDCards is true if the SDCards can be detected. Otherwise they
+	// have to be specified explicitly.
+	CanListSDCards bool
+	// CanEditEXT4Offline is true if the root partition of an image can be
+	// edited without mounting it, as done to start the first boot setup from
+	// /etc/rc.local. It is done in pure Go so it is supported everywhere.
+	CanEditEXT4Offline bool
+	// CanMountEXT4 is true if the root partition can be mounted, which is
+	// needed to install a systemd unit on images without /etc/rc.local.
+	CanMountEXT4 bool
+	// CanMountImage is true if the partitions of an image file can be
+	// mounted, which is needed to edit the image before saving it, e.g. with
+	// efe -save-img.
+	CanMountImage bool
+	// Tools are the helper tools used on this OS and their path, or an empty
+	// string when not found in PATH.
+	Tools map[string]string
+}
+
+// hostTools are the helper tools used on each OS.
+var hostTools = map[string][]string{
+	"darwin":  {"dd", "diskutil", "hdiutil", "sudo", "xz"},
+	"linux":   {"dd", "losetup", "lsblk", "mount", "pmount", "sudo", "udisksctl", "xz"},
+	"windows": {"wmic", "xz"},
+}
+
+// GetCapabilities returns what the host supports.
+//
+// The tools are looked up in PATH each time it is called. o.NoSudo and
+// o.LinuxMount are honored.
+func GetCapabilities(o *Options) Capabilities {
+	tools := map[string]string{}
+	for _, t := range hostTools[runtime.GOOS] {
+		p, _ := exec.LookPath(t)
+		tools[t] = p
+	}
+	// Root doesn't need sudo and NoSudo disables it.
+	elevate := os.Geteuid() == 0 || (!o.noSudo() && tools["sudo"] != "")
+	c := capabilities(runtime.GOOS, tools, elevate)
+	if runtime.GOOS == "linux" {
+		b, _, err := linuxBackend(o)
+		c.CanMount = err == nil
+		c.CanMountEXT4 = c.CanMount
+		// Without udisksctl, the loop device is set up with sudo losetup and
+		// its partitions mounted with sudo mount.
+		c.CanMountImage = err == nil && (b == MountUdisks || (elevate && tools["losetup"] != "" && tools["mount"] != ""))
+	}
+	return c
+}
+
+// capabilities returns the capabilities on goos given the tools found.
+//
+// elevate is true if commands can be run with elevated privileges.
+func capabilities(goos string, tools map[string]string, elevate bool) Capabilities {
+	has := func(names ...string) bool {
+		for _, n := range names {
+			if tools[n] == "" {
+				return false
+			}
+		}
+		return true
+	}
+	c := Capabilities{CanEditEXT4Offline: true, Tools: tools}
+	switch goos {
+	case "linux":
+		c.CanFlash = has("dd") && elevate
+		c.CanListSDCards = has("lsblk")
+		c.CanMount = has("udisksctl") || has("pmount") || (has("mount") && elevate)
+		c.CanMountEXT4 = c.CanMount
+		c.CanMountImage = has("udisksctl") || (has("losetup", "mount") && elevate)
+	case "darwin":
+		c.CanFlash = has("dd", "diskutil") && elevate
+		c.CanListSDCards = has("diskutil")
+		c.CanMount = has("diskutil")
+		c.CanMountImage = has("hdiutil", "diskutil")
+	case "windows":
+		// Flashing and mounting use the Win32 API directly.
+		c.CanFlash = true
+		c.CanMount = true
+		c.CanListSDCards = has("wmic")
+	}
+	return c
+}
+
+// String returns a summary, one capability or tool per line.
+func (c *Capabilities) String() string {
+	yes := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Flash SDCards:        %s\n", yes(c.CanFlash))
+	fmt.Fprintf(&b, "Mount partitions:     %s\n", yes(c.CanMount))
+	fmt.Fprintf(&b, "List SDCards:         %s\n", yes(c.CanListSDCards))
+	fmt.Fprintf(&b, "Edit EXT4 offline:    %s\n", yes(c.CanEditEXT4Offline))
+	fmt.Fprintf(&b, "Mount EXT4:           %s\n", yes(c.CanMountEXT4))
+	fmt.Fprintf(&b, "Mount image files:    %s\n", yes(c.CanMountImage))
+	names := make([]string, 0, len(c.Tools))
+	for n := range c.Tools {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		p := c.Tools[n]
+		if p == "" {
+			p = "not found"
+		}
+		fmt.Fprintf(&b, "%-21s %s\n", n+":", p)
+	}
+	return b.String()
+}
@@ -0,0 +1,51 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	data := []struct {
+		goos                                      string
+		tools                                     map[string]string
+		flash, mount, list, mountEXT4, mountImage bool
+	}{
+		{"linux", map[string]string{"dd": "/bin/dd", "sudo": "/usr/bin/sudo", "lsblk": "/bin/lsblk", "udisksctl": "/usr/bin/udisksctl"}, true, true, true, true, true},
+		{"linux", map[string]string{"dd": "/bin/dd", "lsblk": "/bin/lsblk", "mount": "/bin/mount", "losetup": "/sbin/losetup"}, false, false, true, false, false},
+		{"linux", map[string]string{"dd": "/bin/dd", "sudo": "/usr/bin/sudo", "mount": "/bin/mount", "losetup": "/sbin/losetup"}, true, true, false, true, true},
+		{"linux", map[string]string{"lsblk": "/bin/lsblk", "udisksctl": "/usr/bin/udisksctl"}, false, true, true, true, true},
+		{"darwin", map[string]string{"dd": "/bin/dd", "sudo": "/usr/bin/sudo", "diskutil": "/usr/sbin/diskutil", "hdiutil": "/usr/bin/hdiutil"}, true, true, true, false, true},
+		{"darwin", map[string]string{"dd": "/bin/dd", "sudo": "/usr/bin/sudo"}, false, false, false, false, false},
+		{"windows", map[string]string{}, true, true, false, false, false},
+		{"freebsd", map[string]string{}, false, false, false, false, false},
+	}
+	for i, l := range data {
+		c := capabilities(l.goos, l.tools, l.tools["sudo"] != "")
+		if c.CanFlash != l.flash || c.CanMount != l.mount || c.CanListSDCards != l.list || c.CanMountEXT4 != l.mountEXT4 || c.CanMountImage != l.mountImage || !c.CanEditEXT4Offline {
+			t.Fatalf("%d: %+v", i, c)
+		}
+	}
+}
+
+func TestCapabilitiesRoot(t *testing.T) {
+	// Running as root with -no-sudo: sudo is not needed.
+	c := capabilities("linux", map[string]string{"dd": "/bin/dd", "mount": "/bin/mount"}, true)
+	if !c.CanFlash || !c.CanMount {
+		t.Fatalf("%+v", c)
+	}
+}
+
+func TestCapabilitiesString(t *testing.T) {
+	c := capabilities("linux", map[string]string{"dd": "/bin/dd", "xz": ""}, false)
+	s := c.String()
+	for _, want := range []string{"Flash SDCards:        no\n", "Edit EXT4 offline:    yes\n", "dd:                   /bin/dd\n", "xz:                   not found\n"} {
+		if !strings.Contains(s, want) {
+			t.Fatalf("missing %q in:\n%s", want, s)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+const (
+	// probeSize is the size of each block written by CheckCapacity. It is a
+	// multiple of the sector size and of the direct I/O alignment.
+	probeSize = 4096
+	// probeCount is the minimum number of blocks written by CheckCapacity
+	// across the disk.
+	probeCount = 64
+)
+
+// diskIO reads and writes blocks of a disk, bypassing the OS cache.
+type diskIO interface {
+	WriteAt(p []byte, off int64) (int, error)
+	ReadAt(p []byte, off int64) (int, error)
+	Close() error
+}
+
+// CapacityResult is the result of CheckCapacity.
+type CapacityResult struct {
+	// DiskSize is the size reported by the disk.
+	DiskSize int64
+	// Usable is the estimated usable size, less than DiskSize for a fake
+	// capacity card.
+	Usable int64
+}
+
+// Warnings returns the reasons to suspect the disk is counterfeit, if any.
+func (c *CapacityResult) Warnings() []string {
+	if c.Usable < c.DiskSize {
+		return []string{fmt.Sprintf("it reports a size of %s but only about %s is usable; it is likely a fake capacity card", formatSize(c.DiskSize), formatSize(c.Usable))}
+	}
+	return nil
+}
+
+// Fits returns an error if n bytes don't fit in the usable size.
+func (c *CapacityResult) Fits(n int64) error {
+	if n > c.Usable {
+		return fmt.Errorf("%s doesn't fit in the %s usable", formatSize(n), formatSize(c.Usable))
+	}
+	return nil
+}
+
+// CheckCapacity writes known patterns at intervals across the size reported by
+// disk, then reads them back to estimate its usable size.
+//
+// Counterfeit cards wrap the writes past their real capacity onto the start of
+// the card, so the patterns read back don't match.
+//
+// It overwrites data on the disk, so it is meant to be called right before
+// Flash. It does the same checks as Flash.
+func CheckCapacity(disk string, o *Options) (*CapacityResult, error) {
+	if isRegularFile(disk) {
+		return nil, errors.New("can't check the capacity of a regular file")
+	}
+	size := DiskSize(disk)
+	if size < probeCount*probeSize {
+		return nil, fmt.Errorf("failed to get the size of %s", disk)
+	}
+	if err := checkDisk(disk); err != nil {
+		return nil, err
+	}
+	if err := checkNotSystemDisk(disk, o); err != nil {
+		return nil, err
+	}
+	if err := Umount(disk, o); err != nil {
+		return nil, err
+	}
+	var d diskIO
+	var err error
+	switch runtime.GOOS {
+	case "darwin", "linux":
+		// Cache the credentials first so the password prompt doesn't get mixed
+		// with the progress.
+		if err = run(o, "sudo", "-v"); err != nil {
+			return nil, err
+		}
+		dst := disk
+		if runtime.GOOS == "darwin" {
+			dst = toRawDiskOSX(disk)
+		}
+		d = &ddDevice{disk: dst, o: o}
+	case "windows":
+		if d, err = openDiskWindows(disk); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("CheckCapacity(): %w", ErrUnsupportedOS)
+	}
+	Progressf("- Checking the capacity of %s\n", disk)
+	n, err := checkCapacity(d, size)
+	if err2 := d.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &CapacityResult{DiskSize: size, Usable: n}, nil
+}
+
+// checkCapacity writes blocks across size bytes of d, then reads
+// them back. It returns the end of the last block that matches before the
+// first one that doesn't, or size if they all do.
+func checkCapacity(d diskIO, size int64) (int64, error) {
+	offsets := probeOffsets(size)
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return 0, err
+	}
+	// Write all the blocks first, from the end, so a block past the real
+	// capacity that wraps onto a lower one is overwritten by the lower one.
+	// This way, the first block that doesn't match is past the real capacity.
+	for i := len(offsets) - 1; i >= 0; i-- {
+		off := offsets[i]
+		if _, err := d.WriteAt(probePattern(nonce[:], off), off); err != nil {
+			return 0, fmt.Errorf("failed to write at offset %d: %w", off, err)
+		}
+		Progressf("\r%.1f%%", float64(len(offsets)-i)*50./float64(len(offsets)))
+	}
+	b := make([]byte, probeSize)
+	for i, off := range offsets {
+		n, err := d.ReadAt(b, off)
+		if err != nil || n != len(b) || !bytes.Equal(b, probePattern(nonce[:], off)) {
+			debugf("checkCapacity: mismatch at offset %d: %v", off, err)
+			Progressf("\n")
+			if i == 0 {
+				return 0, nil
+			}
+			return offsets[i-1] + probeSize, nil
+		}
+		Progressf("\r%.1f%%", 50.+float64(i+1)*50./float64(len(offsets)))
+	}
+	Progressf("\n")
+	return size, nil
+}
+
+// probeOffsets returns at least probeCount offsets spread across size bytes,
+// followed by the last block.
+//
+// The offsets are spaced by a power of two. The real capacity of flash memory
+// is a power of two, or a multiple of one, so a block past it wraps exactly
+// onto a lower block.
+func probeOffsets(size int64) []int64 {
+	step := int64(probeSize)
+	for step*2*probeCount <= size {
+		step *= 2
+	}
+	last := (size/probeSize - 1) * probeSize
+	var out []int64
+	for off := int64(0); off < last; off += step {
+		out = append(out, off)
+	}
+	return append(out, last)
+}
+
+// probePattern returns the block written at off. It is unique for each offset
+// and each run.
+func probePattern(nonce []byte, off int64) []byte {
+	out := make([]byte, 0, probeSize)
+	var o [8]byte
+	binary.LittleEndian.PutUint64(o[:], uint64(off))
+	h := sha256.Sum256(append(append([]byte("periph"), nonce...), o[:]...))
+	for len(out) < probeSize {
+		out = append(out, h[:]...)
+		h = sha256.Sum256(h[:])
+	}
+	return out[:probeSize]
+}
+
+// ddDevice accesses a disk with sudo dd, like Flash does on Linux and macOS.
+type ddDevice struct {
+	disk string
+	o    *Options
+}
+
+func (d *ddDevice) WriteAt(p []byte, off int64) (int, error) {
+	var args []string
+	if runtime.GOOS == "darwin" {
+		// BSD dd doesn't support iflag=fullblock and the reads from stdin may be
+		// short, except up to PIPE_BUF which is 512 bytes. The raw disk is not
+		// cached.
+		args = []string{"dd", "bs=512", fmt.Sprintf("seek=%d", off/512), fmt.Sprintf("count=%d", len(p)/512)}
+	} else {
+		args = []string{"dd", fmt.Sprintf("bs=%d", len(p)), fmt.Sprintf("seek=%d", off/int64(len(p))), "count=1", "iflag=fullblock", "oflag=direct"}
+	}
+	args = append(args, "of="+d.disk, "conv=notrunc")
+	if _, err := capture(d.o, string(p), "sudo", args...); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (d *ddDevice) ReadAt(p []byte, off int64) (int, error) {
+	args := []string{"dd", fmt.Sprintf("bs=%d", len(p)), fmt.Sprintf("skip=%d", off/int64(len(p))), "count=1", "if=" + d.disk}
+	if runtime.GOOS != "darwin" {
+		args = append(args, "iflag=direct")
+	}
+	name, args, err := sudoCommand("sudo", args, d.o.noSudo())
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cmdTimeout)
+	defer cancel()
+	debugf("run(%s %v)", name, args)
+	// Only keep stdout, dd prints its statistics to stderr.
+	/* #nosec G204 */
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, out), nil
+}
+
+func (d *ddDevice) Close() error {
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// fakeCard is a card storing only real bytes. The accesses past it wrap, or
+// the writes are dropped.
+type fakeCard struct {
+	real   int64
+	drop   bool
+	blocks map[int64][]byte
+}
+
+func (f *fakeCard) WriteAt(p []byte, off int64) (int, error) {
+	if !f.drop || off < f.real {
+		f.blocks[off%f.real] = append([]byte(nil), p...)
+	}
+	return len(p), nil
+}
+
+func (f *fakeCard) ReadAt(p []byte, off int64) (int, error) {
+	b := make([]byte, len(p))
+	if !f.drop || off < f.real {
+		copy(b, f.blocks[off%f.real])
+	}
+	return copy(p, b), nil
+}
+
+func (f *fakeCard) Close() error {
+	return nil
+}
+
+func TestCheckCapacity(t *testing.T) {
+	const gib = 1024 * 1024 * 1024
+	const size = 32 * 1000 * 1000 * 1000
+	step := int64(size / probeCount)
+	data := []struct {
+		real int64
+		drop bool
+	}{
+		{size, false},
+		{8 * gib, false},
+		{4 * gib, false},
+		{16 * gib, false},
+		{1024 * 1024, false},
+		{3 * gib, false},
+		{8 * gib, true},
+		{7*gib + 12345, true},
+	}
+	for i, line := range data {
+		got, err := checkCapacity(&fakeCard{real: line.real, drop: line.drop, blocks: map[int64][]byte{}}, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got > line.real || got < line.real-step {
+			t.Fatalf("%d: %d not within %d of %d", i, got, step, line.real)
+		}
+	}
+}
+
+func TestCapacityResult(t *testing.T) {
+	const gib = 1024 * 1024 * 1024
+	c := CapacityResult{DiskSize: 32 * gib, Usable: 32 * gib}
+	if w := c.Warnings(); len(w) != 0 {
+		t.Fatal(w)
+	}
+	c.Usable = 8 * gib
+	if w := c.Warnings(); len(w) != 1 {
+		t.Fatal(w)
+	}
+	if err := c.Fits(2 * gib); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Fits(9 * gib); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestProbeOffsets(t *testing.T) {
+	const size = 16*1024*1024*1024 + 512
+	o := probeOffsets(size)
+	if len(o) < probeCount || o[0] != 0 || o[1] != 256*1024*1024 || o[len(o)-1] != 16*1024*1024*1024-probeSize {
+		t.Fatal(len(o), o[0], o[1], o[len(o)-1])
+	}
+	for i, v := range o {
+		if v%probeSize != 0 || (i != 0 && v <= o[i-1]) {
+			t.Fatalf("%d: %d", i, v)
+		}
+	}
+}
+
+func TestCheckCapacityFile(t *testing.T) {
+	if _, err := CheckCapacity(filepath.Join("testdata", "does-not-exist"), nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// Compression is the format and level of an image written by this package.
+type Compression struct {
+	// Format is one of "xz", "gz", "zst" or "none".
+	Format string
+	// Level trades speed for size; higher is smaller but slower.
+	Level int
+}
+
+// compressionLevels is the minimum, maximum and default level of each
+// format. The defaults are the ones of the xz, gzip and zstd tools.
+var compressionLevels = map[string][3]int{
+	"xz":   {0, 9, 6},
+	"gz":   {1, 9, 6},
+	"zst":  {1, 19, 3},
+	"none": {0, 0, 0},
+}
+
+// xzDictCaps is the dictionary size of each xz level, as used by the presets
+// of the xz tool.
+var xzDictCaps = [10]int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// ParseCompression parses a compression in the form format[:level], e.g.
+// "xz:6", "gz:9", "zst:3" or "none". The level defaults to a balance between
+// speed and size.
+func ParseCompression(v string) (Compression, error) {
+	f, l, hasLevel := strings.Cut(v, ":")
+	r, ok := compressionLevels[f]
+	if !ok {
+		return Compression{}, fmt.Errorf("unsupported compression %q; use xz, gz, zst or none", f)
+	}
+	c := Compression{Format: f, Level: r[2]}
+	if !hasLevel {
+		return c, nil
+	}
+	if f == "none" {
+		return Compression{}, errors.New("compression none doesn't take a level")
+	}
+	n, err := strconv.Atoi(l)
+	if err != nil || n < r[0] || n > r[1] {
+		return Compression{}, fmt.Errorf("compression level for %s must be between %d and %d, got %q", f, r[0], r[1], l)
+	}
+	c.Level = n
+	return c, nil
+}
+
+// String returns the compression in the form accepted by ParseCompression.
+func (c Compression) String() string {
+	if c.Format == "none" {
+		return c.Format
+	}
+	return c.Format + ":" + strconv.Itoa(c.Level)
+}
+
+// Ext returns the file extension of the format, e.g. ".xz", or an empty string
+// for "none".
+func (c Compression) Ext() string {
+	if c.Format == "none" {
+		return ""
+	}
+	return "." + c.Format
+}
+
+// NewWriter returns a writer compressing into w. It must be closed to flush
+// the compressed stream; it doesn't close w.
+//
+// zst uses the zstd tool, which must be in PATH.
+func (c Compression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c.Format {
+	case "xz":
+		cfg := xz.WriterConfig{DictCap: xzDictCaps[c.Level]}
+		if c.Level <= 3 {
+			// The fast presets of the xz tool use a hash chain match finder.
+			cfg.Matcher = lzma.HashTable4
+		}
+		return cfg.NewWriter(w)
+	case "gz":
+		return gzip.NewWriterLevel(w, c.Level)
+	case "zst":
+		p, err := exec.LookPath("zstd")
+		if err != nil {
+			return nil, fmt.Errorf("compressing with zst requires the zstd tool: %w", err)
+		}
+		/* #nosec G204 */
+		cmd := exec.Command(p, "-q", "-c", "-"+strconv.Itoa(c.Level), "-T0")
+		cmd.Stdout = w
+		cw := &cmdWriteCloser{cmd: cmd}
+		cmd.Stderr = &cw.stderr
+		if cw.w, err = cmd.StdinPipe(); err != nil {
+			return nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, err
+		}
+		return cw, nil
+	case "none":
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", c.Format)
+	}
+}
+
+// Compress compresses the file src into dst while printing the progress.
+//
+// The data is streamed so the memory use is bounded. dst is deleted on
+// failure, including when ctx is canceled.
+func Compress(ctx context.Context, src, dst string, c Compression) error {
+	/* #nosec G304 */
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	/* #nosec G307 */
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	/* #nosec G304 */
+	o, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	Progressf("- Compressing %s to %s with %s\n", src, dst, c)
+	w, err := c.NewWriter(o)
+	if err == nil {
+		err = copyProgress(ctx, w, f, fi.Size())
+		if err2 := w.Close(); err == nil {
+			err = err2
+		}
+	}
+	if err2 := o.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(dst)
+	}
+	return err
+}
+
+// cmdWriteCloser writes to the stdin of a process and waits for it on Close.
+type cmdWriteCloser struct {
+	cmd    *exec.Cmd
+	w      io.WriteCloser
+	stderr tailBuffer
+}
+
+func (c *cmdWriteCloser) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *cmdWriteCloser) Close() error {
+	err := c.w.Close()
+	if err2 := c.cmd.Wait(); err2 != nil {
+		return fmt.Errorf("%s failed: %w: %s", c.cmd.Path, err2, bytes.TrimSpace([]byte(c.stderr.String())))
+	}
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
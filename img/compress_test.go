@@ -0,0 +1,113 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+func TestParseCompression(t *testing.T) {
+	data := []struct {
+		in       string
+		expected Compression
+		ext      string
+	}{
+		{"xz", Compression{"xz", 6}, ".xz"},
+		{"xz:0", Compression{"xz", 0}, ".xz"},
+		{"xz:9", Compression{"xz", 9}, ".xz"},
+		{"gz", Compression{"gz", 6}, ".gz"},
+		{"gz:1", Compression{"gz", 1}, ".gz"},
+		{"zst", Compression{"zst", 3}, ".zst"},
+		{"zst:19", Compression{"zst", 19}, ".zst"},
+		{"none", Compression{"none", 0}, ""},
+	}
+	for i, l := range data {
+		c, err := ParseCompression(l.in)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if c != l.expected || c.Ext() != l.ext {
+			t.Fatalf("%d: %#v", i, c)
+		}
+		if c2, err := ParseCompression(c.String()); err != nil || c2 != c {
+			t.Fatalf("%d: %q: %v", i, c, err)
+		}
+	}
+	for i, in := range []string{"", "bz2", "XZ", "xz:", "xz:10", "xz:-1", "gz:0", "zst:22", "none:0", "gz:fast"} {
+		if _, err := ParseCompression(in); err == nil {
+			t.Fatalf("%d: %q: expected error", i, in)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	d := t.TempDir()
+	src := filepath.Join(d, "a.img")
+	content := bytes.Repeat([]byte("periph "), 100000)
+	if err := os.WriteFile(src, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		c      Compression
+		reader func(io.Reader) (io.Reader, error)
+	}{
+		{Compression{"xz", 0}, func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) }},
+		{Compression{"xz", 6}, func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) }},
+		{Compression{"gz", 9}, func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{Compression{"zst", 3}, nil},
+		{Compression{"none", 0}, func(r io.Reader) (io.Reader, error) { return r, nil }},
+	}
+	for i, l := range data {
+		if l.c.Format == "zst" {
+			if _, err := exec.LookPath("zstd"); err != nil {
+				continue
+			}
+		}
+		dst := filepath.Join(d, "a.img"+l.c.Ext()+".out")
+		if err := Compress(context.Background(), src, dst, l.c); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		var got []byte
+		if l.reader == nil {
+			out, err := exec.Command("zstd", "-d", "-c", dst).Output()
+			if err != nil {
+				t.Fatalf("%d: %v", i, err)
+			}
+			got = out
+		} else {
+			/* #nosec G304 */
+			f, err := os.Open(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := l.reader(f)
+			if err == nil {
+				got, err = io.ReadAll(r)
+			}
+			_ = f.Close()
+			if err != nil {
+				t.Fatalf("%d: %v", i, err)
+			}
+		}
+		if !bytes.Equal(got, content) {
+			t.Fatalf("%d: got %d bytes", i, len(got))
+		}
+	}
+	if err := Compress(context.Background(), src, filepath.Join(d, "b"), Compression{Format: "bz2"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := os.Stat(filepath.Join(d, "b")); !os.IsNotExist(err) {
+		t.Fatal("the output should be deleted on failure")
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"strings"
+)
+
+// cryptAlphabet is the base64 variant used by crypt(3).
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// CryptSHA512 returns the glibc crypt(3) SHA-512 hash of password with a
+// random salt, e.g. "$6$salt$hash".
+//
+// This is the format expected in /etc/shadow and in the RaspiOS userconf.txt
+// file, the same as "openssl passwd -6" generates.
+func CryptSHA512(password string) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	salt := make([]byte, len(b))
+	for i, c := range b {
+		salt[i] = cryptAlphabet[c&0x3f]
+	}
+	return cryptSHA512(password, string(salt)), nil
+}
+
+// cryptSHA512 implements the SHA-512 crypt algorithm with the default 5000
+// rounds as specified at https://www.akkadia.org/drepper/SHA-crypt.txt.
+func cryptSHA512(password, salt string) string {
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	p := []byte(password)
+	s := []byte(salt)
+
+	h := sha512.New()
+	h.Write(p)
+	h.Write(s)
+	h.Write(p)
+	b := h.Sum(nil)
+
+	h.Reset()
+	h.Write(p)
+	h.Write(s)
+	cnt := len(p)
+	for ; cnt > 64; cnt -= 64 {
+		h.Write(b)
+	}
+	h.Write(b[:cnt])
+	for cnt = len(p); cnt > 0; cnt >>= 1 {
+		if cnt&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(p)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for range p {
+		h.Write(p)
+	}
+	dp := h.Sum(nil)
+	pseq := make([]byte, 0, len(p))
+	for len(pseq) < len(p) {
+		pseq = append(pseq, dp[:min(len(dp), len(p)-len(pseq))]...)
+	}
+
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(s)
+	}
+	sseq := h.Sum(nil)[:len(s)]
+
+	c := a
+	for i := 0; i < 5000; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(pseq)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(sseq)
+		}
+		if i%7 != 0 {
+			h.Write(pseq)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pseq)
+		}
+		c = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString("$6$" + salt + "$")
+	encode := func(b2, b1, b0 byte, n int) {
+		w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+		for ; n > 0; n-- {
+			out.WriteByte(cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	for i := 0; i < 21; i++ {
+		// The bytes are permuted as specified.
+		encode(c[i*22%63], c[(i*22+21)%63], c[(i*22+42)%63], 4)
+	}
+	encode(0, 0, c[63], 2)
+	return out.String()
+}
@@ -0,0 +1,33 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCryptSHA512(t *testing.T) {
+	// Generated with "openssl passwd -6 -salt <salt> <password>".
+	data := []struct {
+		password, salt, expected string
+	}{
+		{"Hello world!", "saltstring", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{strings.Repeat("x", 100), "abcdefghijklmnop", "$6$abcdefghijklmnop$r/HtRGuCzMNedONV3I8Xz8Qm4Qy85pQ/RigX0agmbAzWsa3BCc1B564NfCD/Giyliby36KbTMkrVLsmFYtbTu1"},
+		{"raspberry", "8dTsHeGk", "$6$8dTsHeGk$WLUWcB1o0VobbgUc69dmbOcGKuKAQN4qfj7IgwPnAoPWywSK/ZqXzzEY7RbjihcQ97NlCCvZZfIi.LSzlarbL0"},
+	}
+	for i, l := range data {
+		if got := cryptSHA512(l.password, l.salt); got != l.expected {
+			t.Fatalf("%d: %q != %q", i, got, l.expected)
+		}
+	}
+	got, err := CryptSHA512("raspberry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "$6$") || len(got) != 3+16+1+86 {
+		t.Fatal(got)
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// BoardDefinition describes an image for a board that is not built in.
+//
+// It is loaded from a JSON file with LoadBoards, so a new board can be
+// supported without changing the code.
+type BoardDefinition struct {
+	Manufacturer Manufacturer `json:"manufacturer"`
+	Board        Board        `json:"board"`
+	// Distros is the list of distros the image can be used as; the first one is
+	// the default.
+	Distros         []Distro `json:"distros"`
+	DefaultUser     string   `json:"default_user"`
+	DefaultHostname string   `json:"default_hostname"`
+	// URL is the URL of the image. "{manufacturer}", "{board}" and "{distro}"
+	// are replaced with the image's values.
+	URL string `json:"url"`
+	// Compression is either "xz" or "none". Defaults to "xz" if URL ends with
+	// ".xz", "none" otherwise.
+	Compression string `json:"compression"`
+	// BootPartition is the partition number (1 based) of the FAT boot
+	// partition. Defaults to 1.
+	BootPartition int `json:"boot_partition"`
+	// RootPartition is the partition number (1 based) of the EXT4 root
+	// partition. Defaults to 2.
+	RootPartition int `json:"root_partition"`
+}
+
+// customBoards are the definitions loaded by LoadBoards.
+var customBoards []BoardDefinition
+
+var reName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// LoadBoards loads additional board definitions from the JSON file p, which
+// contains a list of BoardDefinition.
+//
+// The definitions are merged with the built-in ones. A definition cannot
+// replace a built-in image. It must be called before parsing the flags that
+// reference the new names.
+func LoadBoards(p string) error {
+	/* #nosec G304 */
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	var defs []BoardDefinition
+	if err = json.Unmarshal(b, &defs); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", p, err)
+	}
+	for i := range defs {
+		known := append(customBoards[:len(customBoards):len(customBoards)], defs[:i]...)
+		if err = defs[i].check(known); err != nil {
+			return fmt.Errorf("%s: board #%d: %w", p, i+1, err)
+		}
+	}
+	for _, d := range defs {
+		addBoard(d)
+	}
+	return nil
+}
+
+// check validates the definition against the ones already known and sets the
+// default values.
+func (d *BoardDefinition) check(known []BoardDefinition) error {
+	if !reName.MatchString(string(d.Manufacturer)) {
+		return fmt.Errorf("invalid manufacturer %q", d.Manufacturer)
+	}
+	if !reName.MatchString(string(d.Board)) {
+		return fmt.Errorf("invalid board %q", d.Board)
+	}
+	if len(d.Distros) == 0 {
+		return errors.New("distros is required")
+	}
+	for _, di := range d.Distros {
+		if !reName.MatchString(string(di)) {
+			return fmt.Errorf("invalid distro %q", di)
+		}
+		if isBuiltinImage(d.Manufacturer, d.Board, di) {
+			return fmt.Errorf("%s:%s:%s is built in", d.Manufacturer, d.Board, di)
+		}
+		for _, c := range known {
+			if c.Manufacturer == d.Manufacturer && c.Board == d.Board && c.hasDistro(di) {
+				return fmt.Errorf("%s:%s:%s is already defined", d.Manufacturer, d.Board, di)
+			}
+		}
+	}
+	u, err := url.Parse(d.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q; it must be a http or https URL", d.URL)
+	}
+	switch d.Compression {
+	case "":
+		d.Compression = "none"
+		if strings.HasSuffix(u.Path, ".xz") {
+			d.Compression = "xz"
+		}
+	case "xz", "none":
+	default:
+		return fmt.Errorf("unsupported compression %q", d.Compression)
+	}
+	if d.BootPartition == 0 {
+		d.BootPartition = 1
+	}
+	if d.RootPartition == 0 {
+		d.RootPartition = 2
+	}
+	if d.BootPartition < 0 || d.RootPartition < 0 || d.BootPartition == d.RootPartition {
+		return fmt.Errorf("invalid partitions %d and %d", d.BootPartition, d.RootPartition)
+	}
+	return nil
+}
+
+func (d *BoardDefinition) hasDistro(di Distro) bool {
+	for _, e := range d.Distros {
+		if e == di {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the URL of the image and the name of the decompressed file.
+func (d *BoardDefinition) resolve(di Distro) (string, string) {
+	u := strings.NewReplacer("{manufacturer}", string(d.Manufacturer), "{board}", string(d.Board), "{distro}", string(di)).Replace(d.URL)
+	name := u
+	if p, err := url.Parse(u); err == nil {
+		name = p.Path
+	}
+	name = path.Base(name)
+	if d.Compression == "xz" {
+		name = strings.TrimSuffix(name, ".xz")
+	}
+	return u, name
+}
+
+// addBoard merges the definition into the known manufacturers, boards and
+// distros.
+func addBoard(d BoardDefinition) {
+	customBoards = append(customBoards, d)
+	if !containsName(manufacturers, d.Manufacturer) {
+		manufacturers = append(manufacturers, d.Manufacturer)
+	}
+	if !containsName(boards, d.Board) {
+		boards = append(boards, d.Board)
+	}
+	for _, di := range d.Distros {
+		if !containsName(distros, di) {
+			distros = append(distros, di)
+		}
+	}
+}
+
+func containsName[T ~string](l []T, s T) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isBuiltinImage returns true if the combination is supported without a
+// definition file.
+func isBuiltinImage(m Manufacturer, b Board, d Distro) bool {
+	return containsName(m.builtinBoards(), b) && containsName(m.builtinDistros(b), d)
+}
+
+// custom returns the loaded definition for the image, if any.
+func (i *Image) custom() *BoardDefinition {
+	for j := range customBoards {
+		c := &customBoards[j]
+		if c.Manufacturer == i.Manufacturer && c.Board == i.Board && c.hasDistro(i.Distro) {
+			return c
+		}
+	}
+	return nil
+}
+
+// fetchRawMirror is like fetchRaw but tries the mirror first, if any.
+func fetchRawMirror(ctx context.Context, mirror, imgurl, imgpath string, o *Options) error {
+	if mirror != "" {
+		m, err := mirrorURL(mirror, imgurl)
+		if err == nil {
+			if err = fetchRaw(ctx, m, imgpath, o); err == nil {
+				return nil
+			}
+		}
+		Progressf("- Failed to fetch from mirror %s, falling back to the default: %v\n", mirror, err)
+	}
+	return fetchRaw(ctx, imgurl, imgpath, o)
+}
+
+// fetchRaw fetches an uncompressed image.
+func fetchRaw(ctx context.Context, imgurl, imgpath string, o *Options) error {
+	if o.offline() {
+		return fmt.Errorf("failed to fetch %q: %w", imgurl, ErrOffline)
+	}
+	Progressf("- Fetching %s\n", imgurl)
+	resp, err := httpGet(ctx, imgurl, o)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return fmt.Errorf("failed to fetch %q: %w", imgurl, ErrImageNotFound)
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("failed to fetch %q: status %d", imgurl, resp.StatusCode)
+	}
+	return writeRaw(ctx, resp.Body, imgpath, max(resp.ContentLength, 0))
+}
+
+// writeRaw writes the uncompressed image read from r to imgpath while printing
+// the progress. size is the size of the image if known, otherwise 0.
+func writeRaw(ctx context.Context, r io.Reader, imgpath string, size int64) error {
+	/* #nosec G304 */
+	f, err := os.Create(imgpath)
+	if err != nil {
+		return err
+	}
+	if err = copyProgress(ctx, f, r, size); err != nil {
+		_ = f.Close()
+		_ = os.Remove(imgpath)
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,130 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// resetBoards restores the built-in board tables once the test completes.
+func resetBoards(t *testing.T) {
+	m := append([]Manufacturer{}, manufacturers...)
+	b := append([]Board{}, boards...)
+	d := append([]Distro{}, distros...)
+	t.Cleanup(func() {
+		manufacturers = m
+		boards = b
+		distros = d
+		customBoards = nil
+	})
+}
+
+func writeBoards(t *testing.T, content string) string {
+	p := filepath.Join(t.TempDir(), "boards.json")
+	if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadBoards(t *testing.T) {
+	resetBoards(t)
+	p := writeBoards(t, `[
+		{
+			"manufacturer": "pine64",
+			"board": "rock64",
+			"distros": ["armbian", "dietpi"],
+			"default_user": "root",
+			"default_hostname": "rock64",
+			"url": "https://example.com/{board}/{distro}.img.xz",
+			"boot_partition": 2,
+			"root_partition": 3
+		},
+		{
+			"manufacturer": "raspberrypi",
+			"board": "raspberrypi",
+			"distros": ["dietpi"],
+			"url": "https://example.com/dietpi.img"
+		}
+	]`)
+	if err := LoadBoards(p); err != nil {
+		t.Fatal(err)
+	}
+	var m Manufacturer
+	if err := m.Set("pine64"); err != nil {
+		t.Fatal(err)
+	}
+	var d Distro
+	if err := d.Set("dietpi"); err != nil {
+		t.Fatal(err)
+	}
+
+	i := Image{Board: "rock64"}
+	if err := i.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if i.String() != "pine64:rock64:armbian" {
+		t.Fatal(i.String())
+	}
+	if i.DefaultUser() != "root" || i.DefaultHostname() != "rock64" {
+		t.Fatal(i.DefaultUser(), i.DefaultHostname())
+	}
+	if i.BootPartition() != 2 || i.RootPartition() != 3 {
+		t.Fatal(i.BootPartition(), i.RootPartition())
+	}
+	u, name, err := i.URL(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != "https://example.com/rock64/armbian.img.xz" || name != "armbian.img" {
+		t.Fatal(u, name)
+	}
+
+	i = Image{Manufacturer: Raspberry, Distro: "dietpi"}
+	if err = i.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if u, name, err = i.URL(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if u != "https://example.com/dietpi.img" || name != "dietpi.img" {
+		t.Fatal(u, name)
+	}
+	if c := i.custom(); c == nil || c.Compression != "none" {
+		t.Fatal(c)
+	}
+	// The built-in default is unaffected.
+	i = Image{Manufacturer: Raspberry}
+	if err = i.Check(); err != nil || i.Distro != RaspiOS || i.custom() != nil {
+		t.Fatal(i.Distro, err)
+	}
+}
+
+func TestLoadBoardsErr(t *testing.T) {
+	resetBoards(t)
+	data := []string{
+		`{}`,
+		`[{"manufacturer": "Pine64", "board": "rock64", "distros": ["armbian"], "url": "https://example.com/a.img"}]`,
+		`[{"manufacturer": "pine64", "board": "rock:64", "distros": ["armbian"], "url": "https://example.com/a.img"}]`,
+		`[{"manufacturer": "pine64", "board": "rock64", "url": "https://example.com/a.img"}]`,
+		`[{"manufacturer": "pine64", "board": "rock64", "distros": ["armbian"], "url": "ftp://example.com/a.img"}]`,
+		`[{"manufacturer": "pine64", "board": "rock64", "distros": ["armbian"], "url": "https://example.com/a.img", "compression": "zstd"}]`,
+		`[{"manufacturer": "pine64", "board": "rock64", "distros": ["armbian"], "url": "https://example.com/a.img", "boot_partition": 2}]`,
+		`[{"manufacturer": "raspberrypi", "board": "raspberrypi", "distros": ["raspios"], "url": "https://example.com/a.img"}]`,
+		`[{"manufacturer": "pine64", "board": "rock64", "distros": ["armbian"], "url": "https://example.com/a.img"},
+		  {"manufacturer": "pine64", "board": "rock64", "distros": ["armbian"], "url": "https://example.com/b.img"}]`,
+	}
+	for i, line := range data {
+		if err := LoadBoards(writeBoards(t, line)); err == nil {
+			t.Fatalf("%d: expected error", i)
+		}
+	}
+	if err := LoadBoards("does-not-exist.json"); err == nil {
+		t.Fatal("expected error")
+	}
+}
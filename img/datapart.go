@@ -0,0 +1,213 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// DataFS is the file system of the data partition added by AddDataPartition.
+type DataFS string
+
+const (
+	// DataExt4 formats the data partition as EXT4. Only supported on Linux.
+	DataExt4 DataFS = "ext4"
+	// DataFAT formats the data partition as FAT32.
+	DataFAT DataFS = "fat"
+	// DataNone leaves the data partition unformatted, with the Linux partition
+	// type. Not supported on macOS.
+	DataNone DataFS = "none"
+)
+
+var dataFSs = []DataFS{DataExt4, DataFAT, DataNone}
+
+func (d *DataFS) String() string {
+	return string(*d)
+}
+
+// Set implements flag.Value.
+func (d *DataFS) Set(s string) error {
+	for _, e := range dataFSs {
+		if s == string(e) {
+			*d = e
+			return nil
+		}
+	}
+	return errors.New("unsupported data partition file system")
+}
+
+// Check returns an error if the file system cannot be used on this OS.
+func (d DataFS) Check() error {
+	switch {
+	case d == DataExt4 && runtime.GOOS != "linux":
+		return fmt.Errorf("formatting as ext4: %w", ErrUnsupportedOS)
+	case d == DataNone && runtime.GOOS == "darwin":
+		return fmt.Errorf("unformatted partition: %w", ErrUnsupportedOS)
+	default:
+		return nil
+	}
+}
+
+// DataFSHelp generates the help for DataFS.
+func DataFSHelp() string {
+	names := make([]string, len(dataFSs))
+	for i, e := range dataFSs {
+		names[i] = string(e)
+	}
+	return fmt.Sprintf("File system of the -data-partition: %s; ext4 is only supported on Linux", strings.Join(names, ", "))
+}
+
+// ParseDataSize parses the size of a data partition, in MiB with a "M" suffix
+// or in GiB with a "G" suffix. "rest" returns 0, which means the remaining
+// space on the disk.
+func ParseDataSize(s string) (int64, error) {
+	if s == "rest" {
+		return 0, nil
+	}
+	mult := int64(0)
+	switch {
+	case strings.HasSuffix(s, "M"):
+		mult = 1024 * 1024
+	case strings.HasSuffix(s, "G"):
+		mult = 1024 * 1024 * 1024
+	}
+	n, err := strconv.ParseInt(s[:max(len(s)-1, 0)], 10, 64)
+	if mult == 0 || err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q; use a size like 512M or 4G, or \"rest\"", s)
+	}
+	return n * mult, nil
+}
+
+// dataAlign is the alignment of the data partition, as done by the usual
+// partitioning tools.
+const dataAlign = 1024 * 1024
+
+// maxMBRPartitions is the number of primary partitions a MBR partition table
+// holds.
+const maxMBRPartitions = 4
+
+// gptBackupSectors is the number of sectors at the end of the disk used by the
+// backup GPT: its 128 entries of 128 bytes then its header.
+const gptBackupSectors = 33
+
+// PlanDataPartition returns the offset and size in bytes of a data partition
+// of size bytes placed after the partitions parts on disk. size 0 means the
+// remaining space. gpt is true if the partition table is a GPT one, which
+// keeps a backup at the end of the disk.
+//
+// It returns an error if there isn't enough room on disk or in the partition
+// table.
+func PlanDataPartition(disk string, parts []Partition, gpt bool, size int64) (int64, int64, error) {
+	if !gpt && len(parts) >= maxMBRPartitions {
+		return 0, 0, fmt.Errorf("can't add a data partition to %s: a MBR partition table holds at most %d partitions", disk, maxMBRPartitions)
+	}
+	end := int64(0)
+	for _, p := range parts {
+		end = max(end, p.Offset+p.Size)
+	}
+	start := (end + dataAlign - 1) / dataAlign * dataAlign
+	total := DiskSize(disk)
+	if isRegularFile(disk) {
+		if fi, err := os.Stat(disk); err == nil {
+			total = fi.Size()
+		}
+	}
+	if total == 0 {
+		return 0, 0, fmt.Errorf("failed to get the size of %s", disk)
+	}
+	if gpt {
+		total -= gptBackupSectors * SectorSize
+	}
+	free := (total - start) / dataAlign * dataAlign
+	if size == 0 {
+		size = free
+	}
+	if size < dataAlign || size > free {
+		return 0, 0, fmt.Errorf("not enough room on %s for a data partition: %s available", disk, formatSize(max(free, 0)))
+	}
+	return start, size, nil
+}
+
+// AddDataPartition adds a partition of size bytes in the free space after the
+// partitions parts on disk, formats it as fs and returns its number.
+//
+// It is meant to be called right after Flash, with the partitions of the
+// image and whether its partition table is a GPT one.
+func AddDataPartition(ctx context.Context, disk string, parts []Partition, gpt bool, size int64, fs DataFS, o *Options) (int, error) {
+	if err := fs.Check(); err != nil {
+		return 0, err
+	}
+	start, size, err := PlanDataPartition(disk, parts, gpt, size)
+	if err != nil {
+		return 0, err
+	}
+	n := len(parts) + 1
+	Progressf("- Adding a %s data partition #%d to %s\n", formatSize(size), n, disk)
+	switch runtime.GOOS {
+	case "linux":
+		err = addPartitionLinux(ctx, disk, n, start, size, fs, o)
+	case "darwin":
+		err = addPartitionOSX(disk, n, size)
+	case "windows":
+		err = addPartitionWindows(disk, start, size, fs)
+	default:
+		err = ErrUnsupportedOS
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to add a data partition to %s: %w", disk, err)
+	}
+	return n, nil
+}
+
+// addPartitionLinux adds the partition with sfdisk and formats it.
+func addPartitionLinux(ctx context.Context, disk string, n int, start, size int64, fs DataFS, o *Options) error {
+	typ := "83"
+	if fs == DataFAT {
+		typ = "c"
+	}
+	spec := fmt.Sprintf("start=%d, size=%d, type=%s\n", start/SectorSize, size/SectorSize, typ)
+	dev := disk
+	if isRegularFile(disk) {
+		// sfdisk edits the file directly. It is then attached to format the
+		// partition.
+		if _, err := capture(o, spec, "sfdisk", "--append", disk); err != nil {
+			return err
+		}
+		if fs == DataNone {
+			return nil
+		}
+		var err error
+		if dev, err = attachLoop(disk, o); err != nil {
+			return err
+		}
+	} else if _, err := capture(o, spec, "sudo", "sfdisk", "--append", disk); err != nil {
+		return err
+	}
+	if err := WaitForPartition(ctx, dev, n, o.partitionTimeout()); err != nil {
+		return err
+	}
+	part := PartitionPath(dev, n)
+	var err error
+	switch fs {
+	case DataExt4:
+		_, err = capture(o, "", "sudo", "mkfs.ext4", "-F", "-q", "-L", "data", part)
+	case DataFAT:
+		_, err = capture(o, "", "sudo", "mkfs.vfat", "-F", "32", "-n", "DATA", part)
+	}
+	return err
+}
+
+// addPartitionOSX adds the partition after the partition n-1 with diskutil,
+// formatted as FAT32.
+func addPartitionOSX(disk string, n int, size int64) error {
+	_, err := capture(nil, "", "diskutil", "addPartition", PartitionPath(disk, n-1), "MS-DOS FAT32", "DATA", strconv.FormatInt(size, 10)+"B")
+	return err
+}
@@ -0,0 +1,107 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseDataSize(t *testing.T) {
+	data := []struct {
+		in       string
+		expected int64
+	}{
+		{"rest", 0},
+		{"512M", 512 * 1024 * 1024},
+		{"4G", 4 * 1024 * 1024 * 1024},
+	}
+	for i, l := range data {
+		got, err := ParseDataSize(l.in)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if got != l.expected {
+			t.Fatalf("%d: %d != %d", i, got, l.expected)
+		}
+	}
+	for i, s := range []string{"", "M", "4", "4T", "-1G", "0M", "1.5G"} {
+		if _, err := ParseDataSize(s); err == nil {
+			t.Fatalf("%d: expected error", i)
+		}
+	}
+}
+
+func TestDataFS(t *testing.T) {
+	var d DataFS
+	if err := d.Set("fat"); err != nil || d != DataFAT {
+		t.Fatal(d, err)
+	}
+	if err := d.Set("ntfs"); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := DataFAT.Check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlanDataPartition(t *testing.T) {
+	const mib = 1024 * 1024
+	p := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Truncate(64 * mib); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	parts := []Partition{{Offset: 4 * mib, Size: 8 * mib}, {Offset: 12 * mib, Size: 20*mib + 512}}
+	data := []struct {
+		size          int64
+		start, length int64
+	}{
+		{0, 33 * mib, 31 * mib},
+		{16 * mib, 33 * mib, 16 * mib},
+		{31 * mib, 33 * mib, 31 * mib},
+	}
+	for i, l := range data {
+		start, size, err := PlanDataPartition(p, parts, false, l.size)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if start != l.start || size != l.length {
+			t.Fatalf("%d: %d, %d", i, start, size)
+		}
+	}
+	if _, _, err = PlanDataPartition(p, parts, false, 32*mib); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, _, err = PlanDataPartition(p, []Partition{{Offset: 4 * mib, Size: 60 * mib}}, false, 0); err == nil {
+		t.Fatal("expected error")
+	}
+	// The remaining space stops before the backup GPT at the end of the disk.
+	start, size, err := PlanDataPartition(p, parts, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != 33*mib || size != 30*mib || start+size > 64*mib-gptBackupSectors*SectorSize {
+		t.Fatal(start, size)
+	}
+	if _, _, err = PlanDataPartition(p, parts, true, 31*mib); err == nil {
+		t.Fatal("expected the backup GPT to be preserved")
+	}
+	// A MBR holds at most 4 partitions, a GPT more.
+	four := []Partition{{Offset: 1 * mib, Size: mib}, {Offset: 2 * mib, Size: mib}, {}, {Offset: 4 * mib, Size: mib}}
+	if _, _, err = PlanDataPartition(p, four, false, 0); err == nil {
+		t.Fatal("expected the MBR to be full")
+	}
+	if _, _, err = PlanDataPartition(p, four, true, 0); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotDetected is returned by DetectImage when the boot partition doesn't
+// match any known image.
+var ErrNotDetected = errors.New("no known image found")
+
+// DetectImage guesses the image in the boot partition mounted at dir, from the
+// marker files each distro writes in it.
+//
+// This is a best effort meant to suggest the flags to re-flash a SDCard with
+// the same image. The board is left to its default.
+func DetectImage(dir string) (Image, error) {
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	read := func(name string) string {
+		/* #nosec G304 */
+		b, _ := os.ReadFile(filepath.Join(dir, name))
+		return string(b)
+	}
+	var i Image
+	switch {
+	case strings.Contains(read("issue.txt"), "pi-gen"):
+		// RaspiOS records how it was built in issue.txt.
+		i = Image{Manufacturer: Raspberry, Distro: RaspiOS}
+		for _, l := range strings.Split(read("config.txt"), "\n") {
+			if strings.TrimSpace(l) == "arm_64bit=1" {
+				i.Distro = RaspiOS64
+			}
+		}
+	case exists("user-data") && exists("cmdline.txt"):
+		// Ubuntu on the Raspberry Pi is configured with cloud-init.
+		i = Image{Manufacturer: Raspberry, Distro: Ubuntu}
+	case exists("boot.ini"):
+		i = Image{Manufacturer: HardKernel, Board: OdroidC1, Distro: Ubuntu}
+	default:
+		return i, ErrNotDetected
+	}
+	return i, i.Check()
+}
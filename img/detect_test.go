@@ -0,0 +1,53 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectImage(t *testing.T) {
+	data := []struct {
+		files    map[string]string
+		expected string
+	}{
+		{
+			map[string]string{"issue.txt": "Raspberry Pi reference 2024-03-15\nGenerated using pi-gen\n", "config.txt": "dtparam=audio=on\n"},
+			"raspberrypi:raspberrypi:raspios",
+		},
+		{
+			map[string]string{"issue.txt": "Generated using pi-gen\n", "config.txt": "[all]\narm_64bit=1\n"},
+			"raspberrypi:raspberrypi:raspios64",
+		},
+		{
+			map[string]string{"user-data": "#cloud-config\n", "network-config": "", "cmdline.txt": "console=serial0,115200\n"},
+			"raspberrypi:raspberrypi:ubuntu",
+		},
+		{
+			map[string]string{"boot.ini": "ODROIDC-UBOOT-CONFIG\n"},
+			"hardkernel:odroidc1:ubuntu",
+		},
+	}
+	for i, l := range data {
+		d := t.TempDir()
+		for name, c := range l.files {
+			if err := os.WriteFile(filepath.Join(d, name), []byte(c), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := DetectImage(d)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if got.String() != l.expected {
+			t.Fatalf("%d: %s != %s", i, got.String(), l.expected)
+		}
+	}
+	if _, err := DetectImage(t.TempDir()); err != ErrNotDetected {
+		t.Fatal(err)
+	}
+}
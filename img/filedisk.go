@@ -0,0 +1,82 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"errors"
+	"io"
+)
+
+// ReaderWriterAt is implemented by *os.File.
+type ReaderWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// FileDisk exposes a partition within an image file as a disk.
+//
+// Offsets passed to ReadAt and WriteAt are relative to the start of the
+// partition.
+type FileDisk struct {
+	f    ReaderWriterAt
+	off  int64
+	size int64
+}
+
+// NewFileDisk returns a FileDisk for the partition starting at byte off of f
+// and of size bytes.
+func NewFileDisk(f ReaderWriterAt, off, size int64) *FileDisk {
+	return &FileDisk{f: f, off: off, size: size}
+}
+
+// Close implements io.Closer.
+//
+// It doesn't close the underlying file, which is owned by the caller.
+func (f *FileDisk) Close() error {
+	return errors.New("abstraction layer error")
+}
+
+// Len returns the size of the partition in bytes.
+func (f *FileDisk) Len() int64 {
+	return f.size
+}
+
+// ReadAt implements io.ReaderAt.
+//
+// Reads crossing the end of the partition are truncated and return io.EOF.
+func (f *FileDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	if rem := f.size - off; int64(len(p)) > rem {
+		n, err := f.f.ReadAt(p[:rem], off+f.off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return f.f.ReadAt(p, off+f.off)
+}
+
+// SectorSize returns the sector size, which is always 512.
+func (f *FileDisk) SectorSize() int {
+	return 512
+}
+
+// WriteAt implements io.WriterAt.
+//
+// Writes crossing the end of the partition are rejected as a whole.
+func (f *FileDisk) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off+int64(len(p)) > f.size {
+		return 0, errors.New("overflow")
+	}
+	return f.f.WriteAt(p, off+f.off)
+}
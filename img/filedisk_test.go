@@ -0,0 +1,75 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// memFile is an in-memory ReaderWriterAt.
+type memFile []byte
+
+func (m memFile) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(m).ReadAt(p, off)
+}
+
+func (m memFile) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(m)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(m[off:], p), nil
+}
+
+func TestFileDisk(t *testing.T) {
+	m := make(memFile, 4096)
+	for i := range m {
+		m[i] = byte(i / 512)
+	}
+	// The partition is the sectors 2 and 3.
+	d := NewFileDisk(m, 1024, 1024)
+	if d.Len() != 1024 || d.SectorSize() != 512 {
+		t.Fatal(d.Len(), d.SectorSize())
+	}
+	b := make([]byte, 512)
+	// Last sector of the partition.
+	if n, err := d.ReadAt(b, 512); n != 512 || err != nil {
+		t.Fatal(n, err)
+	}
+	if b[0] != 3 || b[511] != 3 {
+		t.Fatal(b[0], b[511])
+	}
+	// Crossing the end of the partition.
+	if n, err := d.ReadAt(b, 768); n != 256 || err != io.EOF {
+		t.Fatal(n, err)
+	}
+	if b[0] != 3 || b[255] != 3 {
+		t.Fatal(b[0], b[255])
+	}
+	// At the end of the partition.
+	if n, err := d.ReadAt(b, 1024); n != 0 || err != io.EOF {
+		t.Fatal(n, err)
+	}
+	if _, err := d.ReadAt(b, -1); err == nil {
+		t.Fatal("expected error")
+	}
+
+	for i := range b {
+		b[i] = 0xFF
+	}
+	if n, err := d.WriteAt(b, 512); n != 512 || err != nil {
+		t.Fatal(n, err)
+	}
+	if m[1535] != 2 || m[1536] != 0xFF || m[2047] != 0xFF || m[2048] != 4 {
+		t.Fatal("wrote outside of the partition")
+	}
+	if _, err := d.WriteAt(b, 513); err == nil {
+		t.Fatal("expected error")
+	}
+	if m[2048] != 4 {
+		t.Fatal("wrote outside of the partition")
+	}
+}
@@ -12,9 +12,13 @@
 package img // import "periph.io/x/bootstrap/img"
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
@@ -25,11 +29,72 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"howett.net/plist"
+	"periph.io/x/bootstrap"
 )
 
+var (
+	// ErrUnsupportedOS is returned when an operation is not implemented on the
+	// host OS.
+	ErrUnsupportedOS = errors.New("not implemented on this OS")
+	// ErrNoSDCard is returned when the SDCard to operate on is not found.
+	ErrNoSDCard = errors.New("SDCard not found")
+	// ErrImageNotFound is returned when no image can be found for the
+	// requested board and distro.
+	ErrImageNotFound = errors.New("image not found")
+	// ErrOffline is returned when a network request is needed while
+	// Options.Offline is set.
+	ErrOffline = errors.New("network access is disabled in offline mode")
+	// ErrImageTooLarge is returned when the image doesn't fit on the SDCard.
+	ErrImageTooLarge = errors.New("image larger than the SDCard")
+)
+
+// maxSDCardSize is the size from which ListSDCards ignores a removable disk on
+// Linux and macOS.
+//
+// Since most workstations disks are generally 120Gb and more, this reduces the
+// risk of flashing a secondary or backup disk by accident. In this case, the
+// user will have to specify the path manually.
+const maxSDCardSize = 70 * 1024 * 1024 * 1024
+
+// partitionPoll is how often to check whether a partition showed up.
+var partitionPoll = 100 * time.Millisecond
+
+// settleDelay is the pause once flashed before looking for the partitions
+// when udev can't be waited on, e.g. on macOS, and between mount attempts.
+var settleDelay = time.Second
+
+// maxBlockSize is the maximum Options.FlashBlockSize accepted by ParseBlockSize.
+const maxBlockSize = 64 * 1024 * 1024
+
+// ParseBlockSize parses a block size in bytes, or in KiB with a "K" suffix or
+// in MiB with a "M" suffix, e.g. 512K. It must be a multiple of 512 and at most
+// 64M.
+func ParseBlockSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1024
+	case strings.HasSuffix(s, "M"):
+		mult = 1024 * 1024
+	}
+	digits := s
+	if mult != 1 {
+		digits = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n <= 0 || n > maxBlockSize/mult {
+		return 0, fmt.Errorf("invalid block size %q; use a size like 1M or 512K, up to 64M", s)
+	}
+	if n *= mult; n%SectorSize != 0 {
+		return 0, fmt.Errorf("block size %d is not a multiple of the sector size %d", n, SectorSize)
+	}
+	return n, nil
+}
+
 // GetTimeLocation returns the time location, e.g. America/Toronto.
 //
 // This is then used by Debian to figure out the right timezone (e.g. EST/EDT)
@@ -55,12 +120,32 @@ func GetTimeLocation() string {
 	return "Etc/UTC"
 }
 
+// GetLocale returns the host locale as found in $LANG, e.g. en_GB.UTF-8.
+//
+// Returns an empty string when unset or set to the "C" or "POSIX" locales.
+// The encoding is normalized so "en_GB.utf8" is returned as "en_GB.UTF-8".
+func GetLocale() string {
+	l := os.Getenv("LANG")
+	if l == "" || l == "C" || l == "POSIX" || strings.HasPrefix(l, "C.") {
+		return ""
+	}
+	if i := strings.IndexByte(l, '.'); i != -1 {
+		if e := strings.ToLower(l[i+1:]); e == "utf8" || e == "utf-8" {
+			l = l[:i] + ".UTF-8"
+		}
+	}
+	return l
+}
+
 // GetCountry returns the automatically detected country.
 //
-// WARNING: This causes an outgoing HTTP request.
-func GetCountry() string {
+// WARNING: This causes an outgoing HTTP request, unless o.Offline is set.
+func GetCountry(ctx context.Context, o *Options) string {
+	if o.offline() {
+		return ""
+	}
 	// TODO(maruel): Ask the OS first if possible.
-	b, err := fetchURL("https://ipinfo.io/country")
+	b, err := fetchURL(ctx, "https://ipinfo.io/country", o)
 	if err != nil {
 		return ""
 	}
@@ -69,28 +154,37 @@ func GetCountry() string {
 
 // GetSetupSH returns the content of setup.sh.
 //
-// Returns nil in case of catastrophic error.
-func GetSetupSH() []byte {
-	var p []string
-	if v, err := os.Getwd(); err == nil {
-		p = append(p, v)
+// It uses setup.sh in the current directory if present, which is useful when
+// working on a checkout of this repository. Otherwise it returns the copy
+// embedded at build time, which is the one that understands the arguments
+// these tools pass to it.
+//
+// When latest is true and o.Offline is not set, the version on GitHub master
+// is fetched instead of the embedded one, falling back to it on failure. It may not support every
+// argument passed by this build, in which case it exits without provisioning
+// the board.
+//
+// An error is returned if no script can be found, so that a board is never
+// flashed with an empty firstboot.sh.
+func GetSetupSH(ctx context.Context, latest bool, o *Options) ([]byte, error) {
+	/* #nosec G304 */
+	b, err := os.ReadFile("setup.sh")
+	if err == nil && len(b) != 0 {
+		return b, nil
 	}
-	if gp := os.Getenv("GOPATH"); len(gp) != 0 {
-		for _, v := range strings.Split(gp, string(os.PathListSeparator)) {
-			p = append(p, filepath.Join(v, "go", "src", "periph.io", "x", "bootstrap"))
-		}
-	} else {
-		p = append(p, filepath.Join(getHome(), "go", "src", "periph.io", "x", "bootstrap"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read the local setup.sh: %w", err)
 	}
-	for _, v := range p {
-		/* #nosec G304 */
-		b, err := os.ReadFile(filepath.Join(v, "setup.sh"))
-		if err == nil && len(b) != 0 {
-			return b
+	if latest && !o.offline() {
+		if b, err := fetchURL(ctx, "https://raw.githubusercontent.com/periph/bootstrap/master/setup.sh", o); err == nil && len(b) != 0 {
+			log.Printf("using the latest setup.sh from GitHub")
+			return b, nil
 		}
 	}
-	b, _ := fetchURL("https://raw.githubusercontent.com/periph/bootstrap/master/setup.sh")
-	return b
+	if len(bootstrap.SetupSH) == 0 {
+		return nil, errors.New("setup.sh is not available: none is embedded")
+	}
+	return bootstrap.SetupSH, nil
 }
 
 // FindPublicKey returns the absolute path to a public key for the user, if any.
@@ -106,6 +200,34 @@ func FindPublicKey() string {
 	return ""
 }
 
+// CheckOS returns an error wrapping ErrUnsupportedOS if SDCards can't be
+// flashed nor mounted on the host OS.
+//
+// On Linux, it also returns an error if lsblk is not installed.
+//
+// Commands should call it before doing any work, so they fail early with a
+// clear message instead of midway. Fetching images works on all OSes.
+func CheckOS() error {
+	if err := checkOS(runtime.GOOS); err != nil {
+		return err
+	}
+	if runtime.GOOS == "linux" {
+		if _, err := exec.LookPath("lsblk"); err != nil {
+			return errNoLsblk
+		}
+	}
+	return nil
+}
+
+func checkOS(goos string) error {
+	switch goos {
+	case "darwin", "linux", "windows":
+		return nil
+	default:
+		return fmt.Errorf("SDCards can't be flashed on %s, only on Linux, macOS and Windows: %w", goos, ErrUnsupportedOS)
+	}
+}
+
 // ListSDCards returns the SD cards found.
 //
 // Returns nil in case of error.
@@ -122,60 +244,373 @@ func ListSDCards() []string {
 	}
 }
 
+// DescribeDisk returns a short human readable description of the disk, like
+// its model and size.
+//
+// Returns an empty string in case of error.
+func DescribeDisk(disk string) string {
+	switch runtime.GOOS {
+	case "linux":
+		b, err := capture(nil, "", "lsblk", "--bytes", "--nodeps", "--noheadings", "-o", "MODEL,SIZE", disk)
+		if err != nil {
+			return ""
+		}
+		f := strings.Fields(b)
+		if len(f) == 0 {
+			return ""
+		}
+		n, err := strconv.ParseInt(f[len(f)-1], 10, 64)
+		if err != nil {
+			return strings.Join(f, " ")
+		}
+		return strings.TrimSpace(strings.Join(f[:len(f)-1], " ") + " " + formatSize(n))
+	case "darwin":
+		b, err := capture(nil, "", "diskutil", "info", "-plist", disk)
+		if err != nil {
+			return ""
+		}
+		info := diskutilInfo{}
+		if _, err = plist.Unmarshal([]byte(b), &info); err != nil {
+			return ""
+		}
+		return strings.TrimSpace(info.MediaName + " " + formatSize(info.Size))
+	case "windows":
+		return describeDiskWindows(disk)
+	default:
+		return ""
+	}
+}
+
+// DiskSize returns the size of the disk in bytes as reported by the OS.
+//
+// Returns 0 in case of error.
+func DiskSize(disk string) int64 {
+	switch runtime.GOOS {
+	case "linux":
+		b, err := capture(nil, "", "lsblk", "--bytes", "--nodeps", "--noheadings", "-o", "SIZE", disk)
+		if err != nil {
+			return 0
+		}
+		n, _ := strconv.ParseInt(strings.TrimSpace(b), 10, 64)
+		return n
+	case "darwin":
+		b, err := capture(nil, "", "diskutil", "info", "-plist", disk)
+		if err != nil {
+			return 0
+		}
+		info := diskutilInfo{}
+		if _, err = plist.Unmarshal([]byte(b), &info); err != nil {
+			return 0
+		}
+		return info.Size
+	case "windows":
+		return diskSizeWindows(disk)
+	default:
+		return 0
+	}
+}
+
+// FreeSpace returns the number of bytes available to the current user on the
+// file system containing dir.
+func FreeSpace(dir string) (int64, error) {
+	return freeSpace(dir)
+}
+
+// CheckFreeSpace returns an error if the file system containing dir has less
+// than need bytes available.
+//
+// It is meant to be used before writing large files, to fail early instead of
+// leaving a half-written image behind.
+func CheckFreeSpace(dir string, need int64) error {
+	n, err := FreeSpace(dir)
+	if err != nil {
+		// Do not block on an unsupported OS or an unexpected error.
+		log.Printf("failed to get free space of %s: %v", dir, err)
+		return nil
+	}
+	if n < need {
+		return fmt.Errorf("not enough free space in %s: %s needed but only %s available", dir, formatSize(need), formatSize(n))
+	}
+	return nil
+}
+
+// SystemDisks returns the disks containing the running OS.
+//
+// Returns nil in case of error.
+func SystemDisks() []string {
+	switch runtime.GOOS {
+	case "linux":
+		return systemDisksLinux()
+	case "darwin":
+		return systemDisksOSX()
+	case "windows":
+		return systemDisksWindows()
+	default:
+		return nil
+	}
+}
+
 // Flash flashes imgPath to disk.
 //
 // Before flashing, it unmounts any partition mounted on disk.
-func Flash(imgPath, disk string) error {
-	if err := Umount(disk); err != nil {
+//
+// It refuses to flash the disk containing the running OS unless
+// o.AllowSystemDisk is set.
+//
+// When ctx is canceled, e.g. on Ctrl-C, flashing stops as soon as possible and
+// the writes done so far to the SDCard are flushed. The returned error wraps
+// context.Canceled, or context.DeadlineExceeded when its deadline expired.
+//
+// disk can also be an existing regular file, which is then used as a raw disk
+// image; Mount attaches it as a loop device. This is useful for testing.
+func Flash(ctx context.Context, imgPath, disk string, o *Options) error {
+	return flash(ctx, imgPath, disk, nil, o)
+}
+
+// FlashStream flashes the content read from r to disk and returns the hex
+// encoded SHA-256 of the data written.
+//
+// The data is hashed as it is written, which saves a separate read pass to
+// get the hash of the image, e.g. to record it or to compare it with the
+// content read back from disk. The same checks as Flash are done before
+// writing.
+func FlashStream(ctx context.Context, r io.Reader, disk string, o *Options) (string, error) {
+	h := sha256.New()
+	if err := flashStream(ctx, io.TeeReader(r, h), disk, true, o); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CheckImageFits returns an error wrapping ErrImageTooLarge if the image
+// imgPath is larger than the capacity of disk.
+//
+// Flash does this check itself; use it to fail before doing any other work.
+// A regular file used as disk grows as needed, and the check is skipped when
+// the capacity can't be determined.
+func CheckImageFits(imgPath, disk string) error {
+	if isRegularFile(disk) {
 		return nil
 	}
+	fi, err := os.Stat(imgPath)
+	if err != nil {
+		return err
+	}
+	return checkFits(fi.Size(), DiskSize(disk), disk)
+}
+
+// checkFits returns an error wrapping ErrImageTooLarge if size is larger than
+// capacity, when known.
+func checkFits(size, capacity int64, disk string) error {
+	if capacity <= 0 || size <= capacity {
+		return nil
+	}
+	return fmt.Errorf("image (%s) larger than %s (%s): %w", formatSize(size), disk, formatSize(capacity), ErrImageTooLarge)
+}
+
+// flash flashes imgPath to disk, only writing the blocks in m if not nil.
+func flash(ctx context.Context, imgPath, disk string, m *bmap, o *Options) error {
+	if isRegularFile(disk) {
+		if err := detachLoop(disk, o); err != nil {
+			return err
+		}
+		return flashFile(imgPath, disk)
+	}
+	restore, err := prepareDisk(disk, o)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	if err = CheckImageFits(imgPath, disk); err != nil {
+		return err
+	}
 	switch runtime.GOOS {
 	case "darwin":
-		if err := ddFlash(imgPath, toRawDiskOSX(disk)); err != nil {
+		if err := ddFlash(ctx, imgPath, toRawDiskOSX(disk), m, o); err != nil {
 			return err
 		}
-		time.Sleep(time.Second)
-		// Assumes this image has at least one partition.
-		p := disk + "s1"
-		for {
-			if _, err := os.Stat(p); err == nil {
-				break
-			}
-			fmt.Printf(" (still waiting for partition %s to show up)\n", p)
-			time.Sleep(time.Second)
-		}
-		return nil
+		return waitFlashed(ctx, disk, o)
 	case "linux":
-		if err := ddFlash(imgPath, disk); err != nil {
+		if err := ddFlash(ctx, imgPath, disk, m, o); err != nil {
 			return err
 		}
-		// Wait a bit to try to workaround "Error looking up object for device" when
-		// immediately using "/usr/bin/udisksctl mount" after this script.
-		time.Sleep(time.Second)
-		// Needs suffix 'p' for /dev/mmcblkN but not for /dev/sdX
-		p := disk
-		if strings.Contains(p, "mmcblk") {
-			p += "p"
-		}
-		// Assumes this image has at least one partition.
-		p += "1"
-		for {
-			if _, err := os.Stat(p); err == nil {
-				break
-			}
-			fmt.Printf(" (still waiting for partition %s to show up)\n", p)
-			time.Sleep(time.Second)
+		return waitFlashed(ctx, disk, o)
+	case "windows":
+		return flashWindows(ctx, imgPath, disk, m, o)
+	default:
+		return fmt.Errorf("Flash(): %w", ErrUnsupportedOS)
+	}
+}
+
+// flashStream is like flash but reads the image from r.
+//
+// progress is false when the caller prints the progress itself.
+func flashStream(ctx context.Context, r io.Reader, disk string, progress bool, o *Options) error {
+	if isRegularFile(disk) {
+		if err := detachLoop(disk, o); err != nil {
+			return err
 		}
-		return nil
+		Progressf("- Writing to the file %s\n", disk)
+		return writeFile(disk, r)
+	}
+	restore, err := prepareDisk(disk, o)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	switch runtime.GOOS {
+	case "darwin", "linux":
+		dst := disk
+		if runtime.GOOS == "darwin" {
+			dst = toRawDiskOSX(disk)
+		}
+		if err := ddFlashStream(ctx, r, dst, progress, o); err != nil {
+			return err
+		}
+		return waitFlashed(ctx, disk, o)
+	case "windows":
+		return writeWindows(ctx, r, -1, disk, nil, progress, o)
+	default:
+		return fmt.Errorf("FlashStream(): %w", ErrUnsupportedOS)
+	}
+}
+
+// waitFlashed waits for the first partition of the freshly flashed disk to
+// show up.
+func waitFlashed(ctx context.Context, disk string, o *Options) error {
+	if runtime.GOOS != "linux" || !hasUdevadm() {
+		// Wait a bit to try to workaround "Error looking up object for device"
+		// when immediately using "/usr/bin/udisksctl mount" after this script.
+		time.Sleep(settleDelay)
+	}
+	// Assumes this image has at least one partition.
+	return WaitForPartition(ctx, disk, 1, o.partitionTimeout())
+}
+
+// prepareDisk verifies that disk can be flashed and unmounts it.
+//
+// The returned function must be called once flashed.
+func prepareDisk(disk string, o *Options) (func(), error) {
+	if err := checkDisk(disk); err != nil {
+		return nil, err
+	}
+	if err := checkNotSystemDisk(disk, o); err != nil {
+		return nil, err
+	}
+	restore := func() {}
+	if o.noAutomount() && runtime.GOOS == "linux" {
+		var err error
+		if restore, err = inhibitAutomount(disk, o); err != nil {
+			return nil, err
+		}
+	}
+	if err := UnmountAll(disk, o); err != nil {
+		restore()
+		return nil, err
+	}
+	return restore, nil
+}
+
+// PartitionPath returns the device path of the partition number n (1 based)
+// on disk.
+//
+// Returns an empty string on Windows, where partitions are accessed as
+// volumes instead.
+func PartitionPath(disk string, n int) string {
+	return partitionPath(runtime.GOOS, disk, n)
+}
+
+func partitionPath(goos, disk string, n int) string {
+	switch goos {
+	case "darwin":
+		// /dev/disk2 -> /dev/disk2s1
+		return fmt.Sprintf("%ss%d", disk, n)
 	case "windows":
-		return flashWindows(imgPath, disk)
+		return ""
 	default:
-		return errors.New("Flash() is not implemented on this OS")
+		// Devices whose name ends with a digit, like /dev/mmcblk0,
+		// /dev/nvme0n1 or /dev/loop0, need a 'p' separator. /dev/sda doesn't.
+		if disk != "" && disk[len(disk)-1] >= '0' && disk[len(disk)-1] <= '9' {
+			return fmt.Sprintf("%sp%d", disk, n)
+		}
+		return fmt.Sprintf("%s%d", disk, n)
+	}
+}
+
+// hasUdevadm returns true if udevadm is available.
+func hasUdevadm() bool {
+	_, err := exec.LookPath("udevadm")
+	return err == nil
+}
+
+// udevSettle waits for at most timeout for udev to process the pending
+// events, so the partition device nodes are (re)created and udisks knows about
+// them once the kernel reread the partition table.
+//
+// Does nothing if udevadm is not available.
+func udevSettle(ctx context.Context, timeout time.Duration) {
+	if !hasUdevadm() {
+		return
+	}
+	secs := int((timeout + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	if _, err := captureOp(ctx, nil, "", "udevadm", "settle", "--timeout="+strconv.Itoa(secs)); err != nil {
+		// It times out when the events keep coming; the poll below still bounds
+		// the wait.
+		log.Printf("udevadm settle: %v", err)
+	}
+}
+
+// WaitForPartition waits for the partition number n (1 based) on disk to show
+// up, for at most timeout or until ctx is done.
+//
+// On Linux, it first waits for udev to settle so a stale node from the
+// previous partition table isn't used while it is being recreated.
+func WaitForPartition(ctx context.Context, disk string, n int, timeout time.Duration) error {
+	if runtime.GOOS == "windows" {
+		// The partitions show up as volumes.
+		for start := time.Now(); time.Since(start) < timeout; time.Sleep(partitionPoll) {
+			if _, err := mountWindows(disk, n, nil); err == nil {
+				return nil
+			}
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("partition #%d on %s: %w", n, disk, err)
+			}
+		}
+		return fmt.Errorf("partition #%d on %s didn't show up after %s; the SDCard may be faulty", n, disk, timeout)
+	}
+	start := time.Now()
+	if runtime.GOOS == "linux" {
+		udevSettle(ctx, timeout)
+	}
+	p := PartitionPath(disk, n)
+	for next := start.Add(time.Second); ; time.Sleep(partitionPoll) {
+		if _, err := os.Stat(p); err == nil {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("partition %s: %w", p, err)
+		}
+		now := time.Now()
+		if now.Sub(start) >= timeout {
+			return fmt.Errorf("partition %s didn't show up after %s; the SDCard may be faulty", p, timeout)
+		}
+		if now.After(next) {
+			Progressf(" (still waiting for partition %s to show up)\n", p)
+			next = now.Add(time.Second)
+		}
 	}
 }
 
 // Mount mounts a partition number n on disk p and returns the mount path.
-func Mount(disk string, n int) (string, error) {
+//
+// It stops retrying when ctx is done.
+func Mount(ctx context.Context, disk string, n int, o *Options) (string, error) {
+	if isRegularFile(disk) {
+		return mountFile(ctx, disk, n, o)
+	}
 	switch runtime.GOOS {
 	case "darwin":
 		// diskutil doesn't report which volume was mounted, so look at the ones
@@ -184,9 +619,9 @@ func Mount(disk string, n int) (string, error) {
 		if err != nil {
 			return "", err
 		}
-		mnt := fmt.Sprintf("%ss%d", disk, n)
+		mnt := PartitionPath(disk, n)
 		log.Printf("- Mounting %s", mnt)
-		if _, err = capture("", "diskutil", "mountDisk", mnt); err != nil {
+		if _, err = captureOp(ctx, nil, "", "diskutil", "mountDisk", mnt); err != nil {
 			return "", err
 		}
 		after, err := getMountedVolumesOSX()
@@ -206,35 +641,48 @@ func Mount(disk string, n int) (string, error) {
 		log.Printf("  Mounted as %s", found)
 		return found, nil
 	case "linux":
-		// Needs 'p' for /dev/mmcblkN but not for /dev/sdX
-		if strings.Contains(disk, "mmcblk") {
-			disk += "p"
-		}
-		mnt := fmt.Sprintf("%s%d", disk, n)
+		mnt := PartitionPath(disk, n)
 		log.Printf("- Mounting %s", mnt)
-		const exe = "/usr/bin/udisksctl"
-		if _, err := os.Stat(exe); err != nil {
-			return "", errors.New("please install package udisks2 to get /usr/bin/udisksctl")
+		dst, err := mountLinux(ctx, mnt, o)
+		for i := 0; err != nil && i < o.mountRetries() && ctx.Err() == nil; i++ {
+			// udisks may not know about the partition yet.
+			log.Printf("  Retrying: %v", err)
+			time.Sleep(settleDelay)
+			dst, err = mountLinux(ctx, mnt, o)
 		}
-		txt, _ := capture("", exe, "mount", "-b", mnt)
-		if dst := udisksctlMount(txt); dst != "" {
-			log.Printf("  Mounted as %s", dst)
-			return dst, nil
+		if err != nil {
+			return "", err
 		}
-		return "", fmt.Errorf("failed to mount %q: %q", mnt, txt)
+		log.Printf("  Mounted as %s", dst)
+		return dst, nil
 	case "windows":
-		return mountWindows(disk, n)
+		return mountWindows(disk, n, o)
 	default:
-		return "", errors.New("Mount() is not implemented on this OS")
+		return "", fmt.Errorf("Mount(): %w", ErrUnsupportedOS)
+	}
+}
+
+// freeDriveLetter returns the first DOS drive letter from D: that is not in
+// use according to the bit mask returned by GetLogicalDrives, e.g. "E:\\".
+// Returns an empty string if none is available.
+func freeDriveLetter(mask uint32) string {
+	for i := 'D' - 'A'; i < 26; i++ {
+		if mask&(1<<i) == 0 {
+			return string(rune('A'+i)) + ":\\"
+		}
 	}
+	return ""
 }
 
 // Umount unmounts all the partitions on disk 'disk'.
-func Umount(disk string) error {
+func Umount(disk string, o *Options) error {
+	if isRegularFile(disk) {
+		return detachLoop(disk, o)
+	}
 	switch runtime.GOOS {
 	case "darwin":
 		log.Printf("- Unmounting %s", disk)
-		_, _ = capture("", "diskutil", "unmountDisk", disk)
+		_, _ = capture(nil, "", "diskutil", "unmountDisk", disk)
 		return nil
 	case "linux":
 		matches, err := filepath.Glob(disk + "*")
@@ -244,9 +692,7 @@ func Umount(disk string) error {
 		sort.Strings(matches)
 		for _, m := range matches {
 			if m != disk {
-				// TODO(maruel): This assumes Ubuntu.
-				log.Printf("- Unmounting %s", m)
-				if _, err1 := capture("", "/usr/bin/udisksctl", "unmount", "-f", "-b", m); err == nil {
+				if err1 := umountLinux(m, o); err == nil {
 					err = err1
 				}
 			}
@@ -255,29 +701,221 @@ func Umount(disk string) error {
 	case "windows":
 		return umountWindows(disk)
 	default:
-		return errors.New("Umount() is not implemented on this OS")
+		return fmt.Errorf("Umount(): %w", ErrUnsupportedOS)
+	}
+}
+
+// checkDisk returns ErrNoSDCard if disk doesn't exist.
+func checkDisk(disk string) error {
+	// Physical drives cannot be stat'ed on Windows.
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	if _, err := os.Stat(disk); err != nil {
+		return fmt.Errorf("%s: %w", disk, ErrNoSDCard)
+	}
+	return nil
+}
+
+// checkNotSystemDisk returns an error if disk contains the running OS.
+//
+// This is the last line of defense before overwriting the disk.
+func checkNotSystemDisk(disk string, o *Options) error {
+	if o.allowSystemDisk() {
+		return nil
+	}
+	d := normalizeDisk(disk)
+	for _, s := range SystemDisks() {
+		if normalizeDisk(s) == d {
+			return fmt.Errorf("refusing to flash %s: it is the system disk %s containing the running OS", disk, s)
+		}
+	}
+	return nil
+}
+
+// normalizeDisk returns a canonical form of the disk path for comparison.
+func normalizeDisk(disk string) string {
+	switch runtime.GOOS {
+	case "darwin":
+		return strings.Replace(disk, "/dev/rdisk", "/dev/disk", 1)
+	case "windows":
+		return strings.ToLower(disk)
+	default:
+		// Resolve paths like /dev/disk/by-id/XXX.
+		if p, err := filepath.EvalSymlinks(disk); err == nil {
+			return p
+		}
+		return disk
+	}
+}
+
+// Eject ejects the media in disk 'disk' so it can be safely removed.
+//
+// The partitions must have been unmounted first with Umount.
+func Eject(disk string, o *Options) error {
+	if isRegularFile(disk) {
+		return detachLoop(disk, o)
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		log.Printf("- Ejecting %s", disk)
+		if _, err := capture(o, "", "diskutil", "eject", disk); err != nil {
+			return fmt.Errorf("failed to eject %s: %w", disk, err)
+		}
+		return nil
+	case "linux":
+		log.Printf("- Powering off %s", disk)
+		if err := ejectLinux(disk, o); err != nil {
+			return fmt.Errorf("failed to power off %s: %w", disk, err)
+		}
+		return nil
+	case "windows":
+		return ejectWindows(disk)
+	default:
+		return fmt.Errorf("Eject(): %w", ErrUnsupportedOS)
+	}
+}
+
+//
+
+// formatSize returns a human readable size in GiB or MiB.
+func formatSize(n int64) string {
+	if n >= 1024*1024*1024 {
+		return fmt.Sprintf("%.1fGiB", float64(n)/(1024*1024*1024))
+	}
+	return fmt.Sprintf("%.1fMiB", float64(n)/(1024*1024))
+}
+
+// cmdTimeout is the time allowed to commands that are expected to complete
+// quickly, like querying, mounting or ejecting a disk, so that a hung
+// udisksctl or diskutil doesn't block forever.
+const cmdTimeout = 2 * time.Minute
+
+// cmdError is returned by run and capture when a command fails.
+type cmdError struct {
+	cmd string
+	out string
+	err error
+}
+
+func (c *cmdError) Error() string {
+	out := strings.TrimSpace(c.out)
+	if out == "" {
+		return fmt.Sprintf("%s: %v", c.cmd, c.err)
 	}
+	return fmt.Sprintf("%s: %v\n%s", c.cmd, c.err, out)
+}
+
+func (c *cmdError) Unwrap() error {
+	return c.err
 }
 
+// newCmdError returns a *cmdError for the command that failed with err.
 //
+// If ctx expired, the error reported is the context's instead of the signal
+// that killed the process.
+func newCmdError(ctx context.Context, cmd *exec.Cmd, out string, err error) error {
+	if errCtx := ctx.Err(); errCtx != nil {
+		err = errCtx
+		if errors.Is(errCtx, context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out: %w", errCtx)
+		}
+	}
+	return &cmdError{cmd: strings.Join(cmd.Args, " "), out: out, err: err}
+}
 
-// run runs a command.
-func run(name string, arg ...string) error {
+// tailBuffer keeps the last bytes written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+// tailSize is the amount of output kept by tailBuffer; it is meant to capture
+// the error message of the command, not its whole output.
+const tailSize = 4096
+
+func (t *tailBuffer) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, b...)
+	if len(t.buf) > tailSize {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-tailSize:]...)
+	}
+	return len(b), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
+}
+
+// run runs a command connected to the terminal, without timeout.
+//
+// It is meant for long running or interactive commands like dd or sudo. The
+// end of the output is included in the returned error. o.NoSudo is honored.
+func run(o *Options, name string, arg ...string) error {
+	return runContext(context.Background(), o, name, arg...)
+}
+
+// runContext is like run but the command is killed when ctx is done.
+func runContext(ctx context.Context, o *Options, name string, arg ...string) error {
+	return runInput(ctx, o, os.Stdin, name, arg...)
+}
+
+// runInput is like runContext but the command reads its input from in.
+func runInput(ctx context.Context, o *Options, in io.Reader, name string, arg ...string) error {
+	name, arg, err := sudoCommand(name, arg, o.noSudo())
+	if err != nil {
+		return err
+	}
 	log.Printf("run(%s %s)", name, strings.Join(arg, " "))
-	cmd := exec.Command(name, arg...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	cmd := exec.CommandContext(ctx, name, arg...)
+	var tail tailBuffer
+	cmd.Stdin = in
+	cmd.Stdout = io.MultiWriter(os.Stdout, &tail)
+	cmd.Stderr = io.MultiWriter(os.Stderr, &tail)
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		return newCmdError(ctx, cmd, tail.String(), err)
+	}
+	return nil
 }
 
 // capture runs a command and return the stdout and stderr merged.
-func capture(in, name string, arg ...string) (string, error) {
-	//log.Printf("capture(%s %s)", name, strings.Join(arg, " "))
-	cmd := exec.Command(name, arg...)
+//
+// The command is killed after cmdTimeout. On failure, the output is both
+// returned and included in the error. o.NoSudo is honored.
+func capture(o *Options, in, name string, arg ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cmdTimeout)
+	defer cancel()
+	return captureContext(ctx, o, in, name, arg...)
+}
+
+// captureOp is like capture but the command is also killed when ctx is done.
+// It is meant for the steps of an operation, not the cleanup.
+func captureOp(ctx context.Context, o *Options, in, name string, arg ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, cmdTimeout)
+	defer cancel()
+	return captureContext(ctx, o, in, name, arg...)
+}
+
+// captureContext is like capture but the command is killed when ctx is done.
+func captureContext(ctx context.Context, o *Options, in, name string, arg ...string) (string, error) {
+	name, arg, err := sudoCommand(name, arg, o.noSudo())
+	if err != nil {
+		return "", err
+	}
+	debugf("capture(%s %s)", name, strings.Join(arg, " "))
+	cmd := exec.CommandContext(ctx, name, arg...)
 	cmd.Stdin = strings.NewReader(in)
+	cmd.WaitDelay = time.Second
 	out, err := cmd.CombinedOutput()
-	return string(out), err
+	debugf("capture(%s): %v\n%s", name, err, out)
+	if err != nil {
+		return string(out), newCmdError(ctx, cmd, string(out), err)
+	}
+	return string(out), nil
 }
 
 func getHome() string {
@@ -287,33 +925,125 @@ func getHome() string {
 	return os.Getenv("HOME")
 }
 
-func ddFlash(imgPath, dst string) error {
-	fmt.Printf("- Flashing (takes 2 minutes)\n")
-	// OSX uses 'M' but Ubuntu uses 'm' but using numbers works everywhere.
-	args := []string{"dd", fmt.Sprintf("bs=%d", 4*1024*1024), "if=" + imgPath, "of=" + dst, "oflag=direct"}
-	if runtime.GOOS != "darwin" {
-		// Not supported on macOS.
-		args = append(args, "status=progress")
+func ddFlash(ctx context.Context, imgPath, dst string, m *bmap, o *Options) error {
+	Progressf("- Flashing %s (takes 2 minutes)\n", dst)
+	if m != nil {
+		if err := ddFlashBmap(ctx, imgPath, dst, m, o); err != nil {
+			return err
+		}
+	} else {
+		// OSX uses 'M' but Ubuntu uses 'm' but using numbers works everywhere.
+		args := []string{"dd", fmt.Sprintf("bs=%d", o.blockSize()), "if=" + imgPath, "of=" + dst, "oflag=direct"}
+		if runtime.GOOS != "darwin" && o.ddProgress() {
+			// Not supported on macOS.
+			args = append(args, "status=progress")
+		}
+		if err := runContext(ctx, o, "sudo", args...); err != nil {
+			return flushAborted(ctx, err, o)
+		}
 	}
-	if err := run("sudo", args...); err != nil {
+	return ddSync(dst, o)
+}
+
+// ddFlashStream is like ddFlash but dd reads the image from r.
+//
+// dd prints its progress when progress is true.
+func ddFlashStream(ctx context.Context, r io.Reader, dst string, progress bool, o *Options) error {
+	Progressf("- Flashing %s (takes 2 minutes)\n", dst)
+	// Cache the credentials first, since the password can't be read from stdin.
+	if err := run(o, "sudo", "-v"); err != nil {
 		return err
 	}
+	// Reading from a pipe returns short reads, so the input is reblocked to keep
+	// the writes aligned.
+	args := []string{"dd", fmt.Sprintf("bs=%d", o.blockSize()), "of=" + dst, "oflag=direct", "iflag=fullblock"}
+	if progress && o.ddProgress() {
+		args = append(args, "status=progress")
+	}
+	if runtime.GOOS == "darwin" {
+		// BSD dd reblocks when ibs and obs differ.
+		args = []string{"dd", fmt.Sprintf("obs=%d", o.blockSize()), "of=" + dst}
+	}
+	if err := runInput(ctx, o, r, "sudo", args...); err != nil {
+		return flushAborted(ctx, err, o)
+	}
+	return ddSync(dst, o)
+}
+
+// ddSync makes the OS reload the partition table of dst and flushes the
+// writes.
+func ddSync(dst string, o *Options) error {
 	if runtime.GOOS != "darwin" {
 		// Tells the OS to wake up with the fact that the partitions changed. It's
 		// fine even if the cache is not written to the disk yet, as the cached
 		// data is in the OS cache. :)
-		if err := run("sudo", "partprobe"); err != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), cmdTimeout)
+		err := runContext(ctx, o, "sudo", "partprobe", dst)
+		cancel()
+		if err != nil {
 			return err
 		}
 	}
 	// This step may take a while for writeback cache.
-	fmt.Printf("- Flushing I/O cache\n")
-	if err := run("sudo", "sync"); err != nil {
+	Progressf("- Flushing I/O cache\n")
+	if err := run(o, "sudo", "sync"); err != nil {
 		return err
 	}
 	return nil
 }
 
+// flushAborted flushes the writes done so far when flashing was aborted via
+// ctx, so the SDCard can be removed safely. It returns err.
+func flushAborted(ctx context.Context, err error, o *Options) error {
+	if ctx.Err() != nil {
+		Progressf("\n- Aborted; flushing I/O cache\n")
+		_ = run(o, "sudo", "sync")
+	}
+	return err
+}
+
+// ddFlashBmap runs dd once per range of mapped blocks.
+func ddFlashBmap(ctx context.Context, imgPath, dst string, m *bmap, o *Options) error {
+	// Cache the credentials first so the password prompt doesn't get mixed with
+	// the progress.
+	if err := run(o, "sudo", "-v"); err != nil {
+		return err
+	}
+	return ddWriteBmap(ctx, imgPath, dst, m, o)
+}
+
+// ddWriteBmap is ddFlashBmap without caching the sudo credentials first.
+func ddWriteBmap(ctx context.Context, imgPath, dst string, m *bmap, o *Options) error {
+	total := float64(m.mappedBytes())
+	done := int64(0)
+	for _, r := range m.ranges {
+		off := r.first * m.blockSize
+		n := (r.last - r.first + 1) * m.blockSize
+		var args []string
+		if runtime.GOOS == "darwin" {
+			// BSD dd doesn't support byte offsets.
+			args = []string{"dd", fmt.Sprintf("bs=%d", m.blockSize), fmt.Sprintf("skip=%d", r.first), fmt.Sprintf("seek=%d", r.first), fmt.Sprintf("count=%d", r.last-r.first+1)}
+		} else {
+			// Use a large buffer with byte offsets; writing 4KiB blocks with
+			// O_DIRECT is very slow.
+			args = []string{"dd", fmt.Sprintf("bs=%d", o.blockSize()), fmt.Sprintf("skip=%d", off), fmt.Sprintf("seek=%d", off), fmt.Sprintf("count=%d", n), "iflag=skip_bytes,count_bytes", "oflag=seek_bytes,direct"}
+		}
+		args = append(args, "if="+imgPath, "of="+dst, "conv=notrunc")
+		// Writing a range can take a while, don't use the default timeout.
+		if _, err := captureContext(ctx, o, "", "sudo", args...); err != nil {
+			return flushAborted(ctx, fmt.Errorf("failed to write blocks %d-%d to %s: %w", r.first, r.last, dst, err), o)
+		}
+		done += n
+		if o.ddProgress() {
+			Progressf("\r%.1f%%", float64(done)*100./total)
+		}
+	}
+	if o.ddProgress() {
+		Progressf("\r100.0%%\n")
+	}
+	return nil
+}
+
 // Linux
 
 var (
@@ -386,14 +1116,16 @@ type blockDevice struct {
 	RO         boolOrString
 	Type       string
 	MountPoint string
-	Children   []blockDevice
+	// FSType is the file system type, e.g. "vfat" or "ext4".
+	FSType string
+	// PartLabel is the GPT partition name, if any.
+	PartLabel string
+	Children  []blockDevice
 }
 
 // isSDCard returns true if the block device looks like a removable drive.
 //
-// Discards cards more than 70GiB in size. Since most workstations disks are
-// generally 120Gb and more, this reduces the risk of flashing a secondary disk
-// by accident. In this case, the user will have to specify the path manually.
+// Discards cards of maxSDCardSize or more.
 func (b *blockDevice) isSDCard() bool {
 	// Do not check for RM == "1". The reason is that for some embedded SD card
 	// readers (like Lenovo x250 embedded SD card reader), RM is set to "0". :(
@@ -409,7 +1141,7 @@ func (b *blockDevice) isSDCard() bool {
 	if b.isSystem() {
 		return false
 	}
-	return b.Size < 70*1024*1024*1024
+	return int64(b.Size) < maxSDCardSize
 }
 
 // isSystem returns true if this blockdevice has a system partition.
@@ -433,16 +1165,145 @@ type lsblkOutput struct {
 	BlockDevices []blockDevice
 }
 
-func listSDCardsLinux() []string {
-	b, err := capture("", "lsblk", "--json", "--bytes")
+// errNoLsblk is returned when lsblk is not installed.
+var errNoLsblk = errors.New("lsblk is required to list the disks; install the util-linux package")
+
+// lsblkColumns are the columns requested to lsblk.
+//
+// PARTLABEL was added in util-linux 2.23.
+const lsblkColumns = "NAME,MAJ:MIN,RM,SIZE,RO,TYPE,MOUNTPOINT,FSTYPE,PARTLABEL"
+
+// lsblkVersion returns the major and minor util-linux version of lsblk, or 0,
+// 0 if it can't be determined.
+var lsblkVersion = sync.OnceValues(func() (int, int) {
+	b, err := capture(nil, "", "lsblk", "--version")
 	if err != nil {
+		return 0, 0
+	}
+	return parseLsblkVersion(b)
+})
+
+var reLsblkVersion = regexp.MustCompile(`util-linux (\d+)\.(\d+)`)
+
+// parseLsblkVersion parses the output of "lsblk --version", e.g. "lsblk from
+// util-linux 2.39.3".
+func parseLsblkVersion(s string) (int, int) {
+	m := reLsblkVersion.FindStringSubmatch(s)
+	if m == nil {
+		return 0, 0
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return major, minor
+}
+
+// getBlockDevicesLinux returns the block devices as reported by lsblk.
+//
+// --json was added in util-linux 2.27, so older versions are parsed from the
+// --pairs output instead. It is also used when the version is unknown and the
+// JSON output can't be parsed.
+func getBlockDevicesLinux() []blockDevice {
+	if _, err := exec.LookPath("lsblk"); err != nil {
+		log.Printf("%v", errNoLsblk)
 		return nil
 	}
-	v := lsblkOutput{}
-	if err = json.Unmarshal([]byte(b), &v); err != nil {
-		log.Printf("failed to parse lsblk output: %v", err)
+	major, minor := lsblkVersion()
+	if major > 2 || (major == 2 && minor >= 27) || major == 0 {
+		b, err := capture(nil, "", "lsblk", "--json", "--bytes", "-o", lsblkColumns)
+		if err == nil {
+			v := lsblkOutput{}
+			if err = json.Unmarshal([]byte(b), &v); err == nil {
+				return v.BlockDevices
+			}
+		}
+		log.Printf("failed to use lsblk --json: %v", err)
+		if major != 0 {
+			return nil
+		}
+	}
+	cols := lsblkColumns
+	if (major == 2 && minor < 23) || major == 0 {
+		cols = strings.TrimSuffix(cols, ",PARTLABEL")
+	}
+	b, err := capture(nil, "", "lsblk", "--pairs", "--bytes", "-o", cols)
+	if err != nil {
+		log.Printf("failed to run lsblk: %v", err)
 		return nil
 	}
+	return parseLsblkPairs(b)
+}
+
+var reLsblkPair = regexp.MustCompile(`([A-Z:_-]+)="((?:[^"\\]|\\.)*)"`)
+
+// parseLsblkPairs parses the output of "lsblk --pairs --bytes".
+//
+// Each line is a device as KEY="value" pairs. The tree isn't printed, so the
+// partitions are attached to the previous disk, which lsblk always lists
+// first.
+func parseLsblkPairs(s string) []blockDevice {
+	var out []blockDevice
+	for _, line := range strings.Split(s, "\n") {
+		var d blockDevice
+		found := false
+		for _, m := range reLsblkPair.FindAllStringSubmatch(line, -1) {
+			found = true
+			v := unescapeLsblk(m[2])
+			switch m[1] {
+			case "NAME":
+				d.Name = v
+			case "MAJ:MIN", "MAJ_MIN":
+				d.MajMin = v
+			case "RM":
+				d.RM = v == "1"
+			case "SIZE":
+				n, _ := strconv.ParseInt(v, 10, 64)
+				d.Size = intOrString(n)
+			case "RO":
+				d.RO = v == "1"
+			case "TYPE":
+				d.Type = v
+			case "MOUNTPOINT":
+				d.MountPoint = v
+			case "FSTYPE":
+				d.FSType = v
+			case "PARTLABEL":
+				d.PartLabel = v
+			}
+		}
+		if !found {
+			continue
+		}
+		if d.Type == "part" && len(out) != 0 {
+			out[len(out)-1].Children = append(out[len(out)-1].Children, d)
+		} else {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// unescapeLsblk decodes the \xHH escapes lsblk uses for unsafe characters in
+// values, like spaces and quotes.
+func unescapeLsblk(s string) string {
+	if !strings.Contains(s, `\x`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if n, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func listSDCardsLinux() []string {
+	v := lsblkOutput{BlockDevices: getBlockDevicesLinux()}
 	var out []string
 	// If there is only one mount point, not worth bothering.
 	// TODO(maruel): Can we always safely assume that the first block device
@@ -457,6 +1318,83 @@ func listSDCardsLinux() []string {
 	return out
 }
 
+// partitionRoles returns the partition numbers (1 based) of the FAT boot
+// partition and the EXT4 root partition on the disk b, or 0 if not found.
+//
+// When multiple partitions qualify, the one labeled "boot" or "root" wins,
+// otherwise the first one.
+func (b *blockDevice) partitionRoles() (int, int) {
+	boot, root := 0, 0
+	bootLabeled, rootLabeled := false, false
+	for _, c := range b.Children {
+		n := partitionNumber(b.Name, c.Name)
+		if n == 0 {
+			continue
+		}
+		l := strings.ToLower(c.PartLabel)
+		switch c.FSType {
+		case "vfat":
+			if labeled := strings.Contains(l, "boot"); boot == 0 || (labeled && !bootLabeled) {
+				boot, bootLabeled = n, labeled
+			}
+		case "ext4", "ext3", "ext2":
+			if labeled := strings.Contains(l, "root"); root == 0 || (labeled && !rootLabeled) {
+				root, rootLabeled = n, labeled
+			}
+		}
+	}
+	return boot, root
+}
+
+// partitionNumber returns the partition number of the partition named part on
+// the disk named disk, e.g. 2 for "sdb2" on "sdb" or "mmcblk0p2" on
+// "mmcblk0". Returns 0 if part isn't a partition of disk.
+func partitionNumber(disk, part string) int {
+	s := strings.TrimPrefix(part, disk)
+	if s == part {
+		return 0
+	}
+	if disk != "" && disk[len(disk)-1] >= '0' && disk[len(disk)-1] <= '9' {
+		if s = strings.TrimPrefix(s, "p"); s == "" {
+			return 0
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0
+	}
+	return n
+}
+
+// PartitionRoles returns the partition numbers (1 based) of the FAT boot
+// partition and the EXT4 root partition on disk, as identified by their file
+// system type instead of their position. A number is 0 when not found.
+//
+// Only implemented on Linux.
+func PartitionRoles(disk string) (int, int, error) {
+	if runtime.GOOS != "linux" {
+		return 0, 0, fmt.Errorf("PartitionRoles(): %w", ErrUnsupportedOS)
+	}
+	name := filepath.Base(normalizeDisk(disk))
+	for _, b := range getBlockDevicesLinux() {
+		if b.Name == name {
+			boot, root := b.partitionRoles()
+			return boot, root, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("%s: %w", disk, ErrNoSDCard)
+}
+
+func systemDisksLinux() []string {
+	var out []string
+	for _, b := range getBlockDevicesLinux() {
+		if b.isSystem() {
+			out = append(out, "/dev/"+b.Name)
+		}
+	}
+	return out
+}
+
 // OSX
 
 type diskutilList struct {
@@ -504,20 +1442,24 @@ type diskutilInfo struct {
 	RemovableMediaOrExternalDevice              bool
 	SMARTStatus                                 string
 	Size                                        int64
+	SolidState                                  bool
 	SupportsGlobalPermissionsDisable            bool
 	SystemImage                                 bool
-	TotalSize                                   int64
-	VirtualOrPhysical                           string
-	VolumeName                                  string
-	VolumeSize                                  int64
-	WholeDisk                                   bool
-	Writable                                    bool
-	WritableMedia                               bool
-	WritableVolume                              bool
+	APFSPhysicalStores                          []struct {
+		APFSPhysicalStore string
+	}
+	TotalSize         int64
+	VirtualOrPhysical string
+	VolumeName        string
+	VolumeSize        int64
+	WholeDisk         bool
+	Writable          bool
+	WritableMedia     bool
+	WritableVolume    bool
 }
 
 func listSDCardsOSX() []string {
-	b, err := capture("", "diskutil", "list", "-plist")
+	b, err := capture(nil, "", "diskutil", "list", "-plist")
 	if err != nil {
 		return nil
 	}
@@ -528,7 +1470,7 @@ func listSDCardsOSX() []string {
 	}
 	var out []string
 	for _, d := range disks.WholeDisks {
-		b, err = capture("", "diskutil", "info", "-plist", d)
+		b, err = capture(nil, "", "diskutil", "info", "-plist", d)
 		if err != nil {
 			continue
 		}
@@ -537,13 +1479,58 @@ func listSDCardsOSX() []string {
 		if err != nil {
 			continue
 		}
-		if info.RemovableMedia && info.Writable {
+		if info.isSDCard() {
 			out = append(out, info.DeviceNode)
 		}
 	}
 	return out
 }
 
+// isSDCard returns true if the disk looks like a SD card, consistent with
+// blockDevice.isSDCard on Linux.
+//
+// External USB drives often report removable media, so the size is capped at
+// maxSDCardSize. Internal removable media is only accepted from the built-in
+// SD card reader.
+func (d *diskutilInfo) isSDCard() bool {
+	if !d.WholeDisk || !d.RemovableMedia || !d.Writable {
+		return false
+	}
+	if d.Internal && d.BusProtocol != "Secure Digital" {
+		return false
+	}
+	if d.VirtualOrPhysical == "Virtual" {
+		// Disk images attached with hdiutil.
+		return false
+	}
+	size := d.TotalSize
+	if size == 0 {
+		size = d.Size
+	}
+	return size < maxSDCardSize
+}
+
+func systemDisksOSX() []string {
+	b, err := capture(nil, "", "diskutil", "info", "-plist", "/")
+	if err != nil {
+		return nil
+	}
+	info := diskutilInfo{}
+	if _, err = plist.Unmarshal([]byte(b), &info); err != nil {
+		return nil
+	}
+	// On APFS, "/" is on a synthesized disk; the physical disk is the one
+	// holding the container.
+	out := []string{"/dev/" + info.ParentWholeDisk}
+	re := regexp.MustCompile(`^disk[0-9]+`)
+	for _, s := range info.APFSPhysicalStores {
+		if d := re.FindString(s.APFSPhysicalStore); d != "" {
+			out = append(out, "/dev/"+d)
+		}
+	}
+	return out
+}
+
 // toRawDiskOSX replaces a path to a buffered disk to the raw equivalent device
 // node.
 //
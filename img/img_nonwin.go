@@ -7,11 +7,26 @@
 
 package img
 
-func flashWindows(imgPath, disk string) error {
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+func flashWindows(ctx context.Context, imgPath, disk string, m *bmap, o *Options) error {
+	return nil
+}
+
+func benchmarkWindows(imgPath, disk string, n int64) (time.Duration, error) {
+	return 0, nil
+}
+
+func writeWindows(ctx context.Context, r io.Reader, size int64, disk string, m *bmap, progress bool, o *Options) error {
 	return nil
 }
 
-func mountWindows(disk string, n int) (string, error) {
+func mountWindows(disk string, n int, o *Options) (string, error) {
 	return "", nil
 }
 
@@ -19,6 +34,34 @@ func umountWindows(disk string) error {
 	return nil
 }
 
+func ejectWindows(disk string) error {
+	return nil
+}
+
+func describeDiskWindows(disk string) string {
+	return ""
+}
+
+func addPartitionWindows(disk string, start, size int64, fs DataFS) error {
+	return nil
+}
+
+func diskSizeWindows(disk string) int64 {
+	return 0
+}
+
+func systemDisksWindows() []string {
+	return nil
+}
+
 func listSDCardsWindows() []string {
 	return nil
 }
+
+func openDiskWindows(disk string) (diskIO, error) {
+	return nil, errors.New("openDiskWindows() is not implemented on this OS")
+}
+
+func setEchoWindows(on bool) error {
+	return errors.New("setEchoWindows() is not implemented on this OS")
+}
@@ -4,7 +4,25 @@
 
 package img
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ulikunitz/xz"
+	"periph.io/x/bootstrap"
+)
 
 func TestUdisksctlMount(t *testing.T) {
 	data := []string{
@@ -18,3 +36,1140 @@ func TestUdisksctlMount(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckMagic(t *testing.T) {
+	r, err := checkMagic(strings.NewReader("\xFD7zXZ\x00data"), magicXZ, "url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "\xFD7zXZ\x00data" {
+		t.Fatalf("%q", b)
+	}
+	for _, in := range []string{"<html><body>Not found</body></html>", "", "\xFD7z"} {
+		if _, err = checkMagic(strings.NewReader(in), magicXZ, "url"); err == nil {
+			t.Fatalf("%q: expected error", in)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	data := []struct {
+		in       int64
+		expected string
+	}{
+		{0, "0.0MiB"},
+		{512 * 1024 * 1024, "512.0MiB"},
+		{31914983424, "29.7GiB"},
+	}
+	for i, l := range data {
+		if got := formatSize(l.in); got != l.expected {
+			t.Fatalf("%d: %q != %q", i, got, l.expected)
+		}
+	}
+}
+
+func TestEmbeddedSetupSH(t *testing.T) {
+	if !bytes.HasPrefix(bootstrap.SetupSH, []byte("#!/bin/bash")) {
+		t.Fatalf("unexpected embedded setup.sh: %.40q", bootstrap.SetupSH)
+	}
+	// It is the default, since it matches the arguments passed to it.
+	if b, err := GetSetupSH(context.Background(), false, nil); err != nil || !bytes.Equal(b, bootstrap.SetupSH) {
+		t.Fatal("expected the embedded setup.sh", err)
+	}
+}
+
+func TestParseBlockSize(t *testing.T) {
+	data := []struct {
+		in   string
+		want int64
+	}{
+		{"512", 512},
+		{"4096", 4096},
+		{"64K", 64 * 1024},
+		{"4M", 4 * 1024 * 1024},
+		{"64M", 64 * 1024 * 1024},
+	}
+	for i, line := range data {
+		got, err := ParseBlockSize(line.in)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if got != line.want {
+			t.Fatalf("%d: %d != %d", i, got, line.want)
+		}
+	}
+	for i, in := range []string{"", "0", "-512", "1000", "100", "65M", "M", "4G", "4MB"} {
+		if _, err := ParseBlockSize(in); err == nil {
+			t.Fatalf("%d: %q: expected error", i, in)
+		}
+	}
+}
+
+func TestErrNoSDCard(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("physical drives are not checked on Windows")
+	}
+	if err := Flash(context.Background(), "foo.img", "/dev/does-not-exist", nil); !errors.Is(err, ErrNoSDCard) {
+		t.Fatal(err)
+	}
+	if err := Backup(context.Background(), "/dev/does-not-exist", "foo.img.gz", nil); !errors.Is(err, ErrNoSDCard) {
+		t.Fatal(err)
+	}
+}
+
+func TestIsSDCard(t *testing.T) {
+	const gib = 1024 * 1024 * 1024
+	data := []struct {
+		d        diskutilInfo
+		expected bool
+	}{
+		// Built-in SD card reader.
+		{diskutilInfo{WholeDisk: true, RemovableMedia: true, Writable: true, Internal: true, BusProtocol: "Secure Digital", TotalSize: 32 * gib}, true},
+		// USB card reader.
+		{diskutilInfo{WholeDisk: true, RemovableMedia: true, Writable: true, BusProtocol: "USB", TotalSize: 64 * gib}, true},
+		// USB backup drive.
+		{diskutilInfo{WholeDisk: true, RemovableMedia: true, Writable: true, BusProtocol: "USB", TotalSize: 1000 * gib}, false},
+		{diskutilInfo{WholeDisk: true, RemovableMedia: true, Writable: true, Internal: true, BusProtocol: "SATA", TotalSize: 8 * gib}, false},
+		{diskutilInfo{WholeDisk: true, RemovableMedia: true, Writable: true, VirtualOrPhysical: "Virtual", Size: 8 * gib}, false},
+		{diskutilInfo{WholeDisk: true, RemovableMedia: true, Size: 8 * gib}, false},
+	}
+	for i, l := range data {
+		if got := l.d.isSDCard(); got != l.expected {
+			t.Fatalf("%d: %t", i, got)
+		}
+	}
+	b := blockDevice{Type: "disk", Size: 100 * gib}
+	if b.isSDCard() {
+		t.Fatal("too large")
+	}
+}
+
+func TestCheckOS(t *testing.T) {
+	for _, goos := range []string{"darwin", "linux", "windows"} {
+		if err := checkOS(goos); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := checkOS("freebsd"); !errors.Is(err, ErrUnsupportedOS) {
+		t.Fatal(err)
+	}
+}
+
+func TestErrImageNotFound(t *testing.T) {
+	i := Image{Manufacturer: NextThingCo}
+	if _, err := i.Fetch(context.Background(), nil); !errors.Is(err, ErrImageNotFound) {
+		t.Fatal(err)
+	}
+	i = Image{Manufacturer: "foo"}
+	if _, err := i.Fetch(context.Background(), nil); !errors.Is(err, ErrImageNotFound) {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckFits(t *testing.T) {
+	const gib = 1024 * 1024 * 1024
+	if err := checkFits(4*gib, 8*gib, "/dev/sdb"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFits(4*gib, 0, "/dev/sdb"); err != nil {
+		t.Fatal(err)
+	}
+	err := checkFits(12*gib, 8*gib, "/dev/sdb")
+	if !errors.Is(err, ErrImageTooLarge) {
+		t.Fatal(err)
+	}
+	if s := err.Error(); s != "image (12.0GiB) larger than /dev/sdb (8.0GiB): image larger than the SDCard" {
+		t.Fatal(s)
+	}
+	// A regular file grows as needed.
+	p := filepath.Join(t.TempDir(), "a.img")
+	if err = os.WriteFile(p, []byte("periph"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckImageFits(p, p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMirrorURL(t *testing.T) {
+	data := []struct {
+		mirror, u, expected string
+	}{
+		{"http://de.eu.odroid.in", "https://odroid.in/ubuntu_16.04lts/a.img.xz", "http://de.eu.odroid.in/ubuntu_16.04lts/a.img.xz"},
+		{"https://example.com/rpi/", "https://downloads.raspberrypi.org/raspios_lite_armhf/images/", "https://example.com/rpi/raspios_lite_armhf/images/"},
+	}
+	for i, l := range data {
+		got, err := mirrorURL(l.mirror, l.u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != l.expected {
+			t.Fatalf("%d: %q != %q", i, got, l.expected)
+		}
+	}
+}
+
+func TestImageCheckMirror(t *testing.T) {
+	i := Image{Manufacturer: HardKernel, Mirror: "https://de.eu.odroid.in"}
+	if err := i.Check(); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []string{"de.eu.odroid.in", "ftp://de.eu.odroid.in", "http://"} {
+		i := Image{Manufacturer: HardKernel, Mirror: m}
+		if err := i.Check(); err == nil {
+			t.Fatalf("%q: expected error", m)
+		}
+	}
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	d := t.TempDir()
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+		n, err := FreeSpace(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n <= 0 {
+			t.Fatal(n)
+		}
+		if err = CheckFreeSpace(d, n+1024*1024*1024*1024); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	if err := CheckFreeSpace(d, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartitionPath(t *testing.T) {
+	data := []struct {
+		goos, disk string
+		n          int
+		expected   string
+	}{
+		{"linux", "/dev/sdb", 1, "/dev/sdb1"},
+		{"linux", "/dev/sdb", 2, "/dev/sdb2"},
+		{"linux", "/dev/mmcblk0", 1, "/dev/mmcblk0p1"},
+		{"linux", "/dev/nvme0n1", 2, "/dev/nvme0n1p2"},
+		{"linux", "/dev/loop12", 1, "/dev/loop12p1"},
+		{"darwin", "/dev/disk4", 1, "/dev/disk4s1"},
+		{"windows", "\\\\.\\physicaldrive2", 1, ""},
+	}
+	for i, l := range data {
+		if got := partitionPath(l.goos, l.disk, l.n); got != l.expected {
+			t.Fatalf("%d: %q != %q", i, got, l.expected)
+		}
+	}
+}
+
+func TestWaitForPartition(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("partitions are volumes on Windows")
+	}
+	d := t.TempDir()
+	disk := filepath.Join(d, "sdx")
+	if err := os.WriteFile(PartitionPath(disk, 1), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WaitForPartition(context.Background(), disk, 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := WaitForPartition(context.Background(), disk, 2, 0); err == nil {
+		t.Fatal("expected error")
+	}
+	// A node showing up late is picked up without waiting a full second.
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_ = os.WriteFile(PartitionPath(disk, 3), nil, 0o600)
+	}()
+	start := time.Now()
+	if err := WaitForPartition(context.Background(), disk, 3, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d >= time.Second {
+		t.Fatal(d)
+	}
+}
+
+func TestWaitForPartitionTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("partitions are volumes on Windows")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := WaitForPartition(ctx, filepath.Join(t.TempDir(), "sdx"), 1, time.Minute)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d >= 10*time.Second {
+		t.Fatal(d)
+	}
+}
+
+func TestImageDefaults(t *testing.T) {
+	data := []struct {
+		board          Board
+		distro         Distro
+		user, hostname string
+	}{
+		{OdroidC1, "", "odroid", "odroid"},
+		{CHIP, "", "chip", "chip"},
+		{CHIPPro, "", "chip", "chip"},
+		{PocketCHIP, "", "chip", "chip"},
+		{RaspberryPi, RaspiOS, "pi", "raspberrypi"},
+		{RaspberryPi, Ubuntu, "ubuntu", "raspberrypi"},
+	}
+	for i, l := range data {
+		img := Image{Board: l.board, Distro: l.distro}
+		if err := img.Check(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if u := img.DefaultUser(); u != l.user {
+			t.Fatalf("%d: %q != %q", i, u, l.user)
+		}
+		if h := img.DefaultHostname(); h != l.hostname {
+			t.Fatalf("%d: %q != %q", i, h, l.hostname)
+		}
+	}
+}
+
+func TestGetLocale(t *testing.T) {
+	data := []struct {
+		in, expected string
+	}{
+		{"", ""},
+		{"C", ""},
+		{"C.UTF-8", ""},
+		{"POSIX", ""},
+		{"en_GB.UTF-8", "en_GB.UTF-8"},
+		{"en_GB.utf8", "en_GB.UTF-8"},
+		{"fr_CA", "fr_CA"},
+	}
+	for i, l := range data {
+		t.Setenv("LANG", l.in)
+		if got := GetLocale(); got != l.expected {
+			t.Fatalf("%d: %q != %q", i, got, l.expected)
+		}
+	}
+}
+
+func TestImageURL(t *testing.T) {
+	data := []struct {
+		img       Image
+		url, name string
+	}{
+		{
+			Image{Manufacturer: HardKernel},
+			"https://odroid.in/ubuntu_16.04lts/ubuntu-16.04.2-minimal-odroid-c1-20170221.img.xz",
+			"ubuntu-16.04.2-minimal-odroid-c1-20170221.img",
+		},
+		{
+			Image{Manufacturer: HardKernel, Mirror: "https://de.eu.odroid.in"},
+			"https://de.eu.odroid.in/ubuntu_16.04lts/ubuntu-16.04.2-minimal-odroid-c1-20170221.img.xz",
+			"ubuntu-16.04.2-minimal-odroid-c1-20170221.img",
+		},
+		{
+			Image{Manufacturer: Raspberry, Distro: Ubuntu},
+			"http://cdimage.ubuntu.com/releases/20.04/release/ubuntu-20.04-preinstalled-server-arm64+raspi.img.xz",
+			"ubuntu-20.04-preinstalled-server-arm64+raspi.img",
+		},
+	}
+	for i, l := range data {
+		u, name, err := l.img.URL(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if u != l.url || name != l.name {
+			t.Fatalf("%d: %q, %q", i, u, name)
+		}
+	}
+	i := Image{Manufacturer: NextThingCo}
+	if _, _, err := i.URL(context.Background(), nil); !errors.Is(err, ErrImageNotFound) {
+		t.Fatal(err)
+	}
+}
+
+func TestRaspiOSFindLatest(t *testing.T) {
+	const base = "https://downloads.raspberrypi.org/raspios_lite_arm64/images/"
+	pages := map[string]string{
+		base: `<a href="raspios_lite_arm64-2024-03-12/">raspios_lite_arm64-2024-03-12/</a>
+<a href="raspios_lite_arm64-2024-07-04/">raspios_lite_arm64-2024-07-04/</a>
+<a href="raspios_lite_arm64-2024-10-28/">raspios_lite_arm64-2024-10-28/</a>`,
+		// Mid-publish: the directory exists but is empty.
+		base + "raspios_lite_arm64-2024-10-28/": `<a href="../">Parent Directory</a>`,
+		base + "raspios_lite_arm64-2024-07-04/": `<a href="2024-07-04-raspios-bookworm-arm64-lite.img.xz">`,
+	}
+	fetch := func(u string) ([]byte, error) {
+		if p, ok := pages[u]; ok {
+			return []byte(p), nil
+		}
+		return nil, errors.New("not found")
+	}
+	date, xz, err := raspiosFindLatest(fetch, base, "arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if date != "2024-07-04" || xz != "2024-07-04-raspios-bookworm-arm64-lite.img.xz" {
+		t.Fatal(date, xz)
+	}
+	delete(pages, base+"raspios_lite_arm64-2024-07-04/")
+	if _, _, err = raspiosFindLatest(fetch, base, "arm64"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestLatestImage(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Error(err)
+		}
+	}()
+	const xzFile = "2024-07-04-raspios-bookworm-arm64-lite.img.xz"
+	if _, _, ok := loadLatest("arm64", nil); ok {
+		t.Fatal("expected nothing cached")
+	}
+	saveLatest("arm64", "2024-07-04", xzFile)
+	// The image is not present.
+	if _, _, ok := loadLatest("arm64", nil); ok {
+		t.Fatal("expected the image to be required")
+	}
+	if err = os.WriteFile(strings.TrimSuffix(xzFile, ".xz"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if d, f, ok := loadLatest("arm64", nil); !ok || d != "2024-07-04" || f != xzFile {
+		t.Fatal(d, f, ok)
+	}
+	if _, _, ok := loadLatest("armhf", nil); ok {
+		t.Fatal("expected nothing cached for armhf")
+	}
+	if _, _, ok := loadLatest("arm64", &Options{ForceRefresh: true}); ok {
+		t.Fatal("expected -force-refresh to skip the cache")
+	}
+	b, err := json.Marshal(latestImage{Date: "2024-07-04", File: xzFile, Time: time.Now().Add(-25 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(latestPath("arm64"), b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := loadLatest("arm64", nil); ok {
+		t.Fatal("expected the entry to be expired")
+	}
+	// Offline, the last entry is the best known, even without the image.
+	offline := &Options{Offline: true}
+	if err = os.Remove(strings.TrimSuffix(xzFile, ".xz")); err != nil {
+		t.Fatal(err)
+	}
+	if d, f, ok := loadLatest("arm64", offline); !ok || d != "2024-07-04" || f != xzFile {
+		t.Fatal(d, f, ok)
+	}
+	// Without an entry, the URL is unknown rather than a stale default.
+	_, _, _, err = raspiosGetLatestImageURL(context.Background(), false, "", "", offline)
+	if !errors.Is(err, ErrOffline) {
+		t.Fatal(err)
+	}
+	b, err = json.Marshal(latestImage{Date: "2024-07-04", File: "../../etc/passwd", Time: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(latestPath("arm64"), b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := loadLatest("arm64", nil); ok {
+		t.Fatal("expected the invalid entry to be ignored")
+	}
+}
+
+func TestRaspiOSFindDate(t *testing.T) {
+	const base = "https://downloads.raspberrypi.org/raspios_lite_armhf/images/"
+	fetch := func(u string) ([]byte, error) {
+		if u == base+"raspios_lite_armhf-2024-07-04/" {
+			return []byte(`<a href="2024-07-04-raspios-bookworm-armhf-lite.img.xz">`), nil
+		}
+		return nil, errors.New("not found")
+	}
+	xz, err := raspiosFindDate(fetch, base, "armhf", "2024-07-04")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xz != "2024-07-04-raspios-bookworm-armhf-lite.img.xz" {
+		t.Fatal(xz)
+	}
+	if _, err = raspiosFindDate(fetch, base, "armhf", "2024-03-12"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRaspiOSFindImage(t *testing.T) {
+	const dir = "https://downloads.raspberrypi.org/raspios_lite_arm64/images/raspios_lite_arm64-2025-05-13/"
+	data := []struct {
+		pages    map[string]string
+		expected string
+	}{
+		{
+			// The full image and the checksums are ignored.
+			map[string]string{dir: `<a href="../">Parent Directory</a>
+<a href="2025-05-13-raspios-bookworm-arm64-full.img.xz">
+<a href="2025-05-13-raspios-bookworm-arm64-lite.img.xz">
+<a href="2025-05-13-raspios-bookworm-arm64-lite.img.xz.sha256">`},
+			"2025-05-13-raspios-bookworm-arm64-lite.img.xz",
+		},
+		{
+			// Renamed.
+			map[string]string{dir: `<a href="2025-05-13-raspios_lite-trixie-arm64.img.xz">`},
+			"2025-05-13-raspios_lite-trixie-arm64.img.xz",
+		},
+		{
+			// The expected name is preferred, then the most recent.
+			map[string]string{dir: `<a href="2025-05-13-raspios-bookworm-arm64-lite.img.xz">
+<a href="2025-05-13-raspios-bookworm-arm64-lite-extra.img.xz">
+<a href="2025-05-12-raspios-bookworm-arm64-lite.img.xz">`},
+			"2025-05-13-raspios-bookworm-arm64-lite.img.xz",
+		},
+		{
+			// Nested.
+			map[string]string{
+				dir:             `<a href="../">Parent Directory</a><a href="/icons/">Icons</a><a href="images/">images/</a><a href="?C=N;O=D">Name</a>`,
+				dir + "images/": `<a href="2025-05-13-raspios-bookworm-arm64-lite.img.xz">`,
+			},
+			"images/2025-05-13-raspios-bookworm-arm64-lite.img.xz",
+		},
+		{
+			map[string]string{dir: `<a href="2025-05-13-raspios-bookworm-arm64-full.img.xz">`},
+			"",
+		},
+		{
+			map[string]string{dir: `<a href="../2025-05-13-raspios-bookworm-arm64-lite.img.xz">`},
+			"",
+		},
+	}
+	for i, l := range data {
+		fetch := func(u string) ([]byte, error) {
+			if p, ok := l.pages[u]; ok {
+				return []byte(p), nil
+			}
+			return nil, errors.New("not found")
+		}
+		f, err := raspiosFindImage(fetch, dir, "arm64")
+		if (err == nil) != (l.expected != "") || f != l.expected {
+			t.Fatalf("%d: %q, %v", i, f, err)
+		}
+	}
+}
+
+func TestRaspiOSParseImageURL(t *testing.T) {
+	data := []struct {
+		u        string
+		date     string
+		expected string
+	}{
+		{"https://downloads.raspberrypi.org/raspios_lite_armhf/images/raspios_lite_armhf-2024-11-19/2024-11-19-raspios-bookworm-armhf-lite.img.xz", "2024-11-19", "2024-11-19-raspios-bookworm-armhf-lite.img.xz"},
+		{"https://downloads.raspberrypi.org/raspios_lite_armhf/images/raspios_lite_armhf-2025-05-13/images/2025-05-13-raspios_lite-trixie-armhf.img.xz", "2025-05-13", "images/2025-05-13-raspios_lite-trixie-armhf.img.xz"},
+		{"https://downloads.raspberrypi.org/raspios_lite_armhf_latest", "", ""},
+		{"https://downloads.raspberrypi.org/raspios_lite_armhf/images/raspios_lite_armhf-2024-11-19/2024-11-19-raspios-bookworm-armhf-full.img.xz", "", ""},
+		{"https://downloads.raspberrypi.org/raspios_lite_armhf/images/raspios_lite_armhf-2024-11-19/../2024-11-19-raspios-bookworm-armhf-lite.img.xz", "", ""},
+	}
+	for i, l := range data {
+		d, f, ok := raspiosParseImageURL(l.u, "armhf")
+		if ok != (l.expected != "") || d != l.date || f != l.expected {
+			t.Fatalf("%d: %q %q %t", i, d, f, ok)
+		}
+	}
+}
+
+func TestResolveRedirect(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest" {
+			http.Redirect(w, r, "/images/a.img.xz", http.StatusFound)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer s.Close()
+	u, err := resolveRedirect(context.Background(), s.URL+"/latest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != s.URL+"/images/a.img.xz" {
+		t.Fatal(u)
+	}
+}
+
+func TestRaspiOSFindRedirect(t *testing.T) {
+	const latest = "/raspios_lite_arm64/images/raspios_lite_arm64-2024-07-04/2024-07-04-raspios-bookworm-arm64-lite.img.xz"
+	var paths []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		case "/mirror/raspios_lite_arm64_latest":
+			http.Redirect(w, r, "/mirror"+latest, http.StatusFound)
+		case "/mirror" + latest:
+			w.WriteHeader(200)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+	d, f, err := raspiosFindRedirect(context.Background(), s.URL+"/mirror/", "arm64", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != "2024-07-04" || f != "2024-07-04-raspios-bookworm-arm64-lite.img.xz" {
+		t.Fatal(d, f)
+	}
+	if paths[0] != "/mirror/raspios_lite_arm64_latest" {
+		t.Fatal(paths)
+	}
+}
+
+func TestFetchXZAlternates(t *testing.T) {
+	var x bytes.Buffer
+	w, err := xz.NewWriter(&x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("periph")); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/down/a.img.xz":
+			w.WriteHeader(500)
+		case "/short/a.img.xz":
+			_, _ = w.Write(x.Bytes()[:x.Len()/2])
+		case "/ok/a.img.xz":
+			_, _ = w.Write(x.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+	imgpath := filepath.Join(t.TempDir(), "a.img")
+	urls := []string{s.URL + "/down/a.img.xz", s.URL + "/missing/a.img.xz", s.URL + "/short/a.img.xz", s.URL + "/ok/a.img.xz"}
+	u, err := fetchXZAlternates(context.Background(), "", urls, imgpath, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != urls[3] {
+		t.Fatal(u)
+	}
+	if b, err := os.ReadFile(imgpath); err != nil || string(b) != "periph" {
+		t.Fatal(string(b), err)
+	}
+	if _, err = fetchXZAlternates(context.Background(), "", urls[:3], imgpath, nil, nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err = os.Stat(imgpath); !os.IsNotExist(err) {
+		t.Fatal("expected the partial image to be removed", err)
+	}
+}
+
+func TestImageAlternateURLs(t *testing.T) {
+	i := Image{Manufacturer: HardKernel}
+	u, _, _, err := i.resolve(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alt := i.alternateURLs()
+	if len(alt) != len(hardKernelMirrors)-1 {
+		t.Fatal(alt)
+	}
+	for _, a := range alt {
+		if a == u || path.Base(a) != path.Base(u) {
+			t.Fatal(a)
+		}
+	}
+	i = Image{Manufacturer: Raspberry}
+	if alt := i.alternateURLs(); len(alt) != 0 {
+		t.Fatal(alt)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	ctx := context.Background()
+	o := &Options{Offline: true}
+	if c := GetCountry(ctx, o); c != "" {
+		t.Fatal(c)
+	}
+	if b, err := GetSetupSH(ctx, true, o); err != nil || !bytes.Equal(b, bootstrap.SetupSH) {
+		t.Fatal("expected the embedded setup.sh", err)
+	}
+	i := Image{Manufacturer: HardKernel}
+	if _, err := i.Fetch(ctx, o); !errors.Is(err, ErrOffline) {
+		t.Fatal(err)
+	}
+	if _, err := fetchURL(ctx, "https://example.com", o); !errors.Is(err, ErrOffline) {
+		t.Fatal(err)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sh")
+	}
+	out, err := capture(nil, "", "sh", "-c", "echo hello; echo oops >&2; exit 3")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if out != "hello\noops\n" {
+		t.Fatalf("%q", out)
+	}
+	if got := err.Error(); !strings.HasPrefix(got, "sh -c ") || !strings.Contains(got, "exit status 3") || !strings.HasSuffix(got, "\nhello\noops") {
+		t.Fatal(got)
+	}
+	if err = run(nil, "sh", "-c", "echo failed >&2; exit 1"); err == nil || !strings.HasSuffix(err.Error(), "\nfailed") {
+		t.Fatal(err)
+	}
+}
+
+func TestCaptureTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sleep")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := captureContext(ctx, nil, "", "sleep", "10")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(err)
+	}
+	if !strings.Contains(err.Error(), "timed out") {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatal(d)
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	var b tailBuffer
+	_, _ = b.Write(bytes.Repeat([]byte{'a'}, tailSize))
+	_, _ = b.Write([]byte("end"))
+	if s := b.String(); len(s) != tailSize || !strings.HasSuffix(s, "aend") {
+		t.Fatal(len(s))
+	}
+}
+
+func TestLevelFromFlags(t *testing.T) {
+	data := []struct {
+		quiet, verbose, debug bool
+		expected              Level
+	}{
+		{false, false, false, LevelInfo},
+		{true, false, false, LevelQuiet},
+		{false, true, false, LevelVerbose},
+		{false, false, true, LevelDebug},
+		{false, true, true, LevelDebug},
+	}
+	for i, l := range data {
+		got, err := LevelFromFlags(l.quiet, l.verbose, l.debug)
+		if err != nil || got != l.expected {
+			t.Fatalf("%d: %d != %d; %v", i, got, l.expected, err)
+		}
+	}
+	if _, err := LevelFromFlags(true, true, false); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestBenchmarkResult(t *testing.T) {
+	r := BenchmarkResult{Written: 16 * 1000 * 1000, Duration: 2 * time.Second, DiskSize: 32 * 1000 * 1000 * 1000}
+	if s := r.Speed(); s != 8*1000*1000 {
+		t.Fatal(s)
+	}
+	if w := r.Warnings(); len(w) != 0 {
+		t.Fatal(w)
+	}
+	r.Duration = 10 * time.Second
+	r.DiskSize = 4 * 1000 * 1000 * 1000 * 1000
+	if w := r.Warnings(); len(w) != 2 {
+		t.Fatal(w)
+	}
+	if s := (&BenchmarkResult{}).Speed(); s != 0 {
+		t.Fatal(s)
+	}
+	if _, err := Benchmark(context.Background(), "does-not-exist.img", filepath.Join(t.TempDir(), "does-not-exist"), nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestPartitionRoles(t *testing.T) {
+	// Output of lsblk 2.39 for a GPT image with the root partition first.
+	const out = `{
+   "blockdevices": [
+      {"name":"sdb", "maj:min":"8:16", "rm":true, "size":31914983424, "ro":false, "type":"disk", "mountpoint":null, "fstype":null, "partlabel":null,
+         "children": [
+            {"name":"sdb1", "maj:min":"8:17", "rm":true, "size":2147483648, "ro":false, "type":"part", "mountpoint":null, "fstype":"ext4", "partlabel":"rootfs"},
+            {"name":"sdb2", "maj:min":"8:18", "rm":true, "size":33554432, "ro":false, "type":"part", "mountpoint":null, "fstype":"vfat", "partlabel":"efi"},
+            {"name":"sdb3", "maj:min":"8:19", "rm":true, "size":268435456, "ro":false, "type":"part", "mountpoint":"/media/boot", "fstype":"vfat", "partlabel":"boot"}
+         ]
+      }
+   ]
+}`
+	v := lsblkOutput{}
+	if err := json.Unmarshal([]byte(out), &v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.BlockDevices) != 1 || v.BlockDevices[0].Children[2].FSType != "vfat" {
+		t.Fatalf("%#v", v)
+	}
+	if boot, root := v.BlockDevices[0].partitionRoles(); boot != 3 || root != 1 {
+		t.Fatal(boot, root)
+	}
+	v.BlockDevices[0].Children[2].PartLabel = ""
+	if boot, root := v.BlockDevices[0].partitionRoles(); boot != 2 || root != 1 {
+		t.Fatal(boot, root)
+	}
+}
+
+func TestParseLsblkVersion(t *testing.T) {
+	data := []struct {
+		in           string
+		major, minor int
+	}{
+		{"lsblk from util-linux 2.39.3\n", 2, 39},
+		{"lsblk from util-linux 2.26\n", 2, 26},
+		{"lsblk: unrecognized option '--version'\n", 0, 0},
+	}
+	for i, l := range data {
+		if major, minor := parseLsblkVersion(l.in); major != l.major || minor != l.minor {
+			t.Fatalf("%d: %d.%d", i, major, minor)
+		}
+	}
+}
+
+func TestParseLsblkPairs(t *testing.T) {
+	// Output of lsblk 2.25 --pairs --bytes, which doesn't support --json.
+	const out = `NAME="sda" MAJ:MIN="8:0" RM="0" SIZE="500107862016" RO="0" TYPE="disk" MOUNTPOINT="" FSTYPE=""
+NAME="sda1" MAJ:MIN="8:1" RM="0" SIZE="500106813440" RO="0" TYPE="part" MOUNTPOINT="/" FSTYPE="ext4"
+NAME="sdb" MAJ:MIN="8:16" RM="1" SIZE="31914983424" RO="0" TYPE="disk" MOUNTPOINT="" FSTYPE=""
+NAME="sdb1" MAJ:MIN="8:17" RM="1" SIZE="268435456" RO="0" TYPE="part" MOUNTPOINT="/media/my\x20boot" FSTYPE="vfat"
+NAME="sdb2" MAJ:MIN="8:18" RM="1" SIZE="2147483648" RO="0" TYPE="part" MOUNTPOINT="" FSTYPE="ext4"
+NAME="sr0" MAJ_MIN="11:0" RM="1" SIZE="1073741312" RO="1" TYPE="rom" MOUNTPOINT="" FSTYPE=""
+`
+	v := parseLsblkPairs(out)
+	if len(v) != 3 || len(v[0].Children) != 1 || len(v[1].Children) != 2 {
+		t.Fatalf("%#v", v)
+	}
+	if v[0].isSDCard() || !v[1].isSDCard() || v[2].isSDCard() {
+		t.Fatalf("%#v", v)
+	}
+	if v[1].Size != 31914983424 || !v[1].RM || v[2].MajMin != "11:0" {
+		t.Fatalf("%#v", v[1])
+	}
+	if m := v[1].Children[0].MountPoint; m != "/media/my boot" {
+		t.Fatal(m)
+	}
+	if boot, root := v[1].partitionRoles(); boot != 1 || root != 2 {
+		t.Fatal(boot, root)
+	}
+}
+
+func TestPartitionNumber(t *testing.T) {
+	data := []struct {
+		disk, part string
+		expected   int
+	}{
+		{"sdb", "sdb1", 1},
+		{"sdb", "sdb12", 12},
+		{"mmcblk0", "mmcblk0p2", 2},
+		{"nvme0n1", "nvme0n1p1", 1},
+		{"sdb", "sdc1", 0},
+		{"mmcblk0", "mmcblk0boot0", 0},
+		{"sdb", "sdb", 0},
+	}
+	for i, l := range data {
+		if got := partitionNumber(l.disk, l.part); got != l.expected {
+			t.Fatalf("%d: %d != %d", i, got, l.expected)
+		}
+	}
+}
+
+func TestImageRaspberryPiBoards(t *testing.T) {
+	data := []struct {
+		board  Board
+		distro Distro
+		model  string
+	}{
+		{RaspberryPi, RaspiOS, ""},
+		{RaspberryPiZero, RaspiOS, "pi0"},
+		{RaspberryPiZero2, RaspiOS, "pi02"},
+		{RaspberryPi3, RaspiOS64, "pi3"},
+		{RaspberryPi4, RaspiOS64, "pi4"},
+		{RaspberryPi5, RaspiOS64, "pi5"},
+	}
+	for i, l := range data {
+		img := Image{Board: l.board}
+		if err := img.Check(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if img.Manufacturer != Raspberry || img.Distro != l.distro || img.PiModel() != l.model {
+			t.Fatalf("%d: %s %q", i, &img, img.PiModel())
+		}
+	}
+	for _, d := range []Distro{RaspiOS64, Ubuntu} {
+		img := Image{Board: RaspberryPiZero, Distro: d}
+		if err := img.Check(); err == nil {
+			t.Fatalf("%s: expected error", d)
+		}
+	}
+}
+
+func TestRaspiOSRelease(t *testing.T) {
+	data := []struct {
+		file    string
+		release string
+		nm      bool
+	}{
+		{"2022-09-22-raspios-bullseye-armhf-lite.img.xz", "bullseye", false},
+		{"2023-12-05-raspios-bullseye-arm64-lite.img", "bullseye", false},
+		{"2024-07-04-raspios-bookworm-arm64-lite.img.xz", "bookworm", true},
+		{"/tmp/2025-11-24-raspios-trixie-armhf-lite.img", "trixie", true},
+		{"https://downloads.raspberrypi.org/raspios_lite_arm64/images/raspios_lite_arm64-2024-11-19/2024-11-19-raspios-bookworm-arm64-lite.img.xz", "bookworm", true},
+		// The release is not in the name, the date is used.
+		{"2023-05-03-custom.img", "", false},
+		{"2024-03-15-custom.img", "", true},
+		{"raspios.img", "", false},
+		{"", "", false},
+	}
+	for i, l := range data {
+		if r := RaspiOSRelease(l.file); r != l.release {
+			t.Fatalf("%d: %q", i, r)
+		}
+		if nm := RaspiOSUsesNetworkManager(l.file); nm != l.nm {
+			t.Fatalf("%d: %t", i, nm)
+		}
+	}
+}
+
+func TestBoardGoArch(t *testing.T) {
+	data := []struct {
+		board  Board
+		goarch string
+		goarm  string
+	}{
+		{RaspberryPi, "arm", "6"},
+		{RaspberryPiZero, "arm", "6"},
+		{RaspberryPiZero2, "arm", "7"},
+		{RaspberryPi4, "arm", "7"},
+		{JetsonNano, "arm64", ""},
+		{"", "", ""},
+	}
+	for i, l := range data {
+		if goarch, goarm := l.board.GoArch(); goarch != l.goarch || goarm != l.goarm {
+			t.Fatalf("%d: %s %s", i, goarch, goarm)
+		}
+	}
+	// Every board must be listed.
+	for _, b := range boards {
+		if goarch, _ := b.GoArch(); goarch == "" {
+			t.Fatalf("%s: missing GOARCH", b)
+		}
+	}
+}
+
+func TestFetchOnlyHelp(t *testing.T) {
+	m := ManufacturerHelp()
+	for _, want := range []string{"raspberrypi,", "radxa (fetch only)", "sinovoip (fetch only)", "xunlong (fetch only)"} {
+		if !strings.Contains(m, want) {
+			t.Fatalf("missing %q in %q", want, m)
+		}
+	}
+	b := ImageBoardHelp()
+	for _, want := range []string{"rpi4,", "bananapim2plus (fetch only)", "orangepizero (fetch only)", "rockpi4 (fetch only)"} {
+		if !strings.Contains(b, want) {
+			t.Fatalf("missing %q in %q", want, b)
+		}
+	}
+	if strings.Contains(b, "rpi4 (fetch only)") || strings.Contains(BoardHelp(), "fetch only") {
+		t.Fatal(b)
+	}
+}
+
+func TestImageArmbianBoards(t *testing.T) {
+	o := &Options{Offline: true}
+	data := []struct {
+		board Board
+		m     Manufacturer
+		url   string
+	}{
+		{BananaPiM2Plus, Sinovoip, "https://dl.armbian.com/bananapim2plus/Bookworm_current_minimal"},
+		{OrangePiPC, Xunlong, "https://dl.armbian.com/orangepipc/Bookworm_current_minimal"},
+		{OrangePiZero, Xunlong, "https://dl.armbian.com/orangepizero/Bookworm_current_minimal"},
+	}
+	for i, l := range data {
+		img := Image{Board: l.board}
+		if err := img.Check(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if img.Manufacturer != l.m || img.Distro != Armbian || img.DefaultHostname() != string(l.board) || img.RootPartition() != 1 {
+			t.Fatalf("%d: %s", i, &img)
+		}
+		// The redirect is not resolved while offline.
+		u, _, err := img.URL(context.Background(), o)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if u != l.url {
+			t.Fatalf("%d: %s", i, u)
+		}
+	}
+	img := Image{Board: OrangePiPC, Distro: Ubuntu}
+	if err := img.Check(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestParseImage(t *testing.T) {
+	data := []struct {
+		in       string
+		expected Image
+	}{
+		{"raspberrypi:rpi4:raspios64", Image{Manufacturer: Raspberry, Board: RaspberryPi4, Distro: RaspiOS64}},
+		{"raspberrypi::raspios", Image{Manufacturer: Raspberry, Distro: RaspiOS}},
+		{":rpi4", Image{Board: RaspberryPi4}},
+		{"xunlong", Image{Manufacturer: Xunlong}},
+		{"::ubuntu", Image{Distro: Ubuntu}},
+	}
+	for i, line := range data {
+		got, err := ParseImage(line.in)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if got != line.expected {
+			t.Fatalf("%d: %s", i, &got)
+		}
+	}
+	// Round trip.
+	img := Image{Board: RaspberryPi3}
+	if err := img.Check(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseImage(img.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != img {
+		t.Fatal(&got)
+	}
+	for i, in := range []string{"", "acme", "raspberrypi:rpi9", "raspberrypi:rpi4:windows", "a:b:c:d"} {
+		if _, err := ParseImage(in); err == nil {
+			t.Fatalf("%d: %q: expected error", i, in)
+		}
+	}
+}
+
+func TestImageRadxa(t *testing.T) {
+	ctx := context.Background()
+	o := &Options{Offline: true}
+	i := Image{Board: Rock3A}
+	if err := i.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if i.Manufacturer != Radxa || i.Distro != Armbian || i.DefaultHostname() != "rock-3a" || i.RootPartition() != 1 {
+		t.Fatal(&i)
+	}
+	u, _, err := i.URL(ctx, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != "https://dl.armbian.com/rock-3a/Bookworm_current_minimal" {
+		t.Fatal(u)
+	}
+	i = Image{Board: RockPi4, Distro: Debian}
+	if err = i.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if i.DefaultUser() != "radxa" || i.DefaultHostname() != "rock-pi-4b" || i.RootPartition() != 3 {
+		t.Fatal(&i)
+	}
+	// The GitHub API can't be queried while offline.
+	if _, _, err = i.URL(ctx, o); !errors.Is(err, ErrOffline) {
+		t.Fatal(err)
+	}
+	i = Image{Board: RockPi4, Distro: RaspiOS}
+	if err = i.Check(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRadxaParseRelease(t *testing.T) {
+	raw := []byte(`{"tag_name": "b38", "assets": [
+		{"name": "rock-pi-4b_debian_bullseye_xfce4_b38.img.xz", "browser_download_url": "https://github.com/radxa-build/rock-pi-4b/releases/download/b38/rock-pi-4b_debian_bullseye_xfce4_b38.img.xz"},
+		{"name": "rock-pi-4b_debian_bullseye_cli_b38.img.xz", "browser_download_url": "https://github.com/radxa-build/rock-pi-4b/releases/download/b38/rock-pi-4b_debian_bullseye_cli_b38.img.xz"},
+		{"name": "rock-pi-4b_debian_bullseye_cli_b38.img.xz.sha256", "browser_download_url": "https://github.com/radxa-build/rock-pi-4b/releases/download/b38/rock-pi-4b_debian_bullseye_cli_b38.img.xz.sha256"}
+	]}`)
+	u, name, tag, err := radxaParseRelease(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != "https://github.com/radxa-build/rock-pi-4b/releases/download/b38/rock-pi-4b_debian_bullseye_cli_b38.img.xz" || name != "rock-pi-4b_debian_bullseye_cli_b38.img" || tag != "b38" {
+		t.Fatal(u, name, tag)
+	}
+	if _, _, _, err = radxaParseRelease([]byte(`{"tag_name": "b1", "assets": []}`)); !errors.Is(err, ErrImageNotFound) {
+		t.Fatal(err)
+	}
+	if _, _, _, err = radxaParseRelease([]byte(`<html>`)); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestImageJetsonNano(t *testing.T) {
+	i := Image{Board: JetsonNano}
+	if err := i.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if i.Manufacturer != NVIDIA {
+		t.Fatal(i.Manufacturer)
+	}
+	_, _, err := i.URL(context.Background(), nil)
+	if !errors.Is(err, ErrImageNotFound) || !strings.Contains(err.Error(), "developer.nvidia.com") {
+		t.Fatal(err)
+	}
+	if _, err = i.Fetch(context.Background(), nil); !errors.Is(err, ErrImageNotFound) {
+		t.Fatal(err)
+	}
+}
+
+func TestArmbianParseImageURL(t *testing.T) {
+	name, version, ok := armbianParseImageURL("https://mirror.example.com/dl/orangepipc/archive/Armbian_24.5.1_Orangepipc_bookworm_current_6.6.31_minimal.img.xz")
+	if !ok || name != "Armbian_24.5.1_Orangepipc_bookworm_current_6.6.31_minimal.img" || version != "24.5.1" {
+		t.Fatal(name, version, ok)
+	}
+	if _, _, ok = armbianParseImageURL("https://dl.armbian.com/orangepipc/Bookworm_current_minimal"); ok {
+		t.Fatal("expected failure")
+	}
+}
+
+func TestFreeDriveLetter(t *testing.T) {
+	data := []struct {
+		mask     uint32
+		expected string
+	}{
+		{0, "D:\\"},
+		// A:, C: and D: are used.
+		{1<<0 | 1<<2 | 1<<3, "E:\\"},
+		{1<<26 - 1, ""},
+		{1<<26 - 1 - 1<<25, "Z:\\"},
+	}
+	for i, l := range data {
+		if got := freeDriveLetter(l.mask); got != l.expected {
+			t.Fatalf("%d: %q != %q", i, got, l.expected)
+		}
+	}
+}
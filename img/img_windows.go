@@ -5,14 +5,17 @@
 package img
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"unsafe"
@@ -29,6 +32,9 @@ const fsctlDismountVolume = 0x90020
 // IOCTL_DISK_UPDATE_PROPERTIES = CTL_CODE(IOCTL_DISK_BASE,0x50,METHOD_BUFFERED,FILE_ANY_ACCESS)
 const ioctlDiskUpdateProperties = 0x70140
 
+// IOCTL_STORAGE_EJECT_MEDIA = CTL_CODE(IOCTL_STORAGE_BASE,0x0202,METHOD_BUFFERED,FILE_READ_ACCESS)
+const ioctlStorageEjectMedia = 0x2d4808
+
 // https://msdn.microsoft.com/en-us/library/windows/desktop/bb968801.aspx
 // IOCTL_STORAGE_GET_DEVICE_NUMBER = CTL_CODE(IOCTL_STORAGE_BASE,0x0420,METHOD_BUFFERED,FILE_ANY_ACCESS)
 const ioctlStorageGetDeviceNumber = 0x2d1080
@@ -46,7 +52,9 @@ type storageDeviceNumber struct {
 // token.
 //
 // 'disk' is expected to be of format "\\\\.\\physicaldriveN"
-func flashWindows(imgPath, disk string) error {
+//
+// If m is not nil, only the blocks listed are written.
+func flashWindows(ctx context.Context, imgPath, disk string, m *bmap, o *Options) error {
 	// TODO(maruel): It'd be worth opening with FILE_FLAG_SEQUENTIAL_SCAN but Go
 	// stdlib doesn't allow this.
 	/* #nosec G304 */
@@ -60,43 +68,90 @@ func flashWindows(imgPath, disk string) error {
 	if err != nil {
 		return err
 	}
-	s := float64(i.Size())
+	return writeWindows(ctx, fi, i.Size(), disk, m, true, o)
+}
 
-	var dummy uint32
-	var handles []syscall.Handle
-	for _, v := range getVolumesForDisk(disk, 0) {
-		var r *uint16
-		if r, err = syscall.UTF16PtrFromString(v); err != nil {
-			return err
-		}
-		var fd syscall.Handle
-		if fd, err = syscall.CreateFile(r, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_EXISTING, 0, 0); err != nil {
-			return fmt.Errorf("failed to open %s: %w", v, err)
+// benchmarkWindows writes the first n bytes of imgPath to the physical disk
+// 'disk' and returns the time it took, including flushing.
+//
+// Unlike flashWindows, locking the volumes and opening the disk are not timed,
+// and it doesn't wait for the volumes to reappear.
+func benchmarkWindows(imgPath, disk string, n int64) (time.Duration, error) {
+	/* #nosec G304 */
+	fi, err := os.Open(imgPath)
+	if err != nil {
+		return 0, err
+	}
+	/* #nosec G307 */
+	defer fi.Close()
+	handles, err := lockVolumes(disk)
+	defer func() {
+		for _, h := range handles {
+			_ = syscall.CloseHandle(h)
 		}
-		// https://msdn.microsoft.com/en-us/library/windows/desktop/aa364575.aspx
-		// "Note that without a successful lock operation, a dismounted volume may
-		// be remounted by any process at any time"
-		if err = syscall.DeviceIoControl(fd, fsctlLockVolume, nil, 0, nil, 0, &dummy, nil); err != nil {
-			_ = syscall.CloseHandle(fd)
-			return fmt.Errorf("failed to lock %s: %w", v, err)
+	}()
+	if err != nil {
+		return 0, err
+	}
+	fd, err := syscall.Open(disk, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	/* #nosec G307 */
+	defer syscall.CloseHandle(fd)
+	// Read the whole data first so only the writes are timed.
+	b := make([]byte, n)
+	if _, err = io.ReadFull(fi, b); err != nil {
+		return 0, fmt.Errorf("failed to read the image: %w", err)
+	}
+	const chunk = 1024 * 1024
+	start := time.Now()
+	for o := 0; o < len(b); o += chunk {
+		if _, err = syscall.Write(fd, b[o:min(o+chunk, len(b))]); err != nil {
+			return 0, fmt.Errorf("failed to write %s: %w", disk, err)
 		}
-		// https://msdn.microsoft.com/en-us/library/windows/desktop/aa364562.aspx
-		//   "It is important to lock the volume first, otherwise unpredictable
-		//   behavior may happen."
-		if err = syscall.DeviceIoControl(fd, fsctlDismountVolume, nil, 0, nil, 0, &dummy, nil); err != nil {
-			_ = syscall.CloseHandle(fd)
-			return fmt.Errorf("failed to unmount %s: %w", v, err)
+	}
+	if err = syscall.FlushFileBuffers(fd); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// writeWindows writes the image of size bytes read from r to the physical
+// disk 'disk'.
+//
+// size is -1 when unknown, in which case r is read until EOF. m must be nil
+// unless r implements io.Seeker. The progress is printed when progress is
+// true. Writing stops when ctx is canceled.
+func writeWindows(ctx context.Context, r io.Reader, size int64, disk string, m *bmap, progress bool, opts *Options) error {
+	// Ranges to write, in bytes.
+	type byteRange struct {
+		off, n int64
+	}
+	ranges := []byteRange{{0, size}}
+	if size < 0 {
+		ranges[0].n = math.MaxInt64
+	}
+	s := float64(size)
+	if m != nil {
+		ranges = ranges[:0]
+		for _, r := range m.ranges {
+			ranges = append(ranges, byteRange{r.first * m.blockSize, (r.last - r.first + 1) * m.blockSize})
 		}
-		// TODO(maruel): In practice, it'd be nicer to just delete the volumes?
-		log.Println("locked volume", v)
-		handles = append(handles, fd)
+		s = float64(m.mappedBytes())
 	}
+
+	var dummy uint32
+	handles, err := lockVolumes(disk)
 	defer func() {
 		// Closing the handle implicitly removes the lock.
 		for _, h := range handles {
 			_ = syscall.CloseHandle(h)
 		}
 	}()
+	if err != nil {
+		return err
+	}
 
 	fd, err := syscall.Open(disk, os.O_RDWR, 0)
 	if err != nil {
@@ -111,28 +166,66 @@ func flashWindows(imgPath, disk string) error {
 	// Use manual buffer instead of io.Copy() to control buffer size. 64Kb should
 	// be a multiple of all common sector sizes, generally 4Kb or 8Kb and it
 	// should work better with the Windows' read-ahead mechanism.
-	var b [64 * 1024]byte
-	fmt.Printf("\n")
-	for o := int64(0); ; {
-		n := 0
-		if n, err = fi.Read(b[:]); err == io.EOF {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("failed to read %s: %w", imgPath, err)
+	bs := int64(64 * 1024)
+	if opts != nil && opts.FlashBlockSize != 0 {
+		bs = opts.FlashBlockSize
+	}
+	b := make([]byte, bs)
+	if progress {
+		Progressf("\n")
+	}
+	o := int64(0)
+	for _, br := range ranges {
+		if m != nil {
+			if _, err = r.(io.Seeker).Seek(br.off, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to seek the image: %w", err)
+			}
 		}
-		nw := 0
-		if nw, err = syscall.Write(fd, b[:n]); err != nil {
-			// TODO(maruel): Find the drive letter(s) and call windows.DeleteVolumeMountPoint().
-			return fmt.Errorf("failed to write %s. It likely means you need to unmount the drive letter: %w", disk, err)
+		if _, err = syscall.Seek(fd, br.off, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek %s: %w", disk, err)
 		}
-		if nw != n {
-			return errors.New("buffer underflow")
+		for left := br.n; left > 0; {
+			if err = ctx.Err(); err != nil {
+				// Make sure what was written so far reaches the SDCard before the
+				// handles are closed.
+				_ = syscall.FlushFileBuffers(fd)
+				Progressf("\n")
+				return err
+			}
+			buf := b[:]
+			if int64(len(buf)) > left {
+				buf = buf[:left]
+			}
+			n := 0
+			if n, err = io.ReadFull(r, buf); err == io.EOF {
+				break
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return fmt.Errorf("failed to read the image: %w", err)
+			}
+			nw := 0
+			if nw, err = syscall.Write(fd, buf[:n]); err != nil {
+				// TODO(maruel): Find the drive letter(s) and call windows.DeleteVolumeMountPoint().
+				return fmt.Errorf("failed to write %s. It likely means you need to unmount the drive letter: %w", disk, err)
+			}
+			if nw != n {
+				return errors.New("buffer underflow")
+			}
+			left -= int64(nw)
+			o += int64(nw)
+			if !progress {
+				continue
+			}
+			if s > 0 {
+				Progressf("\r%.1f%%", float64(o)*100./s)
+			} else {
+				Progressf("\r%s", formatSize(o))
+			}
 		}
-		o += int64(nw)
-		fmt.Printf("\r%.1f%%", float64(o)*100./s)
 	}
-	fmt.Printf("\r100.0%%\n")
+	if progress {
+		Progressf("\r100.0%%\n")
+	}
 	// Refresh partition table.
 	// https://msdn.microsoft.com/en-us/library/windows/desktop/aa365192.aspx
 	err = syscall.DeviceIoControl(fd, ioctlDiskUpdateProperties, nil, 0, nil, 0, &dummy, nil)
@@ -152,23 +245,154 @@ func flashWindows(imgPath, disk string) error {
 
 	// It will take a moment for the volumes to appear. Enforce a "sleep" by
 	// calling mountWindows() for a few seconds until it succeeds.
-	for start := time.Now(); time.Since(start) < 15*time.Second; {
-		if _, err := mountWindows(disk, 1); err == nil {
+	for start := time.Now(); time.Since(start) < opts.partitionTimeout(); {
+		if _, err := mountWindows(disk, 1, nil); err == nil {
 			return nil
 		}
-		time.Sleep(100 * time.Millisecond)
+		time.Sleep(partitionPoll)
 	}
 	// Still return nil, but mountWindows() will likely fail.
 	return nil
 }
 
+// lockVolumes locks and dismounts all the volumes on disk 'disk'.
+//
+// The locks are held until the returned handles are closed, even on error.
+func lockVolumes(disk string) ([]syscall.Handle, error) {
+	var dummy uint32
+	var handles []syscall.Handle
+	var err error
+	for _, v := range getVolumesForDisk(disk, 0) {
+		var r *uint16
+		if r, err = syscall.UTF16PtrFromString(v); err != nil {
+			return handles, err
+		}
+		var fd syscall.Handle
+		if fd, err = syscall.CreateFile(r, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_EXISTING, 0, 0); err != nil {
+			return handles, fmt.Errorf("failed to open %s: %w", v, err)
+		}
+		// https://msdn.microsoft.com/en-us/library/windows/desktop/aa364575.aspx
+		// "Note that without a successful lock operation, a dismounted volume may
+		// be remounted by any process at any time"
+		if err = syscall.DeviceIoControl(fd, fsctlLockVolume, nil, 0, nil, 0, &dummy, nil); err != nil {
+			_ = syscall.CloseHandle(fd)
+			return handles, fmt.Errorf("failed to lock %s: %w", v, err)
+		}
+		// https://msdn.microsoft.com/en-us/library/windows/desktop/aa364562.aspx
+		//   "It is important to lock the volume first, otherwise unpredictable
+		//   behavior may happen."
+		if err = syscall.DeviceIoControl(fd, fsctlDismountVolume, nil, 0, nil, 0, &dummy, nil); err != nil {
+			_ = syscall.CloseHandle(fd)
+			return handles, fmt.Errorf("failed to unmount %s: %w", v, err)
+		}
+		// TODO(maruel): In practice, it'd be nicer to just delete the volumes?
+		log.Println("locked volume", v)
+		handles = append(handles, fd)
+	}
+	return handles, nil
+}
+
+// windowsDisk accesses a physical disk bypassing the OS cache.
+type windowsDisk struct {
+	fd      syscall.Handle
+	handles []syscall.Handle
+	// buf is aligned on the sector size, as required by unbuffered I/O.
+	buf []byte
+}
+
+// openDiskWindows opens the physical disk 'disk' for unbuffered reads and
+// writes of up to probeSize bytes, after locking and dismounting its volumes.
+func openDiskWindows(disk string) (diskIO, error) {
+	d := &windowsDisk{fd: syscall.InvalidHandle}
+	var err error
+	d.handles, err = lockVolumes(disk)
+	if err != nil {
+		_ = d.Close()
+		return nil, err
+	}
+	p, err := syscall.UTF16PtrFromString(disk)
+	if err != nil {
+		_ = d.Close()
+		return nil, err
+	}
+	if d.fd, err = syscall.CreateFile(p, syscall.GENERIC_READ|syscall.GENERIC_WRITE, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil, syscall.OPEN_EXISTING, windows.FILE_FLAG_NO_BUFFERING|windows.FILE_FLAG_WRITE_THROUGH, 0); err != nil {
+		_ = d.Close()
+		return nil, fmt.Errorf("failed to open %s: %w", disk, err)
+	}
+	// Over allocate to align the buffer.
+	b := make([]byte, probeSize+probeSize)
+	o := probeSize - int(uintptr(unsafe.Pointer(&b[0]))%probeSize)
+	d.buf = b[o : o+probeSize]
+	return d, nil
+}
+
+func (d *windowsDisk) WriteAt(p []byte, off int64) (int, error) {
+	if _, err := syscall.Seek(d.fd, off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n := copy(d.buf, p)
+	return syscall.Write(d.fd, d.buf[:n])
+}
+
+func (d *windowsDisk) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := syscall.Seek(d.fd, off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := syscall.Read(d.fd, d.buf[:len(p)])
+	copy(p, d.buf[:n])
+	return n, err
+}
+
+func (d *windowsDisk) Close() error {
+	var err error
+	if d.fd != syscall.InvalidHandle {
+		err = syscall.CloseHandle(d.fd)
+	}
+	// Closing the handle implicitly removes the lock.
+	for _, h := range d.handles {
+		_ = syscall.CloseHandle(h)
+	}
+	return err
+}
+
+// ejectWindows ejects the media in physical disk 'disk'.
+func ejectWindows(disk string) error {
+	handles, err := lockVolumes(disk)
+	defer func() {
+		for _, h := range handles {
+			_ = syscall.CloseHandle(h)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	fd, err := syscall.Open(disk, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(fd)
+	var dummy uint32
+	// https://learn.microsoft.com/en-us/windows/win32/api/winioctl/ni-winioctl-ioctl_storage_eject_media
+	if err = syscall.DeviceIoControl(fd, ioctlStorageEjectMedia, nil, 0, nil, 0, &dummy, nil); err != nil {
+		return fmt.Errorf("failed to eject %s: %w", disk, err)
+	}
+	return nil
+}
+
+// driveLetters are the drive letters assigned by mountWindows with
+// Options.DriveLetter, keyed by disk.
+var (
+	driveLettersMu sync.Mutex
+	driveLetters   = map[string][]string{}
+)
+
 // mountWindows find the volume path for the partition 'n' on disk 'disk'.
 //
 // The returned path is in form
 // "\\\\?\\Volume{00000000-0000-0000-0000-000000000000}", not with a DOS drive
 // letter. In practice it is simpler to work this way than try to find out the
-// drive letter.
-func mountWindows(disk string, n int) (string, error) {
+// drive letter. With o.DriveLetter, a drive letter is returned instead.
+func mountWindows(disk string, n int, o *Options) (string, error) {
 	p := getVolumesForDisk(disk, n)
 	if len(p) == 0 {
 		return "", fmt.Errorf("partition #%d on disk %s not found", n, disk)
@@ -176,13 +400,90 @@ func mountWindows(disk string, n int) (string, error) {
 	if len(p) > 1 {
 		return "", fmt.Errorf("found multiple partitions #%d on disk %s: %v", n, disk, p)
 	}
-	return p[0], nil
+	if !o.driveLetter() {
+		return p[0], nil
+	}
+	return assignDriveLetter(disk, p[0])
+}
+
+// assignDriveLetter returns the drive letter of the volume v on disk,
+// assigning a free one if it has none.
+func assignDriveLetter(disk, v string) (string, error) {
+	// The volume functions require the trailing backslash.
+	vol, err := windows.UTF16PtrFromString(v + "\\")
+	if err != nil {
+		return "", err
+	}
+	var buf [1024]uint16
+	var l uint32
+	if err = windows.GetVolumePathNamesForVolumeName(vol, &buf[0], uint32(len(buf)), &l); err == nil {
+		// The buffer is a list of NUL terminated strings.
+		for start, i := 0, 0; i < int(l) && i < len(buf); i++ {
+			if buf[i] != 0 {
+				continue
+			}
+			if m := syscall.UTF16ToString(buf[start:i]); len(m) == 3 && m[1] == ':' {
+				return m, nil
+			}
+			start = i + 1
+		}
+	}
+	mask, err := windows.GetLogicalDrives()
+	if err != nil {
+		return "", err
+	}
+	letter := freeDriveLetter(mask)
+	if letter == "" {
+		return "", errors.New("no free drive letter")
+	}
+	mp, err := windows.UTF16PtrFromString(letter)
+	if err != nil {
+		return "", err
+	}
+	if err = windows.SetVolumeMountPoint(mp, vol); err != nil {
+		return "", fmt.Errorf("failed to assign %s to %s: %w", letter, v, err)
+	}
+	log.Printf("- Assigned %s to %s", letter, v)
+	driveLettersMu.Lock()
+	driveLetters[disk] = append(driveLetters[disk], letter)
+	driveLettersMu.Unlock()
+	return letter, nil
 }
 
 func umountWindows(disk string) error {
-	// This needs to be done *during* the flashing operation to keep the volumes
-	// locked.
-	return nil
+	// The volumes are dismounted *during* the flashing operation to keep them
+	// locked. Only remove the drive letters assigned by mountWindows.
+	driveLettersMu.Lock()
+	letters := driveLetters[disk]
+	delete(driveLetters, disk)
+	driveLettersMu.Unlock()
+	var err error
+	for _, letter := range letters {
+		log.Printf("- Removing %s", letter)
+		mp, err1 := windows.UTF16PtrFromString(letter)
+		if err1 == nil {
+			err1 = windows.DeleteVolumeMountPoint(mp)
+		}
+		if err1 != nil && err == nil {
+			err = fmt.Errorf("failed to remove %s: %w", letter, err1)
+		}
+	}
+	return err
+}
+
+// setEchoWindows enables or disables the echo of the console on stdin.
+func setEchoWindows(on bool) error {
+	h := windows.Handle(os.Stdin.Fd())
+	var mode uint32
+	if err := windows.GetConsoleMode(h, &mode); err != nil {
+		return err
+	}
+	if on {
+		mode |= windows.ENABLE_ECHO_INPUT
+	} else {
+		mode &^= windows.ENABLE_ECHO_INPUT
+	}
+	return windows.SetConsoleMode(h, mode)
 }
 
 func listSDCardsWindows() []string {
@@ -202,6 +503,88 @@ func listSDCardsWindows() []string {
 	return out
 }
 
+func describeDiskWindows(disk string) string {
+	for _, d := range wmicList("diskdrive", "get", "deviceid,model,size") {
+		if strings.EqualFold(d["DeviceID"], disk) {
+			n, _ := strconv.ParseInt(d["Size"], 10, 64)
+			return strings.TrimSpace(d["Model"] + " " + formatSize(n))
+		}
+	}
+	return ""
+}
+
+// addPartitionWindows adds the partition with diskpart and formats it.
+func addPartitionWindows(disk string, start, size int64, fs DataFS) error {
+	n := diskNum(disk)
+	if n == -1 {
+		return fmt.Errorf("invalid disk %q", disk)
+	}
+	// diskpart takes the offset in KiB and the size in MiB.
+	script := fmt.Sprintf("select disk %d\ncreate partition primary offset=%d size=%d\n", n, start/1024, size/1024/1024)
+	if fs == DataFAT {
+		script += "format fs=fat32 quick label=DATA\n"
+	} else {
+		script += "set id=83 override\n"
+	}
+	_, err := capture(nil, script, "diskpart")
+	return err
+}
+
+func diskSizeWindows(disk string) int64 {
+	for _, d := range wmicList("diskdrive", "get", "deviceid,size") {
+		if strings.EqualFold(d["DeviceID"], disk) {
+			n, _ := strconv.ParseInt(d["Size"], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+func freeSpace(dir string) (int64, error) {
+	p, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var avail, total, free uint64
+	if err = windows.GetDiskFreeSpaceEx(p, &avail, &total, &free); err != nil {
+		return 0, err
+	}
+	/* #nosec G115 */
+	return int64(avail), nil
+}
+
+// systemDisksWindows returns the physical disk hosting the system drive.
+func systemDisksWindows() []string {
+	d := os.Getenv("SystemDrive")
+	if d == "" {
+		d = "C:"
+	}
+	r, err := syscall.UTF16PtrFromString("\\\\.\\" + d)
+	if err != nil {
+		return nil
+	}
+	fd, err := syscall.CreateFile(r, 0, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil, syscall.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		log.Println(d, err)
+		return nil
+	}
+	/* #nosec G307 */
+	defer syscall.CloseHandle(fd)
+	var bytesRead uint32
+	var b [32]byte
+	if err = syscall.DeviceIoControl(fd, ioctlStorageGetDeviceNumber, nil, 0, &b[0], uint32(len(b)), &bytesRead, nil); err != nil {
+		log.Println(d, err)
+		return nil
+	}
+	if bytesRead != uint32(reflect.TypeOf((*storageDeviceNumber)(nil)).Elem().Size()) {
+		log.Println("unexpected length", bytesRead)
+		return nil
+	}
+	/* #nosec G103 */
+	s := (*storageDeviceNumber)(unsafe.Pointer(&b[0]))
+	return []string{fmt.Sprintf("\\\\.\\physicaldrive%d", s.deviceNumber)}
+}
+
 //
 
 // diskNum returns the disk number from its path.
@@ -304,7 +687,7 @@ func wmicList(args ...string) []map[string]string {
 	//
 	// The 'new' way is
 	// https://msdn.microsoft.com/en-us/library/windows/desktop/hh830612.aspx
-	b, err := capture("", "wmic", args...)
+	b, err := capture(nil, "", "wmic", args...)
 	if err != nil || len(b) == 0 {
 		return nil
 	}
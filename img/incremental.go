@@ -0,0 +1,118 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+)
+
+// incrementalBlockSize is the size of the blocks compared by
+// FlashIncremental.
+const incrementalBlockSize = 4 * 1024 * 1024
+
+// FlashIncremental flashes imgPath to disk, only writing the 4MiB blocks that
+// differ from basePath, the image last flashed on disk.
+//
+// It is meant for the development loop where a slightly modified image is
+// flashed repeatedly. The content of disk is not read back, so it must not
+// have been modified since basePath was flashed, e.g. by booting it, otherwise
+// the result is a mix of both images. The partition table and the FAT
+// partitions are always written in full, since they are typically edited once
+// flashed, e.g. by efe.
+//
+// It falls back to Flash when basePath is empty or doesn't exist.
+func FlashIncremental(ctx context.Context, imgPath, basePath, disk string, o *Options) error {
+	if basePath == "" {
+		return Flash(ctx, imgPath, disk, o)
+	}
+	/* #nosec G304 */
+	base, err := os.Open(basePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("%s doesn't exist, flashing %s in full", basePath, imgPath)
+		return Flash(ctx, imgPath, disk, o)
+	}
+	if err != nil {
+		return err
+	}
+	/* #nosec G307 */
+	defer base.Close()
+	/* #nosec G304 */
+	next, err := os.Open(imgPath)
+	if err != nil {
+		return err
+	}
+	/* #nosec G307 */
+	defer next.Close()
+	fi, err := next.Stat()
+	if err != nil {
+		return err
+	}
+	Progressf("- Comparing %s with %s\n", imgPath, basePath)
+	m, err := diffImages(ctx, base, next, fi.Size(), incrementalBlockSize)
+	if err != nil {
+		return fmt.Errorf("failed to compare %s with %s: %w", imgPath, basePath, err)
+	}
+	Progressf("- %s of %s changed\n", formatSize(m.mappedBytes()), formatSize(m.imageSize))
+	return flash(ctx, imgPath, disk, m, o)
+}
+
+// diffImages returns the block map of the blocks of next, of size bytes, that
+// differ from base, plus the first block and the ones of the FAT partitions.
+// It stops early when ctx is canceled.
+func diffImages(ctx context.Context, base, next io.ReaderAt, size, blockSize int64) (*bmap, error) {
+	m := &bmap{imageSize: size, blockSize: blockSize}
+	blocks := (size + blockSize - 1) / blockSize
+	// The partition table is in the first block.
+	forced := []bmapRange{{0, 0}}
+	if parts, err := ReadPartitions(next); err == nil {
+		for _, p := range parts {
+			if p.Size == 0 {
+				continue
+			}
+			if _, err := FATType(io.NewSectionReader(next, p.Offset, p.Size)); err == nil {
+				forced = append(forced, bmapRange{p.Offset / blockSize, (p.Offset + p.Size - 1) / blockSize})
+			}
+		}
+	}
+	a := make([]byte, blockSize)
+	b := make([]byte, blockSize)
+	for i := int64(0); i < blocks; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		changed := false
+		for _, r := range forced {
+			changed = changed || (i >= r.first && i <= r.last)
+		}
+		if !changed {
+			n, err := next.ReadAt(b, i*blockSize)
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			// A block past the end of base is different.
+			o, err := base.ReadAt(a[:n], i*blockSize)
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			changed = o != n || !bytes.Equal(a[:n], b[:n])
+		}
+		if !changed {
+			continue
+		}
+		if l := len(m.ranges); l != 0 && m.ranges[l-1].last == i-1 {
+			m.ranges[l-1].last = i
+		} else {
+			m.ranges = append(m.ranges, bmapRange{i, i})
+		}
+	}
+	return m, nil
+}
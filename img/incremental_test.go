@@ -0,0 +1,80 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+)
+
+func TestDiffImages(t *testing.T) {
+	const bs = 4096
+	next := make([]byte, 16*bs-100)
+	for i := range next {
+		next[i] = byte(i * 7)
+	}
+	copy(next[440:512], make([]byte, 72))
+	next[510] = 0x55
+	next[511] = 0xAA
+	// Partition 1 is a FAT12 in blocks 2-3, partition 2 is linux in blocks
+	// 4-15.
+	for i, p := range [][3]uint32{{0x01, 16, 16}, {0x83, 32, 96}} {
+		e := next[446+16*i:]
+		e[4] = byte(p[0])
+		binary.LittleEndian.PutUint32(e[8:], p[1])
+		binary.LittleEndian.PutUint32(e[12:], p[2])
+	}
+	fat := next[2*bs : 3*bs]
+	copy(fat, make([]byte, 512))
+	binary.LittleEndian.PutUint16(fat[11:], 512)
+	fat[13] = 1
+	binary.LittleEndian.PutUint16(fat[14:], 1)
+	fat[16] = 2
+	binary.LittleEndian.PutUint16(fat[17:], 16)
+	binary.LittleEndian.PutUint16(fat[19:], 16)
+	binary.LittleEndian.PutUint16(fat[22:], 1)
+	fat[510] = 0x55
+	fat[511] = 0xAA
+
+	data := []struct {
+		base     func([]byte) []byte
+		expected []bmapRange
+	}{
+		{
+			func(b []byte) []byte { return b },
+			[]bmapRange{{0, 0}, {2, 3}},
+		},
+		{
+			func(b []byte) []byte {
+				b[7*bs+10]++
+				b[8*bs]++
+				// The last two blocks are past the end of base.
+				return b[:len(b)-5000]
+			},
+			[]bmapRange{{0, 0}, {2, 3}, {7, 8}, {14, 15}},
+		},
+		{
+			func(b []byte) []byte { return nil },
+			[]bmapRange{{0, 15}},
+		},
+	}
+	for i, l := range data {
+		base := l.base(append([]byte(nil), next...))
+		m, err := diffImages(context.Background(), bytes.NewReader(base), bytes.NewReader(next), int64(len(next)), bs)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if m.imageSize != int64(len(next)) || m.blockSize != bs || len(m.ranges) != len(l.expected) {
+			t.Fatalf("%d: %#v", i, m)
+		}
+		for j := range l.expected {
+			if m.ranges[j] != l.expected[j] {
+				t.Fatalf("%d: %#v", i, m.ranges)
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// Level is the verbosity of the output.
+//
+// The progress is printed on stdout along with the prompts, while the
+// diagnostic logs go to stderr.
+type Level int
+
+const (
+	// LevelQuiet only prints the prompts and the errors.
+	LevelQuiet Level = -1
+	// LevelInfo also prints the progress. This is the default.
+	LevelInfo Level = 0
+	// LevelVerbose also prints the diagnostic logs.
+	LevelVerbose Level = 1
+	// LevelDebug also traces the HTTP requests and the commands run, with
+	// their output.
+	LevelDebug Level = 2
+)
+
+var level = LevelInfo
+
+// SetLevel sets the verbosity for the img package and the log package.
+//
+// It must be called before any other function in this package.
+func SetLevel(l Level) {
+	level = l
+	if l >= LevelVerbose {
+		log.SetOutput(os.Stderr)
+	} else {
+		log.SetOutput(io.Discard)
+	}
+}
+
+// LevelFromFlags returns the Level to use for the -q, -v and -vv flags.
+func LevelFromFlags(quiet, verbose, debug bool) (Level, error) {
+	switch {
+	case quiet && (verbose || debug):
+		return LevelInfo, errors.New("-q is mutually exclusive with -v and -vv")
+	case quiet:
+		return LevelQuiet, nil
+	case debug:
+		return LevelDebug, nil
+	case verbose:
+		return LevelVerbose, nil
+	default:
+		return LevelInfo, nil
+	}
+}
+
+// Progressf prints progress on stdout, unless the level is LevelQuiet.
+func Progressf(format string, a ...any) {
+	if level > LevelQuiet {
+		fmt.Printf(format, a...)
+	}
+}
+
+// debugf logs at LevelDebug.
+func debugf(format string, a ...any) {
+	if level >= LevelDebug {
+		log.Printf(format, a...)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// A regular file can be used instead of a SDCard, which is useful to test the
+// whole pipeline without hardware. Flash writes the image to the file and
+// Mount attaches it as a loop device (Linux) or a disk image (macOS).
+
+// loopDevices maps the regular files attached by Mount to their device.
+var (
+	loopMu      sync.Mutex
+	loopDevices = map[string]string{}
+)
+
+// isRegularFile returns true if disk is a regular file instead of a device.
+func isRegularFile(disk string) bool {
+	fi, err := os.Stat(disk)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// flashFile writes imgPath to the regular file dst.
+//
+// The block map is ignored since the whole file is rewritten anyway.
+func flashFile(imgPath, dst string) error {
+	Progressf("- Writing %s to the file %s\n", imgPath, dst)
+	/* #nosec G304 */
+	src, err := os.Open(imgPath)
+	if err != nil {
+		return err
+	}
+	/* #nosec G307 */
+	defer src.Close()
+	return writeFile(dst, src)
+}
+
+// writeFile overwrites the regular file dst with the content of r.
+func writeFile(dst string, r io.Reader) error {
+	/* #nosec G304 */
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// attachLoop attaches the regular file p as a block device and returns the
+// device path.
+func attachLoop(p string, o *Options) (string, error) {
+	loopMu.Lock()
+	defer loopMu.Unlock()
+	if d := loopDevices[p]; d != "" {
+		return d, nil
+	}
+	var d string
+	switch runtime.GOOS {
+	case "darwin":
+		log.Printf("- Attaching %s", p)
+		out, err := capture(o, "", "hdiutil", "attach", "-imagekey", "diskimage-class=CRawDiskImage", "-nomount", p)
+		if err != nil {
+			return "", fmt.Errorf("failed to attach %s: %w", p, err)
+		}
+		if d = hdiutilAttach(out); d == "" {
+			return "", fmt.Errorf("failed to attach %s: %q", p, out)
+		}
+	case "linux":
+		log.Printf("- Setting up a loop device for %s", p)
+		b, exe, err := linuxBackend(o)
+		if err != nil {
+			return "", err
+		}
+		var out string
+		if b == MountUdisks {
+			out, err = capture(o, "", exe, "loop-setup", "-f", p)
+			d = udisksctlLoopSetup(out)
+		} else {
+			out, err = capture(o, "", "sudo", "losetup", "--find", "--show", "--partscan", p)
+			d = strings.TrimSpace(out)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to set up a loop device for %s: %w", p, err)
+		}
+		if !strings.HasPrefix(d, "/dev/loop") {
+			return "", fmt.Errorf("failed to set up a loop device for %s: %q", p, out)
+		}
+	default:
+		return "", fmt.Errorf("attaching a file: %w", ErrUnsupportedOS)
+	}
+	log.Printf("  Attached as %s", d)
+	loopDevices[p] = d
+	return d, nil
+}
+
+// detachLoop unmounts and detaches the device attached for the regular file p,
+// if any.
+func detachLoop(p string, o *Options) error {
+	loopMu.Lock()
+	defer loopMu.Unlock()
+	d := loopDevices[p]
+	if d == "" {
+		return nil
+	}
+	if err := Umount(d, o); err != nil {
+		return err
+	}
+	var err error
+	switch runtime.GOOS {
+	case "darwin":
+		_, err = capture(o, "", "hdiutil", "detach", d)
+	case "linux":
+		var b MountBackend
+		var exe string
+		if b, exe, err = linuxBackend(o); err == nil {
+			if b == MountUdisks {
+				_, err = capture(o, "", exe, "loop-delete", "-b", d)
+			} else {
+				_, err = capture(o, "", "sudo", "losetup", "-d", d)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to detach %s: %w", d, err)
+	}
+	delete(loopDevices, p)
+	return nil
+}
+
+// mountFile attaches the regular file p then mounts its partition number n.
+func mountFile(ctx context.Context, p string, n int, o *Options) (string, error) {
+	d, err := attachLoop(p, o)
+	if err != nil {
+		return "", err
+	}
+	if err = WaitForPartition(ctx, d, n, o.partitionTimeout()); err != nil {
+		return "", err
+	}
+	return Mount(ctx, d, n, o)
+}
+
+var reLoopSetup = regexp.MustCompile(`as (/dev/loop\d+)\.?`)
+
+// udisksctlLoopSetup parses the output of "udisksctl loop-setup".
+func udisksctlLoopSetup(out string) string {
+	if m := reLoopSetup.FindStringSubmatch(out); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// hdiutilAttach parses the output of "hdiutil attach -nomount", where the
+// first field of the first line is the whole disk.
+func hdiutilAttach(out string) string {
+	if f := strings.Fields(out); len(f) != 0 && strings.HasPrefix(f[0], "/dev/disk") {
+		return f[0]
+	}
+	return ""
+}
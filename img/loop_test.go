@@ -0,0 +1,86 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFlashFile(t *testing.T) {
+	d := t.TempDir()
+	src := filepath.Join(d, "src.img")
+	dst := filepath.Join(d, "dst.img")
+	data := bytes.Repeat([]byte("periph"), 1000)
+	if err := os.WriteFile(src, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// The previous content is longer and must be truncated.
+	if err := os.WriteFile(dst, make([]byte, 2*len(data)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !isRegularFile(dst) || isRegularFile(d) {
+		t.Fatal("isRegularFile")
+	}
+	if err := Flash(context.Background(), src, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("content mismatch")
+	}
+	// Nothing was attached.
+	if err = Umount(dst, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlashStream(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "dst.img")
+	if err := os.WriteFile(dst, make([]byte, 4096), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := FlashStream(context.Background(), strings.NewReader("periph"), dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// printf periph | sha256sum
+	if sum != "bafe4dae1e49ce806e56b6ade7d6654da6c623a04bd4d79051cb5d4f34b73740" {
+		t.Fatal(sum)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "periph" {
+		t.Fatalf("%q", got)
+	}
+}
+
+func TestUdisksctlLoopSetup(t *testing.T) {
+	if d := udisksctlLoopSetup("Mapped file /tmp/a.img as /dev/loop12.\n"); d != "/dev/loop12" {
+		t.Fatal(d)
+	}
+	if d := udisksctlLoopSetup("Error setting up loop device"); d != "" {
+		t.Fatal(d)
+	}
+}
+
+func TestHdiutilAttach(t *testing.T) {
+	out := "/dev/disk4          \tFDisk_partition_scheme         \t\n/dev/disk4s1        \tWindows_FAT_32                 \t\n"
+	if d := hdiutilAttach(out); d != "/dev/disk4" {
+		t.Fatal(d)
+	}
+	if d := hdiutilAttach("hdiutil: attach failed"); d != "" {
+		t.Fatal(d)
+	}
+}
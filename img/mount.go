@@ -0,0 +1,333 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MountBackend is the tool used to mount partitions on Linux.
+type MountBackend string
+
+const (
+	// MountAuto selects the first backend available in the order udisks,
+	// pmount then sudo.
+	MountAuto MountBackend = ""
+	// MountUdisks uses udisksctl from UDisks2, as found on most desktop
+	// distros.
+	MountUdisks MountBackend = "udisks"
+	// MountPmount uses pmount and pumount, which mount removable devices in
+	// /media without root.
+	MountPmount MountBackend = "pmount"
+	// MountSudo uses mount and umount with sudo on a temporary directory.
+	MountSudo MountBackend = "sudo"
+)
+
+var mountBackends = []MountBackend{MountUdisks, MountPmount, MountSudo}
+
+func (m *MountBackend) String() string {
+	return string(*m)
+}
+
+// Set implements flag.Value.
+func (m *MountBackend) Set(s string) error {
+	if s == "auto" {
+		*m = MountAuto
+		return nil
+	}
+	for _, e := range mountBackends {
+		if s == string(e) {
+			*m = e
+			return nil
+		}
+	}
+	return errors.New("unsupported mount backend")
+}
+
+// MountBackendHelp generates the help for MountBackend.
+func MountBackendHelp() string {
+	names := make([]string, len(mountBackends))
+	for i, e := range mountBackends {
+		names[i] = string(e)
+	}
+	return fmt.Sprintf("Linux mount backend: %s; defaults to the first one available", strings.Join(names, ", "))
+}
+
+// linuxBackend returns the backend to use and the path to its executable.
+func linuxBackend(o *Options) (MountBackend, string, error) {
+	exes := map[MountBackend]string{MountUdisks: "udisksctl", MountPmount: "pmount", MountSudo: "mount"}
+	if m := o.linuxMount(); m != MountAuto {
+		exe, err := exec.LookPath(exes[m])
+		if err != nil {
+			return m, "", fmt.Errorf("mount backend %s: %w", m, err)
+		}
+		return m, exe, nil
+	}
+	for _, b := range mountBackends {
+		if exe, err := exec.LookPath(exes[b]); err == nil {
+			return b, exe, nil
+		}
+	}
+	return MountAuto, "", errors.New("please install package udisks2 to get udisksctl, or pmount")
+}
+
+// sudoMounts are the temporary directories created by mountLinux with
+// MountSudo, keyed by partition.
+var (
+	sudoMountsMu sync.Mutex
+	sudoMounts   = map[string]string{}
+)
+
+// mountLinux mounts the partition part and returns the mount path.
+func mountLinux(ctx context.Context, part string, o *Options) (string, error) {
+	b, exe, err := linuxBackend(o)
+	if err != nil {
+		return "", err
+	}
+	if b == MountPmount && strings.HasPrefix(part, "/dev/loop") {
+		// pmount refuses devices that are not removable.
+		b, exe = MountSudo, "mount"
+	}
+	switch b {
+	case MountUdisks:
+		txt, _ := captureOp(ctx, o, "", exe, "mount", "-b", part)
+		if dst := udisksctlMount(txt); dst != "" {
+			return dst, nil
+		}
+		return "", fmt.Errorf("failed to mount %q: %q", part, txt)
+	case MountPmount:
+		if _, err = captureOp(ctx, o, "", exe, part); err != nil {
+			return "", fmt.Errorf("failed to mount %q: %w", part, err)
+		}
+		// pmount uses the device name as the mount point by default.
+		return "/media/" + filepath.Base(part), nil
+	default:
+		dir, err := os.MkdirTemp("", "efe-mnt-")
+		if err != nil {
+			return "", err
+		}
+		// Make the files writable by the current user on FAT. The option is
+		// invalid for other file systems, so retry without.
+		opts := "uid=" + strconv.Itoa(os.Getuid()) + ",gid=" + strconv.Itoa(os.Getgid())
+		if _, err = captureOp(ctx, o, "", "sudo", exe, "-o", opts, part, dir); err != nil {
+			_, err = captureOp(ctx, o, "", "sudo", exe, part, dir)
+		}
+		if err != nil {
+			_ = os.Remove(dir)
+			return "", fmt.Errorf("failed to mount %q: %w", part, err)
+		}
+		sudoMountsMu.Lock()
+		sudoMounts[part] = dir
+		sudoMountsMu.Unlock()
+		return dir, nil
+	}
+}
+
+// umountLinux unmounts the partition part, if mounted.
+func umountLinux(part string, o *Options) error {
+	b, exe, err := linuxBackend(o)
+	if err != nil {
+		return err
+	}
+	if b == MountUdisks {
+		// udisksctl tells if it was mounted.
+		log.Printf("- Unmounting %s", part)
+		_, err = capture(o, "", exe, "unmount", "-f", "-b", part)
+		return err
+	}
+	if !isMountedLinux(part) {
+		return nil
+	}
+	log.Printf("- Unmounting %s", part)
+	sudoMountsMu.Lock()
+	dir := sudoMounts[part]
+	sudoMountsMu.Unlock()
+	if b == MountPmount && dir == "" {
+		_, err = capture(o, "", "pumount", part)
+	} else {
+		_, err = capture(o, "", "sudo", "umount", part)
+	}
+	if err != nil || dir == "" {
+		return err
+	}
+	sudoMountsMu.Lock()
+	delete(sudoMounts, part)
+	sudoMountsMu.Unlock()
+	return os.Remove(dir)
+}
+
+// ejectLinux powers off disk.
+func ejectLinux(disk string, o *Options) error {
+	b, exe, err := linuxBackend(o)
+	if err != nil {
+		return err
+	}
+	switch b {
+	case MountUdisks:
+		_, err = capture(o, "", exe, "power-off", "-b", disk)
+	case MountPmount:
+		_, err = capture(o, "", "eject", disk)
+	default:
+		_, err = capture(o, "", "sudo", "eject", disk)
+	}
+	return err
+}
+
+// UnmountAll unmounts every mount point backed by disk or one of its
+// partitions.
+//
+// Unlike Umount, it also unmounts the bind mounts and the partitions mounted
+// multiple times on Linux. On other OSes it is the same as Umount.
+func UnmountAll(disk string, o *Options) error {
+	if err := Umount(disk, o); err != nil {
+		return err
+	}
+	if runtime.GOOS != "linux" || isRegularFile(disk) {
+		return nil
+	}
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return err
+	}
+	mnts := mountPoints(f, disk)
+	_ = f.Close()
+	for _, m := range mnts {
+		log.Printf("- Unmounting %s", m)
+		if _, err = capture(o, "", "sudo", "umount", m); err != nil {
+			return fmt.Errorf("failed to unmount %s: %w", m, err)
+		}
+	}
+	return nil
+}
+
+// EditBootPartition mounts the partition number n (1 based) of disk, calls fn
+// with the path it is mounted at, then unmounts it.
+//
+// It is meant to tweak the boot partition of a SDCard already flashed, e.g.
+// to add or edit configuration files, without flashing it again. The
+// partition is unmounted even if fn fails. The partition is registered as
+// /boot in o.Written, if set.
+func EditBootPartition(ctx context.Context, disk string, n int, fn func(dir string) error, o *Options) error {
+	// Unmount then remount to ensure we get the path.
+	if err := Umount(disk, o); err != nil {
+		return err
+	}
+	dir, err := Mount(ctx, disk, n, o)
+	if err != nil {
+		return err
+	}
+	if dir == "" {
+		return fmt.Errorf("failed to mount partition #%d of %s", n, disk)
+	}
+	log.Printf("  partition #%d of %s mounted as %s", n, disk, dir)
+	o.written().Mounted(disk, dir, "/boot")
+	err = fn(dir)
+	if err2 := Umount(disk, o); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// mountPoints returns the mount points in the mount table r, in the
+// /proc/mounts format, backed by disk or one of its partitions.
+//
+// The nested mount points are returned first so they can be unmounted in
+// order.
+func mountPoints(r io.Reader, disk string) []string {
+	var out []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) < 2 || !strings.HasPrefix(f[0], "/dev/") {
+			continue
+		}
+		if f[0] == disk || partitionNumber(filepath.Base(disk), filepath.Base(f[0])) != 0 {
+			out = append(out, unescapeMount(f[1]))
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return strings.Count(out[i], "/") > strings.Count(out[j], "/")
+	})
+	return out
+}
+
+// unescapeMount decodes the octal escapes used in /proc/mounts for spaces,
+// tabs, new lines and backslashes.
+func unescapeMount(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// automountRule returns the udev rule that prevents UDisks2 from automounting
+// disk and its partitions.
+func automountRule(disk string) string {
+	return fmt.Sprintf("# Generated by https://github.com/periph/bootstrap\nKERNEL==\"%s*\", ENV{UDISKS_AUTO}=\"0\"\n", filepath.Base(disk))
+}
+
+// inhibitAutomount installs a temporary udev rule so the partitions that
+// show up while disk is being flashed are not automounted. The returned
+// function removes the rule.
+func inhibitAutomount(disk string, o *Options) (func(), error) {
+	p := "/run/udev/rules.d/99-efe-" + filepath.Base(disk) + ".rules"
+	log.Printf("- Writing %s", p)
+	if _, err := capture(o, "", "sudo", "mkdir", "-p", filepath.Dir(p)); err != nil {
+		return nil, err
+	}
+	if _, err := capture(o, automountRule(disk), "sudo", "tee", p); err != nil {
+		return nil, err
+	}
+	_, _ = capture(o, "", "sudo", "udevadm", "control", "--reload")
+	return func() {
+		log.Printf("- Removing %s", p)
+		_, _ = capture(o, "", "sudo", "rm", "-f", p)
+		_, _ = capture(o, "", "sudo", "udevadm", "control", "--reload")
+	}, nil
+}
+
+// isMountedLinux returns true if the device is listed in /proc/mounts.
+func isMountedLinux(dev string) bool {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return false
+	}
+	/* #nosec G307 */
+	defer f.Close()
+	return isMounted(f, dev)
+}
+
+// isMounted returns true if dev is in the mount table r, in the /proc/mounts
+// format.
+func isMounted(r io.Reader, dev string) bool {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if f := strings.Fields(s.Text()); len(f) != 0 && f[0] == dev {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMountBackendSet(t *testing.T) {
+	var m MountBackend
+	for _, s := range []string{"udisks", "pmount", "sudo"} {
+		if err := m.Set(s); err != nil || m.String() != s {
+			t.Fatal(s, err)
+		}
+	}
+	if err := m.Set("auto"); err != nil || m != MountAuto {
+		t.Fatal(m, err)
+	}
+	if err := m.Set("fuse"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestIsMounted(t *testing.T) {
+	mounts := "/dev/sda2 / ext4 rw,relatime 0 0\n" +
+		"proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0\n" +
+		"/dev/sdb1 /media/sdb1 vfat rw,nosuid,nodev 0 0\n"
+	data := []struct {
+		dev      string
+		expected bool
+	}{
+		{"/dev/sdb1", true},
+		{"/dev/sda2", true},
+		{"/dev/sdb2", false},
+		{"/dev/sdb", false},
+	}
+	for i, l := range data {
+		if got := isMounted(strings.NewReader(mounts), l.dev); got != l.expected {
+			t.Fatalf("%d: %t != %t", i, got, l.expected)
+		}
+	}
+}
+
+func TestMountPoints(t *testing.T) {
+	mounts := "/dev/sda2 / ext4 rw,relatime 0 0\n" +
+		"/dev/sdb1 /media/user/boot vfat rw,nosuid,nodev 0 0\n" +
+		"/dev/sdb2 /media/user/root\\040fs ext4 rw,nosuid,nodev 0 0\n" +
+		"/dev/sdb1 /media/user/root\\040fs/boot vfat rw,nosuid,nodev 0 0\n" +
+		"/dev/sdb10 /mnt ext4 rw 0 0\n" +
+		"/dev/sdbb1 /mnt/other ext4 rw 0 0\n" +
+		"tmpfs /run tmpfs rw 0 0\n"
+	got := strings.Join(mountPoints(strings.NewReader(mounts), "/dev/sdb"), "|")
+	want := "/media/user/root fs/boot|/media/user/boot|/media/user/root fs|/mnt"
+	if got != want {
+		t.Fatalf("%q != %q", got, want)
+	}
+	got = strings.Join(mountPoints(strings.NewReader("/dev/mmcblk0p1 /boot vfat rw 0 0\n"), "/dev/mmcblk0"), "|")
+	if got != "/boot" {
+		t.Fatal(got)
+	}
+}
+
+func TestAutomountRule(t *testing.T) {
+	if got := automountRule("/dev/sdb"); !strings.Contains(got, "KERNEL==\"sdb*\", ENV{UDISKS_AUTO}=\"0\"\n") {
+		t.Fatal(got)
+	}
+}
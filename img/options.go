@@ -0,0 +1,221 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+const (
+	// DefaultPartitionTimeout is the default of Options.PartitionTimeout.
+	DefaultPartitionTimeout = 30 * time.Second
+	// DefaultMountRetries is the default of Options.MountRetries.
+	DefaultMountRetries = 2
+	// DefaultLatestTTL is the default of Options.LatestTTL.
+	DefaultLatestTTL = 24 * time.Hour
+)
+
+// Options tunes the operations of this package, i.e. fetching, flashing and
+// mounting.
+//
+// The zero value and a nil *Options use the defaults. An Options must not be
+// modified while an operation using it is running; it can be shared by
+// concurrent operations.
+type Options struct {
+	// Offline disables all outbound network requests.
+	//
+	// GetCountry returns an empty string, GetSetupSH uses the local or embedded
+	// copy and Fetch fails with ErrOffline; use LocalImage instead.
+	Offline bool
+	// ForceRefresh disables reusing an image already fetched or decompressed in
+	// the current directory by Fetch and LocalImage. The file is deleted and
+	// fetched or decompressed again.
+	ForceRefresh bool
+	// VerifySignature is true to verify the OpenPGP signature of the images
+	// downloaded by Fetch and refuse to use an image that fails verification.
+	//
+	// Only Raspberry Pi OS images are signed. The signature is checked with
+	// gpgv from GnuPG against the keys added with AddSigningKey; no key is
+	// trusted by default. A cached image is reused only if it was verified
+	// against the same signature when it was downloaded.
+	VerifySignature bool
+	// Proxy is the proxy used for all the fetches.
+	//
+	// When nil, the proxy is selected by the standard environment variables
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY, as documented at
+	// https://pkg.go.dev/golang.org/x/net/http/httpproxy#FromEnvironment.
+	Proxy *url.URL
+	// TraceHTTP logs each HTTP request done by the fetches to stderr,
+	// regardless of the Level.
+	//
+	// Each hop of a redirect chain is logged separately with its status and the
+	// redirect target, along with the connection details and the number of
+	// bytes read. It is meant to diagnose mirror and CDN issues.
+	TraceHTTP bool
+	// LatestTTL is how long the latest RaspiOS image found is remembered. While
+	// it is and the image is present in the current directory, the lookup is
+	// skipped so repeated runs don't need the network. ForceRefresh ignores it.
+	//
+	// 0 uses DefaultLatestTTL and a negative value disables it.
+	LatestTTL time.Duration
+
+	// NoSudo disables running commands with sudo, for unattended use where a
+	// password prompt would hang.
+	//
+	// When running as root, the commands are run directly instead. Otherwise
+	// the operations needing elevated privileges fail with ErrSudoRequired.
+	NoSudo bool
+	// AllowSystemDisk disables the check in Flash that refuses to overwrite the
+	// disk containing the running OS.
+	//
+	// Only set it if you really know what you are doing.
+	AllowSystemDisk bool
+	// FlashBlockSize is the size of the writes when flashing, in bytes. It is
+	// the dd bs= value on Linux and macOS and the buffer size on Windows.
+	//
+	// 0 uses the default, 4MiB for dd and 64KiB on Windows. Larger values may
+	// improve the throughput on fast readers, smaller ones may be more reliable
+	// on flaky readers. It must be a multiple of the sector size; use
+	// ParseBlockSize.
+	FlashBlockSize int64
+	// NoDDProgress stops dd from printing its progress while flashing.
+	//
+	// Set it when flashing multiple SDCards concurrently, since the progress of
+	// each dd would overwrite the others on the terminal.
+	NoDDProgress bool
+	// PartitionTimeout is how long to wait for the partitions of a freshly
+	// flashed or repartitioned disk to show up. Increase it for slow card
+	// readers or USB hubs.
+	//
+	// 0 uses DefaultPartitionTimeout.
+	PartitionTimeout time.Duration
+
+	// MountRetries is the number of times Mount retries mounting a partition on
+	// Linux, waiting a second in between, as it fails while the partition is
+	// still being probed.
+	//
+	// 0 uses DefaultMountRetries and a negative value disables the retries.
+	MountRetries int
+	// LinuxMount is the backend Mount, Umount and Eject use on Linux.
+	LinuxMount MountBackend
+	// NoAutomount tells the desktop automounter to leave the disk alone while
+	// it is being flashed. Only implemented on Linux, with UDisks2.
+	NoAutomount bool
+	// DriveLetter makes Mount assign a free DOS drive letter to the partition
+	// on Windows and return it, e.g. "E:\\", instead of the volume path. The
+	// drive letter is removed by Umount.
+	DriveLetter bool
+
+	// Written records the files written to the partitions by EditBootPartition
+	// and EditRcLocal, when set.
+	Written *WriteLog
+}
+
+func (o *Options) offline() bool {
+	return o != nil && o.Offline
+}
+
+func (o *Options) forceRefresh() bool {
+	return o != nil && o.ForceRefresh
+}
+
+func (o *Options) verifySignature() bool {
+	return o != nil && o.VerifySignature
+}
+
+func (o *Options) proxy() *url.URL {
+	if o == nil {
+		return nil
+	}
+	return o.Proxy
+}
+
+func (o *Options) traceHTTP() bool {
+	return o != nil && o.TraceHTTP
+}
+
+func (o *Options) latestTTL() time.Duration {
+	if o == nil || o.LatestTTL == 0 {
+		return DefaultLatestTTL
+	}
+	return o.LatestTTL
+}
+
+func (o *Options) noSudo() bool {
+	return o != nil && o.NoSudo
+}
+
+func (o *Options) allowSystemDisk() bool {
+	return o != nil && o.AllowSystemDisk
+}
+
+// blockSize returns the dd bs= value to flash with.
+func (o *Options) blockSize() int64 {
+	if o == nil || o.FlashBlockSize == 0 {
+		return 4 * 1024 * 1024
+	}
+	return o.FlashBlockSize
+}
+
+func (o *Options) ddProgress() bool {
+	return o == nil || !o.NoDDProgress
+}
+
+func (o *Options) partitionTimeout() time.Duration {
+	if o == nil || o.PartitionTimeout <= 0 {
+		return DefaultPartitionTimeout
+	}
+	return o.PartitionTimeout
+}
+
+func (o *Options) mountRetries() int {
+	if o == nil || o.MountRetries == 0 {
+		return DefaultMountRetries
+	}
+	if o.MountRetries < 0 {
+		return 0
+	}
+	return o.MountRetries
+}
+
+func (o *Options) linuxMount() MountBackend {
+	if o == nil {
+		return MountAuto
+	}
+	return o.LinuxMount
+}
+
+func (o *Options) noAutomount() bool {
+	return o != nil && o.NoAutomount
+}
+
+func (o *Options) driveLetter() bool {
+	return o != nil && o.DriveLetter
+}
+
+// written returns the WriteLog to record to, which may be nil.
+func (o *Options) written() *WriteLog {
+	if o == nil {
+		return nil
+	}
+	return o.Written
+}
+
+// optionsKey is the context key of the Options of an HTTP request.
+type optionsKey struct{}
+
+// withOptions returns ctx carrying o, so the HTTP transport shared by all the
+// fetches can honor Proxy and TraceHTTP.
+func withOptions(ctx context.Context, o *Options) context.Context {
+	return context.WithValue(ctx, optionsKey{}, o)
+}
+
+// optionsFrom returns the Options carried by ctx, or nil.
+func optionsFrom(ctx context.Context) *Options {
+	o, _ := ctx.Value(optionsKey{}).(*Options)
+	return o
+}
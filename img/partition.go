@@ -0,0 +1,356 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rekby/mbr"
+)
+
+// Partition is a partition in a disk image.
+type Partition struct {
+	// Offset is the start of the partition in bytes from the start of the
+	// disk.
+	Offset int64
+	// Size is the size of the partition in bytes. It is 0 for an unused
+	// entry.
+	Size int64
+}
+
+// ReadPartitions returns the partitions described by the MBR or GPT partition
+// table of a disk image.
+//
+// Partition n (1 based) is at index n-1. Unused entries have a Size of 0 and
+// trailing unused entries are trimmed. Assumes sectors of SectorSize bytes.
+func ReadPartitions(r io.ReaderAt) ([]Partition, error) {
+	h := make([]byte, 512)
+	if _, err := r.ReadAt(h, 0); err != nil {
+		return nil, fmt.Errorf("failed to read MBR: %w", err)
+	}
+	m, err := mbr.Read(bytes.NewReader(h))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read MBR: %w", err)
+	}
+	// The values are in sectors of SectorSize bytes.
+	var out []Partition
+	if m.IsGPT() {
+		if out, err = readGPT(r); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, p := range m.GetAllPartitions() {
+			if p.IsEmpty() {
+				out = append(out, Partition{})
+			} else {
+				out = append(out, Partition{int64(p.GetLBAStart()) * SectorSize, int64(p.GetLBALen()) * SectorSize})
+			}
+		}
+	}
+	for len(out) != 0 && out[len(out)-1].Size == 0 {
+		out = out[:len(out)-1]
+	}
+	return out, nil
+}
+
+// IsGPT returns true if the disk image has a GPT partition table rather than
+// a MBR one.
+func IsGPT(r io.ReaderAt) (bool, error) {
+	h := make([]byte, 512)
+	if _, err := r.ReadAt(h, 0); err != nil {
+		return false, fmt.Errorf("failed to read MBR: %w", err)
+	}
+	m, err := mbr.Read(bytes.NewReader(h))
+	if err != nil {
+		return false, fmt.Errorf("failed to read MBR: %w", err)
+	}
+	return m.IsGPT(), nil
+}
+
+// SectorSize is the size in bytes of a sector in the partition tables read
+// by ReadPartitions.
+const SectorSize = 512
+
+// LBAStart returns the first sector of the partition.
+func (p *Partition) LBAStart() int64 {
+	return p.Offset / SectorSize
+}
+
+// LBALen returns the number of sectors of the partition.
+func (p *Partition) LBALen() int64 {
+	return p.Size / SectorSize
+}
+
+// Layout is the location of the boot and root partitions in a disk image.
+type Layout struct {
+	// SectorSize is the size in bytes of a sector.
+	SectorSize int64
+	// Boot is the FAT boot partition.
+	Boot Partition
+	// Root is the EXT4 root partition.
+	Root Partition
+}
+
+// Partitions returns the location of the boot and root partitions, given
+// their partition number (1 based), in a disk image with a MBR or GPT
+// partition table.
+//
+// A partition number of 0 is not looked up and is left zero in the Layout.
+func Partitions(r io.ReaderAt, boot, root int) (*Layout, error) {
+	parts, err := ReadPartitions(r)
+	if err != nil {
+		return nil, err
+	}
+	l := &Layout{SectorSize: SectorSize}
+	for _, p := range []struct {
+		name string
+		n    int
+		dst  *Partition
+	}{{"boot", boot, &l.Boot}, {"root", root, &l.Root}} {
+		if p.n == 0 {
+			continue
+		}
+		if p.n < 0 || len(parts) < p.n || parts[p.n-1].Size == 0 {
+			return nil, fmt.Errorf("%s partition #%d not found in the image", p.name, p.n)
+		}
+		*p.dst = parts[p.n-1]
+	}
+	return l, nil
+}
+
+// maxGPTEntries is the maximum size of the GPT partition entries array read.
+// The standard 128 entries of 128 bytes is 16KiB.
+const maxGPTEntries = 1024 * 1024
+
+// readGPT reads the partition entries of a GPT partition table.
+//
+// https://uefi.org/specs/UEFI/2.10/05_GUID_Partition_Table_Format.html
+func readGPT(r io.ReaderAt) ([]Partition, error) {
+	h := make([]byte, 92)
+	if _, err := r.ReadAt(h, SectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read GPT header: %w", err)
+	}
+	if string(h[:8]) != "EFI PART" {
+		return nil, errors.New("invalid GPT header signature")
+	}
+	lba := binary.LittleEndian.Uint64(h[72:])
+	num := binary.LittleEndian.Uint32(h[80:])
+	size := binary.LittleEndian.Uint32(h[84:])
+	// The entry size is 128×2^n; bound it and the table so a corrupt header
+	// can't cause a huge allocation.
+	if size < 128 || size > 4096 || size%8 != 0 || num > 1024 || int64(num)*int64(size) > maxGPTEntries {
+		return nil, fmt.Errorf("unexpected GPT entries: %d of %d bytes", num, size)
+	}
+	entries := make([]byte, int(num)*int(size))
+	/* #nosec G115 */
+	if _, err := r.ReadAt(entries, int64(lba)*SectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read GPT entries: %w", err)
+	}
+	out := make([]Partition, num)
+	for i := range out {
+		e := entries[i*int(size):]
+		if bytes.Equal(e[:16], make([]byte, 16)) {
+			// Unused entry.
+			continue
+		}
+		first := binary.LittleEndian.Uint64(e[32:])
+		last := binary.LittleEndian.Uint64(e[40:])
+		if last < first {
+			return nil, fmt.Errorf("invalid GPT entry #%d", i+1)
+		}
+		/* #nosec G115 */
+		out[i] = Partition{int64(first) * SectorSize, int64(last-first+1) * SectorSize}
+	}
+	return out, nil
+}
+
+// FAT variants returned by FATType.
+const (
+	FAT12 = "FAT12"
+	FAT16 = "FAT16"
+	FAT32 = "FAT32"
+)
+
+// FATType returns the FAT variant of the filesystem in the partition r.
+//
+// The variant is determined from the number of clusters as specified in
+// Microsoft's FAT specification, not from the informational label in the boot
+// sector. Returns an error describing the filesystem found when it is not FAT.
+func FATType(r io.ReaderAt) (string, error) {
+	p, err := readBPB(r)
+	if err != nil {
+		return "", err
+	}
+	switch p.bits {
+	case 12:
+		return FAT12, nil
+	case 16:
+		return FAT16, nil
+	default:
+		return FAT32, nil
+	}
+}
+
+// bpb is the geometry of a FAT filesystem, as read from the BIOS parameter
+// block in its boot sector. Sizes are in bytes.
+type bpb struct {
+	// bits is 12, 16 or 32.
+	bits        int
+	bytesPerSec int64
+	clusterSize int64
+	numFATs     int64
+	fatOff      int64
+	fatSize     int64
+	// rootOff and rootSize locate the fixed root directory of FAT12 and FAT16.
+	rootOff  int64
+	rootSize int64
+	dataOff  int64
+	clusters int64
+	// rootClus is the first cluster of the root directory of FAT32.
+	rootClus uint32
+	// fsInfo is the offset of the FSInfo sector of FAT32, 0 if none.
+	fsInfo int64
+}
+
+// readBPB reads and validates the boot sector of the FAT filesystem in r.
+func readBPB(r io.ReaderAt) (*bpb, error) {
+	b := make([]byte, 512)
+	if _, err := r.ReadAt(b, 0); err != nil {
+		return nil, fmt.Errorf("failed to read the boot sector: %w", err)
+	}
+	if string(b[3:11]) == "EXFAT   " {
+		return nil, errors.New("exFAT is not supported")
+	}
+	if b[510] != 0x55 || b[511] != 0xAA {
+		// The superblock of ext2/3/4 is at offset 1024, the magic at 56.
+		m := make([]byte, 2)
+		if _, err := r.ReadAt(m, 1024+56); err == nil && m[0] == 0x53 && m[1] == 0xEF {
+			return nil, errors.New("found an ext filesystem instead of FAT")
+		}
+		return nil, errors.New("not a FAT filesystem: invalid boot sector signature")
+	}
+	bytesPerSec := int64(binary.LittleEndian.Uint16(b[11:]))
+	secPerClus := int64(b[13])
+	rsvdSecCnt := int64(binary.LittleEndian.Uint16(b[14:]))
+	numFATs := int64(b[16])
+	rootEntCnt := int64(binary.LittleEndian.Uint16(b[17:]))
+	totSec := int64(binary.LittleEndian.Uint16(b[19:]))
+	fatSz := int64(binary.LittleEndian.Uint16(b[22:]))
+	if totSec == 0 {
+		totSec = int64(binary.LittleEndian.Uint32(b[32:]))
+	}
+	if fatSz == 0 {
+		fatSz = int64(binary.LittleEndian.Uint32(b[36:]))
+	}
+	if bytesPerSec < 512 || bytesPerSec&(bytesPerSec-1) != 0 || secPerClus == 0 || secPerClus&(secPerClus-1) != 0 || numFATs == 0 || fatSz == 0 {
+		return nil, errors.New("not a FAT filesystem: invalid BIOS parameter block")
+	}
+	rootDirSectors := (rootEntCnt*32 + bytesPerSec - 1) / bytesPerSec
+	dataSec := totSec - (rsvdSecCnt + numFATs*fatSz + rootDirSectors)
+	if dataSec <= 0 {
+		return nil, errors.New("not a FAT filesystem: invalid BIOS parameter block")
+	}
+	p := &bpb{
+		bytesPerSec: bytesPerSec,
+		clusterSize: secPerClus * bytesPerSec,
+		numFATs:     numFATs,
+		fatOff:      rsvdSecCnt * bytesPerSec,
+		fatSize:     fatSz * bytesPerSec,
+		clusters:    dataSec / secPerClus,
+	}
+	p.rootOff = p.fatOff + numFATs*p.fatSize
+	p.dataOff = p.rootOff + rootDirSectors*bytesPerSec
+	switch {
+	case p.clusters < 4085:
+		p.bits = 12
+	case p.clusters < 65525:
+		p.bits = 16
+	default:
+		p.bits = 32
+	}
+	if p.bits == 32 {
+		p.rootClus = binary.LittleEndian.Uint32(b[44:])
+		if s := int64(binary.LittleEndian.Uint16(b[48:])); s != 0 && s != 0xFFFF {
+			p.fsInfo = s * bytesPerSec
+		}
+	} else {
+		p.rootSize = rootEntCnt * 32
+	}
+	return p, nil
+}
+
+// EXT4 is the identification of an ext2/3/4 filesystem, as read from its
+// superblock by ReadEXT4.
+type EXT4 struct {
+	// Label is the volume name, e.g. "rootfs". It may be empty.
+	Label string
+	// UUID is the filesystem UUID formatted like in /etc/fstab, e.g.
+	// "3f2a4c1e-5b6d-4e7f-8a9b-0c1d2e3f4a5b".
+	UUID string
+}
+
+// ReadEXT4 reads the superblock of the ext2/3/4 filesystem in the partition
+// r.
+func ReadEXT4(r io.ReaderAt) (*EXT4, error) {
+	// The superblock is at offset 1024.
+	b := make([]byte, 136)
+	if _, err := r.ReadAt(b, 1024); err != nil {
+		return nil, fmt.Errorf("failed to read the superblock: %w", err)
+	}
+	if b[56] != 0x53 || b[57] != 0xEF {
+		return nil, errors.New("not an ext filesystem: invalid superblock magic")
+	}
+	u := b[104:120]
+	return &EXT4{
+		Label: string(bytes.TrimRight(b[120:136], "\x00")),
+		UUID:  fmt.Sprintf("%x-%x-%x-%x-%x", u[:4], u[4:6], u[6:8], u[8:10], u[10:]),
+	}, nil
+}
+
+// ParseFSSpec parses a filesystem specification in the /etc/fstab form
+// "LABEL=<label>" or "UUID=<uuid>" and returns the key and the value.
+func ParseFSSpec(s string) (string, string, error) {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || v == "" || (k != "LABEL" && k != "UUID") {
+		return "", "", fmt.Errorf("invalid filesystem %q; use LABEL=<label> or UUID=<uuid>", s)
+	}
+	return k, v, nil
+}
+
+// FindPartition returns the partition number (1 based) of the ext2/3/4
+// filesystem matching spec, as accepted by ParseFSSpec, in a disk image with a
+// MBR or GPT partition table.
+//
+// This is more robust than a partition number when the layout of the image
+// changes. The UUID is compared case insensitively.
+func FindPartition(r io.ReaderAt, spec string) (int, error) {
+	k, v, err := ParseFSSpec(spec)
+	if err != nil {
+		return 0, err
+	}
+	parts, err := ReadPartitions(r)
+	if err != nil {
+		return 0, err
+	}
+	for i, p := range parts {
+		if p.Size == 0 {
+			continue
+		}
+		e, err := ReadEXT4(io.NewSectionReader(r, p.Offset, p.Size))
+		if err != nil {
+			// Not an ext filesystem, e.g. the FAT boot partition.
+			continue
+		}
+		if (k == "LABEL" && e.Label == v) || (k == "UUID" && strings.EqualFold(e.UUID, v)) {
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("no ext filesystem with %s found in the image", spec)
+}
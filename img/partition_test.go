@@ -0,0 +1,230 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestReadPartitionsMBR(t *testing.T) {
+	b := make([]byte, 1024)
+	b[510] = 0x55
+	b[511] = 0xAA
+	// Partition 1 is FAT32 LBA, partition 2 is unused and partition 3 is linux.
+	for i, p := range [][3]uint32{{0x0c, 8192, 524288}, {}, {0x83, 532480, 3612672}} {
+		e := b[446+16*i:]
+		e[4] = byte(p[0])
+		binary.LittleEndian.PutUint32(e[8:], p[1])
+		binary.LittleEndian.PutUint32(e[12:], p[2])
+	}
+	got, err := ReadPartitions(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Partition{{8192 * 512, 524288 * 512}, {}, {532480 * 512, 3612672 * 512}}
+	if len(got) != len(expected) {
+		t.Fatalf("%#v", got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("%d: %#v", i, got[i])
+		}
+	}
+}
+
+func TestPartitions(t *testing.T) {
+	b := make([]byte, 1024)
+	b[510] = 0x55
+	b[511] = 0xAA
+	// Partition 1 is FAT32 LBA, partition 2 is unused and partition 3 is linux.
+	for i, p := range [][3]uint32{{0x0c, 8192, 524288}, {}, {0x83, 532480, 3612672}} {
+		e := b[446+16*i:]
+		e[4] = byte(p[0])
+		binary.LittleEndian.PutUint32(e[8:], p[1])
+		binary.LittleEndian.PutUint32(e[12:], p[2])
+	}
+	l, err := Partitions(bytes.NewReader(b), 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.SectorSize != 512 || l.Boot.LBAStart() != 8192 || l.Boot.LBALen() != 524288 || l.Root.LBAStart() != 532480 || l.Root.LBALen() != 3612672 {
+		t.Fatalf("%#v", l)
+	}
+	if l, err = Partitions(bytes.NewReader(b), 1, 0); err != nil || l.Root != (Partition{}) {
+		t.Fatalf("%#v, %v", l, err)
+	}
+	for i, p := range [][2]int{{1, 2}, {4, 3}, {-1, 3}} {
+		if _, err = Partitions(bytes.NewReader(b), p[0], p[1]); err == nil {
+			t.Fatalf("%d: expected error", i)
+		}
+	}
+	if _, err = Partitions(bytes.NewReader(b[:100]), 1, 3); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestReadPartitionsGPT(t *testing.T) {
+	b := make([]byte, 3*512+4*128)
+	// Protective MBR.
+	b[446+4] = 0xEE
+	binary.LittleEndian.PutUint32(b[446+8:], 1)
+	binary.LittleEndian.PutUint32(b[446+12:], 0xFFFFFFFF-1)
+	b[510] = 0x55
+	b[511] = 0xAA
+	// GPT header.
+	h := b[512:]
+	copy(h, "EFI PART")
+	binary.LittleEndian.PutUint64(h[72:], 2)
+	binary.LittleEndian.PutUint32(h[80:], 4)
+	binary.LittleEndian.PutUint32(h[84:], 128)
+	// Entries 1 and 2 are used.
+	for i, p := range [][2]uint64{{2048, 526335}, {526336, 4194270}} {
+		e := b[2*512+i*128:]
+		e[0] = byte(i + 1)
+		binary.LittleEndian.PutUint64(e[32:], p[0])
+		binary.LittleEndian.PutUint64(e[40:], p[1])
+	}
+	got, err := ReadPartitions(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Partition{{2048 * 512, 524288 * 512}, {526336 * 512, 3667935 * 512}}
+	if len(got) != len(expected) {
+		t.Fatalf("%#v", got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("%d: %#v", i, got[i])
+		}
+	}
+
+	// Corrupt entry sizes and counts are refused before allocating.
+	for i, l := range [][2]uint32{{4, 64}, {4, 8192}, {4, 132}, {1024, 4096}, {4096, 128}} {
+		binary.LittleEndian.PutUint32(h[80:], l[0])
+		binary.LittleEndian.PutUint32(h[84:], l[1])
+		if _, err = ReadPartitions(bytes.NewReader(b)); err == nil {
+			t.Fatalf("%d: expected error", i)
+		}
+	}
+
+	copy(h, "NOT PART")
+	if _, err = ReadPartitions(bytes.NewReader(b)); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestFATType(t *testing.T) {
+	bootSector := func(totSec uint32, secPerClus byte, rsvd, rootEnt uint16, fatSz uint32) []byte {
+		b := make([]byte, 2048)
+		binary.LittleEndian.PutUint16(b[11:], 512)
+		b[13] = secPerClus
+		binary.LittleEndian.PutUint16(b[14:], rsvd)
+		b[16] = 2
+		binary.LittleEndian.PutUint16(b[17:], rootEnt)
+		if totSec < 0x10000 {
+			binary.LittleEndian.PutUint16(b[19:], uint16(totSec))
+		} else {
+			binary.LittleEndian.PutUint32(b[32:], totSec)
+		}
+		if rootEnt != 0 {
+			binary.LittleEndian.PutUint16(b[22:], uint16(fatSz))
+		} else {
+			binary.LittleEndian.PutUint32(b[36:], fatSz)
+		}
+		b[510] = 0x55
+		b[511] = 0xAA
+		return b
+	}
+	data := []struct {
+		b        []byte
+		expected string
+	}{
+		// 1.44MB floppy.
+		{bootSector(2880, 1, 1, 224, 9), FAT12},
+		// 64MiB.
+		{bootSector(131072, 4, 4, 512, 128), FAT16},
+		// 256MiB, as on RaspiOS.
+		{bootSector(524288, 4, 32, 0, 1016), FAT32},
+	}
+	for i, l := range data {
+		got, err := FATType(bytes.NewReader(l.b))
+		if err != nil || got != l.expected {
+			t.Fatalf("%d: %q != %q; %v", i, got, l.expected, err)
+		}
+	}
+
+	ext := make([]byte, 2048)
+	ext[1024+56] = 0x53
+	ext[1024+57] = 0xEF
+	exfat := bootSector(524288, 4, 32, 0, 1016)
+	copy(exfat[3:], "EXFAT   ")
+	noFAT := bootSector(524288, 4, 32, 0, 0)
+	for i, b := range [][]byte{ext, exfat, noFAT, make([]byte, 2048), nil} {
+		if got, err := FATType(bytes.NewReader(b)); err == nil {
+			t.Fatalf("%d: expected error, got %q", i, got)
+		}
+	}
+}
+
+func TestFindPartition(t *testing.T) {
+	b := make([]byte, 16*512)
+	b[510] = 0x55
+	b[511] = 0xAA
+	// Partition 1 is not ext, partition 2 is ext4 with a label.
+	for i, p := range [][3]uint32{{0x0c, 2, 6}, {0x83, 8, 8}} {
+		e := b[446+16*i:]
+		e[4] = byte(p[0])
+		binary.LittleEndian.PutUint32(e[8:], p[1])
+		binary.LittleEndian.PutUint32(e[12:], p[2])
+	}
+	sb := b[8*512+1024:]
+	sb[56] = 0x53
+	sb[57] = 0xEF
+	copy(sb[104:], []byte{0x3f, 0x2a, 0x4c, 0x1e, 0x5b, 0x6d, 0x4e, 0x7f, 0x8a, 0x9b, 0x0c, 0x1d, 0x2e, 0x3f, 0x4a, 0x5b})
+	copy(sb[120:], "rootfs")
+
+	e, err := ReadEXT4(bytes.NewReader(b[8*512:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *e != (EXT4{Label: "rootfs", UUID: "3f2a4c1e-5b6d-4e7f-8a9b-0c1d2e3f4a5b"}) {
+		t.Fatalf("%#v", e)
+	}
+	if _, err = ReadEXT4(bytes.NewReader(b[2*512:])); err == nil {
+		t.Fatal("expected error")
+	}
+	for _, spec := range []string{"LABEL=rootfs", "UUID=3f2a4c1e-5b6d-4e7f-8a9b-0c1d2e3f4a5b", "UUID=3F2A4C1E-5B6D-4E7F-8A9B-0C1D2E3F4A5B"} {
+		if n, err := FindPartition(bytes.NewReader(b), spec); err != nil || n != 2 {
+			t.Fatalf("%s: %d, %v", spec, n, err)
+		}
+	}
+	for _, spec := range []string{"LABEL=boot", "UUID=", "PARTUUID=1234", "rootfs"} {
+		if _, err := FindPartition(bytes.NewReader(b), spec); err == nil {
+			t.Fatalf("%s: expected error", spec)
+		}
+	}
+}
+
+func TestIsGPT(t *testing.T) {
+	b := make([]byte, 512)
+	b[510], b[511] = 0x55, 0xAA
+	// A MBR with a single partition.
+	b[446+4] = 0x83
+	binary.LittleEndian.PutUint32(b[446+8:], 1)
+	binary.LittleEndian.PutUint32(b[446+12:], 1)
+	if gpt, err := IsGPT(bytes.NewReader(b)); err != nil || gpt {
+		t.Fatal(gpt, err)
+	}
+	// The protective MBR of a GPT.
+	b[446+4] = 0xEE
+	if gpt, err := IsGPT(bytes.NewReader(b)); err != nil || !gpt {
+		t.Fatal(gpt, err)
+	}
+	if _, err := IsGPT(bytes.NewReader(nil)); err == nil {
+		t.Fatal("expected error")
+	}
+}
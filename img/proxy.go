@@ -0,0 +1,52 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ParseProxy parses a proxy URL. A bare host:port is an HTTP proxy.
+func ParseProxy(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q; use http, https or socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %q has no host", s)
+	}
+	return u, nil
+}
+
+// httpClient is the client used for all the fetches.
+//
+// The Options of a request are carried by its context, see withOptions.
+var httpClient = &http.Client{Transport: newTransport()}
+
+func newTransport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = proxy
+	return &tracingTransport{rt: t}
+}
+
+// proxy returns the Options.Proxy of the request when set, otherwise the
+// proxy selected by the environment variables.
+func proxy(r *http.Request) (*url.URL, error) {
+	if u := optionsFrom(r.Context()).proxy(); u != nil {
+		return u, nil
+	}
+	return http.ProxyFromEnvironment(r)
+}
@@ -0,0 +1,158 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// oldRcLocal is the start of /etc/rc.local as found on Debian derived
+// distributions before Debian 10 and Ubuntu 18.04.
+//
+// The comments are essentially the free space available to edit the file
+// without having to understand EXT4. :)
+//
+// Newer distributions get a systemd unit instead.
+const oldRcLocal = "#!/bin/sh -e\n#\n# rc.local\n#\n# This script is executed at the end of each multiuser runlevel.\n# Make sure that the script will \"exit 0\" on success or any other\n# value on error.\n#\n# In order to enable or disable this script just change the execution\n# bits.\n#\n# By default this script does nothing.\n"
+
+// denseRcLocal is a 'dense' /etc/rc.local running /boot/firstboot.sh once,
+// with the arguments found in FirstBootArgs. The log path is substituted.
+const denseRcLocal = "#!/bin/sh -e\nL=%s;if [ ! -f $L ];then eval \"/boot/firstboot.sh $(cat /boot/" + FirstBootArgs + ")\" 2>&1|tee $L;fi\n#"
+
+// FirstBootArgs is the file in the boot partition with the arguments to pass
+// to /boot/firstboot.sh, quoted for a POSIX shell, as read by the
+// /etc/rc.local written by EditRcLocal.
+//
+// This keeps /etc/rc.local the same length whatever the arguments, and the
+// secrets passed as arguments off the root partition.
+const FirstBootArgs = "firstboot.args"
+
+// maxRcLocalScan is the maximum number of bytes at the start of the root
+// partition to scan for /etc/rc.local.
+//
+// The images that have the file are old Debian derived distributions with a
+// small root partition, where it is found well before this limit. This bounds
+// the time wasted on the images that don't have it, which is the case of
+// recent distros.
+const maxRcLocalScan = 256 * 1024 * 1024
+
+// rcLocalChunk is the size of each read while scanning for /etc/rc.local. It
+// is a multiple of the sector size.
+const rcLocalChunk = 1024 * 1024
+
+// errRcLocalNotFound is returned by findRcLocal when /etc/rc.local is not
+// found.
+var errRcLocalNotFound = errors.New("/etc/rc.local not found")
+
+// FindRcLocal returns the offset of an unedited /etc/rc.local in the root
+// partition number rootPart (1 based) of the image, relative to the start of
+// the partition.
+//
+// It returns false if the image has no /etc/rc.local. The offset is to be
+// passed to EditRcLocal, on the image or a copy of it, so it is not scanned
+// again.
+func FindRcLocal(imgPath string, rootPart int) (int64, bool, error) {
+	if rootPart < 1 {
+		return 0, false, fmt.Errorf("root partition #%d not found in the image", rootPart)
+	}
+	/* #nosec G304 */
+	f, err := os.Open(imgPath)
+	if err != nil {
+		return 0, false, err
+	}
+	/* #nosec G307 */
+	defer f.Close()
+	l, err := Partitions(f, 0, rootPart)
+	if err != nil {
+		return 0, false, err
+	}
+	offset, err := findRcLocal(NewFileDisk(f, l.Root.Offset, l.Root.Size), l.Root.Size)
+	if err == errRcLocalNotFound {
+		return 0, false, nil
+	}
+	return offset, err == nil, err
+}
+
+// EditRcLocal replaces /etc/rc.local at offset in the root partition number
+// rootPart (1 based) of the image f, as returned by FindRcLocal, to run
+// /boot/firstboot.sh on the first boot, with the arguments written in the boot
+// partition as FirstBootArgs, logging to logPath.
+//
+// The EXT4 file system is not parsed; the file was found by its content and is
+// overwritten in place. The edit is recorded in o.Written, if set.
+func EditRcLocal(f *os.File, rootPart int, offset int64, logPath string, o *Options) error {
+	// Both MBR and GPT partition tables are supported.
+	if rootPart < 1 {
+		return fmt.Errorf("root partition #%d not found in the image", rootPart)
+	}
+	// TODO(maruel): Keep everything before the "exit 0" before our injected
+	// lines.
+	content := fmt.Sprintf(denseRcLocal, logPath)
+	// The file size is not updated, so the content must fit in the original
+	// file. Since on Debian /etc/rc.local is mostly comments, it's large enough
+	// to be safely overwritten.
+	if len(content) > len(oldRcLocal) {
+		return fmt.Errorf("first boot log path %q is too long to fit in /etc/rc.local", logPath)
+	}
+	l, err := Partitions(f, 0, rootPart)
+	if err != nil {
+		return err
+	}
+	root := NewFileDisk(f, l.Root.Offset, l.Root.Size)
+	// Only the start of the comments is overwritten. The rest of the sector is
+	// written back as is: the end of the file, e.g. "exit 0", and whatever
+	// follows it. The trailing '#' of denseRcLocal comments out the remainder
+	// of the overwritten line.
+	buf := make([]byte, 512)
+	if _, err = root.ReadAt(buf, offset); err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(buf, []byte(oldRcLocal)) {
+		return fmt.Errorf("/etc/rc.local not found at offset %d of root partition #%d", offset, rootPart)
+	}
+	copy(buf, content)
+	log.Printf("Writing /etc/rc.local:\n%s", buf[:len(oldRcLocal)])
+	if _, err = root.WriteAt(buf, offset); err != nil {
+		return err
+	}
+	o.written().AddAt(f.Name(), "/etc/rc.local", int64(len(buf)), offset)
+	return nil
+}
+
+// findRcLocal returns the offset of /etc/rc.local in the root partition r of
+// size bytes.
+//
+// It looks for a sector starting with oldRcLocal in the first maxRcLocalScan
+// bytes, reading rcLocalChunk bytes at a time.
+func findRcLocal(r io.ReaderAt, size int64) (int64, error) {
+	if size > maxRcLocalScan {
+		size = maxRcLocalScan
+	}
+	// Only full sectors are scanned.
+	size -= size % 512
+	prefix := []byte(oldRcLocal)
+	buf := make([]byte, rcLocalChunk)
+	for offset := int64(0); offset < size; offset += int64(len(buf)) {
+		chunk := buf
+		if rem := size - offset; rem < int64(len(chunk)) {
+			chunk = chunk[:rem]
+		}
+		if _, err := r.ReadAt(chunk, offset); err != nil {
+			return 0, fmt.Errorf("failed to read at offset %d while seaching for /etc/rc.local: %w", offset, err)
+		}
+		for i := 0; i < len(chunk); i += 512 {
+			if bytes.HasPrefix(chunk[i:], prefix) {
+				log.Printf("found /etc/rc.local at offset %d", offset+int64(i))
+				return offset + int64(i), nil
+			}
+		}
+	}
+	return 0, errRcLocalNotFound
+}
@@ -0,0 +1,142 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFindRcLocal(t *testing.T) {
+	b := make([]byte, 4096)
+	if _, err := findRcLocal(bytes.NewReader(b), int64(len(b))); err != errRcLocalNotFound {
+		t.Fatal(err)
+	}
+	copy(b[1024:], oldRcLocal)
+	offset, err := findRcLocal(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 1024 {
+		t.Fatal(offset)
+	}
+	// Only full sectors are scanned.
+	if _, err := findRcLocal(bytes.NewReader(b), 1500); err != errRcLocalNotFound {
+		t.Fatal(err)
+	}
+}
+
+// sparseRcLocal is a partition of zeros with /etc/rc.local at offset.
+type sparseRcLocal struct {
+	offset int64
+	reads  int
+}
+
+func (s *sparseRcLocal) ReadAt(p []byte, off int64) (int, error) {
+	s.reads++
+	clear(p)
+	if d := s.offset - off; d >= 0 && d < int64(len(p)) {
+		copy(p[d:], oldRcLocal)
+	}
+	return len(p), nil
+}
+
+func TestFindRcLocal_Chunks(t *testing.T) {
+	data := []struct {
+		offset int64
+		size   int64
+		want   int64
+		reads  int
+	}{
+		{0, 4096, 0, 1},
+		// The last sector of the first chunk and the first one of the second.
+		{rcLocalChunk - 512, 4 * rcLocalChunk, rcLocalChunk - 512, 1},
+		{rcLocalChunk, 4 * rcLocalChunk, rcLocalChunk, 2},
+		// A partial last chunk.
+		{rcLocalChunk + 1024, rcLocalChunk + 1536, rcLocalChunk + 1024, 2},
+		{maxRcLocalScan - 512, 1 << 40, maxRcLocalScan - 512, maxRcLocalScan / rcLocalChunk},
+		// Past the scanned window.
+		{maxRcLocalScan, 1 << 40, -1, maxRcLocalScan / rcLocalChunk},
+		// Not aligned on a sector.
+		{1000, 4096, -1, 1},
+	}
+	for i, line := range data {
+		r := sparseRcLocal{offset: line.offset}
+		got, err := findRcLocal(&r, line.size)
+		if line.want < 0 {
+			if err != errRcLocalNotFound {
+				t.Fatalf("%d: %v", i, err)
+			}
+		} else if err != nil || got != line.want {
+			t.Fatalf("%d: %d, %v", i, got, err)
+		}
+		if r.reads != line.reads {
+			t.Fatalf("%d: %d reads, expected %d", i, r.reads, line.reads)
+		}
+	}
+}
+
+func TestEditRcLocal(t *testing.T) {
+	b := make([]byte, 64*512)
+	b[510] = 0x55
+	b[511] = 0xAA
+	// Partition 3 is at sector 16 for 16 sectors.
+	e := b[446+16*2:]
+	e[4] = 0x83
+	binary.LittleEndian.PutUint32(e[8:], 16)
+	binary.LittleEndian.PutUint32(e[12:], 16)
+	copy(b[20*512:], oldRcLocal+"\nexit 0\n")
+	// Data following the file in the same block.
+	copy(b[21*512-4:], "tail")
+	p := filepath.Join(t.TempDir(), "a.img")
+	if err := os.WriteFile(p, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	offset, found, err := FindRcLocal(p, 3)
+	if err != nil || !found || offset != 4*512 {
+		t.Fatal(offset, found, err)
+	}
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = EditRcLocal(f, 2, offset, "/var/log/firstboot.log", nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if err = EditRcLocal(f, 3, offset+512, "/var/log/firstboot.log", nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if err = EditRcLocal(f, 3, offset, "/var/log/"+strings.Repeat("a", 300), nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if err = EditRcLocal(f, 3, offset, "/var/log/firstboot.log", nil); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 512)
+	if _, err = f.ReadAt(got, 20*512); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(got, []byte("#!/bin/sh -e\nL=/var/log/firstboot.log;if [ ! -f $L ];then eval \"/boot/firstboot.sh $(cat /boot/firstboot.args)\" 2>&1|tee $L;fi\n#")) {
+		t.Fatalf("%q", got)
+	}
+	// The rest of the sector is preserved.
+	rest := got[len(oldRcLocal):]
+	if !bytes.HasPrefix(rest, []byte("\nexit 0\n")) || !bytes.HasSuffix(rest, []byte("tail")) {
+		t.Fatalf("%q", got)
+	}
+	// Once edited, the original /etc/rc.local is not found anymore.
+	if _, found, err = FindRcLocal(p, 3); err != nil || found {
+		t.Fatal(found, err)
+	}
+	// It is not overwritten twice.
+	if err = EditRcLocal(f, 3, offset, "/var/log/firstboot.log", nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrBadSignature is returned when the signature of an image doesn't verify
+// against the trusted signing keys.
+var ErrBadSignature = errors.New("image signature verification failed")
+
+var (
+	signingKeysMu sync.Mutex
+	// signingKeys is the binary OpenPGP keyring of the trusted keys.
+	signingKeys []byte
+)
+
+// AddSigningKey adds the OpenPGP public keys read from r, either armored or
+// binary, to the keys trusted to sign images.
+func AddSigningKey(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read signing key: %w", err)
+	}
+	if b, err = dearmor(b, "PGP PUBLIC KEY BLOCK"); err != nil {
+		return fmt.Errorf("failed to read signing key: %w", err)
+	}
+	// A keyring starts with a public key packet, tag 6, in either the new or
+	// the old packet format.
+	tag := -1
+	if len(b) != 0 {
+		switch {
+		case b[0]&0xC0 == 0xC0:
+			tag = int(b[0] & 0x3F)
+		case b[0]&0x80 != 0:
+			tag = int(b[0] >> 2 & 0xF)
+		}
+	}
+	if tag != 6 {
+		return errors.New("failed to read signing key: not an OpenPGP public key")
+	}
+	signingKeysMu.Lock()
+	signingKeys = append(signingKeys, b...)
+	signingKeysMu.Unlock()
+	return nil
+}
+
+// dearmor returns the content of the ASCII armored block typ in b, or b as is
+// if it is not armored.
+func dearmor(b []byte, typ string) ([]byte, error) {
+	begin := []byte("-----BEGIN " + typ + "-----")
+	i := bytes.Index(b, begin)
+	if i == -1 {
+		if bytes.HasPrefix(bytes.TrimSpace(b), []byte("-----BEGIN")) {
+			return nil, fmt.Errorf("expected an armored %s", typ)
+		}
+		return b, nil
+	}
+	s := bufio.NewScanner(bytes.NewReader(b[i+len(begin):]))
+	// Skip the end of the BEGIN line then the armor headers, up to the first
+	// empty line.
+	s.Scan()
+	inHeaders := true
+	var body strings.Builder
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		switch {
+		case inHeaders:
+			if l == "" {
+				inHeaders = false
+			} else if !strings.Contains(l, ": ") {
+				// No header at all.
+				inHeaders = false
+				body.WriteString(l)
+			}
+		case strings.HasPrefix(l, "-----END "+typ+"-----"):
+			out, err := base64.StdEncoding.DecodeString(body.String())
+			if err != nil {
+				return nil, fmt.Errorf("invalid armored %s: %w", typ, err)
+			}
+			return out, nil
+		case strings.HasPrefix(l, "="):
+			// The CRC24 checksum is optional and redundant with the packets'.
+		default:
+			body.WriteString(l)
+		}
+	}
+	return nil, fmt.Errorf("truncated armored %s", typ)
+}
+
+// trustedKeys returns the keyring of the keys added with AddSigningKey.
+func trustedKeys() ([]byte, error) {
+	signingKeysMu.Lock()
+	defer signingKeysMu.Unlock()
+	if len(signingKeys) == 0 {
+		return nil, errors.New("no trusted signing key; see AddSigningKey")
+	}
+	return append([]byte(nil), signingKeys...), nil
+}
+
+// signatureURL returns the URL of the detached signature of the image at u,
+// or an error if the image is not signed.
+func (i *Image) signatureURL(u string) (string, error) {
+	if i.custom() != nil || (i.Distro != RaspiOS && i.Distro != RaspiOS64) {
+		return "", fmt.Errorf("%s images are not signed, signature verification is only supported for %s and %s", i.Distro, RaspiOS, RaspiOS64)
+	}
+	return u + ".sig", nil
+}
+
+// verifiedPath returns the file recording that imgpath was decompressed from
+// an image verified against a signature.
+func verifiedPath(imgpath string) string {
+	return imgpath + ".verified"
+}
+
+// sigHash returns the hash of the signature sig as recorded next to a
+// verified image.
+func sigHash(sig []byte) string {
+	h := sha256.Sum256(sig)
+	return hex.EncodeToString(h[:])
+}
+
+// isVerified returns true if imgpath was decompressed from an image verified
+// against sig.
+func isVerified(imgpath string, sig []byte) bool {
+	/* #nosec G304 */
+	b, err := os.ReadFile(verifiedPath(imgpath))
+	return err == nil && strings.TrimSpace(string(b)) == sigHash(sig)
+}
+
+// markVerified records that imgpath was decompressed from an image verified
+// against sig.
+func markVerified(imgpath string, sig []byte) error {
+	return os.WriteFile(verifiedPath(imgpath), []byte(sigHash(sig)+"\n"), 0o644) /* #nosec G306 */
+}
+
+// signatureCheck verifies a detached signature over the data written to it
+// with gpgv.
+//
+// The verification runs concurrently so the image is hashed as it is
+// downloaded.
+type signatureCheck struct {
+	cmd *exec.Cmd
+	w   io.WriteCloser
+	dir string
+	out bytes.Buffer
+}
+
+func newSignatureCheck(sig []byte) (*signatureCheck, error) {
+	keys, err := trustedKeys()
+	if err != nil {
+		return nil, err
+	}
+	gpgv, err := exec.LookPath("gpgv")
+	if err != nil {
+		return nil, fmt.Errorf("verifying signatures requires gpgv from GnuPG: %w", err)
+	}
+	dir, err := os.MkdirTemp("", "efe-gpgv")
+	if err != nil {
+		return nil, err
+	}
+	c := &signatureCheck{dir: dir}
+	keyring := filepath.Join(dir, "keyring.gpg")
+	sigPath := filepath.Join(dir, "image.sig")
+	if err = os.WriteFile(keyring, keys, 0o600); err == nil {
+		err = os.WriteFile(sigPath, sig, 0o600)
+	}
+	if err != nil {
+		c.cleanup()
+		return nil, err
+	}
+	// "-" reads the signed data from stdin. gpgv doesn't use the user's
+	// keyrings, only the one specified.
+	/* #nosec G204 */
+	c.cmd = exec.Command(gpgv, "--homedir", dir, "--keyring", keyring, sigPath, "-")
+	c.cmd.Stdout = &c.out
+	c.cmd.Stderr = &c.out
+	if c.w, err = c.cmd.StdinPipe(); err == nil {
+		err = c.cmd.Start()
+	}
+	if err != nil {
+		c.cleanup()
+		return nil, err
+	}
+	return c, nil
+}
+
+// errGPGVExited is returned by signatureCheck.Write when gpgv exited early,
+// e.g. on an unknown key.
+var errGPGVExited = errors.New("gpgv exited early")
+
+func (c *signatureCheck) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		err = errGPGVExited
+	}
+	return n, err
+}
+
+// close signals the end of the data and returns the verification result.
+//
+// err is the error that interrupted the data, if any.
+func (c *signatureCheck) close(err error) error {
+	defer c.cleanup()
+	_ = c.w.Close()
+	err2 := c.cmd.Wait()
+	if err != nil && !errors.Is(err, errGPGVExited) {
+		return err
+	}
+	if err != nil || err2 != nil {
+		return fmt.Errorf("%w: %s", ErrBadSignature, strings.TrimSpace(c.out.String()))
+	}
+	log.Printf("%s", strings.TrimSpace(c.out.String()))
+	return nil
+}
+
+func (c *signatureCheck) cleanup() {
+	_ = os.RemoveAll(c.dir)
+}
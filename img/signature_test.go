@@ -0,0 +1,185 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+func TestFetchXZSignature(t *testing.T) {
+	trusted := newGPG(t, "periph")
+	other := newGPG(t, "other")
+	x := compressXZ(t, "periph")
+	tampered := compressXZ(t, "periph!")
+	old := signingKeys
+	defer func() { signingKeys = old }()
+	signingKeys = nil
+	if err := AddSigningKey(bytes.NewReader(trusted.run(t, nil, "--armor", "--export"))); err != nil {
+		t.Fatal(err)
+	}
+
+	good := trusted.run(t, x.Bytes(), "--detach-sign")
+	armored := trusted.run(t, x.Bytes(), "--armor", "--detach-sign")
+	bad := other.run(t, x.Bytes(), "--detach-sign")
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.img.xz":
+			_, _ = w.Write(x.Bytes())
+		case "/tampered.img.xz":
+			_, _ = w.Write(tampered.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+	imgpath := filepath.Join(t.TempDir(), "a.img")
+	data := []struct {
+		path string
+		sig  []byte
+		ok   bool
+	}{
+		{"/a.img.xz", good, true},
+		{"/a.img.xz", armored, true},
+		{"/a.img.xz", bad, false},
+		{"/tampered.img.xz", good, false},
+	}
+	for i, l := range data {
+		err := fetchXZ(context.Background(), s.URL+l.path, imgpath, l.sig, nil)
+		if l.ok {
+			if err != nil {
+				t.Fatalf("%d: %v", i, err)
+			}
+			if b, err := os.ReadFile(imgpath); err != nil || string(b) != "periph" {
+				t.Fatalf("%d: %q %v", i, b, err)
+			}
+			if !isVerified(imgpath, l.sig) || isVerified(imgpath, bad) {
+				t.Fatalf("%d: verification not recorded", i)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrBadSignature) {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if _, err = os.Stat(imgpath); !os.IsNotExist(err) {
+			t.Fatalf("%d: expected the image to be removed: %v", i, err)
+		}
+	}
+}
+
+func TestAddSigningKey(t *testing.T) {
+	old := signingKeys
+	defer func() { signingKeys = old }()
+	signingKeys = nil
+	if _, err := trustedKeys(); err == nil {
+		t.Fatal("expected error")
+	}
+	// A minimal public key packet, in the old and the new packet format.
+	for i, k := range [][]byte{{0x98, 0x01, 0x04}, {0xC6, 0x01, 0x04}} {
+		armored := "-----BEGIN PGP PUBLIC KEY BLOCK-----\nComment: test\n\n" + base64.StdEncoding.EncodeToString(k) + "\n=abcd\n-----END PGP PUBLIC KEY BLOCK-----\n"
+		for j, in := range []string{string(k), armored} {
+			signingKeys = nil
+			if err := AddSigningKey(strings.NewReader(in)); err != nil {
+				t.Fatalf("%d, %d: %v", i, j, err)
+			}
+			if b, err := trustedKeys(); err != nil || !bytes.Equal(b, k) {
+				t.Fatalf("%d, %d: %x %v", i, j, b, err)
+			}
+		}
+	}
+	for i, in := range []string{
+		"",
+		"not a key",
+		// A signature packet.
+		"\x88\x01\x04",
+		"-----BEGIN PGP SIGNATURE-----\n\niAEE\n-----END PGP SIGNATURE-----\n",
+		"-----BEGIN PGP PUBLIC KEY BLOCK-----\n\nmAEE\n",
+	} {
+		if err := AddSigningKey(strings.NewReader(in)); err == nil {
+			t.Fatalf("%d: expected error", i)
+		}
+	}
+}
+
+func TestSignatureURL(t *testing.T) {
+	i := Image{Manufacturer: Raspberry, Distro: RaspiOS64}
+	if u, err := i.signatureURL("https://example.com/a.img.xz"); err != nil || u != "https://example.com/a.img.xz.sig" {
+		t.Fatal(u, err)
+	}
+	i = Image{Manufacturer: Raspberry, Distro: Ubuntu}
+	if _, err := i.signatureURL("https://example.com/a.img.xz"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// gpgHome is a GnuPG home directory with a signing key.
+type gpgHome string
+
+// newGPG creates a GnuPG home directory with a new signing key for name.
+//
+// The test is skipped when GnuPG is not installed.
+func newGPG(t *testing.T, name string) gpgHome {
+	for _, n := range []string{"gpg", "gpgv"} {
+		if _, err := exec.LookPath(n); err != nil {
+			t.Skip(err)
+		}
+	}
+	// t.TempDir() may be too long for the gpg-agent socket path.
+	d, err := os.MkdirTemp("", "gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := gpgHome(d)
+	t.Cleanup(func() {
+		/* #nosec G204 */
+		c := exec.Command("gpgconf", "--kill", "gpg-agent")
+		c.Env = append(os.Environ(), "GNUPGHOME="+d)
+		_ = c.Run()
+		_ = os.RemoveAll(d)
+	})
+	h.run(t, nil, "--passphrase", "", "--quick-gen-key", name+" <"+name+"@example.com>", "ed25519", "sign", "never")
+	return h
+}
+
+// run runs gpg with in as stdin and returns its stdout.
+func (h gpgHome) run(t *testing.T, in []byte, args ...string) []byte {
+	/* #nosec G204 */
+	c := exec.Command("gpg", append([]string{"--batch", "--homedir", string(h)}, args...)...)
+	c.Stdin = bytes.NewReader(in)
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		t.Fatalf("gpg %s: %v\n%s", strings.Join(args, " "), err, stderr.String())
+	}
+	return out
+}
+
+func compressXZ(t *testing.T, s string) *bytes.Buffer {
+	var b bytes.Buffer
+	w, err := xz.NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &b
+}
@@ -0,0 +1,145 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrPrivateKey is returned by ParseAuthorizedKeys when it is given a private
+// key instead of a public key.
+var ErrPrivateKey = errors.New("you passed a private key; use the public key instead, generally the .pub file")
+
+// ParseAuthorizedKeys validates that b only contains ssh public keys in
+// authorized_keys format and returns them, one per line.
+//
+// Empty lines and comments are skipped. Options prefixing a key are kept.
+func ParseAuthorizedKeys(b []byte) ([]string, error) {
+	if bytes.Contains(b, []byte("PRIVATE KEY-----")) {
+		return nil, ErrPrivateKey
+	}
+	var out []string
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(l)); err != nil {
+			return nil, fmt.Errorf("invalid public key %.40q: %w", l, err)
+		}
+		out = append(out, l)
+	}
+	return out, nil
+}
+
+// ErrNoPrivateKey is returned by CheckPrivateKey when the private key is not
+// found next to the public key.
+var ErrNoPrivateKey = errors.New("no matching private key found")
+
+// CheckPrivateKey verifies that the private key next to the public key file
+// pub, i.e. the same path without the ".pub" suffix, matches it.
+//
+// This catches authorizing a key whose private half is not available, which
+// would lock the user out. A private key protected by a passphrase is only
+// compared when its public key is stored unencrypted, which is the case with
+// the OpenSSH format.
+func CheckPrivateKey(pub string) error {
+	/* #nosec G304 */
+	b, err := os.ReadFile(pub)
+	if err != nil {
+		return err
+	}
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", pub, err)
+	}
+	priv := strings.TrimSuffix(pub, ".pub")
+	if priv == pub {
+		return fmt.Errorf("%s: %w; expected a file ending with .pub", pub, ErrNoPrivateKey)
+	}
+	/* #nosec G304 */
+	if b, err = os.ReadFile(priv); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%s: %w", pub, ErrNoPrivateKey)
+		}
+		return err
+	}
+	var got ssh.PublicKey
+	s, err := ssh.ParsePrivateKey(b)
+	if err == nil {
+		got = s.PublicKey()
+	} else {
+		var pass *ssh.PassphraseMissingError
+		if !errors.As(err, &pass) {
+			return fmt.Errorf("%s: %w", priv, err)
+		}
+		if pass.PublicKey == nil {
+			// Can't tell without the passphrase.
+			return nil
+		}
+		got = pass.PublicKey
+	}
+	if !bytes.Equal(got.Marshal(), pk.Marshal()) {
+		return fmt.Errorf("%s doesn't match the private key %s", pub, priv)
+	}
+	return nil
+}
+
+// gitHubKeysURL is the URL of the public ssh keys of a GitHub user.
+var gitHubKeysURL = "https://github.com/%s.keys"
+
+var reGitHubUser = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9-]{0,38}$`)
+
+// FetchGitHubKeys returns the ssh public keys of the GitHub user, one per
+// line, like cloud-init's "ssh_import_id gh:user".
+func FetchGitHubKeys(ctx context.Context, user string, o *Options) ([]string, error) {
+	if !reGitHubUser.MatchString(user) {
+		return nil, fmt.Errorf("invalid GitHub user %q", user)
+	}
+	b, err := fetchURL(ctx, fmt.Sprintf(gitHubKeysURL, user), o)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ParseAuthorizedKeys(b)
+	if err != nil {
+		return nil, fmt.Errorf("GitHub user %s: %w", user, err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("GitHub user %s has no ssh public key", user)
+	}
+	return keys, nil
+}
+
+// GenerateHostKey generates an ed25519 ssh host key.
+//
+// It returns the private key in OpenSSH format, as found in
+// /etc/ssh/ssh_host_ed25519_key, and the public key in authorized_keys format,
+// as found in /etc/ssh/ssh_host_ed25519_key.pub.
+func GenerateHostKey() ([]byte, []byte, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(b), ssh.MarshalAuthorizedKey(p), nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// magicGzip is the magic bytes at the start of a gzip stream.
+var magicGzip = []byte{0x1F, 0x8B}
+
+// CheckImageURL verifies that u is a http or https URL, as accepted by
+// FlashURL.
+func CheckImageURL(u string) error {
+	p, err := url.Parse(u)
+	if err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+		return fmt.Errorf("invalid image URL %q; it must be a http or https URL", u)
+	}
+	return nil
+}
+
+// FlashURL streams the image at u straight to disk, without storing it, and
+// returns the hex encoded SHA-256 of the decompressed data written.
+//
+// The image can be raw, xz or gzip compressed; the format is detected from the
+// magic bytes, so an HTML error page is refused before anything is written.
+// The download and flash progress are printed together. The same checks as
+// Flash are done before writing.
+func FlashURL(ctx context.Context, u, disk string, o *Options) (string, error) {
+	if err := CheckImageURL(u); err != nil {
+		return "", err
+	}
+	if o.offline() {
+		return "", fmt.Errorf("failed to fetch %q: %w", u, ErrOffline)
+	}
+	Progressf("- Streaming %s to %s\n", u, disk)
+	resp, err := httpGet(ctx, u, o)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return "", fmt.Errorf("failed to fetch %q: %w", u, ErrImageNotFound)
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("failed to fetch %q: status %d", u, resp.StatusCode)
+	}
+	p := &streamProgress{size: resp.ContentLength}
+	r, wait, err := openImage(&countingReader{ctx: ctx, r: resp.Body, n: &p.downloaded}, u)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	err = flashStream(ctx, io.TeeReader(&countingReader{ctx: ctx, r: r, n: &p.written, p: p}, h), disk, false, o)
+	if err2 := wait(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return "", err
+	}
+	p.print()
+	Progressf("\n")
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// openImage returns a reader decompressing src if it is xz or gzip
+// compressed, or src itself if it is a raw disk image.
+//
+// name is used for error messages. wait must be called once done reading.
+func openImage(src io.Reader, name string) (io.Reader, func() error, error) {
+	b := bufio.NewReader(src)
+	h, err := b.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, nil, fmt.Errorf("failed to read %q: %w", name, err)
+	}
+	switch {
+	case bytes.HasPrefix(h, magicXZ):
+		return newXZReader(b)
+	case bytes.HasPrefix(h, magicGzip):
+		g, err := gzip.NewReader(b)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %q: %w", name, err)
+		}
+		return g, g.Close, nil
+	case isRawImage(h):
+		return b, func() error { return nil }, nil
+	default:
+		if len(h) > 16 {
+			h = h[:16]
+		}
+		return nil, nil, fmt.Errorf("server returned non-image content for %q; expected a raw, xz or gzip image (starts with %q)", name, h)
+	}
+}
+
+// isRawImage returns true if h, the first 512 bytes of an image, is a MBR or
+// the protective MBR of a GPT, i.e. the image is not compressed.
+func isRawImage(h []byte) bool {
+	return len(h) >= 512 && h[510] == 0x55 && h[511] == 0xAA
+}
+
+// writeImage writes the image read from src to imgpath, decompressing it
+// unless it is a raw image, as served by some mirrors.
+//
+// The format is detected from the magic bytes rather than the URL. name is
+// used for error messages. size is the size of src if known, otherwise 0.
+func writeImage(ctx context.Context, src io.Reader, name, imgpath string, size int64) error {
+	b := bufio.NewReader(src)
+	h, err := b.Peek(512)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read %q: %w", name, err)
+	}
+	if isRawImage(h) {
+		log.Printf("%s is not compressed", name)
+		return writeRaw(ctx, b, imgpath, size)
+	}
+	// The uncompressed size is only recorded at the end of the file.
+	return decompressXZ(ctx, b, name, imgpath, 0)
+}
+
+// streamProgress prints the progress of FlashURL.
+type streamProgress struct {
+	// size is the size of the download, or -1 if unknown.
+	size       int64
+	downloaded atomic.Int64
+	written    atomic.Int64
+	last       time.Time
+}
+
+func (s *streamProgress) print() {
+	if s.size > 0 {
+		Progressf("\r%.1f%% downloaded, %s written ", float64(s.downloaded.Load())*100./float64(s.size), formatSize(s.written.Load()))
+	} else {
+		Progressf("\r%s downloaded, %s written ", formatSize(s.downloaded.Load()), formatSize(s.written.Load()))
+	}
+}
+
+// countingReader adds the number of bytes read to n and prints p, if set, at
+// most a few times per second. It fails once ctx is done.
+type countingReader struct {
+	ctx context.Context
+	r   io.Reader
+	n   *atomic.Int64
+	p   *streamProgress
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := c.r.Read(b)
+	c.n.Add(int64(n))
+	if c.p != nil && time.Since(c.p.last) >= 200*time.Millisecond {
+		c.p.last = time.Now()
+		c.p.print()
+	}
+	return n, err
+}
@@ -0,0 +1,148 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+func TestFlashURL(t *testing.T) {
+	// A fake disk image with a MBR signature.
+	raw := bytes.Repeat([]byte("periph"), 100000)
+	raw[510] = 0x55
+	raw[511] = 0xAA
+	var gz bytes.Buffer
+	g := gzip.NewWriter(&gz)
+	if _, err := g.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var xzb bytes.Buffer
+	x, err := xz.NewWriter(&xzb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = x.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	if err = x.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{"/a.img": raw, "/a.img.gz": gz.Bytes(), "/a.img.xz": xzb.Bytes(), "/error.html": []byte("<html>Not here</html>")}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(b)
+	}))
+	defer ts.Close()
+
+	sum := sha256.Sum256(raw)
+	want := hex.EncodeToString(sum[:])
+	dst := filepath.Join(t.TempDir(), "disk.img")
+	for _, p := range []string{"/a.img", "/a.img.gz", "/a.img.xz"} {
+		if err = os.WriteFile(dst, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := FlashURL(context.Background(), ts.URL+p, dst, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		if got != want {
+			t.Fatalf("%s: %s", p, got)
+		}
+		b, err := os.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, raw) {
+			t.Fatalf("%s: content mismatch", p)
+		}
+	}
+	if _, err = FlashURL(context.Background(), ts.URL+"/error.html", dst, nil); err == nil || !strings.Contains(err.Error(), "non-image content") {
+		t.Fatal(err)
+	}
+	if _, err = FlashURL(context.Background(), ts.URL+"/missing.img", dst, nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestCheckImageURL(t *testing.T) {
+	if err := CheckImageURL("https://example.com/a.img.xz"); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{"", "a.img", "ftp://example.com/a.img", "http://"} {
+		if err := CheckImageURL(u); err == nil {
+			t.Fatalf("%q: expected error", u)
+		}
+	}
+}
+
+func TestFetchXZRaw(t *testing.T) {
+	// A mirror serving the image uncompressed under the .img.xz name, and
+	// another one serving it as .img.
+	raw := bytes.Repeat([]byte("periph"), 1000)
+	raw[510] = 0x55
+	raw[511] = 0xAA
+	var xzb bytes.Buffer
+	x, err := xz.NewWriter(&xzb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = x.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	if err = x.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{"/a.img": raw, "/raw/a.img.xz": raw, "/a.img.xz": xzb.Bytes(), "/error.html": []byte("<html>Not here</html>")}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(b)
+	}))
+	defer ts.Close()
+	dst := filepath.Join(t.TempDir(), "a.img")
+	for _, p := range []string{"/a.img", "/raw/a.img.xz", "/a.img.xz"} {
+		if err = fetchXZ(context.Background(), ts.URL+p, dst, nil, nil); err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		b, err := os.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, raw) {
+			t.Fatalf("%s: content mismatch", p)
+		}
+	}
+	if err = os.Remove(dst); err != nil {
+		t.Fatal(err)
+	}
+	if err = fetchXZ(context.Background(), ts.URL+"/error.html", dst, nil, nil); err == nil || !strings.Contains(err.Error(), "non-image content") {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatal("expected no image to be written", err)
+	}
+}
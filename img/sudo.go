@@ -0,0 +1,74 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrSudoRequired is returned when a command needs elevated privileges while
+// Options.NoSudo is set and the process is not running as root.
+var ErrSudoRequired = errors.New("elevated privileges are required but sudo is disabled; run as root instead")
+
+// CacheSudo caches the sudo credentials, prompting for the password when
+// needed, so the commands run concurrently afterward don't all prompt at once.
+func CacheSudo(o *Options) error {
+	return run(o, "sudo", "-v")
+}
+
+// Sudo runs the command arg as root with in as its standard input.
+//
+// Like the commands run by this package, it honors o.NoSudo and fails instead
+// of waiting for a password when there is no terminal to prompt on. The
+// command is killed when ctx is done.
+func Sudo(ctx context.Context, o *Options, in string, arg ...string) error {
+	_, err := captureOp(ctx, o, in, "sudo", arg...)
+	return err
+}
+
+// sudoCommand returns the command line to run instead of name arg.
+//
+// Commands run with sudo honor noSudo. Without a terminal to prompt on, sudo
+// is made to fail instead of waiting for a password that will never come.
+func sudoCommand(name string, arg []string, noSudo bool) (string, []string, error) {
+	if name != "sudo" {
+		return name, arg, nil
+	}
+	return sudoArgs(arg, noSudo, os.Geteuid() == 0, hasTTY())
+}
+
+// sudoArgs returns the command line to run sudo arg.
+func sudoArgs(arg []string, noSudo, root, tty bool) (string, []string, error) {
+	if noSudo {
+		if !root {
+			return "", nil, fmt.Errorf("sudo %s: %w", strings.Join(arg, " "), ErrSudoRequired)
+		}
+		if len(arg) == 1 && arg[0] == "-v" {
+			// Caching the credentials is not needed.
+			return "true", nil, nil
+		}
+		return arg[0], arg[1:], nil
+	}
+	if !tty && !root {
+		// -n makes sudo fail when a password is needed.
+		return "sudo", append([]string{"-n"}, arg...), nil
+	}
+	return "sudo", arg, nil
+}
+
+// hasTTY returns true if the process has a controlling terminal sudo can
+// prompt on.
+func hasTTY() bool {
+	f, err := os.Open("/dev/tty")
+	if err != nil {
+		return false
+	}
+	_ = f.Close()
+	return true
+}
@@ -0,0 +1,68 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSudoArgs(t *testing.T) {
+	data := []struct {
+		arg             []string
+		noSudo, root    bool
+		tty             bool
+		name            string
+		expected        []string
+		errSudoRequired bool
+	}{
+		{[]string{"dd", "if=a"}, false, false, true, "sudo", []string{"dd", "if=a"}, false},
+		{[]string{"dd", "if=a"}, false, false, false, "sudo", []string{"-n", "dd", "if=a"}, false},
+		{[]string{"dd", "if=a"}, false, true, false, "sudo", []string{"dd", "if=a"}, false},
+		{[]string{"dd", "if=a"}, true, true, true, "dd", []string{"if=a"}, false},
+		{[]string{"-v"}, true, true, false, "true", nil, false},
+		{[]string{"dd", "if=a"}, true, false, true, "", nil, true},
+	}
+	for i, l := range data {
+		name, args, err := sudoArgs(l.arg, l.noSudo, l.root, l.tty)
+		if l.errSudoRequired {
+			if !errors.Is(err, ErrSudoRequired) {
+				t.Fatalf("%d: %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if name != l.name || !reflect.DeepEqual(args, l.expected) {
+			t.Fatalf("%d: %s %q", i, name, args)
+		}
+	}
+}
+
+func TestSudoCommand(t *testing.T) {
+	// Commands not run with sudo are left alone.
+	name, args, err := sudoCommand("lsblk", []string{"-J"}, false)
+	if err != nil || name != "lsblk" || !reflect.DeepEqual(args, []string{"-J"}) {
+		t.Fatal(name, args, err)
+	}
+}
+
+func TestSudo(t *testing.T) {
+	err := Sudo(context.Background(), &Options{NoSudo: true}, "", "true")
+	if os.Geteuid() == 0 {
+		// Run directly.
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if !errors.Is(err, ErrSudoRequired) {
+		t.Fatal(err)
+	}
+}
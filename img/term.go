@@ -0,0 +1,63 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// ReadPassword prints prompt and reads a line from the terminal on stdin
+// without echoing it.
+//
+// The echo is restored when ctx is canceled, e.g. on Ctrl-C.
+func ReadPassword(ctx context.Context, prompt string) (string, error) {
+	fmt.Print(prompt)
+	if err := setEcho(false); err != nil {
+		return "", fmt.Errorf("failed to disable the terminal echo: %w", err)
+	}
+	defer func() {
+		_ = setEcho(true)
+		// The newline typed was not echoed.
+		fmt.Println()
+	}()
+	type result struct {
+		line string
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		ch <- result{line, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil && r.line == "" {
+			return "", r.err
+		}
+		return strings.TrimRight(r.line, "\r\n"), nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// setEcho enables or disables the echo of the terminal on stdin.
+func setEcho(on bool) error {
+	if runtime.GOOS == "windows" {
+		return setEchoWindows(on)
+	}
+	arg := "-echo"
+	if on {
+		arg = "echo"
+	}
+	c := exec.Command("stty", arg)
+	c.Stdin = os.Stdin
+	return c.Run()
+}
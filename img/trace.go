@@ -0,0 +1,79 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"time"
+)
+
+// traceLog is where Options.TraceHTTP logs.
+var traceLog = log.New(os.Stderr, "http: ", log.Ltime|log.Lmicroseconds)
+
+// tracingTransport is a http.RoundTripper logging the requests when the
+// Options.TraceHTTP of the request is set.
+type tracingTransport struct {
+	rt http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !optionsFrom(r.Context()).traceHTTP() {
+		return t.rt.RoundTrip(r)
+	}
+	start := time.Now()
+	req := r.Method + " " + r.URL.String()
+	ct := &httptrace.ClientTrace{
+		GotConn: func(i httptrace.GotConnInfo) {
+			traceLog.Printf("%s: connected to %s (reused: %t)", req, i.Conn.RemoteAddr(), i.Reused)
+		},
+		TLSHandshakeDone: func(s tls.ConnectionState, err error) {
+			if err != nil {
+				traceLog.Printf("%s: TLS handshake failed: %v", req, err)
+				return
+			}
+			traceLog.Printf("%s: TLS %s with %s", req, tls.VersionName(s.Version), s.ServerName)
+		},
+		GotFirstResponseByte: func() {
+			traceLog.Printf("%s: first byte after %s", req, time.Since(start).Round(time.Millisecond))
+		},
+	}
+	resp, err := t.rt.RoundTrip(r.WithContext(httptrace.WithClientTrace(r.Context(), ct)))
+	if err != nil {
+		traceLog.Printf("%s: %v", req, err)
+		return nil, err
+	}
+	if loc := resp.Header.Get("Location"); loc != "" {
+		traceLog.Printf("%s: %s, redirect to %s", req, resp.Status, loc)
+	} else {
+		traceLog.Printf("%s: %s, Content-Length %d", req, resp.Status, resp.ContentLength)
+	}
+	resp.Body = &tracingBody{ReadCloser: resp.Body, req: req, start: start}
+	return resp, nil
+}
+
+// tracingBody logs the number of bytes read from a response body once
+// closed.
+type tracingBody struct {
+	io.ReadCloser
+	req   string
+	start time.Time
+	n     int64
+}
+
+func (t *tracingBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.n += int64(n)
+	return n, err
+}
+
+func (t *tracingBody) Close() error {
+	traceLog.Printf("%s: read %d bytes in %s", t.req, t.n, time.Since(t.start).Round(time.Millisecond))
+	return t.ReadCloser.Close()
+}
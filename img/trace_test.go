@@ -0,0 +1,46 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTraceHTTP(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest" {
+			http.Redirect(w, r, "/image", http.StatusFound)
+			return
+		}
+		_, _ = w.Write([]byte("periph"))
+	}))
+	defer ts.Close()
+	var buf bytes.Buffer
+	traceLog.SetOutput(&buf)
+	defer traceLog.SetOutput(os.Stderr)
+	b, err := fetchURL(context.Background(), ts.URL+"/latest", &Options{TraceHTTP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "periph" {
+		t.Fatal(string(b))
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"GET " + ts.URL + "/latest: 302 Found, redirect to /image",
+		"GET " + ts.URL + "/image: 200 OK, Content-Length 6",
+		"GET " + ts.URL + "/image: read 6 bytes in ",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+}
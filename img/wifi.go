@@ -0,0 +1,263 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	/* #nosec G505 */
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// WifiNetwork is a wifi network for the device to connect to.
+type WifiNetwork struct {
+	// SSID is the name of the network.
+	SSID string
+	// Pass is the passphrase, or the 64 hex digits preshared key. It is empty
+	// for an open network.
+	Pass string
+	// Country is the ISO 3166 country code, which affects the usable bands.
+	Country string
+	// Hidden is true when the network doesn't broadcast its SSID, so it has to
+	// be probed for.
+	Hidden bool
+	// KeyMgmt is the wpa_supplicant key_mgmt value, either "WPA-PSK" or
+	// "NONE". Defaults to "WPA-PSK", or "NONE" when Pass is empty.
+	KeyMgmt string
+	// Priority is the wpa_supplicant priority of the network; the networks
+	// with a higher value are preferred.
+	Priority int
+	// PlaintextPSK writes Pass as is in wpa_supplicant.conf instead of the
+	// hashed key, for the networks where the hashed key doesn't work. The
+	// passphrase is then readable by anyone with the SDCard.
+	PlaintextPSK bool
+}
+
+// Check returns an error if the network can't be rendered.
+func (w *WifiNetwork) Check() error {
+	if w.SSID == "" || len(w.SSID) > 32 {
+		return fmt.Errorf("the wifi SSID %q must be 1 to 32 bytes long", w.SSID)
+	}
+	if w.Country != "" && !isCountryCode(w.Country) {
+		return fmt.Errorf("the wifi country %q must be a two letters ISO 3166 code", w.Country)
+	}
+	if w.Priority < 0 {
+		return errors.New("the wifi priority can't be negative")
+	}
+	switch w.keyMgmt() {
+	case "NONE":
+		if w.Pass != "" {
+			return errors.New("an open wifi network doesn't take a password")
+		}
+		if w.PlaintextPSK {
+			return errors.New("an open wifi network doesn't have a preshared key")
+		}
+	case "WPA-PSK":
+		if isRawPSK(w.Pass) && !w.PlaintextPSK {
+			return nil
+		}
+		if len(w.Pass) < 8 || len(w.Pass) > 63 {
+			if w.PlaintextPSK {
+				return errors.New("the wifi password must be 8 to 63 bytes long to be written as is")
+			}
+			return errors.New("the wifi password must be 8 to 63 bytes long, or a 64 hex digits preshared key")
+		}
+		if strings.ContainsAny(w.Pass, "\r\n") {
+			return errors.New("the wifi password must be on a single line")
+		}
+	default:
+		return fmt.Errorf("unsupported wifi key management %q; use WPA-PSK or NONE", w.KeyMgmt)
+	}
+	return nil
+}
+
+// PSK returns the psk value of the network block in wpa_supplicant.conf.
+//
+// It is the hex encoded key derived from the passphrase and the SSID, which
+// removes the need to have the passphrase on the SDCard, unless PlaintextPSK
+// is set. A 64 hex digits Pass is already the key and is returned as is.
+func (w *WifiNetwork) PSK() string {
+	if w.PlaintextPSK {
+		return "\"" + w.Pass + "\""
+	}
+	if isRawPSK(w.Pass) {
+		return strings.ToLower(w.Pass)
+	}
+	return wpaPSK(w.Pass, w.SSID)
+}
+
+// WPASupplicant returns the content of a wpa_supplicant.conf connecting to
+// the network, as picked up from /boot by RaspiOS.
+func (w *WifiNetwork) WPASupplicant() string {
+	var b strings.Builder
+	if w.Country != "" {
+		b.WriteString("country=" + strings.ToUpper(w.Country) + "\n")
+	}
+	b.WriteString("ctrl_interface=DIR=/var/run/wpa_supplicant GROUP=netdev\nupdate_config=1\n\n")
+	b.WriteString("# Generated by https://github.com/periph/bootstrap\nnetwork={\n")
+	b.WriteString("\tssid=" + wpaSSID(w.SSID) + "\n")
+	if w.Hidden {
+		b.WriteString("\tscan_ssid=1\n")
+	}
+	k := w.keyMgmt()
+	if k != "NONE" {
+		b.WriteString("\tpsk=" + w.PSK() + "\n")
+	}
+	b.WriteString("\tkey_mgmt=" + k + "\n")
+	if w.Priority != 0 {
+		b.WriteString("\tpriority=" + strconv.Itoa(w.Priority) + "\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// NMConnection returns the content of a NetworkManager connection profile
+// connecting to the network, to be written as
+// /etc/NetworkManager/system-connections/<NMConnectionName()> with mode 0600,
+// as used by RaspiOS Bookworm and later.
+//
+// NetworkManager doesn't configure the wifi country; it is set with the
+// cfg80211.ieee80211_regdom kernel argument instead.
+func (w *WifiNetwork) NMConnection() string {
+	// The UUID only needs to be stable for a SSID.
+	h := sha256.Sum256([]byte(w.SSID))
+	h[6] = h[6]&0x0F | 0x40
+	h[8] = h[8]&0x3F | 0x80
+	uuid := fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+	var b strings.Builder
+	b.WriteString("# Generated by https://github.com/periph/bootstrap\n")
+	b.WriteString("[connection]\nid=" + keyfileEscape(w.SSID) + "\nuuid=" + uuid + "\ntype=wifi\ninterface-name=wlan0\nautoconnect=true\n")
+	if w.Priority != 0 {
+		b.WriteString("autoconnect-priority=" + strconv.Itoa(w.Priority) + "\n")
+	}
+	b.WriteString("\n[wifi]\nmode=infrastructure\nssid=" + nmSSID(w.SSID) + "\n")
+	if w.Hidden {
+		b.WriteString("hidden=true\n")
+	}
+	if w.keyMgmt() != "NONE" {
+		psk := w.Pass
+		if !w.PlaintextPSK {
+			psk = strings.Trim(w.PSK(), "\"")
+		}
+		b.WriteString("\n[wifi-security]\nkey-mgmt=wpa-psk\npsk=" + keyfileEscape(psk) + "\n")
+	}
+	b.WriteString("\n[ipv4]\nmethod=auto\n\n[ipv6]\naddr-gen-mode=default\nmethod=auto\n")
+	return b.String()
+}
+
+// NMConnectionName returns the file name of the NetworkManager connection
+// profile, derived from the SSID.
+func (w *WifiNetwork) NMConnectionName() string {
+	n := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, w.SSID)
+	return n + ".nmconnection"
+}
+
+// SetupArgs returns the setup.sh arguments to connect to the network.
+//
+// setup.sh only supports the WPA-PSK networks broadcasting their SSID; Hidden,
+// KeyMgmt, Priority and PlaintextPSK are ignored. A 64 hex digits Pass is
+// passed as is and written unquoted as the preshared key.
+func (w *WifiNetwork) SetupArgs() []string {
+	var out []string
+	if w.Country != "" {
+		out = append(out, "-wc", strings.ToUpper(w.Country))
+	}
+	if w.SSID != "" {
+		out = append(out, "-ws", w.SSID)
+	}
+	if w.Pass != "" {
+		out = append(out, "-wp", w.Pass)
+	}
+	return out
+}
+
+func (w *WifiNetwork) keyMgmt() string {
+	if w.KeyMgmt != "" {
+		return w.KeyMgmt
+	}
+	if w.Pass == "" {
+		return "NONE"
+	}
+	return "WPA-PSK"
+}
+
+// wpaPSK calculates the hex encoded preshared key for the SSID based on the
+// plain text passphrase, like wpa_passphrase does.
+func wpaPSK(passphrase, ssid string) string {
+	return hex.EncodeToString(pbkdf2.Key([]byte(passphrase), []byte(ssid), 4096, 32, sha1.New))
+}
+
+// wpaSSID returns the ssid value for wpa_supplicant.conf, quoted when it is
+// printable and hex encoded otherwise, e.g. when it contains a new line.
+func wpaSSID(ssid string) string {
+	for _, c := range ssid {
+		if !unicode.IsPrint(c) {
+			return hex.EncodeToString([]byte(ssid))
+		}
+	}
+	return "\"" + ssid + "\""
+}
+
+// nmSSID returns the ssid value for a NetworkManager keyfile, as is when it is
+// printable and as the list of its bytes otherwise, e.g. when it contains a
+// ';' or starts or ends with a space.
+func nmSSID(ssid string) string {
+	ok := strings.TrimSpace(ssid) == ssid
+	for _, c := range ssid {
+		ok = ok && unicode.IsPrint(c) && c != ';' && c != '\\'
+	}
+	if ok {
+		return ssid
+	}
+	var b strings.Builder
+	for i := 0; i < len(ssid); i++ {
+		b.WriteString(strconv.Itoa(int(ssid[i])) + ";")
+	}
+	return b.String()
+}
+
+// keyfileEscape escapes s as a value in a NetworkManager keyfile, which uses
+// the GLib key file format.
+func keyfileEscape(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	if strings.HasPrefix(s, " ") {
+		s = "\\s" + s[1:]
+	}
+	return s
+}
+
+// isCountryCode returns true if s is two ASCII letters.
+func isCountryCode(s string) bool {
+	if len(s) != 2 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// isRawPSK returns true if s is a 64 hex digits preshared key.
+func isRawPSK(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
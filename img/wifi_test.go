@@ -0,0 +1,228 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWPAPSK(t *testing.T) {
+	// Generated with:
+	// wpa_passphrase "the ssid" "long passphrase"
+	expected := "ae1b388ef471b4b65cf8d0b6cd3720e7ee7074f77e31061121ac8894973642c5"
+	if actual := wpaPSK("long passphrase", "the ssid"); actual != expected {
+		t.Fatal(actual)
+	}
+}
+
+func TestWifiNetworkCheck(t *testing.T) {
+	data := []struct {
+		w     WifiNetwork
+		valid bool
+	}{
+		{WifiNetwork{SSID: "home", Pass: "12345678"}, true},
+		{WifiNetwork{SSID: "home", Pass: "12345678", Country: "ca"}, true},
+		{WifiNetwork{SSID: "home", Pass: strings.Repeat("a", 63)}, true},
+		{WifiNetwork{SSID: "home", Pass: strings.Repeat("A", 64)}, true},
+		{WifiNetwork{SSID: "home", Pass: "p@ss\"w0rd é", PlaintextPSK: true}, true},
+		{WifiNetwork{SSID: "cafe"}, true},
+		{WifiNetwork{SSID: "cafe", KeyMgmt: "NONE", Hidden: true, Priority: 2}, true},
+		{WifiNetwork{SSID: strings.Repeat("s", 32), Pass: "12345678"}, true},
+		{WifiNetwork{Pass: "12345678"}, false},
+		{WifiNetwork{SSID: strings.Repeat("s", 33), Pass: "12345678"}, false},
+		{WifiNetwork{SSID: "home", Pass: "1234567"}, false},
+		{WifiNetwork{SSID: "home", Pass: strings.Repeat("z", 64)}, false},
+		{WifiNetwork{SSID: "home", Pass: strings.Repeat("a", 64), PlaintextPSK: true}, false},
+		{WifiNetwork{SSID: "home", Pass: "pass\nword"}, false},
+		{WifiNetwork{SSID: "home", Pass: "12345678", Country: "USA"}, false},
+		{WifiNetwork{SSID: "home", Pass: "12345678", Country: "U1"}, false},
+		{WifiNetwork{SSID: "home", Pass: "12345678", Priority: -1}, false},
+		{WifiNetwork{SSID: "home", Pass: "12345678", KeyMgmt: "NONE"}, false},
+		{WifiNetwork{SSID: "home", Pass: "12345678", KeyMgmt: "WPA-EAP"}, false},
+		{WifiNetwork{SSID: "home", KeyMgmt: "WPA-PSK"}, false},
+		{WifiNetwork{SSID: "cafe", PlaintextPSK: true}, false},
+	}
+	for i, l := range data {
+		if err := l.w.Check(); (err == nil) != l.valid {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+}
+
+func TestWifiNetworkWPASupplicant(t *testing.T) {
+	data := []struct {
+		w        WifiNetwork
+		expected string
+	}{
+		{
+			WifiNetwork{SSID: "the ssid", Pass: "long passphrase", Country: "US"},
+			"country=US\n" +
+				"ctrl_interface=DIR=/var/run/wpa_supplicant GROUP=netdev\n" +
+				"update_config=1\n" +
+				"\n" +
+				"# Generated by https://github.com/periph/bootstrap\n" +
+				"network={\n" +
+				"\tssid=\"the ssid\"\n" +
+				"\tpsk=ae1b388ef471b4b65cf8d0b6cd3720e7ee7074f77e31061121ac8894973642c5\n" +
+				"\tkey_mgmt=WPA-PSK\n" +
+				"}\n",
+		},
+		{
+			WifiNetwork{SSID: "the ssid", Pass: "long passphrase", Country: "us", PlaintextPSK: true, Hidden: true, Priority: 5},
+			"country=US\n" +
+				"ctrl_interface=DIR=/var/run/wpa_supplicant GROUP=netdev\n" +
+				"update_config=1\n" +
+				"\n" +
+				"# Generated by https://github.com/periph/bootstrap\n" +
+				"network={\n" +
+				"\tssid=\"the ssid\"\n" +
+				"\tscan_ssid=1\n" +
+				"\tpsk=\"long passphrase\"\n" +
+				"\tkey_mgmt=WPA-PSK\n" +
+				"\tpriority=5\n" +
+				"}\n",
+		},
+		{
+			// The raw key is not hashed again and the SSID with a control
+			// character is hex encoded.
+			WifiNetwork{SSID: "a\tb", Pass: strings.Repeat("AB", 32)},
+			"ctrl_interface=DIR=/var/run/wpa_supplicant GROUP=netdev\n" +
+				"update_config=1\n" +
+				"\n" +
+				"# Generated by https://github.com/periph/bootstrap\n" +
+				"network={\n" +
+				"\tssid=610962\n" +
+				"\tpsk=" + strings.Repeat("ab", 32) + "\n" +
+				"\tkey_mgmt=WPA-PSK\n" +
+				"}\n",
+		},
+		{
+			WifiNetwork{SSID: "café \"libre\"", Country: "FR"},
+			"country=FR\n" +
+				"ctrl_interface=DIR=/var/run/wpa_supplicant GROUP=netdev\n" +
+				"update_config=1\n" +
+				"\n" +
+				"# Generated by https://github.com/periph/bootstrap\n" +
+				"network={\n" +
+				"\tssid=\"café \"libre\"\"\n" +
+				"\tkey_mgmt=NONE\n" +
+				"}\n",
+		},
+	}
+	for i, l := range data {
+		if got := l.w.WPASupplicant(); got != l.expected {
+			t.Fatalf("%d: %q", i, got)
+		}
+	}
+}
+
+func TestWifiNetworkSetupArgs(t *testing.T) {
+	data := []struct {
+		w        WifiNetwork
+		expected []string
+	}{
+		{WifiNetwork{}, nil},
+		{WifiNetwork{SSID: "my net", Pass: "p@ss'$1", Country: "us"}, []string{"-wc", "US", "-ws", "my net", "-wp", "p@ss'$1"}},
+		{WifiNetwork{SSID: "home", Pass: "12345678", Hidden: true, PlaintextPSK: true}, []string{"-ws", "home", "-wp", "12345678"}},
+		{WifiNetwork{Country: "CA"}, []string{"-wc", "CA"}},
+	}
+	for i, l := range data {
+		got := l.w.SetupArgs()
+		if strings.Join(got, "|") != strings.Join(l.expected, "|") {
+			t.Fatalf("%d: %q", i, got)
+		}
+	}
+}
+
+func TestWifiNetworkNMConnection(t *testing.T) {
+	w := WifiNetwork{SSID: "the ssid", Pass: "long passphrase", Country: "US"}
+	expected := "# Generated by https://github.com/periph/bootstrap\n" +
+		"[connection]\n" +
+		"id=the ssid\n" +
+		"uuid=" + nmUUID(t, w.NMConnection()) + "\n" +
+		"type=wifi\n" +
+		"interface-name=wlan0\n" +
+		"autoconnect=true\n" +
+		"\n" +
+		"[wifi]\n" +
+		"mode=infrastructure\n" +
+		"ssid=the ssid\n" +
+		"\n" +
+		"[wifi-security]\n" +
+		"key-mgmt=wpa-psk\n" +
+		"psk=ae1b388ef471b4b65cf8d0b6cd3720e7ee7074f77e31061121ac8894973642c5\n" +
+		"\n" +
+		"[ipv4]\n" +
+		"method=auto\n" +
+		"\n" +
+		"[ipv6]\n" +
+		"addr-gen-mode=default\n" +
+		"method=auto\n"
+	if got := w.NMConnection(); got != expected {
+		t.Fatalf("%q", got)
+	}
+	if n := w.NMConnectionName(); n != "the_ssid.nmconnection" {
+		t.Fatal(n)
+	}
+
+	data := []struct {
+		w        WifiNetwork
+		contains []string
+		excludes []string
+	}{
+		{
+			WifiNetwork{SSID: "home", Pass: ` pass\word`, PlaintextPSK: true, Hidden: true, Priority: 3},
+			[]string{"autoconnect-priority=3\n", "hidden=true\n", `psk=\spass\\word` + "\n"},
+			nil,
+		},
+		{
+			WifiNetwork{SSID: "cafe"},
+			[]string{"ssid=cafe\n"},
+			[]string{"[wifi-security]", "psk="},
+		},
+		{
+			WifiNetwork{SSID: "a;b ", Pass: "12345678"},
+			[]string{"ssid=97;59;98;32;\n", "id=a;b \n"},
+			nil,
+		},
+	}
+	for i, l := range data {
+		got := l.w.NMConnection()
+		for _, c := range l.contains {
+			if !strings.Contains(got, c) {
+				t.Fatalf("%d: %q doesn't contain %q", i, got, c)
+			}
+		}
+		for _, c := range l.excludes {
+			if strings.Contains(got, c) {
+				t.Fatalf("%d: %q contains %q", i, got, c)
+			}
+		}
+	}
+	// The UUID is stable per SSID.
+	a := WifiNetwork{SSID: "a", Pass: "12345678"}
+	b := WifiNetwork{SSID: "b", Pass: "12345678"}
+	if u := nmUUID(t, a.NMConnection()); u != nmUUID(t, a.NMConnection()) || u == nmUUID(t, b.NMConnection()) || u[14] != '4' {
+		t.Fatal(u)
+	}
+	if n := (&WifiNetwork{SSID: "../é"}).NMConnectionName(); n != "____.nmconnection" {
+		t.Fatal(n)
+	}
+}
+
+// nmUUID returns the uuid value of the connection profile c.
+func nmUUID(t *testing.T, c string) string {
+	for _, l := range strings.Split(c, "\n") {
+		if u, ok := strings.CutPrefix(l, "uuid="); ok {
+			if len(u) != 36 {
+				t.Fatal(u)
+			}
+			return u
+		}
+	}
+	t.Fatal("no uuid")
+	return ""
+}
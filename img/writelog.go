@@ -0,0 +1,153 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// WrittenFile is a file created or modified on a SDCard or image.
+type WrittenFile struct {
+	// Device is the SDCard or image. It is empty when the file was not in a
+	// partition registered with WriteLog.Mounted.
+	Device string `json:"device,omitempty"`
+	// Path is the path of the file on the booted device, e.g.
+	// /boot/firstboot.sh.
+	Path string `json:"path"`
+	// Size is the size of the file once written, or the number of bytes
+	// overwritten when Offset is set.
+	Size int64 `json:"size"`
+	// Created is false when an existing file was modified.
+	Created bool `json:"created"`
+	// Offset is set when the content was overwritten in place at this offset
+	// of the partition, instead of through its file system.
+	Offset int64 `json:"offset,omitempty"`
+}
+
+// WriteLog records the files written to the partitions of SDCards or images,
+// for auditing. Each file is logged as it is recorded.
+//
+// It is safe for concurrent use. A nil *WriteLog records nothing, WriteFile
+// still writes the file.
+type WriteLog struct {
+	mu     sync.Mutex
+	mounts map[string]mountPoint
+	files  []WrittenFile
+}
+
+// Mounted registers that the partition of device mounted at dir is mounted
+// at root on the booted device, e.g. "/boot" or "/".
+func (w *WriteLog) Mounted(device, dir, root string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.mounts == nil {
+		w.mounts = map[string]mountPoint{}
+	}
+	w.mounts[filepath.Clean(dir)] = mountPoint{device, root}
+}
+
+// Add records that the file p on the host now has size bytes.
+func (w *WriteLog) Add(p string, size int64, created bool) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	f := WrittenFile{Path: filepath.ToSlash(p), Size: size, Created: created}
+	// Use the deepest mount point containing p.
+	best := ""
+	for dir, m := range w.mounts {
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || len(dir) < len(best) {
+			continue
+		}
+		best = dir
+		f.Device = m.device
+		f.Path = path.Join(m.root, filepath.ToSlash(rel))
+	}
+	w.add(f)
+}
+
+// AddFile records that the file name, as seen on the booted device, of a
+// partition of device edited without mounting it now has size bytes.
+func (w *WriteLog) AddFile(device, name string, size int64, created bool) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.add(WrittenFile{Device: device, Path: name, Size: size, Created: created})
+}
+
+// AddAt records that size bytes of the file name, as seen on the booted
+// device, were overwritten in place at offset of a partition of device.
+func (w *WriteLog) AddAt(device, name string, size, offset int64) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.add(WrittenFile{Device: device, Path: name, Size: size, Offset: offset})
+}
+
+// Record records the file p on the host with its current size.
+func (w *WriteLog) Record(p string, created bool) error {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	w.Add(p, fi.Size(), created)
+	return nil
+}
+
+// WriteFile calls os.WriteFile and records p.
+func (w *WriteLog) WriteFile(p string, data []byte, perm os.FileMode) error {
+	_, err := os.Lstat(p)
+	created := os.IsNotExist(err)
+	if err = os.WriteFile(p, data, perm); err != nil {
+		return err
+	}
+	w.Add(p, int64(len(data)), created)
+	return nil
+}
+
+// Files returns the files recorded so far, in order.
+func (w *WriteLog) Files() []WrittenFile {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]WrittenFile(nil), w.files...)
+}
+
+func (w *WriteLog) add(f WrittenFile) {
+	on := ""
+	if f.Device != "" {
+		on = " on " + f.Device
+	}
+	switch {
+	case f.Offset != 0:
+		log.Printf("  overwrote %d bytes of %s%s at offset %d", f.Size, f.Path, on, f.Offset)
+	case f.Created:
+		log.Printf("  created %s%s (%d bytes)", f.Path, on, f.Size)
+	default:
+		log.Printf("  modified %s%s (%d bytes)", f.Path, on, f.Size)
+	}
+	w.files = append(w.files, f)
+}
+
+type mountPoint struct {
+	device string
+	root   string
+}
@@ -0,0 +1,65 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteLog(t *testing.T) {
+	d := t.TempDir()
+	boot := filepath.Join(d, "boot")
+	root := filepath.Join(d, "root")
+	nested := filepath.Join(root, "boot", "firmware")
+	for _, p := range []string{boot, nested} {
+		if err := os.MkdirAll(p, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var w WriteLog
+	w.Mounted("/dev/sdb", boot, "/boot")
+	w.Mounted("/dev/sdb", root, "/")
+	w.Mounted("/dev/sdc", nested, "/boot/firmware")
+	if err := w.WriteFile(filepath.Join(boot, "firstboot.sh"), []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteFile(filepath.Join(boot, "firstboot.sh"), []byte("#!/bin/bash\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(nested, "config.txt"), []byte("dtparam=i2c_arm=on\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Record(filepath.Join(nested, "config.txt"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Record(filepath.Join(root, "missing"), true); err == nil {
+		t.Fatal("expected error")
+	}
+	w.Add(filepath.Join(root, "etc", "hostname"), 5, true)
+	w.Add(filepath.Join(d, "other"), 3, true)
+	w.AddAt("foo.img", "/etc/rc.local", 512, 4096)
+	w.AddFile("foo.img", "/boot/ssh", 0, true)
+
+	expected := []WrittenFile{
+		{Device: "/dev/sdb", Path: "/boot/firstboot.sh", Size: 10, Created: true},
+		{Device: "/dev/sdb", Path: "/boot/firstboot.sh", Size: 12},
+		{Device: "/dev/sdc", Path: "/boot/firmware/config.txt", Size: 19},
+		{Device: "/dev/sdb", Path: "/etc/hostname", Size: 5, Created: true},
+		{Path: filepath.ToSlash(filepath.Join(d, "other")), Size: 3, Created: true},
+		{Device: "foo.img", Path: "/etc/rc.local", Size: 512, Offset: 4096},
+		{Device: "foo.img", Path: "/boot/ssh", Created: true},
+	}
+	got := w.Files()
+	if len(got) != len(expected) {
+		t.Fatalf("%#v", got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("%d: %#v != %#v", i, got[i], expected[i])
+		}
+	}
+}
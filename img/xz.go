@@ -0,0 +1,191 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/ulikunitz/xz"
+)
+
+// xzDecoderEnv is the environment variable selecting the xz decoder: "tool"
+// for the xz tool, "go" for the pure Go decoder. By default the xz tool is
+// used when found in PATH since it is faster, and the Go decoder otherwise.
+const xzDecoderEnv = "EFE_XZ_DECODER"
+
+// xzTool returns the path to the xz tool to decompress with, or an empty
+// string to use the Go decoder, as selected by xzDecoderEnv.
+func xzTool() (string, error) {
+	switch v := os.Getenv(xzDecoderEnv); v {
+	case "go":
+		return "", nil
+	case "", "tool":
+		p, err := exec.LookPath("xz")
+		if err != nil {
+			if v == "tool" {
+				return "", fmt.Errorf("%s=tool: %w", xzDecoderEnv, err)
+			}
+			return "", nil
+		}
+		return p, nil
+	default:
+		return "", fmt.Errorf("%s must be \"tool\" or \"go\", got %q", xzDecoderEnv, v)
+	}
+}
+
+// newXZReader returns a reader decompressing the xz stream src.
+//
+// Both decoders read all the concatenated streams, as some images are
+// published this way. wait must be called once done reading; it returns the
+// error of the xz tool, if any.
+func newXZReader(src io.Reader) (io.Reader, func() error, error) {
+	tool, err := xzTool()
+	if err != nil {
+		return nil, nil, err
+	}
+	if tool == "" {
+		log.Printf("decompressing with the Go xz decoder")
+		// Unlike SingleStream, it reads all the concatenated streams.
+		r, err := xz.ReaderConfig{}.NewReader(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		return r, func() error { return nil }, nil
+	}
+	log.Printf("decompressing with %s", tool)
+	/* #nosec G204 */
+	cmd := exec.Command(tool, "--decompress", "--stdout", "--threads=0")
+	cmd.Stdin = src
+	var stderr tailBuffer
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	wait := func() error {
+		// Unblock the tool if the output was not read completely.
+		_ = out.Close()
+		if err := cmd.Wait(); err != nil {
+			var exit *exec.ExitError
+			if errors.As(err, &exit) {
+				return fmt.Errorf("xz failed: %w: %s", err, bytes.TrimSpace([]byte(stderr.String())))
+			}
+			return err
+		}
+		return nil
+	}
+	return out, wait, nil
+}
+
+// CompressXZ compresses the file src into the xz file dst while printing the
+// progress, with the default xz level.
+//
+// dst is deleted on failure, including when ctx is canceled.
+func CompressXZ(ctx context.Context, src, dst string) error {
+	return Compress(ctx, src, dst, Compression{Format: "xz", Level: compressionLevels["xz"][2]})
+}
+
+// xzUncompressedSize returns the uncompressed size of the xz file r of size
+// bytes, as recorded in the index of each of its streams.
+//
+// Concatenated streams and stream padding are supported, like xz(1) and
+// xz.NewReader do. Returns 0 if it cannot be determined, e.g. when the file
+// has trailing data.
+//
+// The format is described at https://tukaani.org/xz/xz-file-format.txt.
+func xzUncompressedSize(r io.ReaderAt, size int64) int64 {
+	var total int64
+	for end := size; end != 0; {
+		// Skip the stream padding, a multiple of 4 null bytes.
+		var pad [4]byte
+		for end >= 4 {
+			if _, err := r.ReadAt(pad[:], end-4); err != nil {
+				return 0
+			}
+			if pad != [4]byte{} {
+				break
+			}
+			end -= 4
+		}
+		start, n := xzStreamSize(r, end)
+		if start < 0 {
+			return 0
+		}
+		total += n
+		end = start
+	}
+	return total
+}
+
+// xzStreamSize returns the offset and the uncompressed size of the xz stream
+// ending at offset end in r.
+//
+// Returns -1 if there is no valid stream ending at end.
+func xzStreamSize(r io.ReaderAt, end int64) (int64, int64) {
+	const headerSize = 12
+	const footerSize = 12
+	if end < headerSize+footerSize {
+		return -1, 0
+	}
+	var footer [footerSize]byte
+	if _, err := r.ReadAt(footer[:], end-footerSize); err != nil {
+		return -1, 0
+	}
+	if footer[10] != 'Y' || footer[11] != 'Z' {
+		return -1, 0
+	}
+	indexSize := (int64(binary.LittleEndian.Uint32(footer[4:8])) + 1) * 4
+	if indexSize > end-headerSize-footerSize {
+		return -1, 0
+	}
+	index := make([]byte, indexSize)
+	if _, err := r.ReadAt(index, end-footerSize-indexSize); err != nil {
+		return -1, 0
+	}
+	b := bytes.NewReader(index)
+	if c, err := b.ReadByte(); err != nil || c != 0 {
+		// Not an index indicator.
+		return -1, 0
+	}
+	records, err := binary.ReadUvarint(b)
+	if err != nil {
+		return -1, 0
+	}
+	var blocks, total int64
+	for i := uint64(0); i < records; i++ {
+		unpadded, err := binary.ReadUvarint(b)
+		if err != nil {
+			return -1, 0
+		}
+		uncompressed, err := binary.ReadUvarint(b)
+		if err != nil {
+			return -1, 0
+		}
+		// Blocks are padded to a multiple of 4 bytes.
+		blocks += (int64(unpadded) + 3) &^ 3
+		total += int64(uncompressed)
+	}
+	start := end - footerSize - indexSize - blocks - headerSize
+	if start < 0 {
+		return -1, 0
+	}
+	// Only trust the index if the stream header is where it says.
+	h := make([]byte, len(magicXZ))
+	if _, err := r.ReadAt(h, start); err != nil || !bytes.Equal(h, magicXZ) {
+		return -1, 0
+	}
+	return start, total
+}
@@ -0,0 +1,135 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package img
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+func TestXZUncompressedSize(t *testing.T) {
+	data := bytes.Repeat([]byte("periph"), 100000)
+	var b bytes.Buffer
+	w, err := xz.NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(b.Bytes())
+	if got := xzUncompressedSize(r, int64(b.Len())); got != int64(len(data)) {
+		t.Fatalf("%d != %d", got, len(data))
+	}
+	// Concatenated streams, with stream padding.
+	two := append(append(b.Bytes(), 0, 0, 0, 0), b.Bytes()...)
+	if got := xzUncompressedSize(bytes.NewReader(two), int64(len(two))); got != 2*int64(len(data)) {
+		t.Fatalf("%d != %d", got, 2*len(data))
+	}
+	// Trailing data.
+	bad := append(b.Bytes(), "meta"...)
+	if got := xzUncompressedSize(bytes.NewReader(bad), int64(len(bad))); got != 0 {
+		t.Fatal(got)
+	}
+	if got := xzUncompressedSize(bytes.NewReader(data), int64(len(data))); got != 0 {
+		t.Fatal(got)
+	}
+}
+
+func TestDecompressXZTwoStreams(t *testing.T) {
+	var b bytes.Buffer
+	for _, s := range []string{"first", "second"} {
+		w, err := xz.NewWriter(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(bytes.Repeat([]byte(s), 100000)); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := append(bytes.Repeat([]byte("first"), 100000), bytes.Repeat([]byte("second"), 100000)...)
+	r := bytes.NewReader(b.Bytes())
+	size := xzUncompressedSize(r, int64(b.Len()))
+	if size != int64(len(expected)) {
+		t.Fatalf("%d != %d", size, len(expected))
+	}
+	decoders := []string{"go"}
+	if _, err := exec.LookPath("xz"); err == nil {
+		decoders = append(decoders, "tool")
+	}
+	for _, d := range decoders {
+		t.Setenv(xzDecoderEnv, d)
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		out := filepath.Join(t.TempDir(), "a.img")
+		if err := decompressXZ(context.Background(), r, "a.img.xz", out, size); err != nil {
+			t.Fatalf("%s: %v", d, err)
+		}
+		got, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expected) {
+			t.Fatalf("%s: got %d bytes", d, len(got))
+		}
+	}
+}
+
+func TestXZTool(t *testing.T) {
+	t.Setenv(xzDecoderEnv, "go")
+	if p, err := xzTool(); p != "" || err != nil {
+		t.Fatal(p, err)
+	}
+	t.Setenv(xzDecoderEnv, "7z")
+	if _, err := xzTool(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestCompressXZ(t *testing.T) {
+	d := t.TempDir()
+	data := bytes.Repeat([]byte("periph"), 100000)
+	src := filepath.Join(d, "a.img")
+	if err := os.WriteFile(src, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(d, "a.img.xz")
+	if err := CompressXZ(context.Background(), src, dst); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	out := filepath.Join(d, "b.img")
+	if err = decompressXZ(context.Background(), f, dst, out, 0); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("content differs")
+	}
+	if err = CompressXZ(context.Background(), filepath.Join(d, "missing.img"), dst); err == nil {
+		t.Fatal("expected error")
+	}
+}
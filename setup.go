@@ -0,0 +1,15 @@
+// Copyright 2026 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Package bootstrap embeds setup.sh so the tools always have a copy of it.
+//
+// The tools themselves are in the cmd/ directory.
+package bootstrap // import "periph.io/x/bootstrap"
+
+import _ "embed"
+
+// SetupSH is the content of setup.sh at the time the tools were built.
+//
+//go:embed setup.sh
+var SetupSH []byte
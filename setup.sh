@@ -220,11 +220,13 @@ EOF
 EOF
 
   # Now necessary on RaspiOS bullseye. We don't really need to keep the same
-  # password.
+  # password. Skip it when a password was already set, e.g. with efe -password.
   # https://www.raspberrypi.com/news/raspberry-pi-bullseye-update-april-2022/
-  sudo_append_file /boot/userconf.txt << EOF
+  if ! sudo grep -q '^pi:\$' /etc/shadow; then
+    sudo_append_file /boot/userconf.txt << EOF
     pi:$(echo 'raspberry' | openssl passwd -6 -stdin)
 EOF
+  fi
 }
 
 
@@ -272,6 +274,24 @@ EOF
 ## Generic changes.
 
 
+function do_apt_config {
+  echo "- do_apt_config: Set the apt mirror and proxy from --apt-mirror and --apt-proxy"
+  if [ $BANNER_ONLY -eq 1 ]; then return 0; fi
+
+  if [ "$APT_PROXY" != "" ]; then
+    sudo_write_file /etc/apt/apt.conf.d/80periph_proxy << EOF
+    # Generated by https://github.com/periph/bootstrap
+    Acquire::http::Proxy "$APT_PROXY";
+    Acquire::https::Proxy "$APT_PROXY";
+EOF
+  fi
+  if [ "$APT_MIRROR" != "" ]; then
+    # Replace the URL of each deb and deb-src line, keeping the options.
+    run sudo sed -i -E "s#^(deb(-src)?( \[[^]]*\])?) [a-z]+://[^ ]+#\1 $APT_MIRROR#" /etc/apt/sources.list
+  fi
+}
+
+
 function do_apt {
   echo "- do_apt: Run apt-get update & upgrade and install few apps"
   if [ $BANNER_ONLY -eq 1 ]; then return 0; fi
@@ -283,10 +303,14 @@ function do_apt {
     echo "Failed to apt-get update; retrying"
     sleep 1
   done
-  while ! run sudo DEBIAN_FRONTEND=noninteractive apt-get -qy upgrade; do
-    echo "Failed to apt-get upgrade; retrying"
-    sleep 1
-  done
+  if [ $ACTION_UPGRADE -eq 1 ]; then
+    while ! run sudo DEBIAN_FRONTEND=noninteractive apt-get -qy upgrade; do
+      echo "Failed to apt-get upgrade; retrying"
+      sleep 1
+    done
+  else
+    echo "  Skipping apt-get upgrade"
+  fi
 
   # If you are space constrained, here's the approximative size:
   # git:                 17.7MB
@@ -307,12 +331,31 @@ function do_apt {
 }
 
 
+function do_expand_rootfs {
+  echo "- do_expand_rootfs: Expands the root partition to fill the disk"
+  if [ $BANNER_ONLY -eq 1 ]; then return 0; fi
+
+  local ROOT_PART="$(findmnt -n -o SOURCE /)"
+  local ROOT_DISK="/dev/$(lsblk -n -o PKNAME "$ROOT_PART")"
+  local PART_NUM="$(cat /sys/class/block/$(basename "$ROOT_PART")/partition)"
+  if ! (which growpart > /dev/null); then
+    run sudo DEBIAN_FRONTEND=noninteractive apt-get -qy install cloud-guest-utils
+  fi
+  # growpart fails when the partition is already as large as possible.
+  if run sudo growpart "$ROOT_DISK" "$PART_NUM"; then
+    run sudo resize2fs "$ROOT_PART"
+  else
+    echo "  $ROOT_PART is already expanded"
+  fi
+}
+
+
 function do_bash_history {
   echo "- do_bash_history: Injects into .bash_history commands the user may want"
   if [ $BANNER_ONLY -eq 1 ]; then return 0; fi
 
   # TODO(maruel): We want this to happen as the expected user.
-  echo "tail -f /var/log/firstboot.log" >> ~/.bash_history
+  echo "tail -f $FIRSTBOOT_LOG" >> ~/.bash_history
 }
 
 
@@ -324,6 +367,41 @@ function do_timezone {
 }
 
 
+function do_locale {
+  echo "- do_locale: Changes the locale to $LOCALE"
+  if [ $BANNER_ONLY -eq 1 ]; then return 0; fi
+
+  if [ "$LOCALE" = "" ]; then
+    echo "  --locale is required"
+    return 1
+  fi
+  if (which raspi-config > /dev/null); then
+    run sudo raspi-config nonint do_change_locale $LOCALE
+  else
+    run sudo sed -i "s/^# *\(${LOCALE} \)/\1/" /etc/locale.gen
+    run sudo locale-gen
+    run sudo update-locale LANG=$LOCALE
+  fi
+}
+
+
+function do_keyboard {
+  echo "- do_keyboard: Changes the keyboard layout to $KEYBOARD"
+  if [ $BANNER_ONLY -eq 1 ]; then return 0; fi
+
+  if [ "$KEYBOARD" = "" ]; then
+    echo "  --keyboard is required"
+    return 1
+  fi
+  if (which raspi-config > /dev/null); then
+    run sudo raspi-config nonint do_configure_keyboard $KEYBOARD
+  else
+    run sudo sed -i "s/^XKBLAYOUT=.*/XKBLAYOUT=\"${KEYBOARD}\"/" /etc/default/keyboard
+    run sudo DEBIAN_FRONTEND=noninteractive dpkg-reconfigure -f noninteractive keyboard-configuration
+  fi
+}
+
+
 function do_ssh {
   echo "- do_ssh: Enable passwordless ssh"
   if [ $BANNER_ONLY -eq 1 ]; then return 0; fi
@@ -351,6 +429,33 @@ function do_ssh {
     else
       run sudo sed -i 's/#PasswordAuthentication yes/PasswordAuthentication no/' /etc/ssh/sshd_config
     fi
+    if [ $ACTION_LOCK_PASSWORD -eq 1 ]; then
+      # Keys still work but the default password cannot be used anymore, even
+      # on the console.
+      echo "  Locking the password of $USERNAME"
+      run sudo passwd -l $USERNAME
+    fi
+  elif [ $ACTION_LOCK_PASSWORD -eq 1 ]; then
+    echo "  Not locking the password of $USERNAME since there is no authorized key"
+  fi
+
+  if [ -f "$HOST_KEY" ]; then
+    echo "  Installing the ssh host key"
+    run sudo install -m 600 -o root -g root "$HOST_KEY" /etc/ssh/ssh_host_ed25519_key
+    run sudo install -m 644 -o root -g root "$HOST_KEY.pub" /etc/ssh/ssh_host_ed25519_key.pub
+    # Do not leave the private key on the boot partition, readable by anyone
+    # with access to the SDCard.
+    run sudo rm -f "$HOST_KEY" "$HOST_KEY.pub"
+  fi
+
+  if [ "$SSH_PORT" != "" ]; then
+    # Effective on the next boot.
+    echo "  Listening for ssh on port $SSH_PORT"
+    if [ -d /etc/ssh/sshd_config.d ]; then
+      echo "Port $SSH_PORT" | sudo_write_file /etc/ssh/sshd_config.d/port.conf
+    else
+      run sudo sed -i -E "s/^#?Port .*/Port $SSH_PORT/" /etc/ssh/sshd_config
+    fi
   fi
 
   # Some distros (like O-DROID with Ubuntu minimal) enable ssh as root. This is
@@ -526,13 +631,28 @@ function do_sendmail {
     exit 1
   fi
 
+  # This is the mailserver to connect to deliver email
+  # NOTE: This must be the MX server for the account you wish to deliver email
+  # to or an open relay (but you hopefully won't find one of them). In my case,
+  # this is Google's first MX server (which can be found by doing an MX lookup
+  # on my domain).
+  local RELAY_HOST=aspmx.l.google.com
+  local RELAY_AUTH=""
+  if [ -f "$SMTP_RELAY" ]; then
+    # The file is in postfix sasl_passwd format: "[host]:port user:password",
+    # the credentials being optional.
+    RELAY_HOST=$(cut -f 1 -d ' ' "$SMTP_RELAY")
+    RELAY_AUTH=$(cut -s -f 2- -d ' ' "$SMTP_RELAY")
+  fi
+
   # This is needed otherwise postfix will bring a UI.
   echo "postfix postfix/main_mailer_type string 'No Config'" | run sudo debconf-set-selections
 
   # If you are space constrained, here's the approximative size:
   # bsd-mailx:            3.8MB
   # postfix:              570kB
-  run sudo DEBIAN_FRONTEND=noninteractive apt-get install -yq bsd-mailx postfix
+  # libsasl2-modules:     200kB
+  run sudo DEBIAN_FRONTEND=noninteractive apt-get install -yq bsd-mailx postfix libsasl2-modules
 
   # Enables sending emails over TLS. Because we want our emails to be secure.
   echo "  Configure outgoing emails"
@@ -545,11 +665,7 @@ function do_sendmail {
     # This sets the hostname, which will be used for outgoing email
     myhostname = $HOST
     # This is the mailserver to connect to deliver email
-    # NOTE: This must be the MX server for the account you wish to deliver email to
-    # or an open relay (but you hopefully won't find one of them). In my case, this
-    # is Google's first MX server (which can be found by doing an MX lookup on my
-    # domain).
-    relayhost = aspmx.l.google.com
+    relayhost = $RELAY_HOST
     # Do not relay emails.
     inet_interfaces = loopback-only
     # Disable IPv6. See
@@ -562,6 +678,20 @@ function do_sendmail {
     smtp_tls_session_cache_database = btree:\${data_directory}/smtp_scache
     smtp_tls_verify_cert_match = hostname, nexthop, dot-nexthop
 EOF
+  if [ "$RELAY_AUTH" != "" ]; then
+    echo "  Authenticate to $RELAY_HOST"
+    sudo_append_file /etc/postfix/main.cf << EOF
+    smtp_sasl_auth_enable = yes
+    smtp_sasl_password_maps = hash:/etc/postfix/sasl_passwd
+    smtp_sasl_security_options = noanonymous
+EOF
+    run sudo install -m 600 -o root -g root "$SMTP_RELAY" /etc/postfix/sasl_passwd
+    run sudo postmap /etc/postfix/sasl_passwd
+  fi
+  if [ -f "$SMTP_RELAY" ]; then
+    # Do not leave the credentials on the boot partition.
+    run sudo rm -f "$SMTP_RELAY"
+  fi
 
   echo "  Forward root@$HOST to $DEST_EMAIL"
   run sudo sed -i '/root:/d' /etc/aliases
@@ -615,6 +745,40 @@ function do_rename_host {
 }
 
 
+function do_mdns {
+  echo "- do_mdns: Advertises the host and its ssh service over mDNS"
+  if [ $BANNER_ONLY -eq 1 ]; then return 0; fi
+
+  # Minimal images don't always have avahi installed.
+  if ! (dpkg -s avahi-daemon > /dev/null 2>&1); then
+    while ! run sudo DEBIAN_FRONTEND=noninteractive apt-get -qy install avahi-daemon; do
+      echo "Failed to apt-get install; retrying"
+      sleep 1
+    done
+  fi
+  # Advertise as $HOST.local even if the system hostname wasn't updated yet.
+  run sudo sed -i -E "s/^#?host-name=.*/host-name=$HOST/" /etc/avahi/avahi-daemon.conf
+  local PORT=22
+  if [ "$SSH_PORT" != "" ]; then
+    PORT=$SSH_PORT
+  fi
+  sudo_write_file /etc/avahi/services/ssh.service << EOF
+    <?xml version="1.0" standalone='no'?>
+    <!DOCTYPE service-group SYSTEM "avahi-service.dtd">
+    <service-group>
+      <name replace-wildcards="yes">%h</name>
+      <service>
+        <type>_ssh._tcp</type>
+        <port>$PORT</port>
+      </service>
+    </service-group>
+EOF
+  run sudo systemctl enable avahi-daemon
+  run sudo systemctl restart avahi-daemon
+  echo "  Advertised as $HOST.local"
+}
+
+
 function do_update_motd {
   echo "- do_update_motd: Updates motd"
   if [ $BANNER_ONLY -eq 1 ]; then return 0; fi
@@ -670,16 +834,21 @@ function do_wifi {
 EOF
     run sudo connmanctl connect configured_wifi
   elif (which nmcli > /dev/null); then
-    # nmcli is used to configure wifi on the C.H.I.P.
+    # nmcli is used to configure wifi on the C.H.I.P. and RaspiOS Bookworm.
     run sudo nmcli device wifi connect "$WIFI_SSID" password "$WIFI_PASS" ifname wlan0
   elif [ -f /etc/wpa_supplicant/wpa_supplicant.conf ]; then
     # wpa_supplicant file is used to configure wifi on RaspiOS.
     #wpa_passphrase MYSSID passphrase
+    # A passphrase is quoted but a 64 hex digits preshared key must not be.
+    local PSK="\"${WIFI_PASS}\""
+    if [[ "$WIFI_PASS" =~ ^[0-9a-fA-F]{64}$ ]]; then
+      PSK="${WIFI_PASS}"
+    fi
     sudo_append_file /etc/wpa_supplicant/wpa_supplicant.conf <<EOF
       # Generated by https://github.com/periph/bootstrap
       network={
         ssid="${WIFI_SSID}"
-        psk="${WIFI_PASS}"
+        psk=${PSK}
         key_mgmt=WPA-PSK
       }
 EOF
@@ -690,6 +859,48 @@ EOF
 }
 
 
+function do_static_ip {
+  echo "- do_static_ip: Configures a static IP address on the wired network"
+  if [ $BANNER_ONLY -eq 1 ]; then return 0; fi
+
+  if [ "$STATIC_IP" = "" ]; then
+    echo "  --static-ip is required"
+    exit 1
+  fi
+  echo "  Using $STATIC_IP"
+  if [ -f /etc/dhcpcd.conf ]; then
+    # dhcpcd is used on RaspiOS. It takes space separated DNS servers.
+    sudo_append_file /etc/dhcpcd.conf <<EOF
+      # Generated by https://github.com/periph/bootstrap
+      interface eth0
+      static ip_address=${STATIC_IP}
+      static routers=${STATIC_GATEWAY}
+      static domain_name_servers=${STATIC_DNS//,/ }
+EOF
+    run sudo systemctl restart dhcpcd
+  else
+    # Otherwise use systemd-networkd. It takes one DNS server per line.
+    local DNS_LINES=""
+    for i in ${STATIC_DNS//,/ }; do
+      DNS_LINES="${DNS_LINES}DNS=$i
+"
+    done
+    sudo_write_file /etc/systemd/network/10-periph-static.network <<EOF
+# Generated by https://github.com/periph/bootstrap
+[Match]
+Name=eth0
+
+[Network]
+Address=${STATIC_IP}
+Gateway=${STATIC_GATEWAY}
+${DNS_LINES}
+EOF
+    run sudo systemctl enable systemd-networkd
+    run sudo systemctl restart systemd-networkd
+  fi
+}
+
+
 function do_wifi_power {
   echo "- do_wifi_power: Disables wifi powersaving"
   if [ $BANNER_ONLY -eq 1 ]; then return 0; fi
@@ -792,9 +1003,23 @@ function do_all {
   if [ "$WIFI_SSID" != "" ]; then
     do_wifi
   fi
+  if [ -f /boot/firstboot.args ]; then
+    # The arguments were read by /etc/rc.local or firstboot.service. Do not
+    # leave the wifi password on the boot partition.
+    run sudo rm -f /boot/firstboot.args
+  fi
+  if [ "$STATIC_IP" != "" ]; then
+    do_static_ip
+  fi
   do_wifi_power
   wait_network
+  if [ "$APT_MIRROR" != "" ] || [ "$APT_PROXY" != "" ]; then
+    do_apt_config
+  fi
   do_apt
+  if [ $ACTION_EXPAND_ROOTFS -eq 1 ]; then
+    do_expand_rootfs
+  fi
   if [ "$BOARD" = "beaglebone" ]; then
     do_beaglebone
   elif [ "$BOARD" = "chip" ]; then
@@ -812,10 +1037,19 @@ function do_all {
   fi
   do_unattended_upgrade
   do_rename_host
+  if [ $ACTION_MDNS -eq 1 ]; then
+    do_mdns
+  fi
   if [ "$DEST_EMAIL" != "" ]; then
     do_sendmail
   fi
   do_timezone
+  if [ "$LOCALE" != "" ]; then
+    do_locale
+  fi
+  if [ "$KEYBOARD" != "" ]; then
+    do_keyboard
+  fi
   #do_sudo
   #do_swap
   do_update_motd
@@ -923,10 +1157,17 @@ function detect_board {
 
   # Intentionally use HOST to not clash with bash's HOSTNAME.
   HOST="$BOARD-$SERIAL"
+  if [ "$NEW_HOST" != "" ]; then
+    HOST="$NEW_HOST"
+  fi
 }
 
 
 function detect_user {
+  if [ "$USERNAME" != "" ]; then
+    # Specified with --user.
+    return 0
+  fi
   # Assumes there is only one account. This is true for most distros. The value
   # is generally one of: pi, debian, odroid, chip.
   # TODO(maruel): This is brittle!
@@ -934,6 +1175,38 @@ function detect_user {
 }
 
 
+function run_post_scripts {
+  # Each argument is a separate script, run in order. Stop at the first one
+  # failing.
+  for script in "$@"; do
+    echo "-> Running post script $script"
+    run "$script"
+  done
+}
+
+
+function write_status {
+  # Records the result of the setup in $STATUS_FILE so it can be read back
+  # from the host, e.g. with cmd/check-setup. Arguments are the exit code and
+  # the command that failed, if any.
+  trap - EXIT
+  if [ "$STATUS_FILE" = "" ]; then return 0; fi
+  local STATUS=success
+  if [ $1 -ne 0 ]; then
+    STATUS=failure
+  fi
+  sudo_write_file "$STATUS_FILE" << EOF
+    status=$STATUS
+    exit_code=$1
+    command=$2
+    host=${HOST:-}
+    log=$FIRSTBOOT_LOG
+    date=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+EOF
+  run sync
+}
+
+
 function conditional_reboot {
   if [ $ACTION_REBOOT -eq 1 ]; then
     sudo shutdown -r now
@@ -949,7 +1222,7 @@ function show_help {
   fi
 
   cat << EOF
-Usage: setup.sh [args] [command] [-- additional script before reboot]
+Usage: setup.sh [args] [command] [-- scripts to run before reboot]
 
 Options:
   -h  --help             Prints this help page
@@ -957,15 +1230,49 @@ Options:
                          -nr
 
   -5  --5inch            Enables 5" HDMI 800x480 display support (RaspiOS)
+  -am --apt-mirror URL   Mirror to use instead of the ones in
+                         /etc/apt/sources.list
+  -ap --apt-proxy URL    HTTP proxy to use for apt
+  -dp --disable-password Lock the default user password; only done when an
+                         ssh key is authorized
   -e  --email XXX        Email address to forward all root@localhost to
+  -fl --firstboot-log FILE
+                         Path of the first boot log; only used for the shell
+                         history; default: $FIRSTBOOT_LOG
+  -H  --hostname XXX     Hostname to use instead of \$BOARD-\$SERIAL
+  -Hf --hostname-file FILE
+                         Same as --hostname but read from FILE
+  -hk --host-key FILE    ed25519 ssh host private key to install; FILE.pub
+                         must also exist. Both files are deleted afterward
+  -kb --keyboard XXX     Keyboard layout to use, e.g. gb
+  -l  --locale XXX       Locale to use, e.g. en_GB.UTF-8
+  -md --mdns             Install avahi-daemon to advertise \$HOST.local and the
+                         ssh service over mDNS
+  -ip --static-ip XXX    Static IP address in CIDR form for eth0, e.g.
+                         192.168.1.10/24
+  -gw --gateway XXX      Default gateway to use with --static-ip
+  -dns --dns XXX         Comma separated DNS servers to use with --static-ip
   -nr --no-reboot        Disable rebooting at the end
+  -xr --expand-rootfs    Expand the root partition and file system to fill the
+                         disk, for images that don't do it on their own
   -ng --no-go            Disable installing Go toolchain
+  -sr --smtp-relay FILE  SMTP relay to use with --email, in postfix sasl_passwd
+                         format "[host]:port user:password". The file is
+                         deleted afterward
+  -sf --status-file FILE Write the result of the setup to FILE once done, even
+                         on failure
+  -su --skip-upgrade     Skip apt-get upgrade; the packages, including security
+                         fixes, are only updated by the nightly unattended
+                         upgrade
   -sk --ssh-key FILE     SSH authorized_keys to copy to the home user directory
+  -sp --ssh-port XXX     Port for the ssh daemon to listen on instead of 22
   -t  --timezone XXX     Timezone to use; default: $TIMEZONE
+  -u  --user NAME        Account to configure, e.g. for --ssh-key; default: the
+                         only directory in /home
   -wc --wifi-country XXX Country for Wifi settings; if unset, try to guess it
                          but requires ethernet/USB network first
   -ws --wifi-ssid SSID   SSID to connect to
-  -wp --wifi-pass PWD    Password to use for Wifi
+  -wp --wifi-pass PWD    Password to use for Wifi, or its 64 hex digits preshared key
 
 Commands:
 EOF
@@ -978,9 +1285,10 @@ EOF
 
   cat << EOF
 
-By default 'do_all' is run and the host is rebooted afterward. In this case, a
-command line can be supplied after '--', it'll be run before rebooting the
-host.
+By default 'do_all' is run and the host is rebooted afterward. In this case,
+one or multiple scripts can be supplied after '--'. Each argument is a separate
+script; they are run in order before rebooting the host. A failing script stops
+the remaining ones.
 EOF
 }
 
@@ -990,13 +1298,38 @@ EOF
 
 # Default actions.
 ACTION_5INCH=0
+ACTION_EXPAND_ROOTFS=0
 ACTION_GO=1
+# Left unchanged when empty.
+APT_MIRROR=""
+APT_PROXY=""
+ACTION_LOCK_PASSWORD=0
+ACTION_MDNS=0
 ACTION_SPI1=0   # TODO(maruel): Surface, may have side effect with UART and BT.
 ACTION_REBOOT=1
+ACTION_UPGRADE=1
 BANNER_ONLY=0
 DRY_RUN=0
 DEST_EMAIL=""
+FIRSTBOOT_LOG="/var/log/firstboot.log"
+# Defaults to $BOARD-$SERIAL.
+NEW_HOST=""
+# Left unchanged when empty.
+KEYBOARD=""
+LOCALE=""
 SSH_KEY=""
+# Left unchanged when empty.
+SSH_PORT=""
+# Detected when empty.
+USERNAME=""
+SMTP_RELAY=""
+# Not written when empty.
+STATUS_FILE=""
+HOST_KEY=""
+# Static IP configuration; DHCP is used when empty.
+STATIC_IP=""
+STATIC_GATEWAY=""
+STATIC_DNS=""
 # Use "timedatectl list-timezones" to list the values.
 TIMEZONE="Etc/UTC"
 # Must be an ISO/IEC 3166-1 alpha2 country code.
@@ -1017,17 +1350,66 @@ while [ $# -gt 0 ]; do
   "-5" | "--5inch")
     ACTION_5INCH=1
     ;;
+  "-am" | "--apt-mirror")
+    APT_MIRROR=$1
+    shift
+    ;;
+  "-ap" | "--apt-proxy")
+    APT_PROXY=$1
+    shift
+    ;;
   "-d" | "--dry-run")
     echo "-> Dry run mode"
     DRY_RUN=1
     ACTION_REBOOT=0
     ;;
+  "-dp" | "--disable-password")
+    ACTION_LOCK_PASSWORD=1
+    ;;
   "-e" | "--email")
     DEST_EMAIL=$1
     # TODO(maruel): Verify '@' is in the address, it doesn't start with '-', is
     # not empty.
     shift
     ;;
+  "-fl" | "--firstboot-log")
+    FIRSTBOOT_LOG=$1
+    shift
+    ;;
+  "-H" | "--hostname")
+    NEW_HOST=$1
+    shift
+    ;;
+  "-Hf" | "--hostname-file")
+    NEW_HOST=$(tr -d '[:space:]' < "$1")
+    shift
+    ;;
+  "-kb" | "--keyboard")
+    KEYBOARD=$1
+    shift
+    ;;
+  "-l" | "--locale")
+    LOCALE=$1
+    shift
+    ;;
+  "-md" | "--mdns")
+    ACTION_MDNS=1
+    ;;
+  "-su" | "--skip-upgrade")
+    ACTION_UPGRADE=0
+    ;;
+  "-ip" | "--static-ip")
+    STATIC_IP=$1
+    shift
+    ;;
+  "-gw" | "--gateway")
+    STATIC_GATEWAY=$1
+    shift
+    ;;
+  "-dns" | "--dns")
+    STATIC_DNS=$1
+    shift
+    ;;
   "-h" | "--help" | "help")
     show_help
     exit 1
@@ -1036,6 +1418,9 @@ while [ $# -gt 0 ]; do
     echo "-> No reboot"
     ACTION_REBOOT=0
     ;;
+  "-xr" | "--expand-rootfs")
+    ACTION_EXPAND_ROOTFS=1
+    ;;
   "-ng" | "--no-go")
     echo "-> Skip installing Go"
     ACTION_GO=0
@@ -1047,11 +1432,39 @@ while [ $# -gt 0 ]; do
     fi
     shift
     ;;
+  "-sp" | "--ssh-port")
+    SSH_PORT=$1
+    shift
+    ;;
+  "-sf" | "--status-file")
+    STATUS_FILE=$1
+    shift
+    ;;
+  "-hk" | "--host-key")
+    HOST_KEY=$1
+    if [ ! -f "$HOST_KEY" ]; then
+      echo "Error: $HOST_KEY is not a file"
+      exit 1
+    fi
+    shift
+    ;;
+  "-sr" | "--smtp-relay")
+    SMTP_RELAY=$1
+    if [ ! -f "$SMTP_RELAY" ]; then
+      echo "Error: $SMTP_RELAY is not a file"
+      exit 1
+    fi
+    shift
+    ;;
   "-t" | "--timezone")
     TIMEZONE=$1
     # TODO(maruel): Verify is not empty.
     shift
     ;;
+  "-u" | "--user")
+    USERNAME=$1
+    shift
+    ;;
   "-wc" | "--wifi-country")
     WIFI_COUNTRY=$1
     # TODO(maruel): Verify is not empty.
@@ -1077,11 +1490,10 @@ while [ $# -gt 0 ]; do
     ;;
 
   "--")
+    trap 'write_status $? "$BASH_COMMAND"' EXIT
     do_all
-    if [ $# -gt 0 ]; then
-      echo "-> Running custom command $*"
-      run "$@"
-    fi
+    run_post_scripts "$@"
+    write_status 0 ""
     conditional_reboot
     exit 0
     ;;
@@ -1096,9 +1508,8 @@ while [ $# -gt 0 ]; do
 done
 
 
+trap 'write_status $? "$BASH_COMMAND"' EXIT
 do_all
-if [ $# -gt 0 ]; then
-  echo "-> Running custom command $*"
-  run "$@"
-fi
+run_post_scripts "$@"
+write_status 0 ""
 conditional_reboot